@@ -0,0 +1,62 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"fmt"
+
+	"github.com/cloudwan/gohan/util/amqputil"
+	"github.com/streadway/amqp"
+)
+
+// amqpSink publishes records to an AMQP exchange
+// with routing key audit.<schema_id>.<action>
+type amqpSink struct {
+	publisher *amqputil.Publisher
+}
+
+func newAMQPSink(config map[string]interface{}) (Sink, error) {
+	connection, _ := config["connection"].(string)
+	if connection == "" {
+		return nil, fmt.Errorf("connection is required for amqp sink")
+	}
+	exchange, _ := config["exchange"].(string)
+	if exchange == "" {
+		exchange = "gohan_audit"
+	}
+	sink := &amqpSink{publisher: amqputil.NewPublisher(connection, exchange, 0)}
+	if err := sink.publisher.Connect(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *amqpSink) Write(record *Record) error {
+	body, err := marshalRecord(record)
+	if err != nil {
+		return err
+	}
+	return s.publisher.Publish("audit."+record.SchemaID+"."+record.Action, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    record.ID,
+		Body:         body,
+	})
+}
+
+func (s *amqpSink) Close() error {
+	return s.publisher.Close()
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records who changed resources and how
+package audit
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/cloudwan/gohan/db/transaction"
+	l "github.com/cloudwan/gohan/log"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/util"
+	"github.com/mohae/deepcopy"
+	"github.com/twinj/uuid"
+)
+
+// SchemaID is ID of the schema storing audit records
+const SchemaID = "audit_log"
+
+// SecretMask replaces values of secret properties in records
+const SecretMask = "******"
+
+var (
+	enabled bool
+	sinks   []Sink
+	log     = l.NewLogger()
+)
+
+// Record describes a single change of a resource made by an API call
+type Record struct {
+	ID         string
+	Timestamp  int64
+	RequestID  string
+	TenantID   string
+	TenantName string
+	UserID     string
+	UserName   string
+	Roles      []string
+	// Action is create, update, delete, restore or ID of a custom action
+	Action     string
+	SchemaID   string
+	ResourceID string
+	Path       string
+	// Before holds the resource before the change, nil when it was created
+	Before map[string]interface{}
+	// After holds the resource after the change, nil when it was deleted
+	After map[string]interface{}
+	// Input holds the input of a custom action
+	Input map[string]interface{}
+}
+
+// NewRecord creates a record of an action made by auth on a resource
+func NewRecord(requestID string, auth schema.Authorization, action string, s *schema.Schema, resourceID string) *Record {
+	record := &Record{
+		ID:         uuid.NewV4().String(),
+		Timestamp:  time.Now().Unix(),
+		RequestID:  requestID,
+		Roles:      []string{},
+		Action:     action,
+		SchemaID:   s.ID,
+		ResourceID: resourceID,
+		Path:       s.URL + "/" + resourceID,
+	}
+	if auth != nil {
+		record.TenantID = auth.TenantID()
+		record.TenantName = auth.TenantName()
+		record.UserID, record.UserName = schema.AuthorizedUser(auth)
+		for _, role := range auth.Roles() {
+			record.Roles = append(record.Roles, role.Name)
+		}
+	}
+	return record
+}
+
+// SetResources sets copies of the resource before and after the change,
+// with values of properties which s marks as secret masked
+func (r *Record) SetResources(s *schema.Schema, before, after map[string]interface{}) {
+	r.Before = maskSecrets(s, before)
+	r.After = maskSecrets(s, after)
+}
+
+func maskSecrets(s *schema.Schema, data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	masked := deepcopy.Copy(data).(map[string]interface{})
+	for _, property := range s.Properties {
+		if value, ok := masked[property.ID]; property.Secret && ok && value != nil && value != "" {
+			masked[property.ID] = SecretMask
+		}
+	}
+	return masked
+}
+
+// Changes returns properties which differ before and after the change,
+// mapped to objects with their "before" and "after" values
+func (r *Record) Changes() map[string]interface{} {
+	changes := map[string]interface{}{}
+	for key, before := range r.Before {
+		if after := r.After[key]; !reflect.DeepEqual(before, after) {
+			changes[key] = map[string]interface{}{"before": before, "after": after}
+		}
+	}
+	for key, after := range r.After {
+		if _, ok := r.Before[key]; !ok && after != nil {
+			changes[key] = map[string]interface{}{"before": nil, "after": after}
+		}
+	}
+	return changes
+}
+
+// Data returns the record as data of an audit_log resource
+func (r *Record) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          r.ID,
+		"timestamp":   r.Timestamp,
+		"request_id":  r.RequestID,
+		"tenant_id":   r.TenantID,
+		"tenant_name": r.TenantName,
+		"user_id":     r.UserID,
+		"user_name":   r.UserName,
+		"roles":       r.Roles,
+		"action":      r.Action,
+		"schema_id":   r.SchemaID,
+		"resource_id": r.ResourceID,
+		"path":        r.Path,
+		"before":      r.Before,
+		"after":       r.After,
+		"changes":     r.Changes(),
+		"input":       r.Input,
+	}
+}
+
+// Setup configures audit from config
+func Setup(config *util.Config) error {
+	enabled = config.GetBool("audit/enabled", false)
+	newSinks := []Sink{}
+	for i, rawSinkConfig := range config.GetList("audit/sinks", nil) {
+		sinkConfig, ok := rawSinkConfig.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("audit sink %d has to be an object", i)
+		}
+		sink, err := NewSink(sinkConfig)
+		if err != nil {
+			return fmt.Errorf("audit sink %d: %s", i, err)
+		}
+		newSinks = append(newSinks, sink)
+	}
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Warning("Failed to close audit sink: %s", err)
+		}
+	}
+	sinks = newSinks
+	return nil
+}
+
+// Enabled checks if changes should be audited
+func Enabled() bool {
+	return enabled
+}
+
+// Store stores record as an audit_log resource in the transaction
+func Store(ctx context.Context, tx transaction.Transaction, record *Record) error {
+	auditSchema, ok := schema.GetManager().Schema(SchemaID)
+	if !ok {
+		return fmt.Errorf("%s schema not found", SchemaID)
+	}
+	resource, err := schema.NewResource(auditSchema, record.Data())
+	if err != nil {
+		return err
+	}
+	return tx.CreateContext(ctx, resource)
+}
+
+// Emit passes records of committed changes to all configured sinks.
+// Failures are logged, as the changes can't be reverted anymore.
+func Emit(records ...*Record) {
+	for _, record := range records {
+		for _, sink := range sinks {
+			if err := sink.Write(record); err != nil {
+				log.Error("Failed to write audit record %s: %s", record.ID, err)
+			}
+		}
+	}
+}
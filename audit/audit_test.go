@@ -0,0 +1,115 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudwan/gohan/audit"
+	"github.com/cloudwan/gohan/schema"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit", func() {
+	var (
+		networkSchema *schema.Schema
+		auth          schema.Authorization
+	)
+
+	BeforeEach(func() {
+		networkSchema = schema.NewSchema("network", "networks", "Network", "", "")
+		networkSchema.URL = "/v2.0/networks"
+		auth = schema.NewUserAuthorization("alice", "Alice", "tenant", "Tenant", "token", []string{"Member"}, nil)
+	})
+
+	Describe("Records", func() {
+		It("should describe the actor", func() {
+			record := audit.NewRecord("request", auth, "create", networkSchema, "red")
+			Expect(record.Data()).To(SatisfyAll(
+				HaveKeyWithValue("request_id", "request"),
+				HaveKeyWithValue("tenant_id", "tenant"),
+				HaveKeyWithValue("user_id", "alice"),
+				HaveKeyWithValue("user_name", "Alice"),
+				HaveKeyWithValue("roles", []string{"Member"}),
+				HaveKeyWithValue("path", "/v2.0/networks/red"),
+			))
+		})
+
+		It("should list changed properties", func() {
+			record := audit.NewRecord("request", auth, "update", networkSchema, "red")
+			record.Before = map[string]interface{}{"id": "red", "name": "Red", "shared": true}
+			record.After = map[string]interface{}{"id": "red", "name": "Blue", "description": "blue"}
+			Expect(record.Changes()).To(Equal(map[string]interface{}{
+				"name":        map[string]interface{}{"before": "Red", "after": "Blue"},
+				"shared":      map[string]interface{}{"before": true, "after": nil},
+				"description": map[string]interface{}{"before": nil, "after": "blue"},
+			}))
+		})
+
+		It("should mask secret properties", func() {
+			networkSchema.Properties = []schema.Property{{ID: "name"}, {ID: "password", Secret: true}}
+			before := map[string]interface{}{"id": "red", "name": "Red", "password": "old"}
+			record := audit.NewRecord("request", auth, "update", networkSchema, "red")
+			record.SetResources(networkSchema, before, map[string]interface{}{"id": "red", "name": "Red", "password": "new"})
+			Expect(record.Before).To(HaveKeyWithValue("password", audit.SecretMask))
+			Expect(record.After).To(HaveKeyWithValue("password", audit.SecretMask))
+			Expect(record.After).To(HaveKeyWithValue("name", "Red"))
+			Expect(before).To(HaveKeyWithValue("password", "old"))
+		})
+	})
+
+	Describe("File sink", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "audit")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should append records as JSON lines", func() {
+			path := filepath.Join(dir, "audit.log")
+			sink, err := audit.NewSink(map[string]interface{}{"type": "file", "path": path})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sink.Write(audit.NewRecord("first", auth, "create", networkSchema, "red"))).To(Succeed())
+			Expect(sink.Write(audit.NewRecord("second", auth, "delete", networkSchema, "red"))).To(Succeed())
+			Expect(sink.Close()).To(Succeed())
+
+			content, err := ioutil.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			Expect(lines).To(HaveLen(2))
+			var record map[string]interface{}
+			Expect(json.Unmarshal([]byte(lines[1]), &record)).To(Succeed())
+			Expect(record).To(HaveKeyWithValue("request_id", "second"))
+			Expect(record).To(HaveKeyWithValue("action", "delete"))
+		})
+
+		It("should reject unknown sinks", func() {
+			_, err := audit.NewSink(map[string]interface{}{"type": "pigeon"})
+			Expect(err).To(MatchError(ContainSubstring("unknown sink type")))
+		})
+	})
+})
@@ -0,0 +1,122 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// Sink receives audit records in addition to the audit_log table
+type Sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+// SinkFactory creates a sink from its configuration
+type SinkFactory func(config map[string]interface{}) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{
+	"file":   newFileSink,
+	"syslog": newSyslogSink,
+	"amqp":   newAMQPSink,
+}
+
+// RegisterSink registers a factory of sinks configured with the given type
+func RegisterSink(sinkType string, factory SinkFactory) {
+	sinkFactories[sinkType] = factory
+}
+
+// NewSink creates a sink of the type given in its configuration
+func NewSink(config map[string]interface{}) (Sink, error) {
+	sinkType, _ := config["type"].(string)
+	factory, ok := sinkFactories[sinkType]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q", sinkType)
+	}
+	return factory(config)
+}
+
+func marshalRecord(record *Record) ([]byte, error) {
+	return json.Marshal(record.Data())
+}
+
+// fileSink appends records to a file, one JSON object per line
+type fileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileSink(config map[string]interface{}) (Sink, error) {
+	path, _ := config["path"].(string)
+	if path == "" {
+		return nil, fmt.Errorf("path is required for file sink")
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Write(record *Record) error {
+	line, err := marshalRecord(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// syslogSink sends records to the local or a remote syslog
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(config map[string]interface{}) (Sink, error) {
+	network, _ := config["network"].(string)
+	address, _ := config["address"].(string)
+	tag, _ := config["tag"].(string)
+	if tag == "" {
+		tag = "gohan-audit"
+	}
+	writer, err := syslog.Dial(network, address, syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(record *Record) error {
+	line, err := marshalRecord(record)
+	if err != nil {
+		return err
+	}
+	return s.writer.Notice(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
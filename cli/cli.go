@@ -18,7 +18,6 @@ package cli
 import (
 	"fmt"
 	"os"
-	"path"
 	"runtime"
 	"strings"
 	"time"
@@ -34,7 +33,6 @@ import (
 	logger "github.com/cloudwan/gohan/log"
 	"github.com/cloudwan/gohan/schema"
 	"github.com/cloudwan/gohan/server"
-	sync_util "github.com/cloudwan/gohan/sync/util"
 	"github.com/cloudwan/gohan/util"
 	"github.com/codegangsta/cli"
 	"github.com/lestrrat/go-server-starter"
@@ -67,6 +65,9 @@ func Run(name, usage string) {
 		getTestExtensionsCommand(),
 		getMigrateCommand(),
 		getResyncCommand(),
+		getSyncDiffCommand(),
+		getReconcileCommand(),
+		getPolicyExplainCommand(),
 		getTemplateCommand(),
 		getRunCommand(),
 		getTestCommand(),
@@ -322,43 +323,7 @@ func getResyncCommand() cli.Command {
 			cli.StringFlag{Name: "config-file", Value: defaultConfigFile, Usage: "Server config File"},
 		},
 		Action: func(c *cli.Context) {
-			configFile := c.String("config-file")
-
-			config := util.GetConfig()
-			if configFile == "" {
-				log.Fatal("Need to provide server config file")
-			}
-			if err := config.ReadConfig(configFile); err != nil {
-				log.Fatalf("Error while loading server config file: %s", err)
-			}
-			if err := os.Chdir(path.Dir(configFile)); err != nil {
-				log.Fatalf("Chdir error: %s", err)
-			}
-
-			dbConn, err := db.CreateFromConfig(config)
-			if err != nil {
-				log.Fatalf("Failed to create db conn, err: %s", err)
-			}
-
-			sync, err := sync_util.CreateFromConfig(config)
-			if err != nil {
-				log.Fatalf("Failed to create sync, err: %s", err)
-
-			}
-
-			schemaManager := schema.GetManager()
-
-			schemaFiles := config.GetStringList("schemas", nil)
-			if schemaFiles == nil {
-				log.Fatal("No schema specified in configuration")
-			} else {
-				log.Info("Loading schemas %s", schemaFiles)
-				err = schemaManager.LoadSchemasFromFiles(schemaFiles...)
-				if err != nil {
-					log.Fatalf("Error when loading schemas: %s", err)
-				}
-			}
-
+			dbConn, sync := loadSyncEnvironment(c.String("config-file"))
 			server.Resync(dbConn, sync)
 		},
 	}
@@ -441,6 +406,8 @@ func getMigrateCommand() cli.Command {
 			getMigrateSubcommand("create", "Create a template for a new migration"),
 			getMigrateSubcommand("create-next", "Create a sequential template for a new migration"),
 			getCreateInitialMigrationSubcommand(),
+			getMigratePlanSubcommand(),
+			getMigrateApplySubcommand(),
 			getMigrateSubcommand("down", "Migrate to the oldest version"),
 			getMigrateSubcommand("down-to", "Migrate to specific version"),
 			getMigrateSubcommand("redo", "Migrate one version back"),
@@ -468,6 +435,40 @@ func getCreateInitialMigrationSubcommand() cli.Command {
 	}
 }
 
+func getMigratePlanSubcommand() cli.Command {
+	return cli.Command{
+		Name:  "plan",
+		Usage: "Generate a migration from differences between schemas and the database",
+		Description: `Compares loaded schemas with the live database and writes a goose migration
+creating missing tables, adding, renaming, retyping and dropping columns, adding indexes and
+changing relations. Renamed properties have to set "renamed_from" to their previous id.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: flagConfigFile, Value: defaultConfigFile, Usage: "Server config File"},
+			cli.StringFlag{Name: "name, n", Value: "schema_changes", Usage: "Name of the migration"},
+			cli.StringFlag{Name: "type, t", Value: "sql", Usage: "Type of the migration, sql or go"},
+			cli.BoolFlag{Name: "dry-run", Usage: "Only print planned changes"},
+			cli.BoolFlag{Name: "cascade", Usage: "If true, FOREIGN KEYS in database will be created with ON DELETE CASCADE"},
+		},
+		Action: actionMigratePlan(),
+	}
+}
+
+func getMigrateApplySubcommand() cli.Command {
+	return cli.Command{
+		Name:  "apply",
+		Usage: "Generate a migration from differences between schemas and the database and apply it",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: flagConfigFile, Value: defaultConfigFile, Usage: "Server config File"},
+			cli.BoolFlag{Name: FlagLockWithETCD, Usage: "Enable if ETCD should be used to synchronize migrations"},
+			cli.StringFlag{Name: "name, n", Value: "schema_changes", Usage: "Name of the migration"},
+			cli.BoolFlag{Name: "dry-run", Usage: "Only print planned changes"},
+			cli.BoolFlag{Name: "allow-destructive", Usage: "Allow changes losing data, like dropping columns"},
+			cli.BoolFlag{Name: "cascade", Usage: "If true, FOREIGN KEYS in database will be created with ON DELETE CASCADE"},
+		},
+		Action: actionMigrateApply(),
+	}
+}
+
 func getConverterCommand() cli.Command {
 	return cli.Command{
 		Name:  "converter",
@@ -165,9 +165,11 @@ func actionMigrateCreateInitialMigration() func(context *cli.Context) {
 		cascade := c.Bool("cascade")
 		manager := schema.GetManager()
 		configFile := c.String("config-file")
+		sqlDB := db_sql.NewDB(db_options.Default())
 		if configFile != "" {
 			config := util.GetConfig()
 			config.ReadConfig(configFile)
+			sqlDB.SetSQLType(config.GetString("database/type", "mysql"))
 			schemaFiles := config.GetStringList("schemas", nil)
 			if schemaFiles == nil {
 				log.Fatal("No schema specified in configuration")
@@ -187,7 +189,7 @@ func actionMigrateCreateInitialMigration() func(context *cli.Context) {
 		path := filepath.Join(c.String("path"), version)
 		var sqlString = bytes.NewBuffer(make([]byte, 0, 100))
 		fmt.Printf("Generating goose migration file to %s ...\n", path)
-		sqlDB := db_sql.NewDB(db_options.Default())
+		dialect := sqlDB.Dialect()
 		schemas := manager.OrderedSchemas()
 		sqlString.WriteString("\n")
 		sqlString.WriteString("-- +goose Up\n")
@@ -200,9 +202,9 @@ func actionMigrateCreateInitialMigration() func(context *cli.Context) {
 				continue
 			}
 			createSQL, indices := sqlDB.GenTableDef(s, cascade)
-			sqlString.WriteString(createSQL + "\n")
+			sqlString.WriteString(dialect.Rewrite(createSQL) + "\n")
 			for _, indexSQL := range indices {
-				sqlString.WriteString(indexSQL + "\n")
+				sqlString.WriteString(dialect.Rewrite(indexSQL) + "\n")
 			}
 		}
 		sqlString.WriteString("\n")
@@ -225,6 +227,84 @@ func actionMigrateCreateInitialMigration() func(context *cli.Context) {
 	}
 }
 
+// planMigration compares schemas from the loaded config with the database
+func planMigration(cascade bool) *db_sql.MigrationPlan {
+	config := util.GetConfig()
+	dbType := config.GetString("database/type", "sqlite3")
+	if dbType == "json" || dbType == "yaml" {
+		log.Fatalf("Migration planning requires an SQL database, got %s", dbType)
+	}
+	schemaFiles := config.GetStringList("schemas", nil)
+	if schemaFiles == nil {
+		log.Fatal("No schema specified in configuration")
+	}
+	manager := schema.GetManager()
+	if err := manager.LoadSchemasFromFiles(schemaFiles...); err != nil {
+		log.Fatal(err)
+	}
+	sqlDB := db_sql.NewDB(db_options.Read(config))
+	if err := sqlDB.Connect(dbType, config.GetString("database/connection", ""), db.DefaultMaxOpenConn); err != nil {
+		log.Fatal(err)
+	}
+	defer sqlDB.Close()
+	cascade = cascade || config.GetBool("database/cascade_delete", false)
+	plan, err := sqlDB.PlanMigration(manager.OrderedSchemas(), cascade)
+	if err != nil {
+		log.Fatalf("Migration planning failed: %s", err)
+	}
+	fmt.Print(plan)
+	return plan
+}
+
+func actionMigratePlan() func(context *cli.Context) {
+	return func(context *cli.Context) {
+		if migration.LoadConfig(context.String(flagConfigFile)) != nil {
+			return
+		}
+		plan := planMigration(context.Bool("cascade"))
+		if plan.Empty() || context.Bool("dry-run") {
+			return
+		}
+		migrationType := context.String("type")
+		path, err := migration.CreateGeneratedMigration(context.String("name"), migrationType, func(version, fileName string) string {
+			if migrationType == "go" {
+				return plan.GooseGo(version, fileName)
+			}
+			return plan.GooseSQL()
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Created %s migration at %s, review it before applying\n", migrationType, path)
+	}
+}
+
+func actionMigrateApply() func(context *cli.Context) {
+	return withinLockedMigration(func(context *cli.Context) {
+		plan := planMigration(context.Bool("cascade"))
+		if plan.Empty() || context.Bool("dry-run") {
+			return
+		}
+		if plan.Manual() {
+			log.Fatal("Plan contains changes not supported by the database, generate the migration with \"gohan migrate plan\" and complete it by hand")
+		}
+		if plan.Destructive() && !context.Bool("allow-destructive") {
+			log.Fatal("Plan contains destructive changes, review them and run again with --allow-destructive")
+		}
+		path, err := migration.CreateGeneratedMigration(context.String("name"), "sql", func(version, fileName string) string {
+			return plan.GooseSQL()
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Created sql migration at %s\n", path)
+		if err := migration.UpGenerated(path); err != nil {
+			os.Remove(path)
+			log.Fatalf("Migrate run failed, removed %s: %s", path, err)
+		}
+	})
+}
+
 func publishEventWithOptions(envName string, modifiedSchemas []string, eventName string, syncETCDEvent bool, eventTimeout time.Duration, db *server.DbSyncWrapper, manager *schema.Manager, envManager *extension.Manager, sync sync.Sync, ident middleware.IdentityService) {
 	deadline := time.Now().Add(eventTimeout)
 
@@ -290,14 +370,14 @@ func publishEvent(envName string, modifiedSchemas []string, eventName string, sy
 		log.Fatal(err)
 	}
 
-	db := &server.DbSyncWrapper{DB: rawDB}
-
 	sync, err := sync_util.CreateFromConfig(config)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	db := &server.DbSyncWrapper{DB: rawDB, Sync: sync}
+
 	ident, err := middleware.CreateIdentityServiceFromConfig(config)
 
 	if err != nil {
@@ -0,0 +1,117 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server"
+	"github.com/cloudwan/gohan/util"
+	"github.com/codegangsta/cli"
+)
+
+// loadPolicies reads the server config and loads policies of schema files and of the database
+func loadPolicies(configFile string) {
+	config := util.GetConfig()
+	if err := config.ReadConfig(configFile); err != nil {
+		util.ExitFatalf("Error while loading server config file: %s\n", err)
+	}
+	if err := os.Chdir(path.Dir(configFile)); err != nil {
+		util.ExitFatalf("Chdir error: %s\n", err)
+	}
+	manager := schema.GetManager()
+	schemaFiles := config.GetStringList("schemas", nil)
+	if schemaFiles == nil {
+		util.ExitFatal("No schema specified in configuration")
+	}
+	if err := manager.LoadSchemasFromFiles(schemaFiles...); err != nil {
+		util.ExitFatalf("Error when loading schemas: %s\n", err)
+	}
+	policySchema, ok := manager.Schema("policy")
+	if !ok || config.GetString("database/type", "") == "" {
+		return
+	}
+	dbConn, err := db.CreateFromConfig(config)
+	if err != nil {
+		util.ExitFatalf("Failed to create db conn, err: %s\n", err)
+	}
+	if err := db.Within(dbConn, func(tx transaction.Transaction) error {
+		policies, _, err := tx.List(policySchema, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		return manager.LoadPolicies(policies)
+	}); err != nil {
+		util.ExitFatalf("Failed to load policies from database: %s\n", err)
+	}
+}
+
+func getPolicyExplainCommand() cli.Command {
+	return cli.Command{
+		Name:  "policy-explain",
+		Usage: "Explain which policy authorizes a request",
+		Description: `
+Evaluates policies of the server config for the action on the path by a principal,
+printing every policy considered, which one matched and why others didn't,
+visible and hidden properties and tenant filters of the matched policy.
+Exits with status 1 when the request isn't allowed.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "config-file", Value: defaultConfigFile, Usage: "Server config File"},
+			cli.StringFlag{Name: "action, a", Value: "read", Usage: "Action"},
+			cli.StringFlag{Name: "path, p", Value: "", Usage: "Path of the request"},
+			cli.StringSliceFlag{Name: "role, r", Value: &cli.StringSlice{}, Usage: "Role of the principal, can be repeated"},
+			cli.StringFlag{Name: "tenant-id", Value: "", Usage: "Tenant ID of the principal"},
+			cli.StringFlag{Name: "tenant-name", Value: "", Usage: "Tenant name of the principal"},
+			cli.StringFlag{Name: "resource", Value: "", Usage: "Resource checked against the matched policy (JSON)"},
+		},
+		Action: func(c *cli.Context) {
+			loadPolicies(c.String("config-file"))
+			roles := []interface{}{}
+			for _, role := range c.StringSlice("role") {
+				roles = append(roles, role)
+			}
+			request := map[string]interface{}{
+				"action":      c.String("action"),
+				"path":        c.String("path"),
+				"roles":       roles,
+				"tenant_id":   c.String("tenant-id"),
+				"tenant_name": c.String("tenant-name"),
+			}
+			if rawResource := c.String("resource"); rawResource != "" {
+				var resource map[string]interface{}
+				if err := json.Unmarshal([]byte(rawResource), &resource); err != nil {
+					util.ExitFatalf("Invalid resource: %s\n", err)
+				}
+				request["resource"] = resource
+			}
+			explanation, err := server.ExplainPolicy(request)
+			if err != nil {
+				util.ExitFatal(err)
+			}
+			output, _ := json.MarshalIndent(explanation, "", "  ")
+			fmt.Println(string(output))
+			if !explanation.Allowed {
+				os.Exit(1)
+			}
+		},
+	}
+}
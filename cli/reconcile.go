@@ -0,0 +1,134 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server"
+	"github.com/cloudwan/gohan/sync"
+	sync_util "github.com/cloudwan/gohan/sync/util"
+	"github.com/cloudwan/gohan/util"
+	"github.com/codegangsta/cli"
+)
+
+var reconcileFlags = []cli.Flag{
+	cli.StringFlag{Name: "config-file", Value: defaultConfigFile, Usage: "Server config File"},
+	cli.IntFlag{Name: "batch-size", Value: 100, Usage: "Maximum number of resources read or fixed at once"},
+	cli.StringSliceFlag{Name: "schema", Value: &cli.StringSlice{}, Usage: "Schema to check, can be repeated, defaults to all synced schemas"},
+}
+
+// loadSyncEnvironment reads the server config and connects to the database and the sync backend
+func loadSyncEnvironment(configFile string) (db.DB, sync.Sync) {
+	config := util.GetConfig()
+	if configFile == "" {
+		log.Fatal("Need to provide server config file")
+	}
+	if err := config.ReadConfig(configFile); err != nil {
+		log.Fatalf("Error while loading server config file: %s", err)
+	}
+	if err := os.Chdir(path.Dir(configFile)); err != nil {
+		log.Fatalf("Chdir error: %s", err)
+	}
+
+	dbConn, err := db.CreateFromConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create db conn, err: %s", err)
+	}
+
+	sync, err := sync_util.CreateFromConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create sync, err: %s", err)
+	}
+	if sync == nil {
+		log.Fatal("No sync backend specified in configuration")
+	}
+
+	schemaFiles := config.GetStringList("schemas", nil)
+	if schemaFiles == nil {
+		log.Fatal("No schema specified in configuration")
+	}
+	log.Info("Loading schemas %s", schemaFiles)
+	if err := schema.GetManager().LoadSchemasFromFiles(schemaFiles...); err != nil {
+		log.Fatalf("Error when loading schemas: %s", err)
+	}
+	return dbConn, sync
+}
+
+func newReconciler(c *cli.Context, dbConn db.DB, sync sync.Sync) *server.Reconciler {
+	return server.NewReconciler(sync, dbConn, server.ReconcilerOptions{
+		BatchSize: c.Int("batch-size"),
+		Schemas:   c.StringSlice("schema"),
+	})
+}
+
+func getSyncDiffCommand() cli.Command {
+	return cli.Command{
+		Name:  "sync-diff",
+		Usage: "Report keys of the sync (etcd) backend which don't match the database",
+		Description: `
+Reports missing and stale config keys of synced resources and orphaned
+config, state and monitoring keys of resources which don't exist.
+Exits with status 1 when any difference is found.`,
+		Flags: reconcileFlags,
+		Action: func(c *cli.Context) {
+			dbConn, sync := loadSyncEnvironment(c.String("config-file"))
+			diff, err := newReconciler(c, dbConn, sync).Diff()
+			if err != nil {
+				log.Fatalf("Failed to compare sync backend with database: %s", err)
+			}
+			fmt.Print(diff)
+			if !diff.Empty() {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func getReconcileCommand() cli.Command {
+	return cli.Command{
+		Name:  "reconcile",
+		Usage: "Fix keys of the sync (etcd) backend which don't match the database",
+		Description: `
+Re-emits events of resources with missing or stale keys and deletes orphaned keys,
+unlike resync, which rewrites keys of all resources.`,
+		Flags: reconcileFlags,
+		Action: func(c *cli.Context) {
+			dbConn, sync := loadSyncEnvironment(c.String("config-file"))
+			reconciler := newReconciler(c, dbConn, sync)
+			diff, err := reconciler.Diff()
+			if err != nil {
+				log.Fatalf("Failed to compare sync backend with database: %s", err)
+			}
+			fmt.Print(diff)
+			if diff.Empty() {
+				return
+			}
+			fixed, err := reconciler.Reconcile(diff)
+			if err != nil {
+				log.Fatalf("Failed to reconcile sync backend: %s", err)
+			}
+			if _, err := server.SyncPendingEvents(dbConn, sync); err != nil {
+				log.Fatalf("Failed to sync events: %s", err)
+			}
+			fmt.Printf("Fixed %d keys\n", fixed)
+		},
+	}
+}
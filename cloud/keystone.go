@@ -207,6 +207,12 @@ func (client *keystoneV3Client) VerifyToken(token string) (schema.Authorization,
 	project := projectObj.(map[string]interface{})
 	tenantID := project["id"].(string)
 	tenantName := project["name"].(string)
+	domain, _ := project["domain"].(map[string]interface{})
+	domainID, _ := domain["id"].(string)
+	domainName, _ := domain["name"].(string)
+	user, _ := tokenBodyMap["user"].(map[string]interface{})
+	userID, _ := user["id"].(string)
+	userName, _ := user["name"].(string)
 	catalogList, ok := tokenBodyMap["catalog"].([]interface{})
 	catalogObj := []*schema.Catalog{}
 	if ok {
@@ -224,7 +230,7 @@ func (client *keystoneV3Client) VerifyToken(token string) (schema.Authorization,
 			catalogObj = append(catalogObj, schema.NewCatalog(catalog["name"].(string), catalog["type"].(string), endPoints))
 		}
 	}
-	return schema.NewAuthorization(tenantID, tenantName, token, roleIDs, catalogObj), nil
+	return schema.NewDomainAuthorization(domainID, domainName, userID, userName, tenantID, tenantName, token, roleIDs, catalogObj), nil
 }
 
 // GetTenantID maps the given v3.0 project ID to the projects's name
@@ -314,7 +320,9 @@ func (client *keystoneV2Client) VerifyToken(token string) (schema.Authorization,
 		}
 		catalogObj = append(catalogObj, schema.NewCatalog(catalog["name"].(string), catalog["type"].(string), endPoints))
 	}
-	return schema.NewAuthorization(tenantID, tenantName, token, roleIDs, catalogObj), nil
+	userID, _ := userBody.(map[string]interface{})["id"].(string)
+	userName, _ := userBody.(map[string]interface{})["name"].(string)
+	return schema.NewUserAuthorization(userID, userName, tenantID, tenantName, token, roleIDs, catalogObj), nil
 }
 
 // GetTenantID maps the given v2.0 project name to the tenant's id
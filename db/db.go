@@ -55,20 +55,10 @@ type ITransaction interface {
 	Closed() bool
 }
 
-// IsDeadlock checks if error is deadlock
+// IsDeadlock checks if error is deadlock or serialization failure
+// reported by any of supported SQL databases
 func IsDeadlock(err error) bool {
-	knownDatabaseErrorMessages := []string{
-		"Deadlock found when trying to get lock; try restarting transaction", /* MySQL / MariaDB */
-		"database is locked",                                                 /* SQLite */
-	}
-
-	for _, msg := range knownDatabaseErrorMessages {
-		if strings.Contains(err.Error(), msg) {
-			return true
-		}
-	}
-
-	return false
+	return sql.IsDeadlock(err)
 }
 
 func tryToCommit(fn func(ITransaction) error) func(ITransaction) error {
@@ -323,3 +313,28 @@ func InitDBWithSchemas(dbType, dbConnection string, initDBParams InitDBParams) e
 	defer aDb.Close()
 	return InitDBConnWithSchemas(aDb, initDBParams)
 }
+
+// PurgeDeleted physically deletes resources of recoverable schemas soft deleted before the given time.
+// Soft delete is supported only by SQL databases.
+func PurgeDeleted(ctx context.Context, db DB, before time.Time) error {
+	schemas := schema.GetManager().OrderedSchemas()
+	// children are purged before their parents still referencing them
+	for i := len(schemas) - 1; i >= 0; i-- {
+		s := schemas[i]
+		if s.IsAbstract() || !s.Recoverable() {
+			continue
+		}
+		if err := WithinTx(ctx, db, &transaction.TxOptions{IsolationLevel: transaction.ReadCommited}, func(tx transaction.Transaction) error {
+			return sql.PurgeDeletedContext(ctx, tx, s, before)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreDeleted restores a resource of a recoverable schema soft deleted at the given time,
+// together with its children deleted with it
+func RestoreDeleted(ctx context.Context, tx transaction.Transaction, s *schema.Schema, resourceID, deletedAt interface{}) error {
+	return sql.RestoreDeletedContext(ctx, tx, s, resourceID, deletedAt)
+}
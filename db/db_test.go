@@ -22,11 +22,13 @@ import (
 	"github.com/cloudwan/gohan/db"
 	"github.com/cloudwan/gohan/db/mocks"
 	"github.com/cloudwan/gohan/db/options"
+	"github.com/cloudwan/gohan/db/pagination"
 	"github.com/cloudwan/gohan/db/transaction"
 	"github.com/cloudwan/gohan/schema"
 	"github.com/cloudwan/gohan/util"
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"github.com/pkg/errors"
 )
@@ -95,7 +97,7 @@ var _ = Describe("Database operation test", func() {
 				"tenant_id":         "blue",
 				"shared":            false,
 				"route_targets":     []string{"1000:10000", "2000:20000"},
-				"providor_networks": map[string]interface{}{"segmentation_id": 10, "segmentation_type": "vlan"}}
+				"providor_networks": map[string]interface{}{"segmentation_id": 20, "segmentation_type": "vlan"}}
 			networkResource2, err = manager.LoadResource("network", network2)
 			Expect(err).ToNot(HaveOccurred())
 
@@ -138,6 +140,119 @@ var _ = Describe("Database operation test", func() {
 			tx.Close()
 		})
 
+		filterWithOperators := func() {
+			DescribeTable("Returns the expected list with filter operators",
+				func(predicate map[string]interface{}, expected []string) {
+					filter := map[string]interface{}{
+						"__and__": []map[string]interface{}{predicate},
+					}
+					list, _, err := tx.List(networkSchema, filter, nil, nil)
+					Expect(err).ToNot(HaveOccurred())
+					ids := []string{}
+					for _, resource := range list {
+						ids = append(ids, resource.ID())
+					}
+					Expect(ids).To(ConsistOf(expected))
+				},
+				Entry("neq", map[string]interface{}{"property": "tenant_id", "type": "neq", "value": "red"},
+					[]string{"networkBlue"}),
+				Entry("in", map[string]interface{}{"property": "tenant_id", "type": "in", "value": []string{"red", "green"}},
+					[]string{"networkRed"}),
+				Entry("not_in", map[string]interface{}{"property": "tenant_id", "type": "not_in", "value": []string{"red", "green"}},
+					[]string{"networkBlue"}),
+				Entry("like", map[string]interface{}{"property": "name", "type": "like", "value": "Network%"},
+					[]string{"networkRed", "networkBlue"}),
+				Entry("ilike", map[string]interface{}{"property": "name", "type": "ilike", "value": "%blue"},
+					[]string{"networkBlue"}),
+				Entry("prefix", map[string]interface{}{"property": "name", "type": "prefix", "value": "NetworkR"},
+					[]string{"networkRed"}),
+				Entry("gt on JSON path", map[string]interface{}{"property": "providor_networks", "path": "segmentation_id", "type": "gt", "value": 10},
+					[]string{"networkBlue"}),
+				Entry("lte on JSON path", map[string]interface{}{"property": "providor_networks", "path": "segmentation_id", "type": "lte", "value": 10},
+					[]string{"networkRed"}),
+				Entry("eq on JSON path", map[string]interface{}{"property": "providor_networks", "path": "segmentation_type", "type": "eq", "value": "vlan"},
+					[]string{"networkRed", "networkBlue"}),
+			)
+
+			It("Returns the error with unknown filter operator", func() {
+				filter := map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"property": "tenant_id", "type": "regexp", "value": "red"},
+					},
+				}
+				_, _, err := tx.List(networkSchema, filter, nil, nil)
+				Expect(err).To(HaveOccurred())
+			})
+		}
+
+		pageWithMarker := func() {
+			It("Returns pages following the marker", func() {
+				pg, err := pagination.NewPaginator(
+					pagination.OptionKey(networkSchema, "name"), pagination.OptionOrder(pagination.ASC), pagination.OptionLimit(1))
+				Expect(err).ToNot(HaveOccurred())
+				list, num, err := tx.List(networkSchema, nil, nil, pg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(num).To(Equal(uint64(2)))
+				Expect(list).To(HaveLen(1))
+				Expect(list[0].ID()).To(Equal("networkBlue"))
+
+				marker := pg.NextMarker(list)
+				Expect(marker).ToNot(BeEmpty())
+				pg, err = pagination.NewPaginator(
+					pagination.OptionKey(networkSchema, "name"), pagination.OptionOrder(pagination.ASC), pagination.OptionLimit(1),
+					pagination.OptionMarker(marker))
+				Expect(err).ToNot(HaveOccurred())
+				list, num, err = tx.List(networkSchema, nil, nil, pg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(num).To(Equal(uint64(2)))
+				Expect(list).To(HaveLen(1))
+				Expect(list[0].ID()).To(Equal("networkRed"))
+
+				pg.Marker = pg.NextMarker(list)
+				list, _, err = tx.List(networkSchema, nil, nil, pg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(BeEmpty())
+			})
+
+			It("Returns pages following the marker in descending order", func() {
+				pg, err := pagination.NewPaginator(
+					pagination.OptionKey(networkSchema, "id"), pagination.OptionOrder(pagination.DESC), pagination.OptionLimit(1),
+					pagination.OptionMarker(pagination.EncodeMarker("networkRed", "networkRed")))
+				Expect(err).ToNot(HaveOccurred())
+				list, _, err := tx.List(networkSchema, nil, nil, pg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(HaveLen(1))
+				Expect(list[0].ID()).To(Equal("networkBlue"))
+			})
+
+			It("Orders resources following the marker by id without a sort key", func() {
+				pg, err := pagination.NewPaginator(
+					pagination.OptionLimit(1), pagination.OptionMarker(pagination.EncodeMarker("networkBlue", "networkBlue")))
+				Expect(err).ToNot(HaveOccurred())
+				list, _, err := tx.List(networkSchema, nil, nil, pg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(HaveLen(1))
+				Expect(list[0].ID()).To(Equal("networkRed"))
+			})
+		}
+
+		Describe("Using yaml", func() {
+			BeforeEach(func() {
+				conn = "./test.yaml"
+				dbType = "yaml"
+			})
+
+			Describe("When the database is not empty", func() {
+				JustBeforeEach(func() {
+					Expect(tx.Create(networkResource1)).To(Succeed())
+					Expect(tx.Create(networkResource2)).To(Succeed())
+				})
+
+				filterWithOperators()
+				pageWithMarker()
+			})
+		})
+
 		Describe("Using sql", func() {
 			BeforeEach(func() {
 				if os.Getenv("MYSQL_TEST") == "true" {
@@ -220,6 +335,45 @@ var _ = Describe("Database operation test", func() {
 					Expect(tx.Commit()).To(Succeed())
 				})
 
+				filterWithOperators()
+				pageWithMarker()
+
+				It("Pages through resources with NULL sort key values", func() {
+					subnetSchema, _ := manager.Schema("subnet")
+					for id, name := range map[string]interface{}{"subnetRed": "SubnetRed", "subnetBlue": "SubnetBlue", "subnetNull": nil} {
+						subnet, err := manager.LoadResource("subnet", map[string]interface{}{
+							"id":          id,
+							"name":        name,
+							"description": "",
+							"tenant_id":   "red",
+							"cidr":        "10.0.0.0/24"})
+						Expect(err).ToNot(HaveOccurred())
+						subnet.SetParentID("networkRed")
+						Expect(tx.Create(subnet)).To(Succeed())
+					}
+
+					for _, order := range []string{pagination.ASC, pagination.DESC} {
+						ids := []string{}
+						marker := ""
+						for page := 0; page < 4; page++ {
+							pg, err := pagination.NewPaginator(
+								pagination.OptionKey(subnetSchema, "name"), pagination.OptionOrder(order),
+								pagination.OptionLimit(1), pagination.OptionMarker(marker))
+							Expect(err).ToNot(HaveOccurred())
+							list, _, err := tx.List(subnetSchema, nil, nil, pg)
+							Expect(err).ToNot(HaveOccurred())
+							for _, resource := range list {
+								ids = append(ids, resource.ID())
+							}
+							marker = pg.NextMarker(list)
+							if marker == "" {
+								break
+							}
+						}
+						Expect(ids).To(ConsistOf("subnetRed", "subnetBlue", "subnetNull"))
+					}
+				})
+
 				It("Returns the error with invalid filter in List", func() {
 					filter := map[string]interface{}{
 						"bad_filter": []string{"red"},
@@ -18,9 +18,9 @@ package file
 import (
 	"context"
 	"fmt"
-	"math"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/cloudwan/gohan/db/options"
 	"github.com/cloudwan/gohan/db/pagination"
@@ -157,6 +157,15 @@ func (tx *Transaction) UpdateContext(_ context.Context, resource *schema.Resourc
 	return tx.Update(resource)
 }
 
+//UpdateIfMatch updates resource in the db if it still has the given ETag
+func (tx *Transaction) UpdateIfMatch(resource *schema.Resource, etag string) error {
+	return tx.UpdateIfMatchContext(context.Background(), resource, etag)
+}
+
+func (tx *Transaction) UpdateIfMatchContext(ctx context.Context, resource *schema.Resource, etag string) error {
+	return transaction.UpdateIfMatch(ctx, tx, resource, etag)
+}
+
 //Update update resource in the db
 func (tx *Transaction) Update(resource *schema.Resource) error {
 	db := tx.db
@@ -206,38 +215,43 @@ func (tx *Transaction) Delete(s *schema.Schema, resourceID interface{}) error {
 	return nil
 }
 
-type byPaginator struct {
-	data []*schema.Resource
-	pg   *pagination.Paginator
-}
-
-func (s byPaginator) Len() int {
-	return len(s.data)
-}
-func (s byPaginator) Swap(i, j int) {
-	s.data[i], s.data[j] = s.data[j], s.data[i]
-}
-func (s byPaginator) Less(i, j int) bool {
-	key := s.pg.Key
-	vi := s.data[i].Get(key)
-	vj := s.data[j].Get(key)
-	var less bool
-
-	switch vi.(type) {
-	case int:
-		less = vi.(int) < vj.(int)
-	case float64:
-		less = vi.(float64) < vj.(float64)
-	case string:
-		less = vi.(string) < vj.(string)
-	default:
-		panic(fmt.Sprintf("uncomparable type %T", vi))
+// paginate sorts resources by the paginator key and id, then selects the requested page
+func paginate(list []*schema.Resource, pg *pagination.Paginator) ([]*schema.Resource, error) {
+	key := pg.SortKey()
+	order := func(c int) int {
+		if pg.IsDescending() {
+			return -c
+		}
+		return c
+	}
+	compareResources := func(value interface{}, id string, resource *schema.Resource) int {
+		if c := compareValues(value, resource.Get(key)); c != 0 {
+			return order(c)
+		}
+		return order(strings.Compare(id, resource.ID()))
 	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return compareResources(list[i].Get(key), list[i].ID(), list[j]) < 0
+	})
 
-	if s.pg.Order == pagination.DESC {
-		return !less
+	if pg.Marker != "" {
+		value, id, err := pagination.DecodeMarker(pg.Marker)
+		if err != nil {
+			return nil, err
+		}
+		start := sort.Search(len(list), func(i int) bool {
+			return compareResources(value, id, list[i]) < 0
+		})
+		list = list[start:]
+	}
+	if pg.Offset >= uint64(len(list)) {
+		return []*schema.Resource{}, nil
+	}
+	list = list[pg.Offset:]
+	if pg.Limit < uint64(len(list)) {
+		list = list[:pg.Limit]
 	}
-	return less
+	return list, nil
 }
 
 func (tx *Transaction) ListContext(_ context.Context, s *schema.Schema, filter transaction.Filter, options *transaction.ViewOptions, pg *pagination.Paginator) (list []*schema.Resource, total uint64, err error) {
@@ -257,56 +271,19 @@ func (tx *Transaction) List(s *schema.Schema, filter transaction.Filter, options
 			log.Warning("%s %s", resource, err)
 			return
 		}
-		valid := true
-		if filter != nil {
-			for key, value := range filter {
-				if data[key] == nil {
-					continue
-				}
-				property, err := s.GetPropertyByID(key)
-				if err != nil {
-					continue
-				}
-				switch value.(type) {
-				case string:
-					if property.Type == "boolean" {
-						dataBool, err1 := strconv.ParseBool(data[key].(string))
-						valueBool, err2 := strconv.ParseBool(value.(string))
-						if err1 != nil || err2 != nil || dataBool != valueBool {
-							valid = false
-						}
-					} else if data[key] != value {
-						valid = false
-					}
-				case []string:
-					if property.Type == "boolean" {
-						v, _ := strconv.ParseBool(data[key].(string))
-						if !boolInSlice(v, value.([]string)) {
-							valid = false
-						}
-					}
-					if !stringInSlice(fmt.Sprintf("%v", data[key]), value.([]string)) {
-						valid = false
-					}
-				default:
-					if data[key] != value {
-						valid = false
-					}
-				}
-			}
+		var valid bool
+		valid, err = matchFilter(s, data, filter)
+		if err != nil {
+			return nil, 0, err
 		}
 		if valid {
 			list = append(list, resource)
 		}
-
-		if pg != nil {
-			sort.Sort(byPaginator{list, pg})
-			if pg.Limit != math.MaxUint64 {
-				list = list[:pg.Limit]
-			}
-		}
 	}
 	total = uint64(len(list))
+	if pg != nil {
+		list, err = paginate(list, pg)
+	}
 	return
 }
 
@@ -378,6 +355,26 @@ func (tx *Transaction) Query(s *schema.Schema, query string, arguments []interfa
 	panic("Not implemented")
 }
 
+var errHistoryNotSupported = fmt.Errorf("resource history is not supported by file database")
+
+func (tx *Transaction) FetchVersionContext(_ context.Context, s *schema.Schema, resourceID interface{}, version int64) (*transaction.ResourceVersion, error) {
+	return tx.FetchVersion(s, resourceID, version)
+}
+
+// FetchVersion is not supported, as history is not kept
+func (tx *Transaction) FetchVersion(s *schema.Schema, resourceID interface{}, version int64) (*transaction.ResourceVersion, error) {
+	return nil, errHistoryNotSupported
+}
+
+func (tx *Transaction) ListVersionsContext(_ context.Context, s *schema.Schema, resourceID interface{}) ([]*transaction.ResourceVersion, error) {
+	return tx.ListVersions(s, resourceID)
+}
+
+// ListVersions is not supported, as history is not kept
+func (tx *Transaction) ListVersions(s *schema.Schema, resourceID interface{}) ([]*transaction.ResourceVersion, error) {
+	return nil, errHistoryNotSupported
+}
+
 func (tx *Transaction) ExecContext(_ context.Context, sql string, args ...interface{}) error {
 	return tx.Exec(sql, args...)
 }
@@ -0,0 +1,294 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+)
+
+// matchFilter checks if data matches the filter, semantics follow the SQL backend
+func matchFilter(s *schema.Schema, data map[string]interface{}, filter transaction.Filter) (bool, error) {
+	for key, value := range filter {
+		var (
+			match bool
+			err   error
+		)
+		switch key {
+		case transaction.OrCondition:
+			match, err = matchConditions(s, data, value, false)
+		case transaction.AndCondition:
+			match, err = matchConditions(s, data, value, true)
+		default:
+			match = matchProperty(s, data, key, value)
+		}
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchProperty(s *schema.Schema, data map[string]interface{}, key string, value interface{}) bool {
+	if data[key] == nil {
+		return true
+	}
+	property, err := s.GetPropertyByID(key)
+	if err != nil {
+		return true
+	}
+	switch value.(type) {
+	case string:
+		if property.Type == "boolean" {
+			dataBool, err1 := strconv.ParseBool(data[key].(string))
+			valueBool, err2 := strconv.ParseBool(value.(string))
+			if err1 != nil || err2 != nil || dataBool != valueBool {
+				return false
+			}
+		} else if data[key] != value {
+			return false
+		}
+	case []string:
+		if property.Type == "boolean" {
+			v, _ := strconv.ParseBool(data[key].(string))
+			if !boolInSlice(v, value.([]string)) {
+				return false
+			}
+		}
+		if !stringInSlice(fmt.Sprintf("%v", data[key]), value.([]string)) {
+			return false
+		}
+	default:
+		if data[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func matchConditions(s *schema.Schema, data map[string]interface{}, conditions interface{}, all bool) (bool, error) {
+	filters, ok := conditions.([]map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("Invalid filter condition: %v", conditions)
+	}
+	if len(filters) == 0 {
+		return all, nil
+	}
+	for _, filter := range filters {
+		var (
+			match bool
+			err   error
+		)
+		if nested, ok := filter[transaction.OrCondition]; ok {
+			match, err = matchConditions(s, data, nested, false)
+		} else if nested, ok := filter[transaction.AndCondition]; ok {
+			match, err = matchConditions(s, data, nested, true)
+		} else {
+			match, err = matchPredicate(s, data, filter)
+		}
+		if err != nil {
+			return false, err
+		}
+		if match != all {
+			return match, nil
+		}
+	}
+	return all, nil
+}
+
+func matchPredicate(s *schema.Schema, data map[string]interface{}, filter map[string]interface{}) (bool, error) {
+	key, _ := filter["property"].(string)
+	if _, err := s.GetPropertyByID(key); err != nil {
+		return false, err
+	}
+	operator, _ := filter["type"].(string)
+	if err := transaction.CheckOperator(operator); err != nil {
+		return false, err
+	}
+	value := filter["value"]
+	actual := data[key]
+	if path, ok := filter["path"].(string); ok && path != "" {
+		segments, err := transaction.SplitPath(path)
+		if err != nil {
+			return false, err
+		}
+		actual = lookupPath(actual, segments)
+	}
+
+	switch operator {
+	case transaction.Equal:
+		return equalOrIn(actual, value), nil
+	case transaction.NotEqual:
+		return actual != nil && !equalOrIn(actual, value), nil
+	case transaction.LessThan:
+		return compare(actual, value, func(c int) bool { return c < 0 }), nil
+	case transaction.LessOrEqual:
+		return compare(actual, value, func(c int) bool { return c <= 0 }), nil
+	case transaction.GreaterThan:
+		return compare(actual, value, func(c int) bool { return c > 0 }), nil
+	case transaction.GreaterOrEqual:
+		return compare(actual, value, func(c int) bool { return c >= 0 }), nil
+	case transaction.In:
+		return inSlice(actual, value), nil
+	case transaction.NotIn:
+		return actual != nil && !inSlice(actual, value), nil
+	case transaction.Like:
+		return matchLike(actual, fmt.Sprint(value), false), nil
+	case transaction.ILike:
+		return matchLike(actual, fmt.Sprint(value), true), nil
+	case transaction.Prefix:
+		return actual != nil && strings.HasPrefix(fmt.Sprint(actual), fmt.Sprint(value)), nil
+	case transaction.IsNull:
+		isNull, ok := value.(bool)
+		if !ok {
+			return false, fmt.Errorf("Value of %s filter on %s has to be a boolean", operator, key)
+		}
+		return (actual == nil) == isNull, nil
+	}
+	return false, fmt.Errorf("Unsupported filter operator %q", operator)
+}
+
+func lookupPath(value interface{}, path []string) interface{} {
+	for _, segment := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[segment]
+	}
+	return value
+}
+
+func equalOrIn(actual, value interface{}) bool {
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Slice {
+		return inSlice(actual, value)
+	}
+	return equal(actual, value)
+}
+
+func inSlice(actual, values interface{}) bool {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return equal(actual, values)
+	}
+	for i := 0; i < v.Len(); i++ {
+		if equal(actual, v.Index(i).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(actual, value interface{}) bool {
+	if actual == nil || value == nil {
+		return false
+	}
+	if a, ok := toFloat(actual); ok {
+		if b, ok := toFloat(value); ok {
+			return a == b
+		}
+	}
+	return fmt.Sprint(actual) == fmt.Sprint(value)
+}
+
+func compare(actual, value interface{}, check func(int) bool) bool {
+	if actual == nil || value == nil {
+		return false
+	}
+	return check(compareValues(actual, value))
+}
+
+// compareValues compares numbers by value and everything else as strings,
+// nil is less than any other value
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	sa, aIsString := a.(string)
+	sb, bIsString := b.(string)
+	if aIsString && bIsString {
+		return strings.Compare(sa, sb)
+	}
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// matchLike matches value against SQL LIKE pattern
+func matchLike(actual interface{}, pattern string, caseInsensitive bool) bool {
+	if actual == nil {
+		return false
+	}
+	var expr strings.Builder
+	if caseInsensitive {
+		expr.WriteString("(?i)")
+	}
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	matched, err := regexp.MatchString(expr.String(), fmt.Sprint(actual))
+	return err == nil && matched
+}
@@ -18,8 +18,11 @@ package migration
 import (
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
 	logger "github.com/cloudwan/gohan/log"
 	"github.com/cloudwan/gohan/util"
@@ -136,9 +139,65 @@ func readGooseConfig() (dbType, dbConnection, migrationsPath string, noInit bool
 	return
 }
 
+// CreateGeneratedMigration writes a migration of given type ("sql" or "go") into the migrations
+// directory, contents gets the version and the name of the created file
+func CreateGeneratedMigration(name, migrationType string, contents func(version, fileName string) string) (string, error) {
+	_, _, migrationsPath, _ := readGooseConfig()
+	if migrationType != "sql" && migrationType != "go" {
+		return "", fmt.Errorf("migration: unknown migration type %q, has to be sql or go", migrationType)
+	}
+	if err := os.MkdirAll(migrationsPath, 0755); err != nil {
+		return "", fmt.Errorf("migration: failed to create migrations directory: %s", err)
+	}
+	version := time.Now().Format("20060102150405")
+	fileName := fmt.Sprintf("%s_%s.%s", version, name, migrationType)
+	filePath := filepath.Join(migrationsPath, fileName)
+	if err := ioutil.WriteFile(filePath, []byte(contents(version, fileName)), 0644); err != nil {
+		return "", fmt.Errorf("migration: failed to write migration: %s", err)
+	}
+	return filePath, nil
+}
+
+// UpGenerated applies only the migration written by CreateGeneratedMigration to filePath,
+// it fails when other migrations are pending as they would have to be applied first
+func UpGenerated(filePath string) error {
+	dbType, dbConnection, migrationsPath, _ := readGooseConfig()
+
+	if err := goose.SetDialect(dbType); err != nil {
+		return fmt.Errorf("migration: failed to set goose dialect: %s", err)
+	}
+
+	db, err := sql.Open(dbType, dbConnection)
+	if err != nil {
+		return fmt.Errorf("migration: failed to open db: %s", err)
+	}
+	defer db.Close()
+
+	version, err := goose.NumericComponent(filePath)
+	if err != nil {
+		return fmt.Errorf("migration: %s", err)
+	}
+	current, err := goose.EnsureDBVersion(db)
+	if err != nil {
+		return fmt.Errorf("migration: failed to ensure db version: %s", err)
+	}
+	migrations, err := goose.CollectMigrations(migrationsPath, current, version)
+	if err != nil {
+		return fmt.Errorf("migration: failed to collect migrations: %s", err)
+	}
+	next, err := migrations.Next(current)
+	if err != nil {
+		return fmt.Errorf("migration: %s is not pending: %s", filepath.Base(filePath), err)
+	}
+	if next.Version != version {
+		return fmt.Errorf("migration: %s is pending, apply pending migrations with \"gohan migrate up\" first", filepath.Base(next.Source))
+	}
+	return next.Up(db)
+}
+
 // help outputs migration sub command help
 func Help() {
-	fmt.Println("missing subcommand: help, up, up-by-one, up-to, create, create-next, down, down-to, redo, status, version")
+	fmt.Println("missing subcommand: help, up, up-by-one, up-to, create, create-next, plan, apply, down, down-to, redo, status, version")
 }
 
 func Run(subCmd string, args []string) error {
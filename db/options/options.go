@@ -27,10 +27,23 @@ const (
 	DefaultDeadlockRetryTxCount    = 0
 )
 
-// Options is type for retry transaction options
+// default read replica options
+const (
+	DefaultReplicaHealthCheckInterval = 5 * time.Second
+	DefaultReplicaMaxLag              = time.Duration(0)
+)
+
+// Options is type for retry transaction and read replica options
 type Options struct {
 	RetryTxCount    int
 	RetryTxInterval time.Duration
+
+	// ReadReplicas are connection strings of read replicas used by read-only transactions
+	ReadReplicas []string
+	// ReplicaHealthCheckInterval is the period of checking availability and lag of replicas
+	ReplicaHealthCheckInterval time.Duration
+	// ReplicaMaxLag is the maximum replication lag of a used replica, zero accepts any lag
+	ReplicaMaxLag time.Duration
 }
 
 // Read gets retry transaction options from config
@@ -38,6 +51,12 @@ func Read(config *util.Config) Options {
 	opts := Options{
 		RetryTxCount:    config.GetInt("database/deadlock_retry_tx/count", DefaultDeadlockRetryTxCount),
 		RetryTxInterval: time.Duration(config.GetInt("database/deadlock_retry_tx/interval_msec", int(DefaultDeadlockRetryTxInterval))) * time.Millisecond,
+
+		ReadReplicas: config.GetStringList("database/read_replicas/connections", nil),
+		ReplicaHealthCheckInterval: time.Duration(config.GetInt("database/read_replicas/health_check_interval_msec",
+			int(DefaultReplicaHealthCheckInterval/time.Millisecond))) * time.Millisecond,
+		ReplicaMaxLag: time.Duration(config.GetInt("database/read_replicas/max_lag_msec",
+			int(DefaultReplicaMaxLag/time.Millisecond))) * time.Millisecond,
 	}
 
 	if opts.RetryTxCount < 0 {
@@ -50,7 +69,9 @@ func Read(config *util.Config) Options {
 // Default returns default retry transaction options
 func Default() Options {
 	return Options{
-		RetryTxCount:    DefaultDeadlockRetryTxCount,
-		RetryTxInterval: DefaultDeadlockRetryTxInterval,
+		RetryTxCount:               DefaultDeadlockRetryTxCount,
+		RetryTxInterval:            DefaultDeadlockRetryTxInterval,
+		ReplicaHealthCheckInterval: DefaultReplicaHealthCheckInterval,
+		ReplicaMaxLag:              DefaultReplicaMaxLag,
 	}
 }
@@ -16,6 +16,9 @@
 package pagination
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"math"
 	"net/url"
@@ -35,11 +38,14 @@ const (
 )
 
 //Paginator stores pagination data
+//Marker is an opaque cursor pointing at the last resource of the previous page,
+//when it is set resources following the marker are returned (keyset pagination)
 type Paginator struct {
 	Key    string
 	Order  string
 	Limit  uint64
 	Offset uint64
+	Marker string
 }
 
 type OptionPaginator func(*Paginator) error
@@ -59,6 +65,9 @@ func NewPaginator(options ...OptionPaginator) (*Paginator, error) {
 			return nil, err
 		}
 	}
+	if pg.Marker != "" && pg.Offset > 0 {
+		return nil, fmt.Errorf("Marker can't be used together with offset")
+	}
 	return pg, nil
 }
 
@@ -109,6 +118,85 @@ func OptionOffset(offset uint64) OptionPaginator {
 	}
 }
 
+func OptionMarker(marker string) OptionPaginator {
+	return func(pg *Paginator) error {
+		pg.Marker = marker
+
+		if pg.Marker != "" {
+			if _, _, err := DecodeMarker(pg.Marker); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+//SortKey returns key resources are sorted by, defaults to id
+func (pg *Paginator) SortKey() string {
+	if pg.Key == "" {
+		return defaultSortKey
+	}
+	return pg.Key
+}
+
+//IsDescending checks if resources are sorted in descending order
+func (pg *Paginator) IsDescending() bool {
+	return pg.Order == DESC
+}
+
+//EncodeMarker makes marker pointing at resource with given sort key value and id
+func EncodeMarker(value interface{}, id string) string {
+	data, _ := json.Marshal([]interface{}{value, id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//DecodeMarker returns sort key value and id of resource the marker points at
+func DecodeMarker(marker string) (value interface{}, id string, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(marker)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid marker %q", marker)
+	}
+	var decoded []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil || len(decoded) != 2 {
+		return nil, "", fmt.Errorf("Invalid marker %q", marker)
+	}
+	id, ok := decoded[1].(string)
+	if !ok {
+		return nil, "", fmt.Errorf("Invalid marker %q", marker)
+	}
+	value = decoded[0]
+	if number, ok := value.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			value = i
+		} else {
+			value, _ = number.Float64()
+		}
+	}
+	return value, id, nil
+}
+
+//NextMarker returns marker of the page following the listed resources.
+//Empty marker is returned when the page isn't full, so there are no more resources.
+func (pg *Paginator) NextMarker(list []*schema.Resource) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return pg.NextMarkerFromData(len(list), list[len(list)-1].Data())
+}
+
+//NextMarkerFromData returns marker of the page following a page
+//of given size ending with the resource in mapped representation
+func (pg *Paginator) NextMarkerFromData(size int, last map[string]interface{}) string {
+	if pg.Limit == math.MaxUint64 || pg.Offset > 0 || uint64(size) < pg.Limit || last == nil {
+		return ""
+	}
+	id, _ := last["id"].(string)
+	return EncodeMarker(last[pg.SortKey()], id)
+}
+
 //FromURLQuery create Paginator from Query params
 func FromURLQuery(s *schema.Schema, values url.Values) (pg *Paginator, err error) {
 	var sortKey string
@@ -142,5 +230,6 @@ func FromURLQuery(s *schema.Schema, values url.Values) (pg *Paginator, err error
 		}
 	}
 
-	return NewPaginator(OptionKey(s, sortKey), OptionOrder(sortOrder), OptionLimit(limit), OptionOffset(offset))
+	return NewPaginator(OptionKey(s, sortKey), OptionOrder(sortOrder), OptionLimit(limit), OptionOffset(offset),
+		OptionMarker(values.Get("marker")))
 }
@@ -108,3 +108,60 @@ func TestFromURLQueryErrors(t *testing.T) {
 	pg, err = FromURLQuery(s, values)
 	Expect(err).To(HaveOccurred(), "Got %v", pg)
 }
+
+func TestMarker(t *testing.T) {
+	RegisterTestingT(t)
+	marker := EncodeMarker(12, "abc")
+	value, id, err := DecodeMarker(marker)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(value).To(Equal(int64(12)))
+	Expect(id).To(Equal("abc"))
+
+	marker = EncodeMarker("name", "abc")
+	value, id, err = DecodeMarker(marker)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(value).To(Equal("name"))
+	Expect(id).To(Equal("abc"))
+
+	_, _, err = DecodeMarker("not a marker")
+	Expect(err).To(HaveOccurred())
+}
+
+func TestFromURLQueryWithMarker(t *testing.T) {
+	RegisterTestingT(t)
+	marker := EncodeMarker("name", "abc")
+	values := url.Values{
+		"limit":  []string{"10"},
+		"marker": []string{marker},
+	}
+	pg, err := FromURLQuery(nil, values)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(pg.Marker).To(Equal(marker))
+
+	values.Set("offset", "10")
+	_, err = FromURLQuery(nil, values)
+	Expect(err).To(HaveOccurred())
+
+	values.Del("offset")
+	values.Set("marker", "bad")
+	_, err = FromURLQuery(nil, values)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestNextMarker(t *testing.T) {
+	RegisterTestingT(t)
+	pg, err := NewPaginator(OptionKey(nil, "name"), OptionLimit(2))
+	Expect(err).ToNot(HaveOccurred())
+
+	last := map[string]interface{}{"id": "b", "name": "beta"}
+	Expect(pg.NextMarkerFromData(1, last)).To(BeEmpty())
+	marker := pg.NextMarkerFromData(2, last)
+	value, id, err := DecodeMarker(marker)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(value).To(Equal("beta"))
+	Expect(id).To(Equal("b"))
+
+	pg, err = NewPaginator()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(pg.NextMarkerFromData(2, last)).To(BeEmpty())
+}
@@ -41,20 +41,88 @@ type CachedState struct {
 type CachedTransaction struct {
 	TxInterface
 	QueryCache map[string]CachedState
+
+	// shared keeps list results of schemas with cache_ttl between transactions
+	shared *queryCache
+	// written holds schemas changed in the transaction and cached schemas joining them,
+	// invalidated in the shared cache on commit
+	written map[string]bool
+	// writtenRaw is set when raw statements might have changed any schema
+	writtenRaw bool
 }
 
 func MakeCachedTransaction(transx TxInterface) TxInterface {
-	cachedTransaction := &CachedTransaction{transx, nil}
+	cachedTransaction := &CachedTransaction{TxInterface: transx}
+	cachedTransaction.ClearCache()
+	return cachedTransaction
+}
+
+func (db *DB) makeCachedTransaction(transx TxInterface) TxInterface {
+	cachedTransaction := &CachedTransaction{
+		TxInterface: transx,
+		shared:      db.queryCache,
+		written:     map[string]bool{},
+	}
 	cachedTransaction.ClearCache()
 	return cachedTransaction
 }
 
+// markWritten records the schema and cached schemas whose list results might include changed data of it
+func (tx *CachedTransaction) markWritten(s *schema.Schema, deleted bool) {
+	if tx.written == nil {
+		return
+	}
+	tx.written[s.ID] = true
+	for _, dependent := range s.CacheDependents(deleted) {
+		tx.written[dependent.ID] = true
+	}
+}
+
+func (tx *CachedTransaction) markResourceWritten(resource *schema.Resource) {
+	if tx.written != nil {
+		tx.markWritten(resource.Schema(), false)
+	}
+}
+
+func (tx *CachedTransaction) modified() bool {
+	return tx.writtenRaw || len(tx.written) > 0
+}
+
+//Commit commits the transaction and invalidates shared results of schemas changed by it
+func (tx *CachedTransaction) Commit() error {
+	if err := tx.TxInterface.Commit(); err != nil {
+		return err
+	}
+	if tx.shared == nil {
+		return nil
+	}
+	if tx.writtenRaw {
+		tx.shared.invalidateAll()
+		return nil
+	}
+	for schemaID := range tx.written {
+		tx.shared.invalidate(schemaID)
+	}
+	return nil
+}
+
+func (tx *CachedTransaction) Exec(query string, args ...interface{}) error {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *CachedTransaction) ExecContext(ctx context.Context, query string, args ...interface{}) error {
+	tx.ClearCache()
+	tx.writtenRaw = true
+	return tx.TxInterface.ExecContext(ctx, query, args...)
+}
+
 func (tx *CachedTransaction) Create(resource *schema.Resource) error {
 	return tx.CreateContext(context.Background(), resource)
 }
 
 func (tx *CachedTransaction) CreateContext(ctx context.Context, resource *schema.Resource) error {
 	tx.ClearCache()
+	tx.markResourceWritten(resource)
 	return tx.TxInterface.CreateContext(ctx, resource)
 }
 
@@ -64,15 +132,25 @@ func (tx *CachedTransaction) Update(resource *schema.Resource) error {
 
 func (tx *CachedTransaction) UpdateContext(ctx context.Context, resource *schema.Resource) error {
 	tx.ClearCache()
+	tx.markResourceWritten(resource)
 	return tx.TxInterface.UpdateContext(context.Background(), resource)
 }
 
+func (tx *CachedTransaction) UpdateIfMatch(resource *schema.Resource, etag string) error {
+	return tx.UpdateIfMatchContext(context.Background(), resource, etag)
+}
+
+func (tx *CachedTransaction) UpdateIfMatchContext(ctx context.Context, resource *schema.Resource, etag string) error {
+	return transaction.UpdateIfMatch(ctx, tx, resource, etag)
+}
+
 func (tx *CachedTransaction) StateUpdate(resource *schema.Resource, state *transaction.ResourceState) error {
 	return tx.StateUpdateContext(context.Background(), resource, state)
 }
 
 func (tx *CachedTransaction) StateUpdateContext(ctx context.Context, resource *schema.Resource, state *transaction.ResourceState) error {
 	tx.ClearCache()
+	tx.markResourceWritten(resource)
 	return tx.TxInterface.StateUpdateContext(context.Background(), resource, state)
 }
 
@@ -82,7 +160,8 @@ func (tx *CachedTransaction) Delete(s *schema.Schema, resourceID interface{}) er
 
 func (tx *CachedTransaction) DeleteContext(ctx context.Context, s *schema.Schema, resourceID interface{}) error {
 	tx.ClearCache()
-	return tx.TxInterface.DeleteContext(context.Background(), s, resourceID)
+	tx.markWritten(s, true)
+	return tx.TxInterface.DeleteContext(ctx, s, resourceID)
 }
 
 func (tx *CachedTransaction) List(s *schema.Schema, filter transaction.Filter, options *transaction.ViewOptions, pg *pagination.Paginator) (list []*schema.Resource, total uint64, err error) {
@@ -101,7 +180,7 @@ func (tx *CachedTransaction) ListContext(ctx context.Context, s *schema.Schema,
 
 	if !wasCached {
 		metrics.UpdateCounter(1, "tx.%s.cache.miss", s.ID)
-		list, total, err = tx.TxInterface.ListContext(ctx, s, filter, options, pg)
+		list, total, err = tx.listShared(ctx, s, sc, filter, options, pg)
 		tx.saveCache(s.ID, sc, list, total, false, err)
 	} else {
 		metrics.UpdateCounter(1, "tx.%s.cache.hit", s.ID)
@@ -109,12 +188,35 @@ func (tx *CachedTransaction) ListContext(ctx context.Context, s *schema.Schema,
 	return
 }
 
+// listShared lists resources using the cache shared between transactions when the schema enables it.
+// Transactions which changed data don't use it, as they have to see their own changes.
+func (tx *CachedTransaction) listShared(ctx context.Context, s *schema.Schema, sc *selectContext, filter transaction.Filter, options *transaction.ViewOptions, pg *pagination.Paginator) (list []*schema.Resource, total uint64, err error) {
+	if tx.shared == nil || s.CacheTTL() <= 0 || tx.modified() {
+		return tx.TxInterface.ListContext(ctx, s, filter, options, pg)
+	}
+	key, err := tx.createKey(s.ID, sc)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, total, generation, ok := tx.shared.get(s.ID, key)
+	if ok {
+		metrics.UpdateCounter(1, "db.%s.shared_cache.hit", s.ID)
+		return list, total, nil
+	}
+	metrics.UpdateCounter(1, "db.%s.shared_cache.miss", s.ID)
+	list, total, err = tx.TxInterface.ListContext(ctx, s, filter, options, pg)
+	if err == nil {
+		tx.shared.put(s, key, generation, list, total)
+	}
+	return
+}
+
 func (tx *CachedTransaction) createKey(schemaID string, sc *selectContext) (string, error) {
 	filterHash, err := hashstructure.Hash(sc.filter, nil)
 	if err != nil {
 		return "", err
 	}
-	res := fmt.Sprintf("%s %v %v %v", schemaID, sc.join, filterHash, sc.fields)
+	res := fmt.Sprintf("%s %v %v %v %v", schemaID, sc.join, filterHash, sc.fields, sc.showDeleted)
 	if sc.paginator != nil {
 		res = fmt.Sprintf("%s %v", res, *sc.paginator)
 	}
@@ -0,0 +1,685 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// ColumnType is a database independent column type
+type ColumnType int
+
+// Column types used by property handlers
+const (
+	VarcharColumn ColumnType = iota
+	TextColumn
+	BooleanColumn
+	RealColumn
+	IntegerColumn
+	JSONColumn
+)
+
+// Dialect hides the differences between supported SQL databases.
+//
+// Queries inside this package are written in a canonical form, which is
+// the MySQL/SQLite one: identifiers are quoted with backticks and
+// placeholders are question marks. Every statement is passed through
+// Rewrite before it is sent to the driver.
+type Dialect interface {
+	// Name returns the database/sql driver name
+	Name() string
+	// Rewrite translates a canonical query into the dialect
+	Rewrite(query string) string
+	// ColumnType returns column definition for a generic column type
+	ColumnType(ColumnType) string
+	// NormalizeSQLType translates a schema provided "sql" type
+	NormalizeSQLType(sqlType string) string
+	// MaxIdentifierLength returns the maximum length of constraint names
+	MaxIdentifierLength() int
+	// IndexColumn returns index column definition for a column of given type
+	IndexColumn(column, sqlType string) string
+	// SupportsIndexType checks if the index type can be created
+	SupportsIndexType(schema.IndexType) bool
+	// SupportsPartialIndex checks if indexes can be limited with a WHERE clause
+	SupportsPartialIndex() bool
+	// IndexInclude returns clause adding non key columns to an index, or an empty string if it isn't supported
+	IndexInclude(columns []string) string
+	// QuoteString returns a string literal
+	QuoteString(value string) string
+	// AlterTable returns statement adding columns and relations to a table
+	AlterTable(table string, columns, relations []string) string
+	// LockClause returns suffix locking rows selected from the table
+	LockClause(table string) string
+	// NullsFirst checks if NULLs are ordered before other values in ascending order
+	NullsFirst() bool
+	// Upsert returns statement inserting a row or updating it on key conflict
+	Upsert(table string, columns, keyColumns []string) string
+	// JSONExtract returns expression extracting value under path from JSON column,
+	// value is the one the expression is compared with
+	JSONExtract(column string, path []string, value interface{}) string
+	// IsDeadlock checks if error is a deadlock or a serialization failure
+	IsDeadlock(err error) bool
+	// InitStatements returns statements executed on every new transaction
+	InitStatements() []string
+	// ReplicationLag returns how much a read replica lags behind the primary, zero if it isn't a replica
+	ReplicationLag(q sqlx.Queryer) (time.Duration, error)
+	// DescribeTable returns columns, indexes and foreign keys of a table, or nil if it doesn't exist
+	DescribeTable(q sqlx.Queryer, table string) (*TableInfo, error)
+	// CanonicalColumnType returns the column type spelled the same way for declared and described columns
+	CanonicalColumnType(sqlType string) string
+	// RenameColumn returns statement renaming a column to the one of the definition
+	RenameColumn(table, column, definition string) string
+	// AlterColumnType returns statement changing a column to the definition, or an empty string if it isn't supported
+	AlterColumnType(table, column, sqlType, definition string) string
+	// DropIndex returns statement dropping an index
+	DropIndex(table, index string) string
+	// AddForeignKey returns statement adding a foreign key constraint, or an empty string if it isn't supported
+	AddForeignKey(table, relation string) string
+	// DropForeignKey returns statement dropping a foreign key constraint, or an empty string if it isn't supported
+	DropForeignKey(table, constraint string) string
+}
+
+var dialects = map[string]Dialect{
+	"sqlite3":  &sqliteDialect{},
+	"mysql":    &mysqlDialect{},
+	"postgres": &postgresDialect{},
+}
+
+// DialectFor returns dialect for given database type.
+// Unknown types fall back to the MySQL dialect.
+func DialectFor(sqlType string) Dialect {
+	if d, ok := dialects[sqlType]; ok {
+		return d
+	}
+	return dialects["mysql"]
+}
+
+// IsDeadlock checks if error was caused by a deadlock in any of supported databases
+func IsDeadlock(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, d := range dialects {
+		if d.IsDeadlock(err) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(err error, messages ...string) bool {
+	for _, msg := range messages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinQuoted(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quote(column)
+	}
+	return strings.Join(quoted, ",")
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func nonKeyColumns(columns, keyColumns []string) []string {
+	var result []string
+	for _, column := range columns {
+		isKey := false
+		for _, key := range keyColumns {
+			if key == column {
+				isKey = true
+				break
+			}
+		}
+		if !isKey {
+			result = append(result, column)
+		}
+	}
+	return result
+}
+
+func standardStringLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+func jsonPathLiteral(path []string) string {
+	return "'$.\"" + strings.Join(path, "\".\"") + "\"'"
+}
+
+func onConflictUpsert(table string, columns, keyColumns []string) string {
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s)",
+		quote(table), joinQuoted(columns), placeholders(len(columns)), joinQuoted(keyColumns))
+	updates := nonKeyColumns(columns, keyColumns)
+	if len(updates) == 0 {
+		return sql + " DO NOTHING"
+	}
+	sets := make([]string, len(updates))
+	for i, column := range updates {
+		sets[i] = fmt.Sprintf("%s = excluded.%s", quote(column), quote(column))
+	}
+	return sql + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+type mysqlDialect struct{}
+
+func (d *mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (d *mysqlDialect) Rewrite(query string) string {
+	return query
+}
+
+func (d *mysqlDialect) ColumnType(t ColumnType) string {
+	switch t {
+	case VarcharColumn:
+		return "varchar(255)"
+	case BooleanColumn:
+		return "boolean"
+	case RealColumn:
+		return "real"
+	case IntegerColumn:
+		return "numeric"
+	}
+	return "text"
+}
+
+func (d *mysqlDialect) NormalizeSQLType(sqlType string) string {
+	return sqlType
+}
+
+func (d *mysqlDialect) MaxIdentifierLength() int {
+	return 64
+}
+
+func (d *mysqlDialect) IndexColumn(column, sqlType string) string {
+	// mysql cannot index TEXT without prefix spec
+	if sqlType == "text" {
+		return quote(column) + "(255)"
+	}
+	return quote(column)
+}
+
+func (d *mysqlDialect) SupportsIndexType(t schema.IndexType) bool {
+	return true
+}
+
+func (d *mysqlDialect) SupportsPartialIndex() bool {
+	return false
+}
+
+func (d *mysqlDialect) IndexInclude(columns []string) string {
+	return ""
+}
+
+// QuoteString escapes backslashes too, as they are escape characters in MySQL literals
+func (d *mysqlDialect) QuoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(value) + "'"
+}
+
+func (d *mysqlDialect) AlterTable(table string, columns, relations []string) string {
+	return fmt.Sprintf("alter table`%s` add (%s);\n", table, strings.Join(append(columns, relations...), ","))
+}
+
+func (d *mysqlDialect) LockClause(table string) string {
+	return " FOR UPDATE"
+}
+
+func (d *mysqlDialect) NullsFirst() bool {
+	return true
+}
+
+func (d *mysqlDialect) Upsert(table string, columns, keyColumns []string) string {
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE ",
+		quote(table), joinQuoted(columns), placeholders(len(columns)))
+	updates := nonKeyColumns(columns, keyColumns)
+	if len(updates) == 0 {
+		updates = keyColumns
+	}
+	sets := make([]string, len(updates))
+	for i, column := range updates {
+		sets[i] = fmt.Sprintf("%s = VALUES(%s)", quote(column), quote(column))
+	}
+	return sql + strings.Join(sets, ", ")
+}
+
+func (d *mysqlDialect) JSONExtract(column string, path []string, value interface{}) string {
+	expr := fmt.Sprintf("JSON_EXTRACT(%s, %s)", column, jsonPathLiteral(path))
+	if _, ok := value.(string); ok {
+		return "JSON_UNQUOTE(" + expr + ")"
+	}
+	return expr
+}
+
+func (d *mysqlDialect) IsDeadlock(err error) bool {
+	if mysqlError, ok := errors.Cause(err).(*mysql.MySQLError); ok && mysqlError.Number == 1213 {
+		return true
+	}
+	return containsAny(err, "Deadlock found when trying to get lock; try restarting transaction")
+}
+
+func (d *mysqlDialect) InitStatements() []string {
+	return nil
+}
+
+// ReplicationLag reads Seconds_Behind_Master, which is NULL if replication is stopped
+func (d *mysqlDialect) ReplicationLag(q sqlx.Queryer) (time.Duration, error) {
+	rows, err := q.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, fmt.Errorf("replication is not running")
+		}
+		seconds, err := strconv.Atoi(values[i].String)
+		return time.Duration(seconds) * time.Second, err
+	}
+	return 0, nil
+}
+
+func (d *mysqlDialect) DescribeTable(q sqlx.Queryer, table string) (*TableInfo, error) {
+	return describeTable(q, table,
+		"SELECT column_name, column_type, is_nullable = 'YES' FROM information_schema.columns "+
+			"WHERE table_schema = DATABASE() AND table_name = ? ORDER BY ordinal_position",
+		"SELECT DISTINCT index_name FROM information_schema.statistics "+
+			"WHERE table_schema = DATABASE() AND table_name = ?",
+		"SELECT constraint_name, column_name, referenced_table_name FROM information_schema.key_column_usage "+
+			"WHERE table_schema = DATABASE() AND table_name = ? AND referenced_table_name IS NOT NULL")
+}
+
+var (
+	mysqlDisplayWidth = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|bigint)\(\d+\)`)
+	mysqlColumnTypes  = map[string]string{
+		"tinyint(1)":    "boolean",
+		"bool":          "boolean",
+		"decimal(10,0)": "numeric",
+		"double":        "real",
+		"integer":       "int",
+	}
+)
+
+func (d *mysqlDialect) CanonicalColumnType(sqlType string) string {
+	sqlType = baseColumnType(sqlType)
+	if canonical, ok := mysqlColumnTypes[sqlType]; ok {
+		return canonical
+	}
+	return mysqlDisplayWidth.ReplaceAllString(sqlType, "$1")
+}
+
+// RenameColumn uses CHANGE, which unlike RENAME COLUMN is supported by MySQL 5.x
+func (d *mysqlDialect) RenameColumn(table, column, definition string) string {
+	return fmt.Sprintf("alter table %s change %s %s;", quote(table), quote(column), definition)
+}
+
+func (d *mysqlDialect) AlterColumnType(table, column, sqlType, definition string) string {
+	return fmt.Sprintf("alter table %s modify %s;", quote(table), definition)
+}
+
+func (d *mysqlDialect) DropIndex(table, index string) string {
+	return fmt.Sprintf("drop index %s on %s;", quote(index), quote(table))
+}
+
+func (d *mysqlDialect) AddForeignKey(table, relation string) string {
+	return fmt.Sprintf("alter table %s add %s;", quote(table), relation)
+}
+
+func (d *mysqlDialect) DropForeignKey(table, constraint string) string {
+	return fmt.Sprintf("alter table %s drop foreign key %s;", quote(table), quote(constraint))
+}
+
+type sqliteDialect struct {
+	mysqlDialect
+}
+
+func (d *sqliteDialect) Name() string {
+	return "sqlite3"
+}
+
+func (d *sqliteDialect) NormalizeSQLType(sqlType string) string {
+	return strings.Replace(sqlType, "auto_increment", "autoincrement", 1)
+}
+
+func (d *sqliteDialect) IndexColumn(column, sqlType string) string {
+	// SQLite3 doesn't allow specifying key size
+	return quote(column)
+}
+
+func (d *sqliteDialect) SupportsIndexType(t schema.IndexType) bool {
+	return t != schema.Spatial && t != schema.FullText
+}
+
+func (d *sqliteDialect) SupportsPartialIndex() bool {
+	return true
+}
+
+func (d *sqliteDialect) QuoteString(value string) string {
+	return standardStringLiteral(value)
+}
+
+func (d *sqliteDialect) LockClause(table string) string {
+	// sqlite locks the whole database on write
+	return ""
+}
+
+func (d *sqliteDialect) NullsFirst() bool {
+	return true
+}
+
+func (d *sqliteDialect) Upsert(table string, columns, keyColumns []string) string {
+	return onConflictUpsert(table, columns, keyColumns)
+}
+
+// JSONExtract uses json_extract, which already returns SQL values
+func (d *sqliteDialect) JSONExtract(column string, path []string, value interface{}) string {
+	return fmt.Sprintf("json_extract(%s, %s)", column, jsonPathLiteral(path))
+}
+
+func (d *sqliteDialect) IsDeadlock(err error) bool {
+	if sqliteError, ok := errors.Cause(err).(sqlite3.Error); ok && sqliteError.Code == sqlite3.ErrBusy {
+		return true
+	}
+	return containsAny(err, "database is locked")
+}
+
+func (d *sqliteDialect) InitStatements() []string {
+	return []string{"PRAGMA foreign_keys = ON;"}
+}
+
+// ReplicationLag is always zero, SQLite replicas are copies of the database file
+func (d *sqliteDialect) ReplicationLag(q sqlx.Queryer) (time.Duration, error) {
+	return 0, nil
+}
+
+func (d *sqliteDialect) DescribeTable(q sqlx.Queryer, table string) (*TableInfo, error) {
+	return describeTable(q, table,
+		"SELECT name, type, \"notnull\" = 0 AND pk = 0 FROM pragma_table_info(?) ORDER BY cid",
+		"SELECT name FROM pragma_index_list(?)",
+		"SELECT '', \"from\", \"table\" FROM pragma_foreign_key_list(?)")
+}
+
+func (d *sqliteDialect) CanonicalColumnType(sqlType string) string {
+	sqlType = baseColumnType(sqlType)
+	if sqlType == "integer" {
+		return "int"
+	}
+	return sqlType
+}
+
+func (d *sqliteDialect) RenameColumn(table, column, definition string) string {
+	return fmt.Sprintf("alter table %s rename column %s to %s;", quote(table), quote(column), strings.SplitN(definition, " ", 2)[0])
+}
+
+// AlterColumnType isn't supported, SQLite requires copying the table
+func (d *sqliteDialect) AlterColumnType(table, column, sqlType, definition string) string {
+	return ""
+}
+
+func (d *sqliteDialect) DropIndex(table, index string) string {
+	return fmt.Sprintf("drop index %s;", quote(index))
+}
+
+// AddForeignKey isn't supported, SQLite requires copying the table
+func (d *sqliteDialect) AddForeignKey(table, relation string) string {
+	return ""
+}
+
+// DropForeignKey isn't supported, SQLite requires copying the table
+func (d *sqliteDialect) DropForeignKey(table, constraint string) string {
+	return ""
+}
+
+const (
+	postgresDeadlockDetected     = "40P01"
+	postgresSerializationFailure = "40001"
+)
+
+var (
+	postgresAutoIncrement = regexp.MustCompile(`(?i)^\s*(big)?int(eger)?(.*?)\s*auto_increment\s*(.*)$`)
+	postgresLongText      = regexp.MustCompile(`(?i)^\s*(tiny|medium|long)text\b`)
+	postgresDateTime      = regexp.MustCompile(`(?i)^\s*datetime\b`)
+)
+
+type postgresDialect struct{}
+
+func (d *postgresDialect) Name() string {
+	return "postgres"
+}
+
+// Rewrite replaces backticks with double quotes and question mark
+// placeholders with numbered ones, leaving string literals untouched.
+func (d *postgresDialect) Rewrite(query string) string {
+	var buf strings.Builder
+	buf.Grow(len(query) + 8)
+	inLiteral := false
+	param := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inLiteral = !inLiteral
+			buf.WriteByte(c)
+		case inLiteral:
+			buf.WriteByte(c)
+		case c == '`':
+			buf.WriteByte('"')
+		case c == '?':
+			param++
+			buf.WriteByte('$')
+			buf.WriteString(strconv.Itoa(param))
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+func (d *postgresDialect) ColumnType(t ColumnType) string {
+	switch t {
+	case VarcharColumn:
+		return "varchar(255)"
+	case BooleanColumn:
+		return "boolean"
+	case RealColumn:
+		return "double precision"
+	case IntegerColumn:
+		return "bigint"
+	case JSONColumn:
+		return "jsonb"
+	}
+	return "text"
+}
+
+func (d *postgresDialect) NormalizeSQLType(sqlType string) string {
+	if matches := postgresAutoIncrement.FindStringSubmatch(sqlType); matches != nil {
+		return strings.TrimSpace("bigserial" + matches[3] + " " + matches[4])
+	}
+	sqlType = postgresLongText.ReplaceAllString(sqlType, "text")
+	return postgresDateTime.ReplaceAllString(sqlType, "timestamp")
+}
+
+func (d *postgresDialect) MaxIdentifierLength() int {
+	return 63
+}
+
+func (d *postgresDialect) IndexColumn(column, sqlType string) string {
+	return quote(column)
+}
+
+func (d *postgresDialect) SupportsIndexType(t schema.IndexType) bool {
+	return t != schema.Spatial && t != schema.FullText
+}
+
+func (d *postgresDialect) SupportsPartialIndex() bool {
+	return true
+}
+
+func (d *postgresDialect) IndexInclude(columns []string) string {
+	return fmt.Sprintf(" INCLUDE (%s)", strings.Join(columns, ","))
+}
+
+func (d *postgresDialect) QuoteString(value string) string {
+	return standardStringLiteral(value)
+}
+
+func (d *postgresDialect) AlterTable(table string, columns, relations []string) string {
+	var clauses []string
+	for _, column := range columns {
+		clauses = append(clauses, "add column "+column)
+	}
+	for _, relation := range relations {
+		clauses = append(clauses, "add "+relation)
+	}
+	return fmt.Sprintf("alter table %s %s;\n", quote(table), strings.Join(clauses, ", "))
+}
+
+// LockClause locks only rows of the main table, since postgres refuses
+// to lock the nullable side of an outer join
+func (d *postgresDialect) LockClause(table string) string {
+	return " FOR UPDATE OF " + quote(table)
+}
+
+// NullsFirst is false, as postgres treats NULLs as larger than any other value
+func (d *postgresDialect) NullsFirst() bool {
+	return false
+}
+
+func (d *postgresDialect) Upsert(table string, columns, keyColumns []string) string {
+	return onConflictUpsert(table, columns, keyColumns)
+}
+
+// JSONExtract extracts the value as text and casts it to the type of compared value
+func (d *postgresDialect) JSONExtract(column string, path []string, value interface{}) string {
+	expr := fmt.Sprintf("(%s #>> '{%s}')", column, strings.Join(path, ","))
+	switch value.(type) {
+	case int, int32, int64, float32, float64:
+		return expr + "::numeric"
+	case bool:
+		return expr + "::boolean"
+	}
+	return expr
+}
+
+func (d *postgresDialect) IsDeadlock(err error) bool {
+	if pqError, ok := errors.Cause(err).(*pq.Error); ok {
+		return pqError.Code == postgresDeadlockDetected || pqError.Code == postgresSerializationFailure
+	}
+	return containsAny(err, "deadlock detected", "could not serialize access")
+}
+
+func (d *postgresDialect) InitStatements() []string {
+	return nil
+}
+
+// ReplicationLag is zero if all received WAL is replayed, so an idle primary doesn't make replicas lag
+func (d *postgresDialect) ReplicationLag(q sqlx.Queryer) (time.Duration, error) {
+	var seconds float64
+	err := q.QueryRowx("SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 " +
+		"ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END").Scan(&seconds)
+	return time.Duration(seconds * float64(time.Second)), err
+}
+
+func (d *postgresDialect) DescribeTable(q sqlx.Queryer, table string) (*TableInfo, error) {
+	return describeTable(q, table,
+		"SELECT a.attname, format_type(a.atttypid, a.atttypmod), NOT a.attnotnull FROM pg_attribute a "+
+			"JOIN pg_class c ON c.oid = a.attrelid JOIN pg_namespace n ON n.oid = c.relnamespace "+
+			"WHERE c.relname = $1 AND n.nspname = current_schema() AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum",
+		"SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1",
+		"SELECT con.conname, a.attname, f.relname FROM pg_constraint con "+
+			"JOIN pg_class c ON c.oid = con.conrelid JOIN pg_namespace n ON n.oid = c.relnamespace "+
+			"JOIN pg_class f ON f.oid = con.confrelid "+
+			"JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = con.conkey[1] "+
+			"WHERE con.contype = 'f' AND c.relname = $1 AND n.nspname = current_schema()")
+}
+
+var postgresColumnTypes = []struct {
+	pattern   *regexp.Regexp
+	canonical string
+}{
+	{regexp.MustCompile(`^character varying`), "varchar"},
+	{regexp.MustCompile(`^character\b`), "char"},
+	{regexp.MustCompile(`^timestamp without time zone`), "timestamp"},
+	{regexp.MustCompile(`^bigserial$`), "bigint"},
+	{regexp.MustCompile(`^(serial|integer)$`), "int"},
+}
+
+func (d *postgresDialect) CanonicalColumnType(sqlType string) string {
+	sqlType = baseColumnType(d.NormalizeSQLType(sqlType))
+	for _, columnType := range postgresColumnTypes {
+		sqlType = columnType.pattern.ReplaceAllString(sqlType, columnType.canonical)
+	}
+	return sqlType
+}
+
+func (d *postgresDialect) RenameColumn(table, column, definition string) string {
+	return fmt.Sprintf("alter table %s rename column %s to %s;", quote(table), quote(column), strings.SplitN(definition, " ", 2)[0])
+}
+
+// AlterColumnType casts existing values, which fails if they can't be converted
+func (d *postgresDialect) AlterColumnType(table, column, sqlType, definition string) string {
+	sqlType = baseColumnType(d.NormalizeSQLType(sqlType))
+	return fmt.Sprintf("alter table %s alter column %s type %s using %s::%s;", quote(table), quote(column), sqlType, quote(column), sqlType)
+}
+
+func (d *postgresDialect) DropIndex(table, index string) string {
+	return fmt.Sprintf("drop index %s;", quote(index))
+}
+
+func (d *postgresDialect) AddForeignKey(table, relation string) string {
+	return fmt.Sprintf("alter table %s add %s;", quote(table), relation)
+}
+
+func (d *postgresDialect) DropForeignKey(table, constraint string) string {
+	return fmt.Sprintf("alter table %s drop constraint %s;", quote(table), quote(constraint))
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql_test
+
+import (
+	"errors"
+
+	"github.com/cloudwan/gohan/db/options"
+	. "github.com/cloudwan/gohan/db/sql"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dialect", func() {
+	Describe("Rewrite", func() {
+		It("leaves mysql and sqlite3 queries untouched", func() {
+			query := "SELECT `id` FROM `tests` WHERE `name` = ?"
+			Expect(DialectFor("mysql").Rewrite(query)).To(Equal(query))
+			Expect(DialectFor("sqlite3").Rewrite(query)).To(Equal(query))
+		})
+
+		It("translates quotes and placeholders for postgres", func() {
+			query := "SELECT `id` FROM `tests` WHERE `name` = ? AND `tenant_id` IN (?,?)"
+			Expect(DialectFor("postgres").Rewrite(query)).To(Equal(
+				`SELECT "id" FROM "tests" WHERE "name" = $1 AND "tenant_id" IN ($2,$3)`))
+		})
+
+		It("doesn't touch string literals", func() {
+			query := "SELECT `id` FROM `tests` WHERE `name` = 'what?`' AND `id` = ?"
+			Expect(DialectFor("postgres").Rewrite(query)).To(Equal(
+				`SELECT "id" FROM "tests" WHERE "name" = 'what?` + "`" + `' AND "id" = $1`))
+		})
+	})
+
+	Describe("SQL types", func() {
+		It("maps auto increment columns", func() {
+			Expect(DialectFor("sqlite3").NormalizeSQLType("integer primary key auto_increment ")).To(
+				Equal("integer primary key autoincrement "))
+			Expect(DialectFor("postgres").NormalizeSQLType("integer primary key auto_increment ")).To(
+				Equal("bigserial primary key"))
+		})
+
+		It("maps mysql specific text types for postgres", func() {
+			Expect(DialectFor("postgres").NormalizeSQLType("longtext")).To(Equal("text"))
+			Expect(DialectFor("postgres").NormalizeSQLType("varchar(64)")).To(Equal("varchar(64)"))
+		})
+
+		It("uses native JSON columns on postgres", func() {
+			Expect(DialectFor("postgres").ColumnType(JSONColumn)).To(Equal("jsonb"))
+			Expect(DialectFor("mysql").ColumnType(JSONColumn)).To(Equal("text"))
+		})
+	})
+
+	Describe("Upsert", func() {
+		It("generates upsert for every dialect", func() {
+			columns := []string{"id", "name"}
+			keys := []string{"id"}
+			Expect(DialectFor("mysql").Upsert("tests", columns, keys)).To(Equal(
+				"INSERT INTO `tests` (`id`,`name`) VALUES (?,?) ON DUPLICATE KEY UPDATE `name` = VALUES(`name`)"))
+			Expect(DialectFor("sqlite3").Upsert("tests", columns, keys)).To(Equal(
+				"INSERT INTO `tests` (`id`,`name`) VALUES (?,?) ON CONFLICT (`id`) DO UPDATE SET `name` = excluded.`name`"))
+			Expect(DialectFor("postgres").Upsert("tests", columns, keys)).To(Equal(
+				"INSERT INTO `tests` (`id`,`name`) VALUES (?,?) ON CONFLICT (`id`) DO UPDATE SET `name` = excluded.`name`"))
+		})
+
+		It("keeps the row untouched when only key columns are given", func() {
+			keys := []string{"id"}
+			Expect(DialectFor("mysql").Upsert("tests", keys, keys)).To(Equal(
+				"INSERT INTO `tests` (`id`) VALUES (?) ON DUPLICATE KEY UPDATE `id` = VALUES(`id`)"))
+			Expect(DialectFor("postgres").Upsert("tests", keys, keys)).To(Equal(
+				"INSERT INTO `tests` (`id`) VALUES (?) ON CONFLICT (`id`) DO NOTHING"))
+		})
+
+		It("inserts and then updates a row on sqlite3", func() {
+			conn, err := sqlx.Open("sqlite3", ":memory:")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Exec("CREATE TABLE `tests` (`id` varchar(255) primary key, `name` varchar(255))")
+			Expect(err).ToNot(HaveOccurred())
+
+			upsert := DialectFor("sqlite3").Upsert("tests", []string{"id", "name"}, []string{"id"})
+			_, err = conn.Exec(upsert, "a", "first")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = conn.Exec(upsert, "a", "second")
+			Expect(err).ToNot(HaveOccurred())
+
+			var names []string
+			Expect(conn.Select(&names, "SELECT `name` FROM `tests`")).To(Succeed())
+			Expect(names).To(Equal([]string{"second"}))
+		})
+	})
+
+	Describe("Deadlock detection", func() {
+		It("detects postgres deadlocks and serialization failures", func() {
+			Expect(IsDeadlock(&pq.Error{Code: "40P01"})).To(BeTrue())
+			Expect(IsDeadlock(&pq.Error{Code: "40001"})).To(BeTrue())
+			Expect(IsDeadlock(&pq.Error{Code: "23505"})).To(BeFalse())
+		})
+
+		It("detects mysql and sqlite3 deadlocks by message", func() {
+			Expect(IsDeadlock(errors.New("Deadlock found when trying to get lock; try restarting transaction"))).To(BeTrue())
+			Expect(IsDeadlock(errors.New("database is locked"))).To(BeTrue())
+			Expect(IsDeadlock(errors.New("syntax error"))).To(BeFalse())
+		})
+	})
+
+	Describe("Table definition", func() {
+		var (
+			sqlDB   *DB
+			network *schema.Schema
+			server  *schema.Schema
+		)
+
+		BeforeEach(func() {
+			manager := schema.GetManager()
+			Expect(manager.LoadSchemasFromFiles(
+				"../../etc/schema/gohan.json", "../../tests/test_abstract_schema.yaml", "../../tests/test_schema.yaml")).To(Succeed())
+			var ok bool
+			network, ok = manager.Schema("network")
+			Expect(ok).To(BeTrue())
+			server, ok = manager.Schema("server")
+			Expect(ok).To(BeTrue())
+			sqlDB = NewDB(options.Default())
+			sqlDB.SetSQLType("postgres")
+		})
+
+		AfterEach(func() {
+			schema.ClearManager()
+		})
+
+		It("generates postgres column types", func() {
+			table, _ := sqlDB.GenTableDef(network, false)
+			table = sqlDB.Dialect().Rewrite(table)
+			Expect(table).To(ContainSubstring(`create table "networks" ("id" varchar(255) primary key`))
+			Expect(table).To(ContainSubstring(`"route_targets" jsonb not null`))
+		})
+
+		It("generates postgres alter table statement", func() {
+			cols := []string{"`test` varchar(255) not null"}
+			relations := []string{"constraint `fk` foreign key(`test`) REFERENCES `networks`(id)"}
+			Expect(sqlDB.Dialect().AlterTable(server.GetDbTableName(), cols, relations)).To(Equal(
+				"alter table `servers` add column `test` varchar(255) not null, " +
+					"add constraint `fk` foreign key(`test`) REFERENCES `networks`(id);\n"))
+		})
+
+		It("locks only the main table on postgres", func() {
+			Expect(sqlDB.Dialect().LockClause(server.GetDbTableName())).To(Equal(" FOR UPDATE OF `servers`"))
+		})
+	})
+})
@@ -0,0 +1,218 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	sq "github.com/lann/squirrel"
+)
+
+const (
+	historyResourceIDColumnName = "resource_id"
+	historyVersionColumnName    = "version"
+	historyTimestampColumnName  = "timestamp"
+	historyDataColumnName       = "data"
+)
+
+func historyTableName(s *schema.Schema) string {
+	return s.GetDbTableName() + "_history"
+}
+
+// genHistoryTableDef generates the append-only table keeping revisions of resources
+func (db *DB) genHistoryTableDef(s *schema.Schema) string {
+	dialect := db.Dialect()
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s %s not null, %s %s not null, %s %s not null, %s %s null, primary key(%s, %s));",
+		quote(historyTableName(s)),
+		quote(historyResourceIDColumnName), dialect.ColumnType(VarcharColumn),
+		quote(historyVersionColumnName), dialect.ColumnType(IntegerColumn),
+		quote(historyTimestampColumnName), dialect.ColumnType(IntegerColumn),
+		quote(historyDataColumnName), dialect.NormalizeSQLType("longtext"),
+		quote(historyResourceIDColumnName), quote(historyVersionColumnName))
+}
+
+// recordVersion appends the current revision of a resource to the history,
+// numbered by the config version of the resource updated in the same transaction
+func (tx *Transaction) recordVersion(ctx context.Context, s *schema.Schema, resourceID interface{}) error {
+	resource, err := tx.FetchContext(ctx, s, transaction.IDFilter(resourceID), &transaction.ViewOptions{})
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(resource.Data())
+	if err != nil {
+		return err
+	}
+	version, err := tx.configVersion(ctx, s, resourceID)
+	if err != nil {
+		return err
+	}
+	return tx.insertVersion(ctx, s, resourceID, version, string(encoded))
+}
+
+// insertVersion appends a revision of a resource to the history, data is nil for a deletion.
+// Revisions are keyed by resource and version, so recording one again keeps its latest data.
+func (tx *Transaction) insertVersion(ctx context.Context, s *schema.Schema, resourceID interface{}, version int64, data interface{}) error {
+	sql := tx.db.Dialect().Upsert(historyTableName(s),
+		[]string{historyResourceIDColumnName, historyVersionColumnName, historyTimestampColumnName, historyDataColumnName},
+		[]string{historyResourceIDColumnName, historyVersionColumnName})
+	return tx.exec(ctx, sql, resourceID, version, time.Now().Unix(), data)
+}
+
+// configVersion returns the config version of a resource
+func (tx *Transaction) configVersion(ctx context.Context, s *schema.Schema, resourceID interface{}) (int64, error) {
+	sql, args, err := sq.Select(quote(configVersionColumnName)).
+		From(quote(s.GetDbTableName())).
+		Where(sq.Eq{"id": resourceID}).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	var version int64
+	err = tx.queryRowx(ctx, sql, args...).Scan(&version)
+	return version, err
+}
+
+// bumpConfigVersion increments the config version of a resource about to be deleted,
+// so its row stays locked until the deletion is recorded, and returns the new version
+func (tx *Transaction) bumpConfigVersion(ctx context.Context, s *schema.Schema, resourceID interface{}) (int64, error) {
+	sql, args, err := sq.Update(quote(s.GetDbTableName())).
+		Set(quote(configVersionColumnName), sq.Expr(quote(configVersionColumnName)+" + 1")).
+		Where(sq.Eq{"id": resourceID}).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.exec(ctx, sql, args...); err != nil {
+		return 0, err
+	}
+	return tx.configVersion(ctx, s, resourceID)
+}
+
+// nextVersion returns the version following the last one recorded for a resource
+func (tx *Transaction) nextVersion(ctx context.Context, s *schema.Schema, resourceID interface{}) (int64, error) {
+	sql, args, err := sq.Select("COALESCE(MAX(" + quote(historyVersionColumnName) + "), 0) as version").
+		From(quote(historyTableName(s))).
+		Where(sq.Eq{quote(historyResourceIDColumnName): resourceID}).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	result := map[string]interface{}{}
+	if err := tx.queryRowx(ctx, sql, args...).MapScan(result); err != nil {
+		return 0, err
+	}
+	lastVersion, err := (&integerHandler{}).decode(nil, result["version"])
+	if err != nil {
+		return 0, err
+	}
+	return int64(lastVersion.(int)) + 1, nil
+}
+
+//FetchVersion fetches a revision of a resource from the history
+func (tx *Transaction) FetchVersion(s *schema.Schema, resourceID interface{}, version int64) (*transaction.ResourceVersion, error) {
+	return tx.FetchVersionContext(context.Background(), s, resourceID, version)
+}
+
+//FetchVersionContext fetches a revision of a resource from the history
+func (tx *Transaction) FetchVersionContext(ctx context.Context, s *schema.Schema, resourceID interface{}, version int64) (*transaction.ResourceVersion, error) {
+	versions, err := tx.listVersions(ctx, s, sq.Eq{
+		quote(historyResourceIDColumnName): resourceID,
+		quote(historyVersionColumnName):    version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, transaction.ErrResourceNotFound
+	}
+	return versions[0], nil
+}
+
+//ListVersions lists revisions of a resource ordered by version
+func (tx *Transaction) ListVersions(s *schema.Schema, resourceID interface{}) ([]*transaction.ResourceVersion, error) {
+	return tx.ListVersionsContext(context.Background(), s, resourceID)
+}
+
+//ListVersionsContext lists revisions of a resource ordered by version
+func (tx *Transaction) ListVersionsContext(ctx context.Context, s *schema.Schema, resourceID interface{}) ([]*transaction.ResourceVersion, error) {
+	return tx.listVersions(ctx, s, sq.Eq{quote(historyResourceIDColumnName): resourceID})
+}
+
+func (tx *Transaction) listVersions(ctx context.Context, s *schema.Schema, where sq.Eq) ([]*transaction.ResourceVersion, error) {
+	defer tx.measureTime(time.Now(), s.ID, "list_versions")
+
+	if !s.History() {
+		return nil, fmt.Errorf("history of %s is not kept", s.ID)
+	}
+	sql, args, err := sq.Select(
+		quote(historyVersionColumnName)+" as version",
+		quote(historyTimestampColumnName)+" as timestamp",
+		quote(historyDataColumnName)+" as data",
+	).
+		From(quote(historyTableName(s))).
+		Where(where).
+		OrderBy(quote(historyVersionColumnName)).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	tx.logQuery(sql, args...)
+	rows, err := tx.queryx(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*transaction.ResourceVersion{}
+	integer := &integerHandler{}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		version, err := integer.decode(nil, row["version"])
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := integer.decode(nil, row["timestamp"])
+		if err != nil {
+			return nil, err
+		}
+		resourceVersion := &transaction.ResourceVersion{
+			Version:   int64(version.(int)),
+			Timestamp: int64(timestamp.(int)),
+		}
+		if encoded, ok := decodeText(row["data"]); ok {
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+				return nil, err
+			}
+			resourceVersion.Resource, err = schema.NewResource(s, data)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			resourceVersion.Deleted = true
+		}
+		versions = append(versions, resourceVersion)
+	}
+	return versions, rows.Err()
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/jmoiron/sqlx"
+)
+
+// indexTableName is the table recording indexes managed by gohan, so indexes removed
+// from schemas can be told apart from the ones created by hand written migrations
+const indexTableName = "gohan_indexes"
+
+func genIndexTableDef() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s varchar(255) not null, %s varchar(255) not null, %s text not null, primary key(%s, %s));",
+		quote(indexTableName), quote("table_name"), quote("index_name"), quote("definition"), quote("table_name"), quote("index_name"))
+}
+
+// ensureIndexTable creates the index table once per connection
+func (db *DB) ensureIndexTable() error {
+	db.indexTableOnce.Do(func() {
+		if err := db.exec(genIndexTableDef()); err != nil {
+			db.indexTableErr = fmt.Errorf("error when exec index table stmt: %s", err)
+		}
+	})
+	return db.indexTableErr
+}
+
+// checkIndexes rejects indexes of a schema the database can't create
+func (db *DB) checkIndexes(s *schema.Schema) error {
+	dialect := db.Dialect()
+	for _, index := range s.Indexes {
+		if index.Where != "" && !dialect.SupportsPartialIndex() {
+			return fmt.Errorf("index %s of schema %s can't be created since %s doesn't support partial indexes", index.Name, s.ID, dialect.Name())
+		}
+	}
+	return nil
+}
+
+// declaredIndex is an index declared by a schema
+type declaredIndex struct {
+	name       string
+	definition string
+}
+
+// declaredIndexes returns indexes of properties, of the indexes section and of tombstones
+func (db *DB) declaredIndexes(s *schema.Schema, cascade bool) []declaredIndex {
+	_, _, indices := db.genTableCols(s, cascade, nil)
+	if s.Recoverable() {
+		_, tombstoneIndices := db.genTombstoneCols(s)
+		indices = append(indices, tombstoneIndices...)
+	}
+	var declared []declaredIndex
+	for _, index := range indices {
+		if name := indexName(index); name != "" {
+			declared = append(declared, declaredIndex{name, index})
+		}
+	}
+	return declared
+}
+
+// recordedIndexes returns definitions of managed indexes of a table by their names
+func (db *DB) recordedIndexes(q sqlx.Queryer, table string) (map[string]string, error) {
+	recorded := map[string]string{}
+	info, err := db.Dialect().DescribeTable(q, indexTableName)
+	if err != nil || info == nil {
+		return recorded, err
+	}
+	rows, err := q.Query(db.Dialect().Rewrite(fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = ?",
+		quote("index_name"), quote("definition"), quote(indexTableName), quote("table_name"))), table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, err
+		}
+		recorded[name] = definition
+	}
+	return recorded, rows.Err()
+}
+
+func (db *DB) recordIndex(table, name, definition string) []string {
+	dialect := db.Dialect()
+	return []string{
+		db.unrecordIndex(table, name),
+		fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES (%s, %s, %s);",
+			quote(indexTableName), quote("table_name"), quote("index_name"), quote("definition"),
+			dialect.QuoteString(table), dialect.QuoteString(name), dialect.QuoteString(definition)),
+	}
+}
+
+func (db *DB) unrecordIndex(table, name string) string {
+	dialect := db.Dialect()
+	return fmt.Sprintf("DELETE FROM %s WHERE %s = %s AND %s = %s;",
+		quote(indexTableName), quote("table_name"), dialect.QuoteString(table), quote("index_name"), dialect.QuoteString(name))
+}
+
+// planIndexChanges compares indexes declared by a schema with managed indexes of its
+// existing table, info is nil for a table which is going to be created. Dropped indexes
+// are returned separately, so they can be dropped before columns they are using.
+func (db *DB) planIndexChanges(s *schema.Schema, info *TableInfo, cascade bool) (drops, adds []*MigrationChange, err error) {
+	dialect := db.Dialect()
+	table := s.GetDbTableName()
+	recorded, err := db.recordedIndexes(db.DB, table)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read indexes of %s: %s", table, err)
+	}
+	exists := func(name string) bool {
+		return info != nil && info.hasIndex(name)
+	}
+
+	declared := map[string]bool{}
+	for _, index := range db.declaredIndexes(s, cascade) {
+		declared[index.name] = true
+		definition, isRecorded := recorded[index.name]
+		switch {
+		case isRecorded && definition == index.definition && exists(index.name):
+			continue
+		case !isRecorded && exists(index.name):
+			// created before indexes were recorded, the definition is assumed to match
+			adds = append(adds, &MigrationChange{
+				Kind:        RecordIndexChange,
+				Table:       table,
+				Description: index.name,
+				Up:          db.recordIndex(table, index.name, index.definition),
+				Down:        []string{db.unrecordIndex(table, index.name)},
+			})
+			continue
+		case isRecorded && exists(index.name):
+			drops = append(drops, db.dropIndexChange(table, index.name, definition))
+		}
+		adds = append(adds, &MigrationChange{
+			Kind:        AddIndexChange,
+			Table:       table,
+			Description: index.name,
+			Up:          append([]string{index.definition}, db.recordIndex(table, index.name, index.definition)...),
+			Down:        []string{dialect.DropIndex(table, index.name), db.unrecordIndex(table, index.name)},
+		})
+	}
+
+	for name, definition := range recorded {
+		if declared[name] {
+			continue
+		}
+		if exists(name) {
+			drops = append(drops, db.dropIndexChange(table, name, definition))
+		} else {
+			drops = append(drops, &MigrationChange{
+				Kind:        RecordIndexChange,
+				Table:       table,
+				Description: fmt.Sprintf("%s is already dropped", name),
+				Up:          []string{db.unrecordIndex(table, name)},
+				Down:        db.recordIndex(table, name, definition),
+			})
+		}
+	}
+	sort.Slice(drops, func(i, j int) bool {
+		return drops[i].Description < drops[j].Description
+	})
+	return drops, adds, nil
+}
+
+func (db *DB) dropIndexChange(table, name, definition string) *MigrationChange {
+	return &MigrationChange{
+		Kind:        DropIndexChange,
+		Table:       table,
+		Description: name,
+		Up:          []string{db.Dialect().DropIndex(table, name), db.unrecordIndex(table, name)},
+		Down:        append([]string{definition}, db.recordIndex(table, name, definition)...),
+	}
+}
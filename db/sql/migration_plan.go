@@ -0,0 +1,561 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of migration changes
+const (
+	CreateTableChange    = "create_table"
+	AddColumnChange      = "add_column"
+	DropColumnChange     = "drop_column"
+	RenameColumnChange   = "rename_column"
+	ChangeColumnType     = "change_column_type"
+	AddIndexChange       = "add_index"
+	DropIndexChange      = "drop_index"
+	RecordIndexChange    = "record_index"
+	AddRelationChange    = "add_relation"
+	DropRelationChange   = "drop_relation"
+	ChangeRelationChange = "change_relation"
+)
+
+// ColumnInfo describes a column of a live table
+type ColumnInfo struct {
+	Name     string
+	Type     string
+	Nullable bool
+}
+
+// ForeignKeyInfo describes a foreign key constraint of a live table
+type ForeignKeyInfo struct {
+	// Name of the constraint, empty if the database doesn't name them
+	Name   string
+	Column string
+	// Table is the referenced table
+	Table string
+}
+
+// TableInfo describes a live table
+type TableInfo struct {
+	Columns     []ColumnInfo
+	Indexes     []string
+	ForeignKeys []ForeignKeyInfo
+}
+
+// Column returns column with given name or nil
+func (info *TableInfo) Column(name string) *ColumnInfo {
+	for i := range info.Columns {
+		if info.Columns[i].Name == name {
+			return &info.Columns[i]
+		}
+	}
+	return nil
+}
+
+// ForeignKey returns foreign key constraint of given column or nil
+func (info *TableInfo) ForeignKey(column string) *ForeignKeyInfo {
+	for i := range info.ForeignKeys {
+		if info.ForeignKeys[i].Column == column {
+			return &info.ForeignKeys[i]
+		}
+	}
+	return nil
+}
+
+func (info *TableInfo) hasIndex(name string) bool {
+	for _, index := range info.Indexes {
+		if strings.EqualFold(index, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeTable runs dialect specific queries selecting (name, type, nullable) of columns,
+// names of indexes and (constraint, column, referenced table) of foreign keys
+func describeTable(q sqlx.Queryer, table, columnsQuery, indexesQuery, foreignKeysQuery string) (*TableInfo, error) {
+	info := &TableInfo{}
+	rows, err := q.Query(columnsQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var column ColumnInfo
+		if err = rows.Scan(&column.Name, &column.Type, &column.Nullable); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		info.Columns = append(info.Columns, column)
+	}
+	rows.Close()
+	if len(info.Columns) == 0 {
+		return nil, nil
+	}
+
+	rows, err = q.Query(indexesQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var index string
+		if err = rows.Scan(&index); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		info.Indexes = append(info.Indexes, index)
+	}
+	rows.Close()
+
+	rows, err = q.Query(foreignKeysQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var foreignKey ForeignKeyInfo
+		if err = rows.Scan(&foreignKey.Name, &foreignKey.Column, &foreignKey.Table); err != nil {
+			return nil, err
+		}
+		info.ForeignKeys = append(info.ForeignKeys, foreignKey)
+	}
+	return info, rows.Err()
+}
+
+var columnConstraint = regexp.MustCompile(`\s+(auto_?increment|primary\s+key|not\s+null|null|unique|default|references)\b.*$`)
+
+// baseColumnType strips constraints from a column type
+func baseColumnType(sqlType string) string {
+	sqlType = strings.ToLower(strings.TrimSpace(sqlType))
+	sqlType = columnConstraint.ReplaceAllString(sqlType, "")
+	return strings.Replace(sqlType, ", ", ",", -1)
+}
+
+var createIndex = regexp.MustCompile(`(?i)^\s*CREATE\s+(\w+\s+)?INDEX\s+(\S+)\s+ON`)
+
+func indexName(createIndexSQL string) string {
+	match := createIndex.FindStringSubmatch(createIndexSQL)
+	if match == nil {
+		return ""
+	}
+	return strings.Trim(match[2], "`\"")
+}
+
+// MigrationChange is a single change of a migration plan
+type MigrationChange struct {
+	Kind        string
+	Table       string
+	Description string
+	// Up holds statements applying the change
+	Up []string
+	// Down holds statements reverting the change
+	Down []string
+	// Destructive changes lose data
+	Destructive bool
+	// Manual changes can't be expressed in the dialect and have to be written by hand
+	Manual bool
+}
+
+// MigrationPlan holds changes making the database match loaded schemas
+type MigrationPlan struct {
+	Changes []*MigrationChange
+}
+
+// Empty checks if the database already matches schemas
+func (plan *MigrationPlan) Empty() bool {
+	return len(plan.Changes) == 0
+}
+
+// Destructive checks if any change loses data
+func (plan *MigrationPlan) Destructive() bool {
+	for _, change := range plan.Changes {
+		if change.Destructive {
+			return true
+		}
+	}
+	return false
+}
+
+// Manual checks if any change has to be written by hand
+func (plan *MigrationPlan) Manual() bool {
+	for _, change := range plan.Changes {
+		if change.Manual {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a human readable summary of the plan
+func (plan *MigrationPlan) String() string {
+	if plan.Empty() {
+		return "Database matches schemas, nothing to migrate\n"
+	}
+	var buffer bytes.Buffer
+	for _, change := range plan.Changes {
+		marker := " "
+		if change.Destructive {
+			marker = "!"
+		} else if change.Manual {
+			marker = "?"
+		}
+		fmt.Fprintf(&buffer, "%s %s %s: %s\n", marker, change.Kind, change.Table, change.Description)
+		for _, statement := range change.Up {
+			fmt.Fprintf(&buffer, "    %s\n", statement)
+		}
+	}
+	return buffer.String()
+}
+
+func (change *MigrationChange) comment() string {
+	comment := fmt.Sprintf("-- %s %s: %s", change.Kind, change.Table, change.Description)
+	if change.Destructive {
+		comment += " (destructive)"
+	}
+	if change.Manual {
+		comment += " (manual, not supported by the database dialect)"
+	}
+	return comment
+}
+
+// GooseSQL returns the plan as a goose SQL migration, changes are reverted in reverse order
+func (plan *MigrationPlan) GooseSQL() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("-- +goose Up\n")
+	buffer.WriteString("-- SQL in section 'Up' is executed when this migration is applied\n")
+	for _, change := range plan.Changes {
+		buffer.WriteString(change.comment() + "\n")
+		for _, statement := range change.Up {
+			buffer.WriteString(statement + "\n")
+		}
+	}
+	buffer.WriteString("\n")
+	buffer.WriteString("-- +goose Down\n")
+	buffer.WriteString("-- SQL section 'Down' is executed when this migration is rolled back\n")
+	for i := len(plan.Changes) - 1; i >= 0; i-- {
+		change := plan.Changes[i]
+		buffer.WriteString(change.comment() + "\n")
+		for _, statement := range change.Down {
+			buffer.WriteString(statement + "\n")
+		}
+	}
+	return buffer.String()
+}
+
+// GooseGo returns the plan as a goose Go migration with given version and file name
+func (plan *MigrationPlan) GooseGo(version, name string) string {
+	var buffer bytes.Buffer
+	writeStatements := func(change *MigrationChange, statements []string) {
+		buffer.WriteString("\t" + change.comment() + "\n")
+		for _, statement := range statements {
+			fmt.Fprintf(&buffer, "\tif _, err := tx.Exec(%s); err != nil {\n\t\treturn err\n\t}\n", strconv.Quote(statement))
+		}
+	}
+	fmt.Fprintf(&buffer, "package main\n\nimport (\n\t\"database/sql\"\n\n\t\"github.com/cloudwan/goose\"\n)\n\n")
+	fmt.Fprintf(&buffer, "func init() {\n\tgoose.AddNamedMigration(%s, Up_%s, Down_%s)\n}\n\n", strconv.Quote(name), version, version)
+	fmt.Fprintf(&buffer, "func Up_%s(tx *sql.Tx) error {\n", version)
+	for _, change := range plan.Changes {
+		writeStatements(change, change.Up)
+	}
+	buffer.WriteString("\treturn nil\n}\n\n")
+	fmt.Fprintf(&buffer, "func Down_%s(tx *sql.Tx) error {\n", version)
+	for i := len(plan.Changes) - 1; i >= 0; i-- {
+		writeStatements(plan.Changes[i], plan.Changes[i].Down)
+	}
+	buffer.WriteString("\treturn nil\n}\n")
+	return buffer.String()
+}
+
+// plannedColumn is a column expected by a schema
+type plannedColumn struct {
+	name       string
+	definition string
+	sqlType    string
+	property   *schema.Property
+}
+
+func (db *DB) plannedColumns(s *schema.Schema) []plannedColumn {
+	var columns []plannedColumn
+	for i := range s.Properties {
+		property := &s.Properties[i]
+		definition, sqlType := db.columnDef(property)
+		columns = append(columns, plannedColumn{property.ID, definition, sqlType, property})
+	}
+	var extra []string
+	if s.StateVersioning() {
+		extra = append(extra, genStateVersioningCols()...)
+	} else if s.History() {
+		extra = append(extra, genConfigVersionCol())
+	}
+	if s.Recoverable() {
+		tombstoneCols, _ := db.genTombstoneCols(s)
+		extra = append(extra, tombstoneCols...)
+	}
+	for _, definition := range extra {
+		parts := strings.SplitN(definition, " ", 3)
+		columns = append(columns, plannedColumn{strings.Trim(parts[0], "`"), definition, parts[1], nil})
+	}
+	return columns
+}
+
+// PlanMigration compares loaded schemas with the live database and plans changes
+// making the database match them. Renamed properties are detected using their
+// "renamed_from" attribute, other missing columns are planned to be dropped.
+func (db *DB) PlanMigration(schemas []*schema.Schema, cascade bool) (*MigrationPlan, error) {
+	plan := &MigrationPlan{}
+	dialect := db.Dialect()
+	indexTableInfo, err := dialect.DescribeTable(db.DB, indexTableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %s", indexTableName, err)
+	}
+	if indexTableInfo == nil {
+		plan.add(dialect, &MigrationChange{
+			Kind:        CreateTableChange,
+			Table:       indexTableName,
+			Description: "indexes managed by gohan",
+			Up:          []string{genIndexTableDef()},
+			Down:        []string{fmt.Sprintf("drop table %s;", quote(indexTableName))},
+		})
+	}
+	for _, s := range schemas {
+		if s.IsAbstract() || s.Metadata["type"] == "metaschema" {
+			continue
+		}
+		if err := db.checkIndexes(s); err != nil {
+			return nil, err
+		}
+		table := s.GetDbTableName()
+		info, err := dialect.DescribeTable(db.DB, table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe table %s: %s", table, err)
+		}
+		if info == nil {
+			tableDef, indices := db.GenTableDef(s, cascade)
+			change := &MigrationChange{
+				Kind:        CreateTableChange,
+				Table:       table,
+				Description: fmt.Sprintf("schema %s", s.ID),
+				Up:          []string{strings.TrimSpace(tableDef)},
+				Down:        []string{fmt.Sprintf("drop table %s;", quote(table))},
+			}
+			for _, index := range indices {
+				change.Up = append(change.Up, index)
+				if name := indexName(index); name != "" {
+					change.Up = append(change.Up, db.recordIndex(table, name, index)...)
+					change.Down = append([]string{db.unrecordIndex(table, name)}, change.Down...)
+				}
+			}
+			plan.add(dialect, change)
+		} else if err := db.planTableChanges(plan, s, info, cascade); err != nil {
+			return nil, err
+		}
+
+		if s.History() {
+			historyInfo, err := dialect.DescribeTable(db.DB, historyTableName(s))
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe table %s: %s", historyTableName(s), err)
+			}
+			if historyInfo == nil {
+				plan.add(dialect, &MigrationChange{
+					Kind:        CreateTableChange,
+					Table:       historyTableName(s),
+					Description: fmt.Sprintf("history of schema %s", s.ID),
+					Up:          []string{db.genHistoryTableDef(s)},
+					Down:        []string{fmt.Sprintf("drop table %s;", quote(historyTableName(s)))},
+				})
+			}
+		}
+	}
+	return plan, nil
+}
+
+func (plan *MigrationPlan) add(dialect Dialect, change *MigrationChange) {
+	for i, statement := range change.Up {
+		change.Up[i] = dialect.Rewrite(statement)
+	}
+	for i, statement := range change.Down {
+		change.Down[i] = dialect.Rewrite(statement)
+	}
+	plan.Changes = append(plan.Changes, change)
+}
+
+func (db *DB) planTableChanges(plan *MigrationPlan, s *schema.Schema, info *TableInfo, cascade bool) error {
+	dialect := db.Dialect()
+	table := s.GetDbTableName()
+	columns := db.plannedColumns(s)
+	kept := map[string]bool{}
+
+	indexDrops, indexAdds, err := db.planIndexChanges(s, info, cascade)
+	if err != nil {
+		return err
+	}
+	for _, change := range indexDrops {
+		plan.add(dialect, change)
+	}
+
+	for _, column := range columns {
+		actual := info.Column(column.name)
+		if actual == nil && column.property != nil && column.property.RenamedFrom != "" {
+			if previous := info.Column(column.property.RenamedFrom); previous != nil {
+				actual = previous
+				previousDefinition := quote(previous.Name) + " " + previous.Type + nullability(previous.Nullable)
+				plan.add(dialect, &MigrationChange{
+					Kind:        RenameColumnChange,
+					Table:       table,
+					Description: fmt.Sprintf("%s to %s", previous.Name, column.name),
+					Up:          []string{dialect.RenameColumn(table, previous.Name, column.definition)},
+					Down:        []string{dialect.RenameColumn(table, column.name, previousDefinition)},
+				})
+			}
+		}
+		if actual == nil {
+			plan.add(dialect, &MigrationChange{
+				Kind:        AddColumnChange,
+				Table:       table,
+				Description: column.name,
+				Up:          []string{fmt.Sprintf("alter table %s add column %s;", quote(table), column.definition)},
+				Down:        []string{fmt.Sprintf("alter table %s drop column %s;", quote(table), quote(column.name))},
+			})
+			continue
+		}
+		kept[actual.Name] = true
+
+		if dialect.CanonicalColumnType(column.sqlType) == dialect.CanonicalColumnType(actual.Type) {
+			continue
+		}
+		previousDefinition := quote(column.name) + " " + actual.Type + nullability(actual.Nullable)
+		change := &MigrationChange{
+			Kind:        ChangeColumnType,
+			Table:       table,
+			Description: fmt.Sprintf("%s from %s to %s", column.name, actual.Type, column.sqlType),
+		}
+		up := dialect.AlterColumnType(table, column.name, column.sqlType, column.definition)
+		down := dialect.AlterColumnType(table, column.name, actual.Type, previousDefinition)
+		if up == "" || down == "" {
+			change.Manual = true
+		} else {
+			change.Up = []string{up}
+			change.Down = []string{down}
+		}
+		plan.add(dialect, change)
+	}
+
+	for _, actual := range info.Columns {
+		if kept[actual.Name] {
+			continue
+		}
+		plan.add(dialect, &MigrationChange{
+			Kind:        DropColumnChange,
+			Table:       table,
+			Description: actual.Name,
+			Up:          []string{fmt.Sprintf("alter table %s drop column %s;", quote(table), quote(actual.Name))},
+			// dropped values can't be restored
+			Down:        []string{fmt.Sprintf("alter table %s add column %s %s null;", quote(table), quote(actual.Name), actual.Type)},
+			Destructive: true,
+		})
+	}
+
+	for _, change := range indexAdds {
+		plan.add(dialect, change)
+	}
+
+	db.planRelationChanges(plan, s, info, kept, cascade)
+	return nil
+}
+
+func (db *DB) planRelationChanges(plan *MigrationPlan, s *schema.Schema, info *TableInfo, kept map[string]bool, cascade bool) {
+	dialect := db.Dialect()
+	table := s.GetDbTableName()
+	related := map[string]bool{}
+	for i := range s.Properties {
+		property := &s.Properties[i]
+		relation := db.relationDef(s, property, cascade)
+		if relation == "" {
+			continue
+		}
+		related[property.ID] = true
+		foreignSchema, _ := schema.GetManager().Schema(property.Relation)
+		foreignTable := foreignSchema.GetDbTableName()
+		constraint := quote(foreignKeyName(table, property.ID, foreignTable, relationColumn(property), dialect.MaxIdentifierLength()))
+		existing := info.ForeignKey(property.ID)
+		if existing != nil && existing.Table == foreignTable {
+			continue
+		}
+
+		change := &MigrationChange{Table: table}
+		up := []string{dialect.AddForeignKey(table, relation)}
+		down := []string{dialect.DropForeignKey(table, strings.Trim(constraint, "`"))}
+		if existing == nil {
+			change.Kind = AddRelationChange
+			change.Description = fmt.Sprintf("%s to %s", property.ID, foreignTable)
+		} else {
+			change.Kind = ChangeRelationChange
+			change.Description = fmt.Sprintf("%s from %s to %s", property.ID, existing.Table, foreignTable)
+			up = append([]string{dialect.DropForeignKey(table, existing.Name)}, up...)
+			// the previous constraint definition isn't known
+			down = append(down, "")
+		}
+		db.setRelationStatements(change, up, down)
+		plan.add(dialect, change)
+	}
+
+	for _, existing := range info.ForeignKeys {
+		if related[existing.Column] || !kept[existing.Column] {
+			continue
+		}
+		change := &MigrationChange{
+			Kind:        DropRelationChange,
+			Table:       table,
+			Description: fmt.Sprintf("%s to %s", existing.Column, existing.Table),
+		}
+		db.setRelationStatements(change, []string{dialect.DropForeignKey(table, existing.Name)}, []string{""})
+		plan.add(dialect, change)
+	}
+}
+
+// setRelationStatements marks change as manual if any statement isn't supported
+func (db *DB) setRelationStatements(change *MigrationChange, up, down []string) {
+	for _, statement := range append(up, down...) {
+		if statement == "" {
+			change.Manual = true
+			return
+		}
+	}
+	change.Up = up
+	change.Down = down
+}
+
+func relationColumn(property *schema.Property) string {
+	if property.RelationColumn != "" {
+		return property.RelationColumn
+	}
+	return "id"
+}
+
+func nullability(nullable bool) string {
+	if nullable {
+		return " null"
+	}
+	return " not null"
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/mohae/deepcopy"
+)
+
+// queryCacheMaxEntries limits the number of list results cached per schema
+const queryCacheMaxEntries = 1000
+
+type queryCacheEntry struct {
+	list    []*schema.Resource
+	total   uint64
+	expires time.Time
+}
+
+// queryCache shares list results of schemas having cache_ttl metadata between transactions.
+// Each schema has a generation increased on invalidation, so a result read from the database
+// concurrently with a commit changing the schema isn't stored.
+type queryCache struct {
+	mu          sync.Mutex
+	entries     map[string]map[string]*queryCacheEntry
+	generations map[string]uint64
+}
+
+func newQueryCache() *queryCache {
+	return &queryCache{
+		entries:     map[string]map[string]*queryCacheEntry{},
+		generations: map[string]uint64{},
+	}
+}
+
+// get returns a copy of a cached list and the current generation of the schema
+func (cache *queryCache) get(schemaID, key string) (list []*schema.Resource, total uint64, generation uint64, ok bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	generation = cache.generations[schemaID]
+	entry, ok := cache.entries[schemaID][key]
+	if !ok {
+		return
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries[schemaID], key)
+		return nil, 0, generation, false
+	}
+	return copyResources(entry.list), entry.total, generation, true
+}
+
+// put stores a list unless the schema was invalidated since the generation was read
+func (cache *queryCache) put(s *schema.Schema, key string, generation uint64, list []*schema.Resource, total uint64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.generations[s.ID] != generation {
+		return
+	}
+	entries, ok := cache.entries[s.ID]
+	if !ok {
+		entries = map[string]*queryCacheEntry{}
+		cache.entries[s.ID] = entries
+	}
+	now := time.Now()
+	if len(entries) >= queryCacheMaxEntries {
+		for entryKey, entry := range entries {
+			if now.After(entry.expires) {
+				delete(entries, entryKey)
+			}
+		}
+		if len(entries) >= queryCacheMaxEntries {
+			return
+		}
+	}
+	entries[key] = &queryCacheEntry{
+		list:    copyResources(list),
+		total:   total,
+		expires: now.Add(s.CacheTTL()),
+	}
+}
+
+func (cache *queryCache) invalidate(schemaID string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generations[schemaID]++
+	delete(cache.entries, schemaID)
+	metrics.UpdateCounter(1, "db.%s.shared_cache.invalidate", schemaID)
+}
+
+func (cache *queryCache) invalidateAll() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, s := range schema.GetManager().Schemas() {
+		cache.generations[s.ID]++
+	}
+	cache.entries = map[string]map[string]*queryCacheEntry{}
+	metrics.UpdateCounter(1, "db.shared_cache.invalidate_all")
+}
+
+// copyResources copies resources, so callers modifying them don't change the cached ones
+func copyResources(list []*schema.Resource) []*schema.Resource {
+	if list == nil {
+		return nil
+	}
+	copied := make([]*schema.Resource, 0, len(list))
+	for _, resource := range list {
+		data, _ := deepcopy.Copy(resource.Data()).(map[string]interface{})
+		resourceCopy, _ := schema.NewResource(resource.Schema(), data)
+		copied = append(copied, resourceCopy)
+	}
+	return copied
+}
+
+// InvalidateQueryCache drops list results of the schema shared between transactions
+func (db *DB) InvalidateQueryCache(schemaID string) {
+	db.queryCache.invalidate(schemaID)
+}
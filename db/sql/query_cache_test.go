@@ -0,0 +1,226 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/options"
+	. "github.com/cloudwan/gohan/db/sql"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shared query cache", func() {
+	const conn = "./test_cache.db"
+
+	var (
+		testSchema *schema.Schema
+		sqlConn    *DB
+	)
+
+	// insert adds a resource through another connection, so the cache doesn't know about it
+	insert := func(id string) {
+		dbc, err := db.ConnectDB("sqlite3", conn, db.DefaultMaxOpenConn, options.Default())
+		Expect(err).ToNot(HaveOccurred())
+		defer dbc.Close()
+		Expect(db.Within(dbc, func(tx transaction.Transaction) error {
+			return tx.Exec("INSERT INTO `tests` (`id`, `tenant_id`) values (?, 'tenant')", id)
+		})).To(Succeed())
+	}
+
+	count := func() int {
+		var list []*schema.Resource
+		Expect(db.Within(sqlConn, func(tx transaction.Transaction) (err error) {
+			list, _, err = tx.List(testSchema, nil, nil, nil)
+			return
+		})).To(Succeed())
+		return len(list)
+	}
+
+	BeforeEach(func() {
+		if os.Getenv("MYSQL_TEST") == "true" || os.Getenv("POSTGRES_TEST") == "true" {
+			Skip("changes are made through a separate SQLite connection")
+		}
+		manager := schema.GetManager()
+		Expect(manager.LoadSchemasFromFiles(
+			"../../etc/schema/gohan.json", "../../tests/test_abstract_schema.yaml", "../../tests/test_schema.yaml")).To(Succeed())
+		Expect(db.InitDBWithSchemas("sqlite3", conn, db.DefaultTestInitDBParams())).To(Succeed())
+		insert("first")
+
+		var ok bool
+		testSchema, ok = manager.Schema("test")
+		Expect(ok).To(BeTrue())
+		testSchema.Metadata["cache_ttl"] = 60
+
+		dbc, err := db.ConnectDB("sqlite3", conn, db.DefaultMaxOpenConn, options.Default())
+		Expect(err).ToNot(HaveOccurred())
+		sqlConn = dbc.(*DB)
+	})
+
+	AfterEach(func() {
+		if sqlConn != nil {
+			sqlConn.Close()
+			sqlConn = nil
+		}
+		schema.ClearManager()
+		os.Remove(conn)
+	})
+
+	It("Shares list results between transactions until a commit changes the schema", func() {
+		Expect(count()).To(Equal(1))
+		insert("second")
+		Expect(count()).To(Equal(1))
+
+		resource, err := schema.NewResource(testSchema, map[string]interface{}{"id": "third", "tenant_id": "tenant"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+			return tx.Create(resource)
+		})).To(Succeed())
+		Expect(count()).To(Equal(3))
+	})
+
+	It("Drops results changed by conditional updates", func() {
+		Expect(count()).To(Equal(1))
+		insert("second")
+		Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+			stored, err := tx.Fetch(testSchema, transaction.IDFilter("first"), nil)
+			Expect(err).ToNot(HaveOccurred())
+			etag := transaction.ETag(testSchema, stored.Data())
+			resource, err := schema.NewResource(testSchema, map[string]interface{}{"id": "first", "tenant_id": "tenant", "test_string": "changed"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tx.UpdateIfMatch(resource, etag)).To(Succeed())
+			return tx.UpdateIfMatch(resource, etag)
+		})).To(Equal(transaction.ErrPreconditionFailed))
+		Expect(count()).To(Equal(1))
+
+		resource, err := schema.NewResource(testSchema, map[string]interface{}{"id": "first", "tenant_id": "tenant"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+			return tx.UpdateIfMatch(resource, "*")
+		})).To(Succeed())
+		Expect(count()).To(Equal(2))
+	})
+
+	It("Isn't changed by transactions which were rolled back", func() {
+		Expect(count()).To(Equal(1))
+		errRollback := fmt.Errorf("rollback")
+		Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+			Expect(tx.Delete(testSchema, "first")).To(Succeed())
+			list, _, err := tx.List(testSchema, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list).To(BeEmpty())
+			return errRollback
+		})).To(MatchError(errRollback))
+		Expect(count()).To(Equal(1))
+	})
+
+	It("Expires results after the TTL", func() {
+		testSchema.Metadata["cache_ttl"] = 0.05
+		Expect(count()).To(Equal(1))
+		insert("second")
+		Expect(count()).To(Equal(1))
+		time.Sleep(100 * time.Millisecond)
+		Expect(count()).To(Equal(2))
+	})
+
+	It("Drops results on invalidation", func() {
+		Expect(count()).To(Equal(1))
+		insert("second")
+		sqlConn.InvalidateQueryCache(testSchema.ID)
+		Expect(count()).To(Equal(2))
+	})
+
+	Context("Related resources", func() {
+		var (
+			networkSchema *schema.Schema
+			serverSchema  *schema.Schema
+		)
+
+		// servers lists servers with the names of their networks, as joined by the cached list
+		servers := func() map[string]interface{} {
+			var list []*schema.Resource
+			Expect(db.Within(sqlConn, func(tx transaction.Transaction) (err error) {
+				list, _, err = tx.List(serverSchema, nil, nil, nil)
+				return
+			})).To(Succeed())
+			names := map[string]interface{}{}
+			for _, resource := range list {
+				names[resource.ID()] = resource.Data()["network"].(map[string]interface{})["name"]
+			}
+			return names
+		}
+
+		BeforeEach(func() {
+			manager := schema.GetManager()
+			networkSchema, _ = manager.Schema("network")
+			serverSchema, _ = manager.Schema("server")
+			serverSchema.Metadata["cache_ttl"] = 60
+
+			network, err := schema.NewResource(networkSchema, map[string]interface{}{
+				"id": "red", "name": "Red", "description": "", "tenant_id": "tenant", "shared": false,
+				"route_targets": []string{}, "providor_networks": map[string]interface{}{},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			server, err := schema.NewResource(serverSchema, map[string]interface{}{
+				"id": "server", "name": "Server", "description": "", "tenant_id": "tenant", "network_id": "red",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+				Expect(tx.Create(network)).To(Succeed())
+				return tx.Create(server)
+			})).To(Succeed())
+		})
+
+		It("Drops results joining a changed schema", func() {
+			Expect(servers()).To(Equal(map[string]interface{}{"server": "Red"}))
+			Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+				network, err := tx.Fetch(networkSchema, transaction.IDFilter("red"), nil)
+				Expect(err).ToNot(HaveOccurred())
+				network.Data()["name"] = "Blue"
+				return tx.Update(network)
+			})).To(Succeed())
+			Expect(servers()).To(Equal(map[string]interface{}{"server": "Blue"}))
+		})
+
+		It("Drops results of resources deleted by cascades", func() {
+			Expect(servers()).To(HaveLen(1))
+			Expect(db.Within(sqlConn, func(tx transaction.Transaction) error {
+				return tx.Delete(networkSchema, "red")
+			})).To(Succeed())
+			Expect(servers()).To(BeEmpty())
+		})
+
+		It("Lists cached schemas affected by changes", func() {
+			Expect(networkSchema.CacheDependents(false)).To(ConsistOf(serverSchema))
+			Expect(serverSchema.CacheDependents(false)).To(ConsistOf(serverSchema))
+			delete(serverSchema.Metadata, "cache_ttl")
+			Expect(networkSchema.CacheDependents(true)).To(BeEmpty())
+		})
+	})
+
+	It("Doesn't cache schemas without TTL", func() {
+		delete(testSchema.Metadata, "cache_ttl")
+		Expect(count()).To(Equal(1))
+		insert("second")
+		Expect(count()).To(Equal(2))
+	})
+})
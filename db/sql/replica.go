@@ -0,0 +1,185 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/jmoiron/sqlx"
+)
+
+// dsnPassword matches passwords of key=value connection strings
+var dsnPassword = regexp.MustCompile(`(?i)(password=)('[^']*'|\S+)`)
+
+// replica is a read-only copy of the primary database
+type replica struct {
+	// name identifies the replica in logs, the password of its connection is masked
+	name string
+	db   *sqlx.DB
+	// healthy is set to 1 if the replica is reachable and its lag is acceptable
+	healthy int32
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// connectReplicas opens connections of configured replicas and starts checking them,
+// unreachable replicas are skipped until they become healthy
+func (db *DB) connectReplicas(maxOpenConn int) error {
+	if len(db.options.ReadReplicas) == 0 {
+		return nil
+	}
+	for _, connection := range db.options.ReadReplicas {
+		rawDB, err := sql.Open(db.sqlType, connection)
+		if err != nil {
+			return err
+		}
+		rawDB.SetMaxOpenConns(maxOpenConn)
+		rawDB.SetMaxIdleConns(maxOpenConn)
+		db.replicas = append(db.replicas, &replica{
+			name: fmt.Sprintf("%d (%s)", len(db.replicas), maskConnection(connection)),
+			db:   sqlx.NewDb(rawDB, db.sqlType),
+		})
+	}
+	db.checkReplicas()
+	db.stopReplicaChecks = make(chan struct{})
+	go db.runReplicaChecks(db.stopReplicaChecks)
+	return nil
+}
+
+func (db *DB) runReplicaChecks(stop chan struct{}) {
+	interval := db.options.ReplicaHealthCheckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			db.checkReplicas()
+		}
+	}
+}
+
+func (db *DB) checkReplicas() {
+	for i, r := range db.replicas {
+		healthy := db.checkReplica(i, r)
+		if atomic.SwapInt32(&r.healthy, boolToInt32(healthy)) != boolToInt32(healthy) {
+			if healthy {
+				log.Info("Read replica %s is healthy", r.name)
+			} else {
+				log.Warning("Read replica %s is unhealthy, reads fall back to other replicas or the primary", r.name)
+			}
+		}
+	}
+}
+
+func (db *DB) checkReplica(index int, r *replica) bool {
+	if err := r.db.Ping(); err != nil {
+		log.Debug("Read replica %s is unreachable: %s", r.name, err)
+		return false
+	}
+	lag, err := db.Dialect().ReplicationLag(r.db)
+	if err != nil {
+		log.Debug("Failed to check lag of read replica %s: %s", r.name, err)
+		return false
+	}
+	metrics.UpdateGauge(int64(lag/time.Millisecond), "db.replica.%d.lag_msec", index)
+	if db.options.ReplicaMaxLag > 0 && lag > db.options.ReplicaMaxLag {
+		log.Debug("Read replica %s lags %s behind the primary", r.name, lag)
+		return false
+	}
+	return true
+}
+
+// readReplica returns the next healthy replica or nil if there is none
+func (db *DB) readReplica() *replica {
+	count := len(db.replicas)
+	for i := 0; i < count; i++ {
+		r := db.replicas[int(atomic.AddUint32(&db.nextReplica, 1))%count]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// toPrimary moves a transaction routed to a read replica to the primary before it writes or locks,
+// later reads of the transaction go to the primary too
+func (tx *Transaction) toPrimary() error {
+	if !tx.onReplica {
+		return nil
+	}
+	rawTx, err := tx.beginPrimary()
+	if err != nil {
+		return err
+	}
+	tx.db.execInitStatements(rawTx)
+	if err := tx.transaction.Rollback(); err != nil {
+		log.Debug("Failed to end transaction on a read replica: %s", err)
+	}
+	tx.transaction = rawTx
+	tx.onReplica = false
+	tx.db.updateCounter(1, "begin.replica_to_primary")
+	return nil
+}
+
+// maskConnection hides the password of a connection string
+func maskConnection(connection string) string {
+	if u, err := url.Parse(connection); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		return u.String()
+	}
+	if at := strings.LastIndex(connection, "@"); at >= 0 {
+		credentials := connection[:at]
+		if colon := strings.Index(credentials, ":"); colon >= 0 {
+			return credentials[:colon+1] + "xxxxx" + connection[at:]
+		}
+		return connection
+	}
+	return dsnPassword.ReplaceAllString(connection, "${1}xxxxx")
+}
+
+func (db *DB) closeReplicas() {
+	if db.stopReplicaChecks != nil {
+		close(db.stopReplicaChecks)
+		db.stopReplicaChecks = nil
+	}
+	for _, r := range db.replicas {
+		r.db.Close()
+	}
+	db.replicas = nil
+}
+
+func boolToInt32(value bool) int32 {
+	if value {
+		return 1
+	}
+	return 0
+}
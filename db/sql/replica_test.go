@@ -0,0 +1,132 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql_test
+
+import (
+	"context"
+	"os"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/options"
+	. "github.com/cloudwan/gohan/db/sql"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Read replicas", func() {
+	const (
+		primaryConn = "./test_primary.db"
+		replicaConn = "./test_replica.db"
+	)
+
+	var (
+		testSchema *schema.Schema
+		sqlConn    *DB
+	)
+
+	insert := func(conn, id string) {
+		dbc, err := db.ConnectDB("sqlite3", conn, db.DefaultMaxOpenConn, options.Default())
+		Expect(err).ToNot(HaveOccurred())
+		defer dbc.Close()
+		Expect(db.Within(dbc, func(tx transaction.Transaction) error {
+			return tx.Exec("INSERT INTO `tests` (`id`, `tenant_id`) values (?, 'tenant')", id)
+		})).To(Succeed())
+	}
+
+	connect := func(replicas ...string) {
+		opts := options.Default()
+		opts.ReadReplicas = replicas
+		dbc, err := db.ConnectDB("sqlite3", primaryConn, db.DefaultMaxOpenConn, opts)
+		Expect(err).ToNot(HaveOccurred())
+		sqlConn = dbc.(*DB)
+	}
+
+	fetch := func(options *transaction.TxOptions, id string) error {
+		return db.WithinTx(context.Background(), sqlConn, options, func(tx transaction.Transaction) error {
+			_, err := tx.Fetch(testSchema, transaction.IDFilter(id), nil)
+			return err
+		})
+	}
+
+	BeforeEach(func() {
+		if os.Getenv("MYSQL_TEST") == "true" || os.Getenv("POSTGRES_TEST") == "true" {
+			Skip("replicas are emulated with separate SQLite databases")
+		}
+		manager := schema.GetManager()
+		Expect(manager.LoadSchemasFromFiles(
+			"../../etc/schema/gohan.json", "../../tests/test_abstract_schema.yaml", "../../tests/test_schema.yaml")).To(Succeed())
+		Expect(db.InitDBWithSchemas("sqlite3", primaryConn, db.DefaultTestInitDBParams())).To(Succeed())
+		Expect(db.InitDBWithSchemas("sqlite3", replicaConn, db.DefaultTestInitDBParams())).To(Succeed())
+		insert(primaryConn, "primary")
+		insert(replicaConn, "replica")
+
+		var ok bool
+		testSchema, ok = manager.Schema("test")
+		Expect(ok).To(BeTrue())
+	})
+
+	AfterEach(func() {
+		if sqlConn != nil {
+			sqlConn.Close()
+			sqlConn = nil
+		}
+		schema.ClearManager()
+		os.Remove(primaryConn)
+		os.Remove(replicaConn)
+	})
+
+	It("Routes read-only transactions to replicas", func() {
+		connect(replicaConn)
+		readOnly := &transaction.TxOptions{IsolationLevel: transaction.RepeatableRead, ReadOnly: true}
+		Expect(fetch(readOnly, "replica")).To(Succeed())
+		Expect(fetch(readOnly, "primary")).To(MatchError(ContainSubstring("not found")))
+
+		readWrite := &transaction.TxOptions{IsolationLevel: transaction.RepeatableRead}
+		Expect(fetch(readWrite, "primary")).To(Succeed())
+		Expect(fetch(readWrite, "replica")).To(MatchError(ContainSubstring("not found")))
+	})
+
+	It("Moves transactions writing or locking to the primary", func() {
+		connect(replicaConn)
+		readOnly := &transaction.TxOptions{IsolationLevel: transaction.ReadCommited, ReadOnly: true}
+		Expect(db.WithinTx(context.Background(), sqlConn, readOnly, func(tx transaction.Transaction) error {
+			if _, err := tx.Fetch(testSchema, transaction.IDFilter("replica"), nil); err != nil {
+				return err
+			}
+			if err := tx.Exec("INSERT INTO `tests` (`id`, `tenant_id`) values ('written', 'tenant')"); err != nil {
+				return err
+			}
+			_, err := tx.Fetch(testSchema, transaction.IDFilter("written"), nil)
+			return err
+		})).To(Succeed())
+		Expect(db.WithinTx(context.Background(), sqlConn, readOnly, func(tx transaction.Transaction) error {
+			_, err := tx.LockFetch(testSchema, transaction.IDFilter("written"), schema.LockRelatedResources, nil)
+			return err
+		})).To(Succeed())
+
+		readWrite := &transaction.TxOptions{IsolationLevel: transaction.RepeatableRead}
+		Expect(fetch(readWrite, "written")).To(Succeed())
+		Expect(fetch(readOnly, "written")).To(MatchError(ContainSubstring("not found")))
+	})
+
+	It("Falls back to the primary if no replica is healthy", func() {
+		connect("file:./missing/replica.db?mode=ro")
+		readOnly := &transaction.TxOptions{IsolationLevel: transaction.RepeatableRead, ReadOnly: true}
+		Expect(fetch(readOnly, "primary")).To(Succeed())
+	})
+})
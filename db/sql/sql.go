@@ -22,8 +22,10 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudwan/gohan/db/options"
@@ -32,11 +34,14 @@ import (
 	"github.com/cloudwan/gohan/extension/goext"
 	"github.com/cloudwan/gohan/metrics"
 	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/cloudwan/gohan/util"
 	"github.com/jmoiron/sqlx"
 	sq "github.com/lann/squirrel"
 	// Import mysql lib
 	_ "github.com/go-sql-driver/mysql"
+	// Import postgres lib
+	_ "github.com/lib/pq"
 	// Import go-sqlite3 lib
 	_ "github.com/mattn/go-sqlite3"
 	// Import go-fakedb lib
@@ -53,6 +58,8 @@ const (
 	stateErrorColumnName      = "state_error"
 	stateColumnName           = "state"
 	stateMonitoringColumnName = "state_monitoring"
+	deletedAtColumnName       = transaction.DeletedAtKey
+	deletedByColumnName       = transaction.DeletedByKey
 )
 
 //DB is sql implementation of DB
@@ -63,6 +70,15 @@ type DB struct {
 
 	// options
 	options options.Options
+
+	replicas          []*replica
+	nextReplica       uint32
+	stopReplicaChecks chan struct{}
+
+	queryCache *queryCache
+
+	indexTableOnce sync.Once
+	indexTableErr  error
 }
 
 //Transaction is sql implementation of Transaction
@@ -71,6 +87,12 @@ type Transaction struct {
 	db             *DB
 	closed         bool
 	isolationLevel transaction.Type
+	// span is the parent of query spans when the query context doesn't carry one
+	span *tracing.Span
+	// onReplica is set for read-only transactions routed to a read replica
+	onReplica bool
+	// beginPrimary begins the transaction replacing the one on a replica before it writes or locks
+	beginPrimary func() (*sqlx.Tx, error)
 }
 
 type TxInterface transaction.Transaction
@@ -104,7 +126,7 @@ func NewDB(options options.Options) *DB {
 	handlers["object"] = &jsonHandler{}
 	handlers["array"] = &jsonHandler{}
 	handlers["boolean"] = &boolHandler{}
-	return &DB{handlers: handlers, options: options}
+	return &DB{handlers: handlers, options: options, queryCache: newQueryCache()}
 }
 
 //Options returns DB options
@@ -112,11 +134,21 @@ func (db *DB) Options() options.Options {
 	return db.options
 }
 
+//SetSQLType selects the SQL dialect without connecting to the db
+func (db *DB) SetSQLType(sqlType string) {
+	db.sqlType = sqlType
+}
+
+//Dialect returns SQL dialect of the db
+func (db *DB) Dialect() Dialect {
+	return DialectFor(db.sqlType)
+}
+
 //propertyHandler for each propertys
 type propertyHandler interface {
 	encode(*schema.Property, interface{}) (interface{}, error)
 	decode(*schema.Property, interface{}) (interface{}, error)
-	dataType(*schema.Property) string
+	dataType(*schema.Property) ColumnType
 }
 
 type defaultHandler struct {
@@ -130,12 +162,12 @@ func (handler *defaultHandler) decode(property *schema.Property, data interface{
 	return data, nil
 }
 
-func (handler *defaultHandler) dataType(property *schema.Property) (res string) {
+func (handler *defaultHandler) dataType(property *schema.Property) (res ColumnType) {
 	// TODO(marcin) extend types for schema. Here is pretty ugly guessing
 	if property.ID == "id" || property.Relation != "" || property.Unique {
-		res = "varchar(255)"
+		res = VarcharColumn
 	} else {
-		res = "text"
+		res = TextColumn
 	}
 	return
 }
@@ -196,8 +228,8 @@ func (handler *boolHandler) decode(property *schema.Property, data interface{})
 	return
 }
 
-func (handler *boolHandler) dataType(property *schema.Property) string {
-	return "boolean"
+func (handler *boolHandler) dataType(property *schema.Property) ColumnType {
+	return BooleanColumn
 }
 
 type numberHandler struct{}
@@ -231,8 +263,8 @@ func (handler *numberHandler) decode(property *schema.Property, data interface{}
 	return
 }
 
-func (handler *numberHandler) dataType(property *schema.Property) string {
-	return "real"
+func (handler *numberHandler) dataType(property *schema.Property) ColumnType {
+	return RealColumn
 }
 
 type integerHandler struct{}
@@ -266,8 +298,8 @@ func (handler *integerHandler) decode(property *schema.Property, data interface{
 	return
 }
 
-func (handler *integerHandler) dataType(property *schema.Property) string {
-	return "numeric"
+func (handler *integerHandler) dataType(property *schema.Property) ColumnType {
+	return IntegerColumn
 }
 
 type jsonHandler struct {
@@ -283,26 +315,32 @@ func (handler *jsonHandler) encode(property *schema.Property, data interface{})
 }
 
 func (handler *jsonHandler) decode(property *schema.Property, data interface{}) (interface{}, error) {
-	if bytes, ok := data.([]byte); ok {
-		var ret interface{}
-		err := json.Unmarshal(bytes, &ret)
-		return ret, err
+	var bytes []byte
+	switch t := data.(type) {
+	case []byte:
+		bytes = t
+	case string: // postgres text columns
+		bytes = []byte(t)
+	default:
+		return data, nil
 	}
-	return data, nil
+	var ret interface{}
+	err := json.Unmarshal(bytes, &ret)
+	return ret, err
 }
 
-func (handler *jsonHandler) dataType(property *schema.Property) string {
-	return "text"
+func (handler *jsonHandler) dataType(property *schema.Property) ColumnType {
+	return JSONColumn
 }
 
 func quote(str string) string {
 	return fmt.Sprintf("`%s`", str)
 }
 
-func foreignKeyName(fromTable, fromProperty, toTable, toProperty string) string {
+func foreignKeyName(fromTable, fromProperty, toTable, toProperty string, maxLength int) string {
 	name := fmt.Sprintf("%s_%s_%s_%s", fromTable, fromProperty, toTable, toProperty)
-	if len(name) > 64 {
-		diff := len(name) - 64
+	if len(name) > maxLength {
+		diff := len(name) - maxLength
 		return name[diff:]
 	}
 	return name
@@ -329,15 +367,12 @@ func (db *DB) Connect(sqlType, conn string, maxOpenConn int) (err error) {
 	rawDB.SetMaxOpenConns(maxOpenConn)
 	rawDB.SetMaxIdleConns(maxOpenConn)
 	db.DB = sqlx.NewDb(rawDB, db.sqlType)
-
-	if db.sqlType == "sqlite3" {
-		db.DB.Exec("PRAGMA foreign_keys = ON;")
-	}
+	db.execInitStatements(db.DB)
 
 	for i := 0; i < retryDB; i++ {
 		err = db.DB.Ping()
 		if err == nil {
-			return nil
+			return db.connectReplicas(maxOpenConn)
 		}
 		time.Sleep(retryDBWait * time.Second)
 		log.Info("Retrying db connection... (%s)", err)
@@ -349,6 +384,7 @@ func (db *DB) Connect(sqlType, conn string, maxOpenConn int) (err error) {
 // Close closes db connection
 func (db *DB) Close() {
 	defer db.measureTime(time.Now(), "close")
+	db.closeReplicas()
 	db.DB.Close()
 }
 
@@ -365,10 +401,8 @@ func (db *DB) Begin() (tx transaction.Transaction, err error) {
 		return nil, err
 	}
 	db.updateCounter(1, "active")
+	db.execInitStatements(rawTx)
 
-	if db.sqlType == "sqlite3" {
-		rawTx.Exec("PRAGMA foreign_keys = ON;")
-	}
 	transx = Transaction{
 		db:             db,
 		transaction:    rawTx,
@@ -380,7 +414,7 @@ func (db *DB) Begin() (tx transaction.Transaction, err error) {
 		log.Notice("FUZZY_DB_TX is enabled")
 		tx = &transaction.FuzzyTransaction{Tx: transaction.Transaction(&transx)}
 	} else {
-		tx = MakeCachedTransaction(&transx)
+		tx = db.makeCachedTransaction(&transx)
 	}
 	log.Debug("[%p] Created transaction %#v, isolation level: %s", rawTx, rawTx, transx.GetIsolationLevel())
 	return
@@ -398,23 +432,43 @@ func (db *DB) BeginTx(ctx context.Context, options *transaction.TxOptions) (tx t
 		return nil, err
 	}
 
-	rawTx, err := db.DB.BeginTxx(ctx, sqlOptions)
+	// writes and locking reads always go to the primary
+	conn := db.DB
+	onReplica := false
+	if options.ReadOnly && len(db.replicas) > 0 {
+		if r := db.readReplica(); r != nil {
+			conn, onReplica = r.db, true
+			db.updateCounter(1, "begin.replica")
+		} else {
+			db.updateCounter(1, "begin.replica_fallback")
+		}
+	}
+
+	rawTx, err := conn.BeginTxx(ctx, sqlOptions)
 	if err != nil {
 		db.updateCounter(1, "begin.failed")
 		return nil, err
 	}
 	db.updateCounter(1, "active")
-	if db.sqlType == "sqlite3" {
-		rawTx.Exec("PRAGMA foreign_keys = ON;")
-	}
+	db.execInitStatements(rawTx)
+
 	transx = Transaction{
 		db:             db,
 		transaction:    rawTx,
 		closed:         false,
 		isolationLevel: options.IsolationLevel,
+		span:           tracing.SpanFromContext(ctx),
+		onReplica:      onReplica,
+	}
+	if onReplica {
+		primaryOptions := *sqlOptions
+		primaryOptions.ReadOnly = false
+		transx.beginPrimary = func() (*sqlx.Tx, error) {
+			return db.DB.BeginTxx(ctx, &primaryOptions)
+		}
 	}
 	if transx.isolationLevel == transaction.RepeatableRead || transx.isolationLevel == transaction.Serializable {
-		tx = MakeCachedTransaction(&transx)
+		tx = db.makeCachedTransaction(&transx)
 	} else {
 		tx = &transx
 	}
@@ -423,96 +477,182 @@ func (db *DB) BeginTx(ctx context.Context, options *transaction.TxOptions) (tx t
 	return
 }
 
+func (db *DB) execInitStatements(execer sqlx.Execer) {
+	for _, statement := range db.Dialect().InitStatements() {
+		execer.Exec(statement)
+	}
+}
+
+func (db *DB) exec(query string) error {
+	_, err := db.DB.Exec(db.Dialect().Rewrite(query))
+	return err
+}
+
 func (db *DB) genTableCols(s *schema.Schema, cascade bool, exclude []string) ([]string, []string, []string) {
 	var cols []string
 	var relations []string
 	var indices []string
-	schemaManager := schema.GetManager()
+	dialect := db.Dialect()
 	for _, property := range s.Properties {
 		if util.ContainsString(exclude, property.ID) {
 			continue
 		}
-		handler := db.handlers[property.Type]
-		sqlDataType := property.SQLType
-		sqlDataProperties := ""
-		if db.sqlType == "sqlite3" {
-			sqlDataType = strings.Replace(sqlDataType, "auto_increment", "autoincrement", 1)
+		query, sqlDataType := db.columnDef(&property)
+		cols = append(cols, query)
+		if relation := db.relationDef(s, &property, cascade); relation != "" {
+			relations = append(relations, relation)
 		}
-		if sqlDataType == "" {
-			sqlDataType = handler.dataType(&property)
-			if property.ID == "id" {
-				sqlDataProperties = " primary key"
-			}
+
+		if property.Indexed {
+			indices = append(indices, fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s(%s);", s.GetDbTableName(), property.ID,
+				quote(s.GetDbTableName()), dialect.IndexColumn(property.ID, sqlDataType)))
+		}
+	}
+
+	for _, index := range s.Indexes {
+		if !dialect.SupportsIndexType(index.Type) {
+			log.Error("index %s won't be created since %s doesn't support %s index type", index.Name, dialect.Name(), index.Type)
+			continue
+		}
+		// rejected by checkIndexes before tables are created or migrations planned
+		if index.Where != "" && !dialect.SupportsPartialIndex() {
+			continue
+		}
+		indices = append(indices, db.genIndexDef(s, index))
+	}
+	return cols, relations, indices
+}
+
+// genIndexDef generates statement creating an index from the indexes section of a schema
+func (db *DB) genIndexDef(s *schema.Schema, index schema.Index) string {
+	dialect := db.Dialect()
+	quotedColumns := make([]string, len(index.Columns))
+	for i, column := range index.Columns {
+		quotedColumns[i] = quote(column)
+		if i < len(index.Orders) && index.Orders[i] != "" {
+			quotedColumns[i] += " " + index.Orders[i]
+		}
+	}
+
+	include := ""
+	if len(index.Include) > 0 {
+		quotedInclude := make([]string, len(index.Include))
+		for i, column := range index.Include {
+			quotedInclude[i] = quote(column)
 		}
-		if property.ID != "id" {
-			if property.Nullable {
-				sqlDataProperties = " null"
+		include = dialect.IndexInclude(quotedInclude)
+		if include == "" {
+			if index.Type == schema.Unique {
+				// appending key columns would change what is unique
+				log.Warning("index %s won't cover included columns since %s doesn't support them in unique indexes", index.Name, dialect.Name())
 			} else {
-				sqlDataProperties = " not null"
-			}
-			if property.Unique {
-				sqlDataProperties = " unique"
+				// covering is emulated with trailing key columns
+				quotedColumns = append(quotedColumns, quotedInclude...)
 			}
 		}
+	}
 
-		query := "`" + property.ID + "` " + sqlDataType + sqlDataProperties
-
-		cols = append(cols, query)
-		if property.Relation != "" {
-			foreignSchema, _ := schemaManager.Schema(property.Relation)
-			if foreignSchema != nil {
-				cascadeString := ""
-				if cascade ||
-					property.OnDeleteCascade ||
-					(property.Relation == s.Parent && s.OnParentDeleteCascade) {
-					cascadeString = "on delete cascade"
-				}
+	where := ""
+	if index.Where != "" {
+		where = " WHERE " + index.Where
+	}
 
-				relationColumn := "id"
-				if property.RelationColumn != "" {
-					relationColumn = property.RelationColumn
-				}
+	return fmt.Sprintf(
+		"CREATE %s INDEX %s ON %s(%s)%s%s;",
+		index.Type, index.Name, quote(s.GetDbTableName()), strings.Join(quotedColumns, ","), include, where)
+}
 
-				relations = append(relations, fmt.Sprintf("constraint %s foreign key(`%s`) REFERENCES `%s`(%s) %s",
-					quote(foreignKeyName(s.GetDbTableName(), property.ID, foreignSchema.GetDbTableName(), relationColumn)),
-					property.ID, foreignSchema.GetDbTableName(), relationColumn, cascadeString))
-			}
+// columnDef generates the column definition of a property and returns it with the column type
+func (db *DB) columnDef(property *schema.Property) (string, string) {
+	dialect := db.Dialect()
+	handler := db.handler(property)
+	sqlDataType := dialect.NormalizeSQLType(property.SQLType)
+	sqlDataProperties := ""
+	if sqlDataType == "" {
+		sqlDataType = dialect.ColumnType(handler.dataType(property))
+		if property.ID == "id" {
+			sqlDataProperties = " primary key"
 		}
-
-		if property.Indexed {
-			prefix := ""
-			// mysql cannot index TEXT without prefix spec, while SQLite3 doesn't allow specifying key size
-			if sqlDataType == "text" && db.sqlType == "mysql" {
-				prefix = "(255)"
-			}
-			indices = append(indices, fmt.Sprintf("CREATE INDEX %s_%s_idx ON `%s`(`%s`%s);", s.GetDbTableName(), property.ID,
-				s.GetDbTableName(), property.ID, prefix))
+	}
+	if property.ID != "id" {
+		if property.Nullable {
+			sqlDataProperties = " null"
+		} else {
+			sqlDataProperties = " not null"
+		}
+		if property.Unique {
+			sqlDataProperties = " unique"
 		}
 	}
+	return quote(property.ID) + " " + sqlDataType + sqlDataProperties, sqlDataType
+}
 
-	for _, index := range s.Indexes {
-		quotedColumns := make([]string, len(index.Columns))
-		for i, column := range index.Columns {
-			quotedColumns[i] = quote(column)
-		}
+// relationDef generates the foreign key constraint of a property, or an empty string if it has no relation
+func (db *DB) relationDef(s *schema.Schema, property *schema.Property, cascade bool) string {
+	if property.Relation == "" {
+		return ""
+	}
+	foreignSchema, _ := schema.GetManager().Schema(property.Relation)
+	if foreignSchema == nil {
+		return ""
+	}
+	cascadeString := ""
+	if cascade ||
+		property.OnDeleteCascade ||
+		(property.Relation == s.Parent && s.OnParentDeleteCascade) {
+		cascadeString = "on delete cascade"
+	}
 
-		if db.sqlType == "sqlite3" && (index.Type == schema.Spatial || index.Type == schema.FullText) {
-			log.Error("index %s won't be created since sqlite doesn't support spatial and fulltext index types", index.Name)
-			continue
-		}
+	relationColumn := "id"
+	if property.RelationColumn != "" {
+		relationColumn = property.RelationColumn
+	}
+
+	return fmt.Sprintf("constraint %s foreign key(`%s`) REFERENCES `%s`(%s) %s",
+		quote(foreignKeyName(s.GetDbTableName(), property.ID, foreignSchema.GetDbTableName(), relationColumn, db.Dialect().MaxIdentifierLength())),
+		property.ID, foreignSchema.GetDbTableName(), relationColumn, cascadeString)
+}
 
-		createIndexQuery := fmt.Sprintf(
-			"CREATE %s INDEX %s ON %s(%s);",
-			index.Type, index.Name, quote(s.GetDbTableName()), strings.Join(quotedColumns, ","))
-		indices = append(indices, createIndexQuery)
+// genConfigVersionCol generates the column counting versions of resources
+func genConfigVersionCol() string {
+	return quote(configVersionColumnName) + " int not null default 1"
+}
+
+// hasConfigVersion whether resources of the schema count their versions,
+// which history of resources is numbered by
+func hasConfigVersion(s *schema.Schema) bool {
+	return s.StateVersioning() || s.History()
+}
+
+// genStateVersioningCols generates columns of states of resources
+func genStateVersioningCols() []string {
+	return []string{
+		genConfigVersionCol(),
+		quote(stateVersionColumnName) + " int not null default 0",
+		quote(stateErrorColumnName) + " text not null default ''",
+		quote(stateColumnName) + " text not null default ''",
+		quote(stateMonitoringColumnName) + " text not null default ''",
 	}
-	return cols, relations, indices
+}
+
+// genTombstoneCols generates columns and indices of soft deleted resources
+func (db *DB) genTombstoneCols(s *schema.Schema) ([]string, []string) {
+	dialect := db.Dialect()
+	cols := []string{
+		quote(deletedAtColumnName) + " " + dialect.ColumnType(IntegerColumn) + " null",
+		quote(deletedByColumnName) + " " + dialect.ColumnType(VarcharColumn) + " null",
+	}
+	indices := []string{
+		fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s(%s);", s.GetDbTableName(), deletedAtColumnName,
+			quote(s.GetDbTableName()), quote(deletedAtColumnName)),
+	}
+	return cols, indices
 }
 
 //AlterTableDef generates alter table sql
 func (db *DB) AlterTableDef(s *schema.Schema, cascade bool) (string, []string, error) {
 	var existing []string
-	rows, err := db.DB.Query(fmt.Sprintf("select * from `%s` limit 1;", s.GetDbTableName()))
+	rows, err := db.DB.Query(db.Dialect().Rewrite(fmt.Sprintf("select * from `%s` limit 1;", s.GetDbTableName())))
 	if err == nil {
 		defer rows.Close()
 		existing, err = rows.Columns()
@@ -523,12 +663,19 @@ func (db *DB) AlterTableDef(s *schema.Schema, cascade bool) (string, []string, e
 	}
 
 	cols, relations, indices := db.genTableCols(s, cascade, existing)
-	cols = append(cols, relations...)
+	if s.History() && !s.StateVersioning() && !util.ContainsString(existing, configVersionColumnName) {
+		cols = append(cols, genConfigVersionCol())
+	}
+	if s.Recoverable() && !util.ContainsString(existing, deletedAtColumnName) {
+		tombstoneCols, tombstoneIndices := db.genTombstoneCols(s)
+		cols = append(cols, tombstoneCols...)
+		indices = append(indices, tombstoneIndices...)
+	}
 
-	if len(cols) == 0 {
+	if len(cols) == 0 && len(relations) == 0 {
 		return "", nil, nil
 	}
-	alterTable := fmt.Sprintf("alter table`%s` add (%s);\n", s.GetDbTableName(), strings.Join(cols, ","))
+	alterTable := db.Dialect().AlterTable(s.GetDbTableName(), cols, relations)
 	log.Debug("Altering table: " + alterTable)
 	log.Debug("Altering indices: " + strings.Join(indices, ""))
 	return alterTable, indices, nil
@@ -539,11 +686,14 @@ func (db *DB) GenTableDef(s *schema.Schema, cascade bool) (string, []string) {
 	cols, relations, indices := db.genTableCols(s, cascade, nil)
 
 	if s.StateVersioning() {
-		cols = append(cols, quote(configVersionColumnName)+"int not null default 1")
-		cols = append(cols, quote(stateVersionColumnName)+"int not null default 0")
-		cols = append(cols, quote(stateErrorColumnName)+"text not null default ''")
-		cols = append(cols, quote(stateColumnName)+"text not null default ''")
-		cols = append(cols, quote(stateMonitoringColumnName)+"text not null default ''")
+		cols = append(cols, genStateVersioningCols()...)
+	} else if s.History() {
+		cols = append(cols, genConfigVersionCol())
+	}
+	if s.Recoverable() {
+		tombstoneCols, tombstoneIndices := db.genTombstoneCols(s)
+		cols = append(cols, tombstoneCols...)
+		indices = append(indices, tombstoneIndices...)
 	}
 
 	cols = append(cols, relations...)
@@ -558,26 +708,63 @@ func (db *DB) RegisterTable(s *schema.Schema, cascade, migrate bool) error {
 	if s.IsAbstract() {
 		return nil
 	}
-	tableDef, indices, err := db.AlterTableDef(s, cascade)
+	if err := db.checkIndexes(s); err != nil {
+		return err
+	}
+	if err := db.ensureIndexTable(); err != nil {
+		return err
+	}
+	tableDef, _, err := db.AlterTableDef(s, cascade)
 	if !migrate {
-		if tableDef != "" || (indices != nil && len(indices) > 0) {
+		if tableDef != "" {
 			return fmt.Errorf("needs migration, run \"gohan migrate\"")
 		}
 	}
-	if err != nil {
-		tableDef, indices = db.GenTableDef(s, cascade)
+	created := err != nil
+	if created {
+		tableDef, _ = db.GenTableDef(s, cascade)
 	}
 	if tableDef != "" {
-		if _, err = db.DB.Exec(tableDef); err != nil {
+		if err = db.exec(tableDef); err != nil {
 			return errors.Errorf("error when exec table stmt: '%s': %s", tableDef, err)
 		}
 	}
-	for _, indexSQL := range indices {
-		if _, err = db.DB.Exec(indexSQL); err != nil {
-			return errors.Errorf("error when exec index stmt: '%s': %s", indexSQL, err)
+	if err = db.registerIndexes(s, cascade, migrate || created); err != nil {
+		return err
+	}
+	if s.History() {
+		historyDef := db.genHistoryTableDef(s)
+		if err = db.exec(historyDef); err != nil {
+			return errors.Errorf("error when exec history table stmt: '%s': %s", historyDef, err)
 		}
 	}
-	return err
+	return nil
+}
+
+// registerIndexes creates, drops and recreates indexes of an existing table to match the schema.
+// Without migrate only indexes created before they were recorded are recorded.
+func (db *DB) registerIndexes(s *schema.Schema, cascade, migrate bool) error {
+	info, err := db.Dialect().DescribeTable(db.DB, s.GetDbTableName())
+	if err != nil {
+		return err
+	}
+	drops, adds, err := db.planIndexChanges(s, info, cascade)
+	if err != nil {
+		return err
+	}
+	for _, change := range append(drops, adds...) {
+		if !migrate && change.Kind != RecordIndexChange {
+			return fmt.Errorf("needs migration, run \"gohan migrate\"")
+		}
+	}
+	for _, change := range append(drops, adds...) {
+		for _, statement := range change.Up {
+			if err = db.exec(statement); err != nil {
+				return errors.Errorf("error when exec index stmt: '%s': %s", statement, err)
+			}
+		}
+	}
+	return nil
 }
 
 //DropTable drop table definition
@@ -585,9 +772,22 @@ func (db *DB) DropTable(s *schema.Schema) error {
 	if s.IsAbstract() {
 		return nil
 	}
+	if s.History() {
+		if err := db.exec(fmt.Sprintf("drop table if exists %s\n", quote(historyTableName(s)))); err != nil {
+			return err
+		}
+	}
+	recorded, err := db.recordedIndexes(db.DB, s.GetDbTableName())
+	if err != nil {
+		return err
+	}
+	for name := range recorded {
+		if err := db.exec(db.unrecordIndex(s.GetDbTableName(), name)); err != nil {
+			return err
+		}
+	}
 	sql := fmt.Sprintf("drop table if exists %s\n", quote(s.GetDbTableName()))
-	_, err := db.DB.Exec(sql)
-	return err
+	return db.exec(sql)
 }
 
 func escapeID(ID string) string {
@@ -600,6 +800,39 @@ func (tx *Transaction) logQuery(sql string, args ...interface{}) {
 	log.Debug("[%p] Executing SQL query '%s'", tx.transaction, query)
 }
 
+func (tx *Transaction) rewrite(sql string) string {
+	return tx.db.Dialect().Rewrite(sql)
+}
+
+// startQuerySpan starts a span of a query when the query is a part of a traced request
+func (tx *Transaction) startQuerySpan(ctx context.Context, sql string) *tracing.Span {
+	parent := tracing.SpanFromContext(ctx)
+	if parent == nil {
+		parent = tx.span
+	}
+	if parent == nil {
+		return nil
+	}
+	span := tracing.StartSpan(parent, "sql")
+	span.SetAttribute("db.system", tx.db.sqlType)
+	span.SetAttribute("db.statement", sql)
+	return span
+}
+
+func (tx *Transaction) queryx(ctx context.Context, sql string, args ...interface{}) (*sqlx.Rows, error) {
+	span := tx.startQuerySpan(ctx, sql)
+	defer span.Finish()
+	rows, err := tx.transaction.QueryxContext(ctx, tx.rewrite(sql), args...)
+	span.SetError(err)
+	return rows, err
+}
+
+func (tx *Transaction) queryRowx(ctx context.Context, sql string, args ...interface{}) *sqlx.Row {
+	span := tx.startQuerySpan(ctx, sql)
+	defer span.Finish()
+	return tx.transaction.QueryRowxContext(ctx, tx.rewrite(sql), args...)
+}
+
 func (tx *Transaction) measureTime(timeStarted time.Time, schemaId, action string) {
 	metrics.UpdateTimer(timeStarted, "tx.%s.%s", schemaId, action)
 }
@@ -615,8 +848,14 @@ func (tx *Transaction) ExecContext(ctx context.Context, sql string, args ...inte
 }
 
 func (tx *Transaction) exec(ctx context.Context, sql string, args ...interface{}) error {
+	if err := tx.toPrimary(); err != nil {
+		return err
+	}
 	tx.logQuery(sql, args...)
-	_, err := tx.transaction.ExecContext(ctx, sql, args...)
+	span := tx.startQuerySpan(ctx, sql)
+	defer span.Finish()
+	_, err := tx.transaction.ExecContext(ctx, tx.rewrite(sql), args...)
+	span.SetError(err)
 	return err
 }
 
@@ -633,6 +872,17 @@ func (tx *Transaction) CreateContext(ctx context.Context, resource *schema.Resou
 	db := tx.db
 	s := resource.Schema()
 	data := resource.Data()
+	if s.History() {
+		// versions of a resource created again follow the ones recorded before
+		version, err := tx.nextVersion(ctx, s, resource.ID())
+		if err != nil {
+			return err
+		}
+		if version > 1 {
+			cols = append(cols, quote(configVersionColumnName))
+			values = append(values, version)
+		}
+	}
 	q := sq.Insert(quote(s.GetDbTableName()))
 	for _, attr := range s.Properties {
 		//TODO(nati) support optional value
@@ -651,9 +901,89 @@ func (tx *Transaction) CreateContext(ctx context.Context, resource *schema.Resou
 	if err != nil {
 		return err
 	}
+	if s.Recoverable() {
+		if err := tx.purgeConflictingTombstones(ctx, s, data); err != nil {
+			return err
+		}
+	}
+	if err := tx.exec(ctx, sql, args...); err != nil {
+		return err
+	}
+	if s.History() {
+		return tx.recordVersion(ctx, s, resource.ID())
+	}
+	return nil
+}
+
+// purgeConflictingTombstones physically deletes soft deleted resources holding
+// the id or unique values of data, so a resource can be created again
+func (tx *Transaction) purgeConflictingTombstones(ctx context.Context, s *schema.Schema, data map[string]interface{}) error {
+	encode := func(propertyID string) (interface{}, bool, error) {
+		property, err := s.GetPropertyByID(propertyID)
+		if err != nil || data[propertyID] == nil {
+			return nil, false, nil
+		}
+		encoded, err := tx.db.handler(property).encode(property, data[propertyID])
+		return encoded, err == nil, err
+	}
+	conflicts := sq.Or{}
+	for _, property := range s.Properties {
+		if property.ID != "id" && !property.Unique {
+			continue
+		}
+		encoded, ok, err := encode(property.ID)
+		if err != nil {
+			return fmt.Errorf("SQL Create encoding error: %s", err)
+		}
+		if ok {
+			conflicts = append(conflicts, sq.Eq{quote(property.ID): encoded})
+		}
+	}
+	for _, index := range s.Indexes {
+		if index.Type != schema.Unique || index.Where != "" {
+			continue
+		}
+		columns := sq.Eq{}
+		for _, column := range index.Columns {
+			encoded, ok, err := encode(column)
+			if err != nil {
+				return fmt.Errorf("SQL Create encoding error: %s", err)
+			}
+			if !ok {
+				columns = nil
+				break
+			}
+			columns[quote(column)] = encoded
+		}
+		if len(columns) > 0 {
+			conflicts = append(conflicts, columns)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sql, args, err := sq.Delete(quote(s.GetDbTableName())).
+		Where(sq.NotEq{quote(deletedAtColumnName): nil}).
+		Where(conflicts).
+		ToSql()
+	if err != nil {
+		return err
+	}
 	return tx.exec(ctx, sql, args...)
 }
 
+// checkNotDeleted returns ErrResourceNotFound for soft deleted resources, which can't be updated
+func (tx *Transaction) checkNotDeleted(ctx context.Context, s *schema.Schema, resourceID interface{}) error {
+	count, err := tx.count(ctx, s, transaction.IDFilter(resourceID), false)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return transaction.ErrResourceNotFound
+	}
+	return nil
+}
+
 func (tx *Transaction) updateQuery(resource *schema.Resource) (sq.UpdateBuilder, error) {
 	s := resource.Schema()
 	db := tx.db
@@ -684,6 +1014,11 @@ func (tx *Transaction) Update(resource *schema.Resource) error {
 func (tx *Transaction) UpdateContext(ctx context.Context, resource *schema.Resource) error {
 	defer tx.measureTime(time.Now(), resource.Schema().ID, "update")
 
+	if resource.Schema().Recoverable() {
+		if err := tx.checkNotDeleted(ctx, resource.Schema(), resource.ID()); err != nil {
+			return err
+		}
+	}
 	q, err := tx.updateQuery(resource)
 	if err != nil {
 		return err
@@ -692,12 +1027,28 @@ func (tx *Transaction) UpdateContext(ctx context.Context, resource *schema.Resou
 	if err != nil {
 		return err
 	}
-	if resource.Schema().StateVersioning() {
+	if hasConfigVersion(resource.Schema()) {
 		sql += ", `" + configVersionColumnName + "` = `" + configVersionColumnName + "` + 1"
 	}
 	sql += " WHERE id = ?"
 	args = append(args, resource.ID())
-	return tx.exec(ctx, sql, args...)
+	if err := tx.exec(ctx, sql, args...); err != nil {
+		return err
+	}
+	if resource.Schema().History() {
+		return tx.recordVersion(ctx, resource.Schema(), resource.ID())
+	}
+	return nil
+}
+
+//UpdateIfMatch updates resource in the db if the stored one still has the given ETag
+func (tx *Transaction) UpdateIfMatch(resource *schema.Resource, etag string) error {
+	return tx.UpdateIfMatchContext(context.Background(), resource, etag)
+}
+
+//UpdateIfMatchContext updates resource in the db if the stored one still has the given ETag
+func (tx *Transaction) UpdateIfMatchContext(ctx context.Context, resource *schema.Resource, etag string) error {
+	return transaction.UpdateIfMatch(ctx, tx, resource, etag)
 }
 
 func (tx *Transaction) StateUpdate(resource *schema.Resource, state *transaction.ResourceState) error {
@@ -708,6 +1059,11 @@ func (tx *Transaction) StateUpdate(resource *schema.Resource, state *transaction
 func (tx *Transaction) StateUpdateContext(ctx context.Context, resource *schema.Resource, state *transaction.ResourceState) error {
 	defer tx.measureTime(time.Now(), resource.Schema().ID, "state_update")
 
+	if resource.Schema().Recoverable() {
+		if err := tx.checkNotDeleted(ctx, resource.Schema(), resource.ID()); err != nil {
+			return err
+		}
+	}
 	q, err := tx.updateQuery(resource)
 	if err != nil {
 		return err
@@ -734,13 +1090,148 @@ func (tx *Transaction) Delete(s *schema.Schema, resourceID interface{}) error {
 func (tx *Transaction) DeleteContext(ctx context.Context, s *schema.Schema, resourceID interface{}) error {
 	defer tx.measureTime(time.Now(), s.ID, "delete")
 
-	sql, args, err := sq.Delete(quote(s.GetDbTableName())).Where(sq.Eq{"id": resourceID}).ToSql()
+	var version int64
+	if s.History() {
+		var err error
+		if version, err = tx.bumpConfigVersion(ctx, s, resourceID); err != nil {
+			return err
+		}
+	}
+	if s.Recoverable() {
+		if err := tx.softDelete(ctx, s, resourceID); err != nil {
+			return err
+		}
+	} else {
+		sql, args, err := sq.Delete(quote(s.GetDbTableName())).Where(sq.Eq{"id": resourceID}).ToSql()
+		if err != nil {
+			return err
+		}
+		if err := tx.exec(ctx, sql, args...); err != nil {
+			return err
+		}
+	}
+	if s.History() {
+		return tx.insertVersion(ctx, s, resourceID, version, nil)
+	}
+	return nil
+}
+
+// softDelete replaces the resource with a tombstone
+func (tx *Transaction) softDelete(ctx context.Context, s *schema.Schema, resourceID interface{}) error {
+	return tx.tombstoneTree(ctx, s, sq.Eq{"id": resourceID}, time.Now().Unix(), transaction.DeletedByFromContext(ctx))
+}
+
+// childSchemas returns schemas of resources having a resource of s as their parent
+func childSchemas(s *schema.Schema) []*schema.Schema {
+	children := []*schema.Schema{}
+	for _, child := range schema.GetManager().OrderedSchemas() {
+		if child.Parent == s.ID && !child.IsAbstract() {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// childrenOf matches children of resources of s matching where
+func childrenOf(s, child *schema.Schema, where sq.Sqlizer) (sq.Sqlizer, error) {
+	parents, args, err := sq.Select("id").From(quote(s.GetDbTableName())).Where(where).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	return sq.Expr(quote(child.ParentSchemaPropertyID())+" IN ("+parents+")", args...), nil
+}
+
+// tombstoneTree replaces resources matching where with tombstones, together with their children,
+// which are deleted the way a foreign key would delete them
+func (tx *Transaction) tombstoneTree(ctx context.Context, s *schema.Schema, where sq.Sqlizer, deletedAt int64, deletedBy string) error {
+	for _, child := range childSchemas(s) {
+		children, err := childrenOf(s, child, where)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !child.OnParentDeleteCascade:
+			count := sq.Select("Count(id) as count").From(quote(child.GetDbTableName())).Where(children)
+			sql, args, err := hideDeleted(child, count, false).ToSql()
+			if err != nil {
+				return err
+			}
+			var referenced int
+			if err := tx.queryRowx(ctx, sql, args...).Scan(&referenced); err != nil {
+				return err
+			}
+			if referenced > 0 {
+				return fmt.Errorf("Resource is still referenced by %s", child.ID)
+			}
+		case child.Recoverable():
+			if err := tx.tombstoneTree(ctx, child, children, deletedAt, deletedBy); err != nil {
+				return err
+			}
+		default:
+			sql, args, err := sq.Delete(quote(child.GetDbTableName())).Where(children).ToSql()
+			if err != nil {
+				return err
+			}
+			if err := tx.exec(ctx, sql, args...); err != nil {
+				return err
+			}
+		}
+	}
+	sql, args, err := sq.Update(quote(s.GetDbTableName())).
+		Set(quote(deletedAtColumnName), deletedAt).
+		Set(quote(deletedByColumnName), deletedBy).
+		Where(where).
+		Where(sq.Eq{quote(deletedAtColumnName): nil}).
+		ToSql()
 	if err != nil {
 		return err
 	}
 	return tx.exec(ctx, sql, args...)
 }
 
+// RestoreDeletedContext restores a resource of a recoverable schema soft deleted at the given time,
+// together with its children deleted with it
+func RestoreDeletedContext(ctx context.Context, tx transaction.Transaction, s *schema.Schema, resourceID, deletedAt interface{}) error {
+	return restoreTree(ctx, tx, s, sq.Eq{"id": resourceID}, deletedAt)
+}
+
+func restoreTree(ctx context.Context, tx transaction.Transaction, s *schema.Schema, where sq.Sqlizer, deletedAt interface{}) error {
+	deleted := sq.And{where, sq.Eq{quote(deletedAtColumnName): deletedAt}}
+	// children are restored first, as they are matched by tombstones of their parents
+	for _, child := range childSchemas(s) {
+		if !child.Recoverable() || !child.OnParentDeleteCascade {
+			continue
+		}
+		children, err := childrenOf(s, child, deleted)
+		if err != nil {
+			return err
+		}
+		if err := restoreTree(ctx, tx, child, children, deletedAt); err != nil {
+			return err
+		}
+	}
+	sql, args, err := sq.Update(quote(s.GetDbTableName())).
+		Set(quote(deletedAtColumnName), nil).
+		Set(quote(deletedByColumnName), nil).
+		Where(deleted).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	return tx.ExecContext(ctx, sql, args...)
+}
+
+// PurgeDeletedContext physically deletes resources of a recoverable schema soft deleted before the given time
+func PurgeDeletedContext(ctx context.Context, tx transaction.Transaction, s *schema.Schema, before time.Time) error {
+	sql, args, err := sq.Delete(quote(s.GetDbTableName())).
+		Where(sq.Lt{quote(deletedAtColumnName): before.Unix()}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	return tx.ExecContext(ctx, sql, args...)
+}
+
 func (db *DB) handler(property *schema.Property) propertyHandler {
 	handler, ok := db.handlers[property.Type]
 	if ok {
@@ -803,6 +1294,22 @@ func makeStateColumns(s *schema.Schema) (cols []string) {
 	return cols
 }
 
+func makeTombstoneColumns(s *schema.Schema) []string {
+	dbTableName := s.GetDbTableName()
+	return []string{
+		dbTableName + "." + quote(deletedAtColumnName) + " as " + quote(deletedAtColumnName),
+		dbTableName + "." + quote(deletedByColumnName) + " as " + quote(deletedByColumnName),
+	}
+}
+
+// hideDeleted skips soft deleted resources of recoverable schemas
+func hideDeleted(s *schema.Schema, q sq.SelectBuilder, showDeleted bool) sq.SelectBuilder {
+	if !s.Recoverable() || showDeleted {
+		return q
+	}
+	return q.Where(sq.Eq{s.GetDbTableName() + "." + quote(deletedAtColumnName): nil})
+}
+
 func makeJoin(s *schema.Schema, tableName string, q sq.SelectBuilder) sq.SelectBuilder {
 	manager := schema.GetManager()
 	for _, property := range s.Properties {
@@ -829,24 +1336,52 @@ func decodeState(data map[string]interface{}, state *transaction.ResourceState)
 	if !ok {
 		return fmt.Errorf("Wrong state column %s returned from query", stateVersionColumnName)
 	}
-	stateError, ok := data[stateErrorColumnName].([]byte)
+	state.Error, ok = decodeText(data[stateErrorColumnName])
 	if !ok {
 		return fmt.Errorf("Wrong state column %s returned from query", stateErrorColumnName)
 	}
-	state.Error = string(stateError)
-	stateState, ok := data[stateColumnName].([]byte)
+	state.State, ok = decodeText(data[stateColumnName])
 	if !ok {
 		return fmt.Errorf("Wrong state column %s returned from query", stateColumnName)
 	}
-	state.State = string(stateState)
-	stateMonitoring, ok := data[stateMonitoringColumnName].([]byte)
+	state.Monitoring, ok = decodeText(data[stateMonitoringColumnName])
 	if !ok {
 		return fmt.Errorf("Wrong state column %s returned from query", stateMonitoringColumnName)
 	}
-	state.Monitoring = string(stateMonitoring)
 	return nil
 }
 
+// decodeTombstone copies the tombstone of a soft deleted resource, if it was selected
+func decodeTombstone(data, resourceData map[string]interface{}) {
+	deletedAt, ok := data[deletedAtColumnName]
+	if !ok {
+		return
+	}
+	if deletedAt != nil {
+		decoded, err := (&integerHandler{}).decode(nil, deletedAt)
+		if err == nil {
+			deletedAt = decoded
+		}
+	}
+	resourceData[transaction.DeletedAtKey] = deletedAt
+	resourceData[transaction.DeletedByKey] = nil
+	if deletedBy, ok := decodeText(data[deletedByColumnName]); ok && deletedAt != nil {
+		resourceData[transaction.DeletedByKey] = deletedBy
+	}
+}
+
+// decodeText decodes text column, which is returned as []byte by mysql
+// and sqlite3, and as string by postgres
+func decodeText(data interface{}) (string, bool) {
+	switch t := data.(type) {
+	case []byte:
+		return string(t), true
+	case string:
+		return t, true
+	}
+	return "", false
+}
+
 //normFields runs normFields on all the fields.
 func normFields(fields []string, s *schema.Schema) []string {
 	if fields != nil {
@@ -866,27 +1401,46 @@ func normField(field, schemaID string) string {
 }
 
 type selectContext struct {
+	dialect   Dialect
 	schema    *schema.Schema
 	filter    transaction.Filter
 	fields    []string
 	join      bool
 	paginator *pagination.Paginator
+	// showDeleted includes soft deleted resources of recoverable schemas
+	showDeleted bool
 }
 
 func buildSelect(sc *selectContext) (string, []interface{}, error) {
 	t := sc.schema.GetDbTableName()
 
 	cols := MakeColumns(sc.schema, t, sc.fields, sc.join)
+	if sc.schema.Recoverable() && sc.showDeleted {
+		cols = append(cols, makeTombstoneColumns(sc.schema)...)
+	}
 	q := sq.Select(cols...).From(quote(t))
-	q, err := AddFilterToQuery(sc.schema, q, sc.filter, sc.join)
+	q, err := addFilterToQuery(sc.dialect, sc.schema, q, sc.filter, sc.join)
 	if err != nil {
 		return "", nil, err
 	}
+	q = hideDeleted(sc.schema, q, sc.showDeleted)
 	if sc.paginator != nil {
-		if sc.paginator.Key != "" {
-			property, err := sc.schema.GetPropertyByID(sc.paginator.Key)
+		if sc.paginator.Marker != "" {
+			q, err = addMarkerToQuery(sc.dialect, sc.schema, q, sc.paginator)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		// resources following a marker have to be ordered like the previous page,
+		// which is by id when no sort key is given
+		if sc.paginator.Key != "" || sc.paginator.Marker != "" {
+			property, err := sc.schema.GetPropertyByID(sc.paginator.SortKey())
 			if err == nil {
 				q = q.OrderBy(makeColumn(t, *property) + " " + sc.paginator.Order)
+				if property.ID != "id" {
+					// id makes the order stable, which is required by markers
+					q = q.OrderBy(t + "." + quote("id") + " " + sc.paginator.Order)
+				}
 			}
 		}
 
@@ -903,9 +1457,51 @@ func buildSelect(sc *selectContext) (string, []interface{}, error) {
 	return q.ToSql()
 }
 
+// addMarkerToQuery selects resources following the marker in the paginator order.
+// NULL sort key values are compared explicitly, as they are placed at one end
+// of the order depending on the dialect and no comparison with them is true.
+func addMarkerToQuery(dialect Dialect, s *schema.Schema, q sq.SelectBuilder, pg *pagination.Paginator) (sq.SelectBuilder, error) {
+	value, id, err := pagination.DecodeMarker(pg.Marker)
+	if err != nil {
+		return q, err
+	}
+	property, err := s.GetPropertyByID(pg.SortKey())
+	if err != nil {
+		return q, err
+	}
+	t := s.GetDbTableName()
+	column := makeColumn(t, *property)
+	idColumn := t + "." + quote("id")
+	after := func(column string, value interface{}) sq.Sqlizer {
+		if pg.IsDescending() {
+			return sq.Lt{column: value}
+		}
+		return sq.Gt{column: value}
+	}
+	if property.ID == "id" {
+		return q.Where(after(idColumn, id)), nil
+	}
+	nullsBefore := dialect.NullsFirst() != pg.IsDescending()
+	if value == nil {
+		sameValue := sq.And{sq.Eq{column: nil}, after(idColumn, id)}
+		if nullsBefore {
+			return q.Where(sq.Or{sameValue, sq.NotEq{column: nil}}), nil
+		}
+		return q.Where(sameValue), nil
+	}
+	following := sq.Or{
+		after(column, value),
+		sq.And{sq.Eq{column: value}, after(idColumn, id)},
+	}
+	if !nullsBefore {
+		following = append(following, sq.Eq{column: nil})
+	}
+	return q.Where(following), nil
+}
+
 func (tx *Transaction) executeSelect(ctx context.Context, sc *selectContext, sql string, args []interface{}) (list []*schema.Resource, total uint64, err error) {
 	tx.logQuery(sql, args...)
-	rows, err := tx.transaction.QueryxContext(ctx, sql, args...)
+	rows, err := tx.queryx(ctx, sql, args...)
 	if err != nil {
 		return
 	}
@@ -915,7 +1511,7 @@ func (tx *Transaction) executeSelect(ctx context.Context, sc *selectContext, sql
 	if err != nil {
 		return nil, 0, err
 	}
-	total, err = tx.CountContext(ctx, sc.schema, sc.filter)
+	total, err = tx.count(ctx, sc.schema, sc.filter, sc.showDeleted)
 	return
 }
 
@@ -928,6 +1524,7 @@ func (tx *Transaction) ListContext(ctx context.Context, s *schema.Schema, filter
 	defer tx.measureTime(time.Now(), s.ID, "list")
 
 	sc := listContextHelper(s, filter, options, pg)
+	sc.dialect = tx.db.Dialect()
 
 	sql, args, err := buildSelect(sc)
 	if err != nil {
@@ -947,6 +1544,7 @@ func listContextHelper(s *schema.Schema, filter transaction.Filter, options *tra
 	if options != nil {
 		sc.fields = normFields(options.Fields, s)
 		sc.join = options.Details
+		sc.showDeleted = options.ShowDeleted
 	}
 	return sc
 }
@@ -970,17 +1568,19 @@ func (tx *Transaction) LockList(s *schema.Schema, filter transaction.Filter, opt
 // LockList locks resources in the db
 func (tx *Transaction) LockListContext(ctx context.Context, s *schema.Schema, filter transaction.Filter, options *transaction.ViewOptions, pg *pagination.Paginator, lockPolicy schema.LockPolicy) (list []*schema.Resource, total uint64, err error) {
 	defer tx.measureTime(time.Now(), s.ID, "lock_list")
+	if err := tx.toPrimary(); err != nil {
+		return nil, 0, err
+	}
 
 	sc := lockListContextHelper(s, filter, options, pg, lockPolicy)
+	sc.dialect = tx.db.Dialect()
 
 	sql, args, err := buildSelect(sc)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	if tx.db.sqlType == "mysql" {
-		sql += " FOR UPDATE"
-	}
+	sql += tx.db.Dialect().LockClause(s.GetDbTableName())
 
 	// update join for recursive
 	if options != nil {
@@ -1003,6 +1603,7 @@ func lockListContextHelper(s *schema.Schema, filter transaction.Filter, options
 	if options != nil {
 		sc.fields = normFields(options.Fields, s)
 		sc.join = policyJoin && options.Details
+		sc.showDeleted = options.ShowDeleted
 	}
 	return sc
 }
@@ -1016,7 +1617,7 @@ func (tx *Transaction) QueryContext(ctx context.Context, s *schema.Schema, query
 	defer tx.measureTime(time.Now(), s.ID, "query")
 
 	tx.logQuery(query, arguments...)
-	rows, err := tx.transaction.QueryxContext(ctx, query, arguments...)
+	rows, err := tx.queryx(ctx, query, arguments...)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to run query: %s", query)
 	}
@@ -1037,6 +1638,7 @@ func (tx *Transaction) decodeRows(s *schema.Schema, rows *sqlx.Rows, list []*sch
 
 		var resource *schema.Resource
 		resourceData := tx.decode(s, s.GetDbTableName(), skipNil, recursive, data)
+		decodeTombstone(data, resourceData)
 		resource, err := schema.NewResource(s, resourceData)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to decode rows")
@@ -1077,17 +1679,24 @@ func (tx *Transaction) decode(s *schema.Schema, tableName string, skipNil, recur
 
 //CountContext count all matching resources in the db
 func (tx *Transaction) CountContext(ctx context.Context, s *schema.Schema, filter transaction.Filter) (res uint64, err error) {
+	return tx.count(ctx, s, filter, false)
+}
+
+func (tx *Transaction) count(ctx context.Context, s *schema.Schema, filter transaction.Filter, showDeleted bool) (res uint64, err error) {
 	defer tx.measureTime(time.Now(), s.ID, "count")
 
 	q := sq.Select("Count(id) as count").From(quote(s.GetDbTableName()))
-	//Filter get already tested
-	q, _ = AddFilterToQuery(s, q, filter, false)
+	q, err = addFilterToQuery(tx.db.Dialect(), s, q, filter, false)
+	if err != nil {
+		return
+	}
+	q = hideDeleted(s, q, showDeleted)
 	sql, args, err := q.ToSql()
 	if err != nil {
 		return
 	}
 	result := map[string]interface{}{}
-	err = tx.transaction.QueryRowxContext(ctx, sql, args...).MapScan(result)
+	err = tx.queryRowx(ctx, sql, args...).MapScan(result)
 	if err != nil {
 		return
 	}
@@ -1160,13 +1769,17 @@ func (tx *Transaction) StateFetchContext(ctx context.Context, s *schema.Schema,
 	}
 	cols := makeStateColumns(s)
 	q := sq.Select(cols...).From(quote(s.GetDbTableName()))
-	q, _ = AddFilterToQuery(s, q, filter, true)
+	q, err = addFilterToQuery(tx.db.Dialect(), s, q, filter, true)
+	if err != nil {
+		return
+	}
+	q = hideDeleted(s, q, false)
 	sql, args, err := q.ToSql()
 	if err != nil {
 		return
 	}
 	tx.logQuery(sql, args...)
-	rows, err := tx.transaction.QueryxContext(ctx, sql, args...)
+	rows, err := tx.queryx(ctx, sql, args...)
 	if err != nil {
 		return
 	}
@@ -1234,24 +1847,30 @@ func (tx *Transaction) GetIsolationLevel() transaction.Type {
 }
 
 const (
-	OrCondition  = "__or__"
-	AndCondition = "__and__"
+	OrCondition  = transaction.OrCondition
+	AndCondition = transaction.AndCondition
 )
 
+// AddFilterToQuery adds filter to the query using the canonical (MySQL) dialect
 func AddFilterToQuery(s *schema.Schema, q sq.SelectBuilder, filter map[string]interface{}, join bool) (sq.SelectBuilder, error) {
+	return addFilterToQuery(DialectFor("mysql"), s, q, filter, join)
+}
+
+func addFilterToQuery(dialect Dialect, s *schema.Schema, q sq.SelectBuilder, filter map[string]interface{}, join bool) (sq.SelectBuilder, error) {
 	if filter == nil {
 		return q, nil
 	}
+	fb := &filterBuilder{dialect: dialect, schema: s, join: join}
 	for key, value := range filter {
 		if key == OrCondition {
-			orFilter, err := addOrToQuery(s, q, value, join)
+			orFilter, err := fb.addOr(value)
 			if err != nil {
 				return q, err
 			}
 			q = q.Where(orFilter)
 			continue
 		} else if key == AndCondition {
-			andFilter, err := addAndToQuery(s, q, value, join)
+			andFilter, err := fb.addAnd(value)
 			if err != nil {
 				return q, err
 			}
@@ -1264,12 +1883,7 @@ func AddFilterToQuery(s *schema.Schema, q sq.SelectBuilder, filter map[string]in
 			return q, err
 		}
 
-		var column string
-		if join {
-			column = makeColumn(s.GetDbTableName(), *property)
-		} else {
-			column = quote(key)
-		}
+		column := fb.column(property)
 
 		queryValues, ok := value.([]string)
 		if ok && property.Type == "boolean" {
@@ -1285,56 +1899,126 @@ func AddFilterToQuery(s *schema.Schema, q sq.SelectBuilder, filter map[string]in
 	return q, nil
 }
 
-func addOrToQuery(s *schema.Schema, q sq.SelectBuilder, filter interface{}, join bool) (sq.Or, error) {
-	return addToFilter(s, q, filter, join, sq.Or{})
+type filterBuilder struct {
+	dialect Dialect
+	schema  *schema.Schema
+	join    bool
+}
+
+func (fb *filterBuilder) column(property *schema.Property) string {
+	if fb.join {
+		return makeColumn(fb.schema.GetDbTableName(), *property)
+	}
+	return quote(property.ID)
+}
+
+func (fb *filterBuilder) addOr(filter interface{}) (sq.Or, error) {
+	return fb.add(filter, sq.Or{})
 }
 
-func addAndToQuery(s *schema.Schema, q sq.SelectBuilder, filter interface{}, join bool) (sq.And, error) {
-	return addToFilter(s, q, filter, join, sq.And{})
+func (fb *filterBuilder) addAnd(filter interface{}) (sq.And, error) {
+	return fb.add(filter, sq.And{})
 }
 
-func addToFilter(s *schema.Schema, q sq.SelectBuilder, filter interface{}, join bool, sqlizer []sq.Sqlizer) ([]sq.Sqlizer, error) {
-	filters := filter.([]map[string]interface{})
+func (fb *filterBuilder) add(filter interface{}, sqlizer []sq.Sqlizer) ([]sq.Sqlizer, error) {
+	filters, ok := filter.([]map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid filter condition: %v", filter)
+	}
 	for _, filter := range filters {
 		if match, ok := filter[OrCondition]; ok {
-			res, err := addOrToQuery(s, q, match, join)
+			res, err := fb.addOr(match)
 			if err != nil {
 				return nil, err
 			}
 			sqlizer = append(sqlizer, res)
 		} else if match, ok := filter[AndCondition]; ok {
-			res, err := addAndToQuery(s, q, match, join)
+			res, err := fb.addAnd(match)
 			if err != nil {
 				return nil, err
 			}
 			sqlizer = append(sqlizer, res)
 		} else {
-			key := filter["property"].(string)
-			property, err := s.GetPropertyByID(key)
+			res, err := fb.predicate(filter)
 			if err != nil {
 				return nil, err
 			}
+			sqlizer = append(sqlizer, res)
+		}
+	}
+	return sqlizer, nil
+}
 
-			var column string
-			if join {
-				column = makeColumn(s.GetDbTableName(), *property)
-			} else {
-				column = quote(key)
-			}
+func (fb *filterBuilder) predicate(filter map[string]interface{}) (sq.Sqlizer, error) {
+	key, _ := filter["property"].(string)
+	property, err := fb.schema.GetPropertyByID(key)
+	if err != nil {
+		return nil, err
+	}
+	operator, _ := filter["type"].(string)
+	if err := transaction.CheckOperator(operator); err != nil {
+		return nil, err
+	}
+	value := filter["value"]
 
-			// TODO: add other operators
-			value := filter["value"]
-			switch filter["type"] {
-			case "eq":
-				sqlizer = append(sqlizer, sq.Eq{column: value})
-			case "neq":
-				sqlizer = append(sqlizer, sq.NotEq{column: value})
-			default:
-				panic("type has to be one of [eq, neq]")
-			}
+	column := fb.column(property)
+	if path, ok := filter["path"].(string); ok && path != "" {
+		if property.Type != "object" {
+			return nil, fmt.Errorf("JSON path can't be used with %s property of type %s", property.ID, property.Type)
+		}
+		segments, err := transaction.SplitPath(path)
+		if err != nil {
+			return nil, err
+		}
+		column = fb.dialect.JSONExtract(column, segments, value)
+	}
+
+	switch operator {
+	case transaction.Equal:
+		return sq.Eq{column: value}, nil
+	case transaction.NotEqual:
+		return sq.NotEq{column: value}, nil
+	case transaction.LessThan:
+		return sq.Lt{column: value}, nil
+	case transaction.LessOrEqual:
+		return sq.LtOrEq{column: value}, nil
+	case transaction.GreaterThan:
+		return sq.Gt{column: value}, nil
+	case transaction.GreaterOrEqual:
+		return sq.GtOrEq{column: value}, nil
+	case transaction.In:
+		return sq.Eq{column: toSlice(value)}, nil
+	case transaction.NotIn:
+		return sq.NotEq{column: toSlice(value)}, nil
+	case transaction.Like:
+		return sq.Expr(column+" LIKE ?", value), nil
+	case transaction.ILike:
+		return sq.Expr("LOWER("+column+") LIKE LOWER(?)", value), nil
+	case transaction.Prefix:
+		return sq.Expr(column+" LIKE ? ESCAPE '!'", likePrefix.Replace(fmt.Sprint(value))+"%"), nil
+	case transaction.IsNull:
+		isNull, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Value of %s filter on %s has to be a boolean", operator, property.ID)
+		}
+		if isNull {
+			return sq.Eq{column: nil}, nil
 		}
+		return sq.NotEq{column: nil}, nil
 	}
-	return sqlizer, nil
+	return nil, fmt.Errorf("Unsupported filter operator %q", operator)
+}
+
+// likePrefix escapes LIKE wildcards, '!' is used as escape character
+// because backslash is handled differently by each database
+var likePrefix = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func toSlice(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		return value
+	}
+	return []interface{}{value}
 }
 
 //SetMaxOpenConns limit maximum connections
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transaction
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/cloudwan/gohan/schema"
+)
+
+// ErrPreconditionFailed is returned when a resource was modified since its ETag was read
+var ErrPreconditionFailed = errors.New("resource was modified")
+
+// ETag returns a strong entity tag of resource data.
+// Only properties of the schema are hashed, so related resources joined
+// through relation properties don't change the tag, which is the same
+// no matter how the resource was fetched. Properties without a value are
+// skipped, so missing properties may be stored as null or not at all.
+func ETag(s *schema.Schema, data map[string]interface{}) string {
+	values := make(map[string]interface{}, len(s.Properties))
+	for _, property := range s.Properties {
+		if value := data[property.ID]; value != nil {
+			values[property.ID] = value
+		}
+	}
+	// encoding/json sorts map keys, which makes the output stable
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(encoded)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// MatchETag checks if etag is listed in the If-Match or If-None-Match header value
+func MatchETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || (candidate != "" && candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// LockUpdater is the part of a transaction needed by UpdateIfMatch
+type LockUpdater interface {
+	LockFetchContext(context.Context, *schema.Schema, Filter, schema.LockPolicy, *ViewOptions) (*schema.Resource, error)
+	UpdateContext(context.Context, *schema.Resource) error
+}
+
+// UpdateIfMatch updates resource only if the stored one still has the given ETag,
+// otherwise ErrPreconditionFailed is returned. The stored resource is locked
+// until the end of the transaction. Transactions implement their UpdateIfMatch with it.
+func UpdateIfMatch(ctx context.Context, tx LockUpdater, resource *schema.Resource, etag string) error {
+	current, err := tx.LockFetchContext(ctx, resource.Schema(), IDFilter(resource.ID()), schema.SkipRelatedResources, nil)
+	if err != nil {
+		return err
+	}
+	if !MatchETag(etag, ETag(resource.Schema(), current.Data())) {
+		return ErrPreconditionFailed
+	}
+	return tx.UpdateContext(ctx, resource)
+}
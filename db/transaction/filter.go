@@ -0,0 +1,76 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transaction
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Keys of filter holding a list of conditions joined with OR/AND
+const (
+	OrCondition  = "__or__"
+	AndCondition = "__and__"
+)
+
+// Filter operators supported by every backend.
+// Operator is stored under "type" key of a filter predicate, i.e.
+// {"property": "size", "type": "gte", "value": 10}
+const (
+	Equal          = "eq"
+	NotEqual       = "neq"
+	LessThan       = "lt"
+	LessOrEqual    = "lte"
+	GreaterThan    = "gt"
+	GreaterOrEqual = "gte"
+	In             = "in"
+	NotIn          = "not_in"
+	Like           = "like"
+	ILike          = "ilike"
+	Prefix         = "prefix"
+	IsNull         = "is_null"
+)
+
+// Operators lists all supported filter operators
+var Operators = []string{
+	Equal, NotEqual, LessThan, LessOrEqual, GreaterThan, GreaterOrEqual,
+	In, NotIn, Like, ILike, Prefix, IsNull,
+}
+
+var pathSegment = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// CheckOperator returns error if operator is not supported
+func CheckOperator(operator string) error {
+	for _, supported := range Operators {
+		if operator == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown filter operator %q, has to be one of [%s]", operator, strings.Join(Operators, ", "))
+}
+
+// SplitPath splits a dot separated JSON path, i.e. "spec.size",
+// into its segments. Only alphanumeric segments are accepted.
+func SplitPath(path string) ([]string, error) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments {
+		if !pathSegment.MatchString(segment) {
+			return nil, fmt.Errorf("Invalid JSON path %q", path)
+		}
+	}
+	return segments, nil
+}
@@ -174,6 +174,32 @@ func (ft *FuzzyTransaction) StateFetchContext(_ context.Context, s *schema.Schem
 	return ft.StateFetch(s, filter)
 }
 
+func (ft *FuzzyTransaction) FetchVersion(s *schema.Schema, resourceID interface{}, version int64) (*ResourceVersion, error) {
+	var outVersion *ResourceVersion
+	return outVersion, ft.fuzzIt(func() error {
+		var err error
+		outVersion, err = ft.Tx.FetchVersion(s, resourceID, version)
+		return err
+	})
+}
+
+func (ft *FuzzyTransaction) ListVersions(s *schema.Schema, resourceID interface{}) ([]*ResourceVersion, error) {
+	var outVersions []*ResourceVersion
+	return outVersions, ft.fuzzIt(func() error {
+		var err error
+		outVersions, err = ft.Tx.ListVersions(s, resourceID)
+		return err
+	})
+}
+
+func (ft *FuzzyTransaction) FetchVersionContext(_ context.Context, s *schema.Schema, resourceID interface{}, version int64) (*ResourceVersion, error) {
+	return ft.FetchVersion(s, resourceID, version)
+}
+
+func (ft *FuzzyTransaction) ListVersionsContext(_ context.Context, s *schema.Schema, resourceID interface{}) ([]*ResourceVersion, error) {
+	return ft.ListVersions(s, resourceID)
+}
+
 func (ft *FuzzyTransaction) QueryContext(_ context.Context, s *schema.Schema, query string, arguments []interface{}) (list []*schema.Resource, err error) {
 	return ft.Query(s, query, arguments)
 }
@@ -198,6 +224,14 @@ func (ft *FuzzyTransaction) UpdateContext(_ context.Context, resource *schema.Re
 	return ft.Update(resource)
 }
 
+func (ft *FuzzyTransaction) UpdateIfMatch(resource *schema.Resource, etag string) error {
+	return ft.UpdateIfMatchContext(context.Background(), resource, etag)
+}
+
+func (ft *FuzzyTransaction) UpdateIfMatchContext(ctx context.Context, resource *schema.Resource, etag string) error {
+	return UpdateIfMatch(ctx, ft, resource, etag)
+}
+
 func (ft *FuzzyTransaction) CreateContext(_ context.Context, resource *schema.Resource) error {
 	return ft.Create(resource)
 }
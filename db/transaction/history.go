@@ -0,0 +1,61 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transaction
+
+import (
+	"time"
+
+	"github.com/cloudwan/gohan/schema"
+)
+
+// ResourceVersion is a revision of a resource kept in the history of a schema with history enabled
+type ResourceVersion struct {
+	// Version counts changes of the resource starting from 1
+	Version int64
+	// Timestamp is the unix time of the change
+	Timestamp int64
+	// Deleted is set for the revision recording deletion of the resource
+	Deleted bool
+	// Resource is nil for deleted revisions
+	Resource *schema.Resource
+}
+
+// Data returns the revision as a map
+func (v *ResourceVersion) Data() map[string]interface{} {
+	var data map[string]interface{}
+	if v.Resource != nil {
+		data = v.Resource.Data()
+	}
+	return map[string]interface{}{
+		"version":   v.Version,
+		"timestamp": v.Timestamp,
+		"deleted":   v.Deleted,
+		"resource":  data,
+	}
+}
+
+// VersionAt returns the revision which was current at the given time,
+// nil if the resource didn't exist yet. Versions have to be ordered by version.
+func VersionAt(versions []*ResourceVersion, at time.Time) *ResourceVersion {
+	var current *ResourceVersion
+	for _, version := range versions {
+		if version.Timestamp > at.Unix() {
+			break
+		}
+		current = version
+	}
+	return current
+}
@@ -267,6 +267,30 @@ func (mr *MockTransactionMockRecorder) UpdateContext(arg0, arg1 interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateContext", reflect.TypeOf((*MockTransaction)(nil).UpdateContext), arg0, arg1)
 }
 
+// UpdateIfMatch mocks base method
+func (m *MockTransaction) UpdateIfMatch(arg0 *schema.Resource, arg1 string) error {
+	ret := m.ctrl.Call(m, "UpdateIfMatch", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateIfMatch indicates an expected call of UpdateIfMatch
+func (mr *MockTransactionMockRecorder) UpdateIfMatch(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateIfMatch", reflect.TypeOf((*MockTransaction)(nil).UpdateIfMatch), arg0, arg1)
+}
+
+// UpdateIfMatchContext mocks base method
+func (m *MockTransaction) UpdateIfMatchContext(arg0 context.Context, arg1 *schema.Resource, arg2 string) error {
+	ret := m.ctrl.Call(m, "UpdateIfMatchContext", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateIfMatchContext indicates an expected call of UpdateIfMatchContext
+func (mr *MockTransactionMockRecorder) UpdateIfMatchContext(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateIfMatchContext", reflect.TypeOf((*MockTransaction)(nil).UpdateIfMatchContext), arg0, arg1, arg2)
+}
+
 // StateUpdateContext mocks base method
 func (m *MockTransaction) StateUpdateContext(arg0 context.Context, arg1 *schema.Resource, arg2 *transaction.ResourceState) error {
 	ret := m.ctrl.Call(m, "StateUpdateContext", arg0, arg1, arg2)
@@ -384,6 +408,58 @@ func (mr *MockTransactionMockRecorder) QueryContext(arg0, arg1, arg2, arg3 inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueryContext", reflect.TypeOf((*MockTransaction)(nil).QueryContext), arg0, arg1, arg2, arg3)
 }
 
+// FetchVersion mocks base method
+func (m *MockTransaction) FetchVersion(arg0 *schema.Schema, arg1 interface{}, arg2 int64) (*transaction.ResourceVersion, error) {
+	ret := m.ctrl.Call(m, "FetchVersion", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*transaction.ResourceVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchVersion indicates an expected call of FetchVersion
+func (mr *MockTransactionMockRecorder) FetchVersion(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchVersion", reflect.TypeOf((*MockTransaction)(nil).FetchVersion), arg0, arg1, arg2)
+}
+
+// ListVersions mocks base method
+func (m *MockTransaction) ListVersions(arg0 *schema.Schema, arg1 interface{}) ([]*transaction.ResourceVersion, error) {
+	ret := m.ctrl.Call(m, "ListVersions", arg0, arg1)
+	ret0, _ := ret[0].([]*transaction.ResourceVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListVersions indicates an expected call of ListVersions
+func (mr *MockTransactionMockRecorder) ListVersions(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListVersions", reflect.TypeOf((*MockTransaction)(nil).ListVersions), arg0, arg1)
+}
+
+// FetchVersionContext mocks base method
+func (m *MockTransaction) FetchVersionContext(arg0 context.Context, arg1 *schema.Schema, arg2 interface{}, arg3 int64) (*transaction.ResourceVersion, error) {
+	ret := m.ctrl.Call(m, "FetchVersionContext", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(*transaction.ResourceVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchVersionContext indicates an expected call of FetchVersionContext
+func (mr *MockTransactionMockRecorder) FetchVersionContext(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchVersionContext", reflect.TypeOf((*MockTransaction)(nil).FetchVersionContext), arg0, arg1, arg2, arg3)
+}
+
+// ListVersionsContext mocks base method
+func (m *MockTransaction) ListVersionsContext(arg0 context.Context, arg1 *schema.Schema, arg2 interface{}) ([]*transaction.ResourceVersion, error) {
+	ret := m.ctrl.Call(m, "ListVersionsContext", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]*transaction.ResourceVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListVersionsContext indicates an expected call of ListVersionsContext
+func (mr *MockTransactionMockRecorder) ListVersionsContext(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListVersionsContext", reflect.TypeOf((*MockTransaction)(nil).ListVersionsContext), arg0, arg1, arg2)
+}
+
 // ExecContext mocks base method
 func (m *MockTransaction) ExecContext(ctx context.Context, query string, args ...interface{}) error {
 	varargs := []interface{}{ctx, query}
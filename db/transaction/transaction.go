@@ -47,6 +47,9 @@ const (
 // TxOptions represents transaction options
 type TxOptions struct {
 	IsolationLevel Type
+	// ReadOnly transactions are routed to a healthy read replica if any is configured,
+	// writes and locking reads fail in them
+	ReadOnly bool
 }
 
 //Filter represents db filter
@@ -68,12 +71,38 @@ type ViewOptions struct {
 	Details bool
 	// Fields limits list output to only showing selected fields.
 	Fields []string
+	// ShowDeleted specifies if soft deleted resources of recoverable
+	// schemas should be returned, together with DeletedAtKey and DeletedByKey.
+	ShowDeleted bool
+}
+
+// Keys of resource data holding the tombstone of a soft deleted resource
+const (
+	DeletedAtKey = "deleted_at"
+	DeletedByKey = "deleted_by"
+)
+
+type deletedByContextKey struct{}
+
+//ContextWithDeletedBy returns context recording who deletes resources of recoverable schemas
+func ContextWithDeletedBy(ctx context.Context, deletedBy string) context.Context {
+	return context.WithValue(ctx, deletedByContextKey{}, deletedBy)
+}
+
+//DeletedByFromContext returns who deletes resources, as set by ContextWithDeletedBy
+func DeletedByFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	deletedBy, _ := ctx.Value(deletedByContextKey{}).(string)
+	return deletedBy
 }
 
 //Transaction is common interface for handling transaction
 type Transaction interface {
 	Create(*schema.Resource) error
 	Update(*schema.Resource) error
+	UpdateIfMatch(*schema.Resource, string) error
 	StateUpdate(*schema.Resource, *ResourceState) error
 	Delete(*schema.Schema, interface{}) error
 	Fetch(*schema.Schema, Filter, *ViewOptions) (*schema.Resource, error)
@@ -83,6 +112,8 @@ type Transaction interface {
 	LockList(*schema.Schema, Filter, *ViewOptions, *pagination.Paginator, schema.LockPolicy) ([]*schema.Resource, uint64, error)
 	RawTransaction() *sqlx.Tx
 	Query(*schema.Schema, string, []interface{}) (list []*schema.Resource, err error)
+	FetchVersion(*schema.Schema, interface{}, int64) (*ResourceVersion, error)
+	ListVersions(*schema.Schema, interface{}) ([]*ResourceVersion, error)
 	Commit() error
 	Exec(query string, args ...interface{}) error
 	Close() error
@@ -91,6 +122,7 @@ type Transaction interface {
 
 	CreateContext(context.Context, *schema.Resource) error
 	UpdateContext(context.Context, *schema.Resource) error
+	UpdateIfMatchContext(context.Context, *schema.Resource, string) error
 	StateUpdateContext(context.Context, *schema.Resource, *ResourceState) error
 	DeleteContext(context.Context, *schema.Schema, interface{}) error
 	FetchContext(context.Context, *schema.Schema, Filter, *ViewOptions) (*schema.Resource, error)
@@ -101,6 +133,8 @@ type Transaction interface {
 	CountContext(context.Context, *schema.Schema, Filter) (uint64, error)
 	QueryContext(context.Context, *schema.Schema, string, []interface{}) (list []*schema.Resource, err error)
 	ExecContext(ctx context.Context, query string, args ...interface{}) error
+	FetchVersionContext(context.Context, *schema.Schema, interface{}, int64) (*ResourceVersion, error)
+	ListVersionsContext(context.Context, *schema.Schema, interface{}) ([]*ResourceVersion, error)
 }
 
 // GetIsolationLevel returns isolation level for an action
@@ -68,7 +68,7 @@ var _ = Describe("Transaction", func() {
 		BeforeEach(func() {
 			mockCtrl = gomock.NewController(GinkgoT())
 			transx = mocks.NewMockTransaction(mockCtrl)
-			cachedTx = &sql.CachedTransaction{transx, nil}
+			cachedTx = &sql.CachedTransaction{TxInterface: transx}
 			cachedTx.ClearCache()
 
 			manager := schema.GetManager()
@@ -195,4 +195,74 @@ var _ = Describe("Transaction", func() {
 			Expect(count).To(Equal(5))
 		})
 	})
+
+	Describe("ETag", func() {
+		BeforeEach(func() {
+			manager := schema.GetManager()
+			Expect(manager.LoadSchemaFromFile("../../tests/test_abstract_schema.yaml")).To(Succeed())
+			Expect(manager.LoadSchemaFromFile("../../tests/test_schema.yaml")).To(Succeed())
+			netSchema, _ = manager.Schema("network")
+		})
+
+		It("Doesn't depend on key order and missing values", func() {
+			etag := tx.ETag(netSchema, map[string]interface{}{"id": "a", "shared": true, "providor_networks": map[string]interface{}{"segmentation_id": 1, "segmentaion_type": "vlan"}})
+			Expect(etag).To(HavePrefix(`"`))
+			Expect(tx.ETag(netSchema, map[string]interface{}{"providor_networks": map[string]interface{}{"segmentaion_type": "vlan", "segmentation_id": 1.0}, "shared": true, "id": "a", "name": nil})).To(Equal(etag))
+			Expect(tx.ETag(netSchema, map[string]interface{}{"id": "a", "shared": false, "providor_networks": map[string]interface{}{"segmentation_id": 1, "segmentaion_type": "vlan"}})).ToNot(Equal(etag))
+		})
+
+		It("Doesn't depend on joined related resources", func() {
+			subnetSchema, _ := schema.GetManager().Schema("subnet")
+			data := map[string]interface{}{"id": "a", "network_id": "net", "cidr": "10.0.0.0/24"}
+			joined := map[string]interface{}{"id": "a", "network_id": "net", "cidr": "10.0.0.0/24", "network": map[string]interface{}{"id": "net"}}
+			Expect(tx.ETag(subnetSchema, joined)).To(Equal(tx.ETag(subnetSchema, data)))
+		})
+
+		It("Matches header values", func() {
+			Expect(tx.MatchETag(`"a"`, `"a"`)).To(BeTrue())
+			Expect(tx.MatchETag(`"b", W/"a"`, `"a"`)).To(BeTrue())
+			Expect(tx.MatchETag(`*`, `"a"`)).To(BeTrue())
+			Expect(tx.MatchETag(`"b"`, `"a"`)).To(BeFalse())
+			Expect(tx.MatchETag(``, `"a"`)).To(BeFalse())
+		})
+	})
+
+	Describe("UpdateIfMatch", func() {
+		var (
+			mockCtrl *gomock.Controller
+			transx   *mocks.MockTransaction
+			stored   *schema.Resource
+			updated  *schema.Resource
+		)
+
+		BeforeEach(func() {
+			mockCtrl = gomock.NewController(GinkgoT())
+			transx = mocks.NewMockTransaction(mockCtrl)
+
+			manager := schema.GetManager()
+			Expect(manager.LoadSchemaFromFile("../../tests/test_abstract_schema.yaml")).To(Succeed())
+			Expect(manager.LoadSchemaFromFile("../../tests/test_schema.yaml")).To(Succeed())
+			netSchema, _ = manager.Schema("network")
+
+			var err error
+			stored, err = schema.NewResource(netSchema, map[string]interface{}{"id": "net", "name": "old"})
+			Expect(err).ToNot(HaveOccurred())
+			updated, err = schema.NewResource(netSchema, map[string]interface{}{"id": "net", "name": "new"})
+			Expect(err).ToNot(HaveOccurred())
+			transx.EXPECT().LockFetchContext(gomock.Any(), netSchema, tx.IDFilter("net"), schema.SkipRelatedResources, gomock.Nil()).Return(stored, nil)
+		})
+
+		AfterEach(func() {
+			mockCtrl.Finish()
+		})
+
+		It("Updates resource with matching ETag", func() {
+			transx.EXPECT().UpdateContext(gomock.Any(), updated).Return(nil)
+			Expect(tx.UpdateIfMatch(context.Background(), transx, updated, tx.ETag(netSchema, stored.Data()))).To(Succeed())
+		})
+
+		It("Doesn't update modified resource", func() {
+			Expect(tx.UpdateIfMatch(context.Background(), transx, updated, tx.ETag(netSchema, updated.Data()))).To(Equal(tx.ErrPreconditionFailed))
+		})
+	})
 })
@@ -23,6 +23,7 @@ import (
 	"github.com/cloudwan/gohan/metrics"
 	"github.com/cloudwan/gohan/schema"
 	"github.com/cloudwan/gohan/singleton"
+	"github.com/cloudwan/gohan/tracing"
 )
 
 //Environment is a interface for extension environment
@@ -115,7 +116,15 @@ func measureExtensionTime(timeStarted time.Time, event string, schemaID string)
 //HandleEvent handles the event in the given environment
 func HandleEvent(context map[string]interface{}, environment Environment, event string, schemaID string) error {
 	defer measureExtensionTime(time.Now(), event, schemaID)
+	span := tracing.StartSpan(tracing.CurrentSpan(context), "extension."+event)
+	span.SetAttribute("schema", schemaID)
+	span.SetAttribute("event", event)
+	defer span.Finish()
+	restore := tracing.SetCurrentSpan(context, span)
+	defer restore()
+
 	if err := environment.HandleEvent(event, context); err != nil {
+		span.SetError(err)
 		return err
 	}
 	exceptionInfoRaw, ok := context["exception"]
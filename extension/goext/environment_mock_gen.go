@@ -595,6 +595,19 @@ func (mr *MockITransactionMockRecorder) Fetch(arg0, arg1, arg2 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fetch", reflect.TypeOf((*MockITransaction)(nil).Fetch), arg0, arg1, arg2)
 }
 
+// FetchVersion mocks base method
+func (m *MockITransaction) FetchVersion(arg0 context.Context, arg1 ISchema, arg2 interface{}, arg3 int64) (*ResourceVersion, error) {
+	ret := m.ctrl.Call(m, "FetchVersion", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(*ResourceVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchVersion indicates an expected call of FetchVersion
+func (mr *MockITransactionMockRecorder) FetchVersion(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchVersion", reflect.TypeOf((*MockITransaction)(nil).FetchVersion), arg0, arg1, arg2, arg3)
+}
+
 // GetIsolationLevel mocks base method
 func (m *MockITransaction) GetIsolationLevel() Type {
 	ret := m.ctrl.Call(m, "GetIsolationLevel")
@@ -621,6 +634,19 @@ func (mr *MockITransactionMockRecorder) List(arg0, arg1, arg2, arg3, arg4 interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockITransaction)(nil).List), arg0, arg1, arg2, arg3, arg4)
 }
 
+// ListVersions mocks base method
+func (m *MockITransaction) ListVersions(arg0 context.Context, arg1 ISchema, arg2 interface{}) ([]*ResourceVersion, error) {
+	ret := m.ctrl.Call(m, "ListVersions", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]*ResourceVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListVersions indicates an expected call of ListVersions
+func (mr *MockITransactionMockRecorder) ListVersions(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListVersions", reflect.TypeOf((*MockITransaction)(nil).ListVersions), arg0, arg1, arg2)
+}
+
 // LockFetch mocks base method
 func (m *MockITransaction) LockFetch(arg0 context.Context, arg1 ISchema, arg2 Filter, arg3 LockPolicy) (map[string]interface{}, error) {
 	ret := m.ctrl.Call(m, "LockFetch", arg0, arg1, arg2, arg3)
@@ -710,6 +736,18 @@ func (mr *MockITransactionMockRecorder) Update(arg0, arg1, arg2 interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockITransaction)(nil).Update), arg0, arg1, arg2)
 }
 
+// UpdateIfMatch mocks base method
+func (m *MockITransaction) UpdateIfMatch(arg0 context.Context, arg1 ISchema, arg2 map[string]interface{}, arg3 string) error {
+	ret := m.ctrl.Call(m, "UpdateIfMatch", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateIfMatch indicates an expected call of UpdateIfMatch
+func (mr *MockITransactionMockRecorder) UpdateIfMatch(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateIfMatch", reflect.TypeOf((*MockITransaction)(nil).UpdateIfMatch), arg0, arg1, arg2, arg3)
+}
+
 // MockIHTTP is a mock of IHTTP interface
 type MockIHTTP struct {
 	ctrl     *gomock.Controller
@@ -876,6 +914,18 @@ func (m *MockIUtil) EXPECT() *MockIUtilMockRecorder {
 	return m.recorder
 }
 
+// ETag mocks base method
+func (m *MockIUtil) ETag(arg0 ISchema, arg1 map[string]interface{}) string {
+	ret := m.ctrl.Call(m, "ETag", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// ETag indicates an expected call of ETag
+func (mr *MockIUtilMockRecorder) ETag(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ETag", reflect.TypeOf((*MockIUtil)(nil).ETag), arg0, arg1)
+}
+
 // GetTransaction mocks base method
 func (m *MockIUtil) GetTransaction(arg0 Context) (ITransaction, bool) {
 	ret := m.ctrl.Call(m, "GetTransaction", arg0)
@@ -889,6 +939,18 @@ func (mr *MockIUtilMockRecorder) GetTransaction(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTransaction", reflect.TypeOf((*MockIUtil)(nil).GetTransaction), arg0)
 }
 
+// NextMarker mocks base method
+func (m *MockIUtil) NextMarker(arg0 *Paginator, arg1 []interface{}) string {
+	ret := m.ctrl.Call(m, "NextMarker", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// NextMarker indicates an expected call of NextMarker
+func (mr *MockIUtilMockRecorder) NextMarker(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NextMarker", reflect.TypeOf((*MockIUtil)(nil).NextMarker), arg0, arg1)
+}
+
 // NewUUID mocks base method
 func (m *MockIUtil) NewUUID() string {
 	ret := m.ctrl.Call(m, "NewUUID")
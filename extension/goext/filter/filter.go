@@ -29,3 +29,55 @@ func Or(filters ...FilterElem) FilterElem {
 		"__or__": filters,
 	}
 }
+
+func Lt(property string, value interface{}) FilterElem {
+	return Predicate(property, "lt", value)
+}
+
+func Lte(property string, value interface{}) FilterElem {
+	return Predicate(property, "lte", value)
+}
+
+func Gt(property string, value interface{}) FilterElem {
+	return Predicate(property, "gt", value)
+}
+
+func Gte(property string, value interface{}) FilterElem {
+	return Predicate(property, "gte", value)
+}
+
+func In(property string, values interface{}) FilterElem {
+	return Predicate(property, "in", values)
+}
+
+func NotIn(property string, values interface{}) FilterElem {
+	return Predicate(property, "not_in", values)
+}
+
+func Like(property, pattern string) FilterElem {
+	return Predicate(property, "like", pattern)
+}
+
+func ILike(property, pattern string) FilterElem {
+	return Predicate(property, "ilike", pattern)
+}
+
+func Prefix(property, prefix string) FilterElem {
+	return Predicate(property, "prefix", prefix)
+}
+
+func IsNull(property string) FilterElem {
+	return Predicate(property, "is_null", true)
+}
+
+func IsNotNull(property string) FilterElem {
+	return Predicate(property, "is_null", false)
+}
+
+// JSONPath makes predicate comparing value stored under dot separated path
+// inside an object property, i.e. JSONPath("config", "vlan.id", "gte", 10)
+func JSONPath(property, path, comp string, value interface{}) FilterElem {
+	elem := Predicate(property, comp, value)
+	elem["path"] = path
+	return elem
+}
@@ -51,11 +51,13 @@ type Context map[string]interface{}
 type Filter map[string]interface{}
 
 // Paginator represents a paginator
+// Marker is an opaque cursor, see IUtil.NextMarker
 type Paginator struct {
 	Key    string
 	Order  string
 	Limit  uint64
 	Offset uint64
+	Marker string
 }
 
 // Below code is adapted from similar code in db/pagination/pagination.go, but
@@ -101,6 +103,12 @@ func OptionOffset(offset uint64) OptionPaginator {
 	}
 }
 
+func OptionMarker(marker string) OptionPaginator {
+	return func(pg *Paginator) {
+		pg.Marker = marker
+	}
+}
+
 // MakeContext creates an empty context
 func MakeContext() Context {
 	return make(map[string]interface{})
@@ -160,6 +168,9 @@ const PriorityDefault = 0
 // ErrResourceNotFound represents 'resource not found' error
 var ErrResourceNotFound = errors.New("resource not found")
 
+// ErrPreconditionFailed represents 'resource was modified' error returned by ITransaction.UpdateIfMatch
+var ErrPreconditionFailed = errors.New("resource was modified")
+
 // ISchema is an interface representing a single schema in Gohan
 type ISchema interface {
 	// ID returns the identifier of this resource
@@ -195,6 +206,12 @@ type ISchema interface {
 	// StateFetchRaw returns a resource state
 	StateFetchRaw(id string, requestContext Context) (ResourceState, error)
 
+	// FetchVersion returns a recorded version of a resource, the schema has to keep history
+	FetchVersion(id string, version int64, context Context) (*ResourceVersion, error)
+
+	// ListVersions returns all recorded versions of a resource, the schema has to keep history
+	ListVersions(id string, context Context) ([]*ResourceVersion, error)
+
 	// LockFetch returns a pointer to locked resource derived from BaseResource, containing db annotations
 	LockFetch(id string, context Context, lockPolicy LockPolicy) (interface{}, error)
 
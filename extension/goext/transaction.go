@@ -40,6 +40,8 @@ const (
 // TxOptions represents transaction options
 type TxOptions struct {
 	IsolationLevel Type
+	// ReadOnly transactions may be routed to read replicas
+	ReadOnly bool
 }
 
 // ResourceState represents the state of a resource
@@ -51,6 +53,15 @@ type ResourceState struct {
 	Monitoring    string
 }
 
+// ResourceVersion represents a recorded version of a resource of a schema with history enabled
+type ResourceVersion struct {
+	Version   int64
+	Timestamp int64
+	Deleted   bool
+	// Resource is nil for the version recording deletion
+	Resource map[string]interface{}
+}
+
 // ListOptions specifies additional list related options.
 type ListOptions struct {
 	// Details specifies if all the underlying structures should be
@@ -66,6 +77,9 @@ type ITransaction interface {
 	Create(ctx context.Context, schema ISchema, resource map[string]interface{}) error
 	// Update updates an existing resource
 	Update(ctx context.Context, schema ISchema, resource map[string]interface{}) error
+	// UpdateIfMatch updates an existing resource only if the stored one still has the given ETag,
+	// returns ErrPreconditionFailed otherwise
+	UpdateIfMatch(ctx context.Context, schema ISchema, resource map[string]interface{}, etag string) error
 	// StateUpdate updates state of an existing resource
 	StateUpdate(ctx context.Context, schema ISchema, resource map[string]interface{}, state *ResourceState) error
 	// Delete deletes an existing resource
@@ -82,6 +96,10 @@ type ITransaction interface {
 	LockList(ctx context.Context, schema ISchema, filter Filter, listOptions *ListOptions, paginator *Paginator, lockPolicy LockPolicy) ([]map[string]interface{}, uint64, error)
 	// Count returns number of resources matching the filter
 	Count(ctx context.Context, schema ISchema, filter Filter) (uint64, error)
+	// FetchVersion fetches a recorded version of a resource
+	FetchVersion(ctx context.Context, schema ISchema, resourceID interface{}, version int64) (*ResourceVersion, error)
+	// ListVersions lists all recorded versions of a resource
+	ListVersions(ctx context.Context, schema ISchema, resourceID interface{}) ([]*ResourceVersion, error)
 	// RawTransaction returns the raw transaction
 	RawTransaction() interface{} // *sqlx.Tx
 	// Query executes a query
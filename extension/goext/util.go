@@ -26,4 +26,10 @@ type IUtil interface {
 
 	// ResourceToMap converts structure representation of the resource to mapped representation
 	ResourceToMap(resource interface{}) map[string]interface{}
+
+	// NextMarker returns marker of the page following listed resources or empty string if there are no more pages
+	NextMarker(paginator *Paginator, resources []interface{}) string
+
+	// ETag returns entity tag of a resource, as used by ITransaction.UpdateIfMatch and HTTP ETag header
+	ETag(schema ISchema, resource map[string]interface{}) string
 }
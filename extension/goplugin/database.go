@@ -63,7 +63,7 @@ func (db *Database) Begin() (goext.ITransaction, error) {
 
 // BeginTx starts a new transaction with options
 func (db *Database) BeginTx(ctx goext.Context, options *goext.TxOptions) (goext.ITransaction, error) {
-	opts := transaction.TxOptions{IsolationLevel: transaction.Type(options.IsolationLevel)}
+	opts := transaction.TxOptions{IsolationLevel: transaction.Type(options.IsolationLevel), ReadOnly: options.ReadOnly}
 	t, err := db.raw.BeginTx(context.Background(), &opts)
 	return handleBeginError(t, err)
 }
@@ -33,6 +33,7 @@ import (
 	"github.com/cloudwan/gohan/metrics"
 	"github.com/cloudwan/gohan/schema"
 	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/mohae/deepcopy"
 	"github.com/pkg/errors"
 	"github.com/twinj/uuid"
@@ -508,7 +509,7 @@ type interrupt struct {
 }
 
 func newInterrupt(env IEnvironment, event string, requestContext map[string]interface{}) *interrupt {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(tracing.ContextWithSpan(context.Background(), tracing.CurrentSpan(requestContext)))
 	doneCh := make(chan struct{}, 1)
 	interrupt := &interrupt{env, event, requestContext, doneCh, ctx, cancel}
 
@@ -23,6 +23,7 @@ import (
 
 	"github.com/cloudwan/gohan/extension/goext"
 	"github.com/cloudwan/gohan/extension/otto"
+	"github.com/cloudwan/gohan/tracing"
 )
 
 // HTTP is an implementation of IHTTP
@@ -49,7 +50,9 @@ func (http *HTTP) RequestRaw(ctx context.Context, method, rawURL string, headers
 		req.Header.Set(header, value)
 	}
 
+	span := tracing.StartClientSpan(req)
 	resp, err := net_http.DefaultTransport.RoundTrip(req)
+	tracing.FinishClientSpan(span, resp, err)
 	if err != nil {
 		return nil, err
 	}
@@ -343,6 +343,18 @@ func (schema *Schema) StateFetchRaw(id string, requestContext goext.Context) (go
 	return tx.StateFetch(goext.GetContext(requestContext), schema, goext.Filter{"id": id})
 }
 
+// FetchVersion returns a recorded version of a resource
+func (schema *Schema) FetchVersion(id string, version int64, requestContext goext.Context) (*goext.ResourceVersion, error) {
+	tx := mustGetOpenTransactionFromContext(requestContext)
+	return tx.FetchVersion(goext.GetContext(requestContext), schema, id, version)
+}
+
+// ListVersions returns all recorded versions of a resource
+func (schema *Schema) ListVersions(id string, requestContext goext.Context) ([]*goext.ResourceVersion, error) {
+	tx := mustGetOpenTransactionFromContext(requestContext)
+	return tx.ListVersions(goext.GetContext(requestContext), schema, id)
+}
+
 func setValue(field, value reflect.Value) {
 	if value.IsValid() {
 		if value.Type() != field.Type() && field.Kind() == reflect.Slice { // empty slice has type []interface{}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/cloudwan/gohan/extension/goext"
 	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/tracing"
 )
 
 func convertEvent(event *gohan_sync.Event) *goext.Event {
@@ -82,6 +83,10 @@ func (sync *Sync) Delete(path string, prefix bool) error {
 
 // Watch watches a single path in sync
 func (sync *Sync) Watch(ctx context.Context, path string, timeout time.Duration, revision int64) ([]*goext.Event, error) {
+	span, ctx := tracing.StartSpanFromContext(ctx, "sync.watch")
+	span.SetAttribute("path", path)
+	defer span.Finish()
+
 	eventChan := sync.raw.WatchContext(ctx, path, revision)
 	select {
 	case event := <-eventChan:
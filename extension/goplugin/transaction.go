@@ -33,6 +33,7 @@ type cancelableTransaction interface {
 
 	CreateContext(context.Context, *schema.Resource) error
 	UpdateContext(context.Context, *schema.Resource) error
+	UpdateIfMatchContext(context.Context, *schema.Resource, string) error
 	StateUpdateContext(context.Context, *schema.Resource, *transaction.ResourceState) error
 	DeleteContext(context.Context, *schema.Schema, interface{}) error
 	FetchContext(context.Context, *schema.Schema, transaction.Filter, *transaction.ViewOptions) (*schema.Resource, error)
@@ -43,6 +44,8 @@ type cancelableTransaction interface {
 	QueryContext(context.Context, *schema.Schema, string, []interface{}) (list []*schema.Resource, err error)
 	ExecContext(ctx context.Context, query string, args ...interface{}) error
 	CountContext(context.Context, *schema.Schema, transaction.Filter) (uint64, error)
+	FetchVersionContext(context.Context, *schema.Schema, interface{}, int64) (*transaction.ResourceVersion, error)
+	ListVersionsContext(context.Context, *schema.Schema, interface{}) ([]*transaction.ResourceVersion, error)
 }
 
 //Transaction is common interface for handling transaction
@@ -88,6 +91,25 @@ func (t *Transaction) Update(ctx context.Context, s goext.ISchema, resource map[
 	return t.tx.UpdateContext(context.Background(), res)
 }
 
+// UpdateIfMatch updates an existing resource only if the stored one still has the given ETag
+func (t *Transaction) UpdateIfMatch(ctx context.Context, s goext.ISchema, resource map[string]interface{}, etag string) error {
+	if err := ctx.Err(); err != nil {
+		return ctx.Err()
+	}
+	res, err := schema.NewResource(t.findRawSchema(s.ID()), resource)
+	if err != nil {
+		return err
+	}
+	switch err := t.tx.UpdateIfMatchContext(context.Background(), res, etag); err {
+	case transaction.ErrResourceNotFound:
+		return goext.ErrResourceNotFound
+	case transaction.ErrPreconditionFailed:
+		return goext.ErrPreconditionFailed
+	default:
+		return err
+	}
+}
+
 func mapGoExtResourceState(resourceState *goext.ResourceState) *transaction.ResourceState {
 	if resourceState == nil {
 		return nil
@@ -155,6 +177,49 @@ func (t *Transaction) LockFetch(ctx context.Context, schema goext.ISchema, filte
 	return res.Data(), nil
 }
 
+func mapTransactionResourceVersion(version *transaction.ResourceVersion) *goext.ResourceVersion {
+	result := &goext.ResourceVersion{
+		Version:   version.Version,
+		Timestamp: version.Timestamp,
+		Deleted:   version.Deleted,
+	}
+	if version.Resource != nil {
+		result.Resource = version.Resource.Data()
+	}
+	return result
+}
+
+// FetchVersion fetches a recorded version of a resource
+func (t *Transaction) FetchVersion(ctx context.Context, schema goext.ISchema, resourceID interface{}, version int64) (*goext.ResourceVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ctx.Err()
+	}
+	res, err := t.tx.FetchVersionContext(context.Background(), t.findRawSchema(schema.ID()), resourceID, version)
+	if err != nil {
+		if err == transaction.ErrResourceNotFound {
+			return nil, goext.ErrResourceNotFound
+		}
+		return nil, err
+	}
+	return mapTransactionResourceVersion(res), nil
+}
+
+// ListVersions lists all recorded versions of a resource
+func (t *Transaction) ListVersions(ctx context.Context, schema goext.ISchema, resourceID interface{}) ([]*goext.ResourceVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ctx.Err()
+	}
+	versions, err := t.tx.ListVersionsContext(context.Background(), t.findRawSchema(schema.ID()), resourceID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*goext.ResourceVersion, len(versions))
+	for i, version := range versions {
+		result[i] = mapTransactionResourceVersion(version)
+	}
+	return result, nil
+}
+
 func convertLockPolicy(policy goext.LockPolicy) schema.LockPolicy {
 	switch policy {
 	case goext.SkipRelatedResources:
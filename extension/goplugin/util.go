@@ -20,8 +20,10 @@ import (
 	"reflect"
 	"strings"
 
+	"github.com/cloudwan/gohan/db/pagination"
 	"github.com/cloudwan/gohan/db/transaction"
 	"github.com/cloudwan/gohan/extension/goext"
+	gohan_schema "github.com/cloudwan/gohan/schema"
 	"github.com/golang/mock/gomock"
 	"github.com/jmoiron/sqlx/reflectx"
 	"github.com/pkg/errors"
@@ -479,3 +481,20 @@ func GetSchemaID(schemaID interface{}) goext.SchemaID {
 	}
 	return goext.SchemaID(schemaID.(string))
 }
+
+// NextMarker returns marker of the page following listed resources or empty string if there are no more pages
+func (util *Util) NextMarker(paginator *goext.Paginator, resources []interface{}) string {
+	if paginator == nil || len(resources) == 0 {
+		return ""
+	}
+	last, ok := resources[len(resources)-1].(map[string]interface{})
+	if !ok {
+		last = util.ResourceToMap(resources[len(resources)-1])
+	}
+	return (*pagination.Paginator)(paginator).NextMarkerFromData(len(resources), last)
+}
+
+// ETag returns entity tag of a resource, as used by ITransaction.UpdateIfMatch and HTTP ETag header
+func (util *Util) ETag(schema goext.ISchema, resource map[string]interface{}) string {
+	return transaction.ETag(schema.RawSchema().(*gohan_schema.Schema), resource)
+}
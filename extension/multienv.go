@@ -16,9 +16,12 @@
 package extension
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/tracing"
 )
 
 //MultiEnvironment can handle multiple environment
@@ -71,7 +74,17 @@ func (env *MultiEnvironment) handleEventInChild(childIdx int, event string, cont
 		return nil
 	}
 	env.cloneChildIfNeeded(childIdx)
-	return env.childEnv[childIdx].HandleEvent(event, context)
+	environmentType := strings.TrimPrefix(strings.TrimSuffix(fmt.Sprintf("%T", env.baseEnvs[childIdx]), ".Environment"), "*")
+	span := tracing.StartSpan(tracing.CurrentSpan(context), environmentType+"."+event)
+	span.SetAttribute("event", event)
+	span.SetAttribute("environment", environmentType)
+	defer span.Finish()
+	restore := tracing.SetCurrentSpan(context, span)
+	defer restore()
+
+	err := env.childEnv[childIdx].HandleEvent(event, context)
+	span.SetError(err)
+	return err
 }
 
 func (env *MultiEnvironment) cloneChildIfNeeded(childIdx int) {
@@ -75,9 +75,14 @@ func init() {
 					return otto.NullValue()
 				}
 
+				span := env.startSpan("sync.fetch")
+				span.SetAttribute("path", path)
+				defer span.Finish()
+
 				errCh := make(chan error, 1)
 				go func() {
 					node, err = env.Sync.Fetch(path)
+					span.SetError(err)
 					errCh <- err
 				}()
 
@@ -121,9 +126,14 @@ func init() {
 					return otto.NullValue()
 				}
 
+				span := env.startSpan("sync.delete")
+				span.SetAttribute("path", path)
+				defer span.Finish()
+
 				errCh := make(chan error, 1)
 				go func() {
 					err = env.Sync.Delete(path, prefix)
+					span.SetError(err)
 					errCh <- err
 				}()
 
@@ -155,9 +165,14 @@ func init() {
 					return otto.NullValue()
 				}
 
+				span := env.startSpan("sync.update")
+				span.SetAttribute("path", path)
+				defer span.Finish()
+
 				errCh := make(chan error, 1)
 				go func() {
 					err = env.Sync.Update(path, value)
+					span.SetError(err)
 					errCh <- err
 				}()
 
@@ -197,6 +212,10 @@ func init() {
 					return otto.NullValue()
 				}
 
+				span := env.startSpan("sync.watch")
+				span.SetAttribute("path", path)
+				defer span.Finish()
+
 				eventChan := make(chan *sync.Event, 32) // non-blocking
 				stopChan := make(chan bool, 1)          // non-blocking
 				defer close(stopChan)
@@ -222,6 +241,7 @@ func init() {
 						return value
 					}
 				case err := <-errorChan:
+					span.SetError(err)
 					ThrowOttoException(&call, fmt.Sprintf("Watching on %s since revision %d failed: %s", path, revision, err.Error()))
 				}
 				return otto.NullValue()
@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/cloudwan/gohan/util"
 	"github.com/twinj/uuid"
 	"github.com/xyproto/otto"
@@ -80,7 +81,7 @@ func init() {
 				}
 				log.Debug("gohan_http  [%s] %s %s %s %s", method, rawHeaders, url, opaque, timeout)
 
-				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+				ctx, cancel := context.WithTimeout(tracing.ContextWithSpan(context.Background(), env.span), time.Duration(timeout)*time.Millisecond)
 				defer cancel()
 
 				var (
@@ -138,7 +139,7 @@ func init() {
 				}
 				//TODO: pass Transport options like timeouts
 
-				ctx, cancel := context.WithCancel(context.Background())
+				ctx, cancel := context.WithCancel(tracing.ContextWithSpan(context.Background(), env.span))
 				defer cancel()
 
 				// prepare request
@@ -162,8 +163,10 @@ func init() {
 
 				// run query
 				done := make(chan struct{})
+				span := tracing.StartClientSpan(req)
 				go func() {
 					resp, err = http.DefaultTransport.RoundTrip(req)
+					tracing.FinishClientSpan(span, resp, err)
 					close(done)
 				}()
 
@@ -403,7 +406,9 @@ func GohanHTTP(ctx context.Context, method, rawURL string, headers map[string]in
 			Opaque: rawURL,
 		}
 	}
+	span := tracing.StartClientSpan(req)
 	resp, err := http.DefaultClient.Do(req)
+	tracing.FinishClientSpan(span, resp, err)
 	if err != nil {
 		return 0, http.Header{}, "", err
 	}
@@ -31,6 +31,7 @@ import (
 	"github.com/cloudwan/gohan/schema"
 	"github.com/cloudwan/gohan/server/middleware"
 	"github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/ddliu/motto"
 	"github.com/xyproto/otto"
 	//Import otto underscore lib
@@ -65,6 +66,8 @@ type Environment struct {
 	Sync        sync.Sync
 	globalStore *GlobalStore
 	loadHooks   []string
+	// span is the current span of the event being handled
+	span *tracing.Span
 }
 
 //NewEnvironment create new gohan extension environment based on context
@@ -192,6 +195,11 @@ func (env *Environment) HandleEvent(event string, context map[string]interface{}
 		}
 	}
 	context["event_type"] = event
+	previousSpan := env.span
+	env.span = tracing.CurrentSpan(context)
+	defer func() {
+		env.span = previousSpan
+	}()
 	var timeout = fmt.Errorf("exceed timeout for extension execution for event: %s", event)
 	var disconnected = fmt.Errorf("client disconnected for event: %s", event)
 
@@ -282,6 +290,14 @@ func (env *Environment) HandleEvent(event string, context map[string]interface{}
 	return err
 }
 
+// startSpan starts a child span of the event being handled, nil if the event isn't traced
+func (env *Environment) startSpan(name string) *tracing.Span {
+	if env.span == nil {
+		return nil
+	}
+	return tracing.StartSpan(env.span, name)
+}
+
 func getClosers(vm *otto.Otto) (closers []io.Closer, err error) {
 	closersValue, err := vm.Get("gohan_closers")
 	if err != nil {
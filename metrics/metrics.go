@@ -64,12 +64,15 @@ func getGraphiteConfig(config *util.Config) (graphiteConfigs []graphite.Config,
 // SetupMetrics setups metrics from config
 func SetupMetrics(config *util.Config) (err error) {
 	monitoringEnabled = config.GetBool("metrics/enabled", false)
+	setupPrometheus(config)
 	graphiteConfigs, err = getGraphiteConfig(config)
 	return
 }
 
 // StartMetricsProcess starts to send runtime metrics to graphite
+// and to serve Prometheus metrics on a separate listener when configured
 func StartMetricsProcess() {
+	startPrometheusListener()
 	if monitoringEnabled && len(graphiteConfigs) > 0 {
 		log.Debug("Starting sending runtime metrics to graphite, config %+v", graphiteConfigs)
 		metrics.RegisterRuntimeMemStats(graphiteConfigs[0].Registry)
@@ -87,6 +90,9 @@ func UpdateTimer(since time.Time, format string, args ...interface{}) {
 		m := metrics.GetOrRegisterTimer(fmt.Sprintf(format, args...), metrics.DefaultRegistry)
 		m.UpdateSince(since)
 	}
+	if prometheusEnabled {
+		observePrometheusTimer(time.Since(since), format, args)
+	}
 }
 
 func UpdateCounter(delta int64, format string, args ...interface{}) {
@@ -94,4 +100,18 @@ func UpdateCounter(delta int64, format string, args ...interface{}) {
 		m := metrics.GetOrRegisterCounter(fmt.Sprintf(format, args...), metrics.DefaultRegistry)
 		m.Inc(delta)
 	}
+	if prometheusEnabled {
+		addPrometheusCounter(delta, format, args)
+	}
+}
+
+// UpdateGauge sets the value of metrics gauge
+func UpdateGauge(value int64, format string, args ...interface{}) {
+	if monitoringEnabled {
+		m := metrics.GetOrRegisterGauge(fmt.Sprintf(format, args...), metrics.DefaultRegistry)
+		m.Update(value)
+	}
+	if prometheusEnabled {
+		setPrometheusGauge(value, format, args)
+	}
 }
@@ -0,0 +1,251 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cloudwan/gohan/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const prometheusNamespace = "gohan"
+
+// prometheusMetric describes how a dotted go-metrics name is exposed to Prometheus.
+// Arguments of the name format become values of labels, followed by fixed values.
+type prometheusMetric struct {
+	name   string
+	help   string
+	labels []string
+	fixed  []string
+	// scale converts values of gauges to the unit of the Prometheus metric, 0 keeps them
+	scale float64
+}
+
+// prometheusTimers maps formats of timer names to Prometheus histograms
+var prometheusTimers = map[string]*prometheusMetric{
+	"db.%s":                {name: "db_duration_seconds", help: "Duration of database operations", labels: []string{"action"}},
+	"tx.%s.%s":             {name: "tx_duration_seconds", help: "Duration of transaction operations", labels: []string{"schema", "action"}},
+	"ext.%s.%s":            {name: "extension_duration_seconds", help: "Duration of extension event handling", labels: []string{"schema", "event"}},
+	"req.%s.%s":            {name: "resource_request_duration_seconds", help: "Duration of resource requests", labels: []string{"schema", "operation"}},
+	"state.%s.%s":          {name: "state_update_duration_seconds", help: "Duration of state updates", labels: []string{"schema", "event"}},
+	"sync.%s":              {name: "sync_duration_seconds", help: "Duration of sync watch processing", labels: []string{"action"}},
+	"sync.v3.%s":           {name: "sync_backend_duration_seconds", help: "Duration of sync backend operations", labels: []string{"action"}},
+	"sync.writer.%d.batch": {name: "sync_writer_batch_duration_seconds", help: "Duration of applying batches of events by the sync writer", labels: []string{"shard"}},
+	"http.%s.duration.%d":  {name: "http_request_duration_seconds", help: "Duration of HTTP requests", labels: []string{"method", "status"}},
+}
+
+// prometheusCounters maps formats of counter names to Prometheus counters, nil skips the counter
+var prometheusCounters = map[string]*prometheusMetric{
+	"db.%s":                         {name: "db_total", help: "Number of database events", labels: []string{"event"}},
+	"sync.v3.%s":                    {name: "sync_backend_total", help: "Number of sync backend events", labels: []string{"event"}},
+	"sync.writer.%d.events":         {name: "sync_writer_events_total", help: "Number of events written by the sync writer", labels: []string{"shard"}},
+	"http.%s.status.%d":             {name: "http_requests_total", help: "Number of HTTP requests", labels: []string{"method", "status"}},
+	"http.%s.ok":                    nil,
+	"http.%s.failed":                nil,
+	"req.peer_disconnect":           {name: "peer_disconnects_total", help: "Number of requests canceled by the peer"},
+	"tx.%s.cache.hit":               {name: "tx_cache_total", help: "Number of transaction cache lookups", labels: []string{"schema", "result"}, fixed: []string{"hit"}},
+	"tx.%s.cache.miss":              {name: "tx_cache_total", help: "Number of transaction cache lookups", labels: []string{"schema", "result"}, fixed: []string{"miss"}},
+	"tx.%s.cache.hitLock":           {name: "tx_cache_total", help: "Number of transaction cache lookups", labels: []string{"schema", "result"}, fixed: []string{"hit_lock"}},
+	"tx.%s.cache.missLock":          {name: "tx_cache_total", help: "Number of transaction cache lookups", labels: []string{"schema", "result"}, fixed: []string{"miss_lock"}},
+	"tx.%s.cache.notLocked":         {name: "tx_cache_total", help: "Number of transaction cache lookups", labels: []string{"schema", "result"}, fixed: []string{"not_locked"}},
+	"db.%s.shared_cache.hit":        {name: "db_shared_cache_total", help: "Number of shared query cache lookups", labels: []string{"schema", "result"}, fixed: []string{"hit"}},
+	"db.%s.shared_cache.miss":       {name: "db_shared_cache_total", help: "Number of shared query cache lookups", labels: []string{"schema", "result"}, fixed: []string{"miss"}},
+	"db.%s.shared_cache.invalidate": {name: "db_shared_cache_invalidations_total", help: "Number of shared query cache invalidations", labels: []string{"schema"}},
+	// schema * counts invalidations of all schemas
+	"db.shared_cache.invalidate_all": {name: "db_shared_cache_invalidations_total", help: "Number of shared query cache invalidations", labels: []string{"schema"}, fixed: []string{"*"}},
+}
+
+// prometheusGauges maps formats of gauge names to Prometheus gauges
+var prometheusGauges = map[string]*prometheusMetric{
+	"sync.writer.%d.lag":     {name: "sync_writer_lag_seconds", help: "Age of the oldest event waiting for the sync writer", labels: []string{"shard"}},
+	"sync.writer.%d.pending": {name: "sync_writer_pending_events", help: "Number of events waiting for the sync writer", labels: []string{"shard"}},
+	"db.replica.%d.lag_msec": {name: "db_replica_lag_seconds", help: "Replication lag of read replicas", labels: []string{"replica"}, scale: 0.001},
+}
+
+// prometheusLevels maps names of counters which are decremented too,
+// as they count things in progress, to Prometheus gauges
+var prometheusLevels = map[string]*prometheusMetric{
+	"db.active":                {name: "db_active_transactions", help: "Number of open transactions"},
+	"db.begin.waiting":         {name: "db_begin_waiting_transactions", help: "Number of transactions waiting to begin"},
+	"sync.v3.lock.waiting":     {name: "sync_waiting_locks", help: "Number of sync locks being waited for", labels: []string{"backend"}, fixed: []string{"etcd"}},
+	"sync.v3.lock.granted":     {name: "sync_held_locks", help: "Number of sync locks held", labels: []string{"backend"}, fixed: []string{"etcd"}},
+	"sync.v3.watch.active":     {name: "sync_active_watches", help: "Number of active sync watches", labels: []string{"backend"}, fixed: []string{"etcd"}},
+	"sync.consul.lock.waiting": {name: "sync_waiting_locks", help: "Number of sync locks being waited for", labels: []string{"backend"}, fixed: []string{"consul"}},
+	"sync.consul.lock.granted": {name: "sync_held_locks", help: "Number of sync locks held", labels: []string{"backend"}, fixed: []string{"consul"}},
+	"sync.consul.watch.active": {name: "sync_active_watches", help: "Number of active sync watches", labels: []string{"backend"}, fixed: []string{"consul"}},
+}
+
+var (
+	prometheusEnabled bool
+	prometheusPath    string
+	prometheusAddress string
+
+	prometheusMutex      sync.Mutex
+	prometheusHistograms = map[string]*prometheus.HistogramVec{}
+	prometheusCounterVec = map[string]*prometheus.CounterVec{}
+	prometheusGaugeVec   = map[string]*prometheus.GaugeVec{}
+
+	invalidMetricNameChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+)
+
+func setupPrometheus(config *util.Config) {
+	prometheusEnabled = monitoringEnabled && config.GetBool("metrics/prometheus/enabled", false)
+	prometheusPath = config.GetString("metrics/prometheus/path", "/metrics")
+	prometheusAddress = config.GetString("metrics/prometheus/address", "")
+}
+
+// PrometheusPath returns the path of Prometheus endpoint served by the API server,
+// empty when the endpoint is disabled or served on a separate listener
+func PrometheusPath() string {
+	if !prometheusEnabled || prometheusAddress != "" {
+		return ""
+	}
+	return prometheusPath
+}
+
+// PrometheusHandler returns a handler exposing metrics in Prometheus format
+func PrometheusHandler() http.Handler {
+	return prometheus.UninstrumentedHandler()
+}
+
+func startPrometheusListener() {
+	if !prometheusEnabled || prometheusAddress == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prometheusPath, PrometheusHandler())
+	log.Info("Serving Prometheus metrics on %s%s", prometheusAddress, prometheusPath)
+	go func() {
+		if err := http.ListenAndServe(prometheusAddress, mux); err != nil {
+			log.Error("Prometheus metrics listener failed: %s", err)
+		}
+	}()
+}
+
+// lookupPrometheusMetric returns the description of a metric and label values,
+// names of unknown formats are converted to metrics without labels
+func lookupPrometheusMetric(known map[string]*prometheusMetric, suffix string, format string, args []interface{}) (*prometheusMetric, []string) {
+	metric, ok := known[format]
+	if !ok {
+		name := invalidMetricNameChars.ReplaceAllString(fmt.Sprintf(format, args...), "_")
+		return &prometheusMetric{name: name + suffix, help: "Gohan metric " + name}, nil
+	}
+	if metric == nil {
+		return nil, nil
+	}
+	values := make([]string, 0, len(metric.labels))
+	for _, arg := range args {
+		values = append(values, fmt.Sprint(arg))
+	}
+	values = append(values, metric.fixed...)
+	if len(values) != len(metric.labels) {
+		return nil, nil
+	}
+	return metric, values
+}
+
+func observePrometheusTimer(duration time.Duration, format string, args []interface{}) {
+	metric, values := lookupPrometheusMetric(prometheusTimers, "_duration_seconds", format, args)
+	if metric == nil {
+		return
+	}
+	prometheusMutex.Lock()
+	histogram, ok := prometheusHistograms[metric.name]
+	if !ok {
+		histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      metric.name,
+			Help:      metric.help,
+		}, metric.labels)
+		if err := prometheus.Register(histogram); err != nil {
+			prometheusMutex.Unlock()
+			log.Warning("Can't register Prometheus histogram %s: %s", metric.name, err)
+			return
+		}
+		prometheusHistograms[metric.name] = histogram
+	}
+	prometheusMutex.Unlock()
+	histogram.WithLabelValues(values...).Observe(duration.Seconds())
+}
+
+func addPrometheusCounter(delta int64, format string, args []interface{}) {
+	if metric, ok := prometheusLevels[fmt.Sprintf(format, args...)]; ok {
+		if gauge := prometheusGauge(metric); gauge != nil {
+			gauge.WithLabelValues(metric.fixed...).Add(float64(delta))
+		}
+		return
+	}
+	metric, values := lookupPrometheusMetric(prometheusCounters, "_total", format, args)
+	if metric == nil || delta < 0 {
+		return
+	}
+	prometheusMutex.Lock()
+	counter, ok := prometheusCounterVec[metric.name]
+	if !ok {
+		counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      metric.name,
+			Help:      metric.help,
+		}, metric.labels)
+		if err := prometheus.Register(counter); err != nil {
+			prometheusMutex.Unlock()
+			log.Warning("Can't register Prometheus counter %s: %s", metric.name, err)
+			return
+		}
+		prometheusCounterVec[metric.name] = counter
+	}
+	prometheusMutex.Unlock()
+	counter.WithLabelValues(values...).Add(float64(delta))
+}
+
+func setPrometheusGauge(value int64, format string, args []interface{}) {
+	metric, values := lookupPrometheusMetric(prometheusGauges, "", format, args)
+	if metric == nil {
+		return
+	}
+	scaled := float64(value)
+	if metric.scale != 0 {
+		scaled *= metric.scale
+	}
+	if gauge := prometheusGauge(metric); gauge != nil {
+		gauge.WithLabelValues(values...).Set(scaled)
+	}
+}
+
+// prometheusGauge returns the registered gauge of a metric, nil if it can't be registered
+func prometheusGauge(metric *prometheusMetric) *prometheus.GaugeVec {
+	prometheusMutex.Lock()
+	defer prometheusMutex.Unlock()
+	gauge, ok := prometheusGaugeVec[metric.name]
+	if !ok {
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      metric.name,
+			Help:      metric.help,
+		}, metric.labels)
+		if err := prometheus.Register(gauge); err != nil {
+			log.Warning("Can't register Prometheus gauge %s: %s", metric.name, err)
+			return nil
+		}
+		prometheusGaugeVec[metric.name] = gauge
+	}
+	return gauge
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Prometheus", func() {
+	var dir string
+
+	setup := func(content string) {
+		configFile := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configFile, []byte(content), 0600)).To(Succeed())
+		config := util.GetConfig()
+		Expect(config.ReadConfig(configFile)).To(Succeed())
+		Expect(metrics.SetupMetrics(config)).To(Succeed())
+	}
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/metrics", nil)
+		Expect(err).NotTo(HaveOccurred())
+		metrics.PrometheusHandler().ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		return recorder.Body.String()
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "metrics")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should be disabled by default", func() {
+		setup("metrics:\n  enabled: true\n")
+		Expect(metrics.PrometheusPath()).To(BeEmpty())
+	})
+
+	It("should not be served by the API server on a separate listener", func() {
+		setup("metrics:\n  enabled: true\n  prometheus:\n    enabled: true\n    address: ':0'\n")
+		Expect(metrics.PrometheusPath()).To(BeEmpty())
+	})
+
+	Context("when enabled", func() {
+		BeforeEach(func() {
+			setup("metrics:\n  enabled: true\n  prometheus:\n    enabled: true\n    path: /prometheus\n")
+		})
+
+		It("should use the configured path", func() {
+			Expect(metrics.PrometheusPath()).To(Equal("/prometheus"))
+		})
+
+		It("should expose timers as labeled histograms", func() {
+			metrics.UpdateTimer(time.Now(), "ext.%s.%s", "network", "pre_create")
+			Expect(scrape()).To(ContainSubstring(`gohan_extension_duration_seconds_count{event="pre_create",schema="network"} 1`))
+		})
+
+		It("should expose counters with labels", func() {
+			metrics.UpdateCounter(1, "http.%s.status.%d", "PUT", 412)
+			metrics.UpdateCounter(1, "tx.%s.cache.hit", "network")
+			body := scrape()
+			Expect(body).To(ContainSubstring(`gohan_http_requests_total{method="PUT",status="412"} 1`))
+			Expect(body).To(ContainSubstring(`gohan_tx_cache_total{result="hit",schema="network"} 1`))
+		})
+
+		It("should expose shared query cache counters with labels", func() {
+			metrics.UpdateCounter(1, "db.%s.shared_cache.hit", "network")
+			metrics.UpdateCounter(1, "db.%s.shared_cache.miss", "network")
+			metrics.UpdateCounter(1, "db.%s.shared_cache.invalidate", "network")
+			metrics.UpdateCounter(1, "db.shared_cache.invalidate_all")
+			body := scrape()
+			Expect(body).To(ContainSubstring(`gohan_db_shared_cache_total{result="hit",schema="network"} 1`))
+			Expect(body).To(ContainSubstring(`gohan_db_shared_cache_total{result="miss",schema="network"} 1`))
+			Expect(body).To(ContainSubstring(`gohan_db_shared_cache_invalidations_total{schema="network"} 1`))
+			Expect(body).To(ContainSubstring(`gohan_db_shared_cache_invalidations_total{schema="*"} 1`))
+			Expect(body).NotTo(ContainSubstring("shared_cache_hit_total"))
+		})
+
+		It("should expose gauges with labels", func() {
+			metrics.UpdateGauge(7, "sync.writer.%d.pending", 2)
+			metrics.UpdateGauge(3, "sync.writer.%d.pending", 2)
+			Expect(scrape()).To(ContainSubstring(`gohan_sync_writer_pending_events{shard="2"} 3`))
+		})
+
+		It("should expose gauges in seconds", func() {
+			metrics.UpdateGauge(1500, "db.replica.%d.lag_msec", 1)
+			Expect(scrape()).To(ContainSubstring(`gohan_db_replica_lag_seconds{replica="1"} 1.5`))
+		})
+
+		It("should expose counters of things in progress as gauges", func() {
+			metrics.UpdateCounter(1, "sync.v3.%s", "lock.waiting")
+			metrics.UpdateCounter(1, "sync.v3.%s", "lock.waiting")
+			metrics.UpdateCounter(-1, "sync.v3.%s", "lock.waiting")
+			metrics.UpdateCounter(1, "db.%s", "active")
+			metrics.UpdateCounter(-1, "db.%s", "active")
+			body := scrape()
+			Expect(body).To(ContainSubstring(`gohan_sync_waiting_locks{backend="etcd"} 1`))
+			Expect(body).To(ContainSubstring("gohan_db_active_transactions 0"))
+			Expect(body).NotTo(ContainSubstring(`gohan_sync_backend_total{event="lock.waiting"}`))
+		})
+
+		It("should skip counters duplicating other ones", func() {
+			metrics.UpdateCounter(1, "http.%s.ok", "GET")
+			Expect(scrape()).NotTo(ContainSubstring("ok_total"))
+		})
+
+		It("should expose unknown metrics without labels", func() {
+			metrics.UpdateCounter(2, "custom.%s", "event")
+			Expect(scrape()).To(ContainSubstring("gohan_custom_event_total 2"))
+		})
+	})
+})
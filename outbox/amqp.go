@@ -0,0 +1,64 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbox
+
+import (
+	"fmt"
+
+	"github.com/cloudwan/gohan/util/amqputil"
+	"github.com/streadway/amqp"
+)
+
+// amqpPublisher publishes messages to an AMQP topic exchange with the topic as the routing key.
+// Publisher confirms are used, so a message is delivered once the broker acknowledged it.
+// The connection is opened by the first message.
+type amqpPublisher struct {
+	publisher *amqputil.Publisher
+}
+
+func newAMQPPublisher(config map[string]interface{}) (Publisher, error) {
+	connection, _ := config["connection"].(string)
+	if connection == "" {
+		return nil, fmt.Errorf("connection is required for amqp publisher")
+	}
+	exchange, _ := config["exchange"].(string)
+	if exchange == "" {
+		exchange = "gohan_outbox"
+	}
+	timeout, err := timeoutFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpPublisher{publisher: amqputil.NewPublisher(connection, exchange, timeout)}, nil
+}
+
+func (p *amqpPublisher) Publish(topic string, message *Message) error {
+	body, err := message.JSON()
+	if err != nil {
+		return err
+	}
+	return p.publisher.Publish(topic, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    message.ID,
+		Type:         message.Type,
+		Body:         body,
+	})
+}
+
+func (p *amqpPublisher) Close() error {
+	return p.publisher.Close()
+}
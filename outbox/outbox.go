@@ -0,0 +1,204 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package outbox publishes changes of resources logged in the event table
+// to message brokers and webhooks
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	l "github.com/cloudwan/gohan/log"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/util"
+)
+
+const (
+	// DeliverySchemaID is ID of the schema storing messages waiting for delivery
+	DeliverySchemaID = "outbox_delivery"
+	// DeadLetterSchemaID is ID of the schema storing messages which couldn't be delivered
+	DeadLetterSchemaID = "outbox_dead_letter"
+)
+
+var (
+	publishers      map[string]Publisher
+	retry           util.Retry
+	pollingInterval time.Duration
+	log             = l.NewLogger()
+)
+
+// Message describes a change of a resource
+type Message struct {
+	// ID of the event the message was created from, the same for all deliveries of the event
+	ID string
+	// Type is create, update or delete
+	Type      string
+	SchemaID  string
+	Path      string
+	Version   int64
+	Timestamp int64
+	// Body holds the resource, or its property selected by the route, encoded in JSON
+	Body json.RawMessage
+}
+
+// Data returns the message as sent to publishers
+func (m *Message) Data() map[string]interface{} {
+	var body interface{} = m.Body
+	if len(m.Body) == 0 {
+		body = nil
+	}
+	return map[string]interface{}{
+		"id":        m.ID,
+		"type":      m.Type,
+		"schema_id": m.SchemaID,
+		"path":      m.Path,
+		"version":   m.Version,
+		"timestamp": m.Timestamp,
+		"body":      body,
+	}
+}
+
+// JSON returns the message encoded in JSON
+func (m *Message) JSON() ([]byte, error) {
+	return json.Marshal(m.Data())
+}
+
+// Route tells which publisher receives changes of resources of a schema
+type Route struct {
+	// Publisher is name of a configured publisher
+	Publisher string
+	// Topic is an AMQP routing key, Kafka topic, NATS subject or webhook topic, defaults to the schema ID
+	Topic string
+	// Property selects a property of the resource to publish, the whole resource is published if empty
+	Property string
+}
+
+// Routes returns routes given in the outbox metadata of a schema
+func Routes(s *schema.Schema) []Route {
+	routes := []Route{}
+	for _, rawRoute := range util.MaybeList(s.Metadata["outbox"]) {
+		route := util.MaybeMap(rawRoute)
+		publisher := util.MaybeString(route["publisher"])
+		if publisher == "" {
+			log.Warning("outbox route of schema %s without publisher is ignored", s.ID)
+			continue
+		}
+		topic := util.MaybeString(route["topic"])
+		if topic == "" {
+			topic = s.ID
+		}
+		routes = append(routes, Route{
+			Publisher: publisher,
+			Topic:     topic,
+			Property:  util.MaybeString(route["property"]),
+		})
+	}
+	return routes
+}
+
+// CheckRoutes checks that outbox metadata of schemas route changes to configured publishers
+func CheckRoutes(schemas []*schema.Schema) error {
+	for _, s := range schemas {
+		for i, rawRoute := range util.MaybeList(s.Metadata["outbox"]) {
+			publisher := util.MaybeString(util.MaybeMap(rawRoute)["publisher"])
+			if publisher == "" {
+				return fmt.Errorf("outbox route %d of schema %s: publisher is required", i, s.ID)
+			}
+			if _, ok := publishers[publisher]; !ok {
+				return fmt.Errorf("outbox route %d of schema %s: publisher %s is not configured", i, s.ID, publisher)
+			}
+		}
+	}
+	return nil
+}
+
+// Setup configures publishers and retries from config.
+// Publishers connect on the first message, so brokers don't have to be available on startup.
+func Setup(config *util.Config) error {
+	Close()
+	var err error
+	if retry, err = util.RetryFromConfig(config, "outbox/retry"); err != nil {
+		return err
+	}
+	if pollingInterval, err = time.ParseDuration(config.GetString("outbox/polling_interval", "5s")); err != nil {
+		return fmt.Errorf("outbox polling interval: %s", err)
+	}
+	if pollingInterval <= 0 {
+		return fmt.Errorf("outbox polling interval has to be positive")
+	}
+
+	newPublishers := map[string]Publisher{}
+	for i, rawPublisherConfig := range config.GetList("outbox/publishers", nil) {
+		publisherConfig, ok := rawPublisherConfig.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("outbox publisher %d has to be an object", i)
+		}
+		name, _ := publisherConfig["name"].(string)
+		if name == "" {
+			return fmt.Errorf("outbox publisher %d: name is required", i)
+		}
+		if _, ok := newPublishers[name]; ok {
+			return fmt.Errorf("outbox publisher %d: duplicated name %q", i, name)
+		}
+		publisher, err := NewPublisher(publisherConfig)
+		if err != nil {
+			return fmt.Errorf("outbox publisher %s: %s", name, err)
+		}
+		newPublishers[name] = publisher
+	}
+	publishers = newPublishers
+	return CheckRoutes(schema.GetManager().OrderedSchemas())
+}
+
+// Enabled checks if any publisher is configured
+func Enabled() bool {
+	return len(publishers) > 0
+}
+
+// GetPublisher returns a configured publisher by its name
+func GetPublisher(name string) (Publisher, bool) {
+	publisher, ok := publishers[name]
+	return publisher, ok
+}
+
+// MaxAttempts returns the number of attempts to deliver a message before it is moved to dead letters
+func MaxAttempts() int {
+	return retry.MaxAttempts
+}
+
+// Retry returns how delivery of messages is retried
+func Retry() util.Retry {
+	return retry
+}
+
+// PollingInterval returns how often messages waiting for retry are checked
+func PollingInterval() time.Duration {
+	if pollingInterval <= 0 {
+		return 5 * time.Second
+	}
+	return pollingInterval
+}
+
+// Close closes publishers
+func Close() {
+	for name, publisher := range publishers {
+		if err := publisher.Close(); err != nil {
+			log.Warning("Failed to close outbox publisher %s: %s", name, err)
+		}
+	}
+	publishers = nil
+}
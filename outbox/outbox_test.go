@@ -0,0 +1,267 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbox_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/outbox"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Outbox", func() {
+	var (
+		dir     string
+		message *outbox.Message
+	)
+
+	setup := func(content string) error {
+		configFile := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configFile, []byte(content), 0600)).To(Succeed())
+		config := util.GetConfig()
+		Expect(config.ReadConfig(configFile)).To(Succeed())
+		return outbox.Setup(config)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "outbox")
+		Expect(err).NotTo(HaveOccurred())
+		message = &outbox.Message{
+			ID:        "42",
+			Type:      "create",
+			SchemaID:  "network",
+			Path:      "/v2.0/networks/red",
+			Version:   1,
+			Timestamp: 1500000000,
+			Body:      json.RawMessage(`{"id":"red"}`),
+		}
+	})
+
+	AfterEach(func() {
+		outbox.Close()
+		os.RemoveAll(dir)
+	})
+
+	Describe("Routes", func() {
+		It("should default topic to the schema ID", func() {
+			networkSchema := schema.NewSchema("network", "networks", "Network", "", "")
+			networkSchema.Metadata = map[string]interface{}{
+				"outbox": []interface{}{
+					map[string]interface{}{"publisher": "broker"},
+					map[string]interface{}{"publisher": "hook", "topic": "networks.changed", "property": "name"},
+					map[string]interface{}{"topic": "ignored"},
+				},
+			}
+			Expect(outbox.Routes(networkSchema)).To(Equal([]outbox.Route{
+				{Publisher: "broker", Topic: "network"},
+				{Publisher: "hook", Topic: "networks.changed", Property: "name"},
+			}))
+		})
+	})
+
+	Describe("Setup", func() {
+		It("should configure retries", func() {
+			Expect(setup("outbox:\n  retry:\n    max_attempts: 4\n    initial_backoff: 1s\n    max_backoff: 5s\n")).To(Succeed())
+			Expect(outbox.Enabled()).To(BeFalse())
+			Expect(outbox.MaxAttempts()).To(Equal(4))
+			Expect(outbox.Retry().Backoff(1)).To(Equal(time.Second))
+			Expect(outbox.Retry().Backoff(3)).To(Equal(4 * time.Second))
+			Expect(outbox.Retry().Backoff(10)).To(Equal(5 * time.Second))
+		})
+
+		It("should reject unknown publishers", func() {
+			Expect(setup("outbox:\n  publishers:\n  - name: test\n    type: pigeon\n")).To(
+				MatchError(ContainSubstring("unknown publisher type")))
+		})
+
+		It("should reject routes to publishers which are not configured", func() {
+			networkSchema := schema.NewSchema("network", "networks", "Network", "", "")
+			networkSchema.Metadata = map[string]interface{}{
+				"outbox": []interface{}{map[string]interface{}{"publisher": "broker"}},
+			}
+			Expect(outbox.CheckRoutes([]*schema.Schema{networkSchema})).To(
+				MatchError(ContainSubstring("publisher broker is not configured")))
+
+			networkSchema.Metadata["outbox"] = []interface{}{map[string]interface{}{"topic": "networks"}}
+			Expect(outbox.CheckRoutes([]*schema.Schema{networkSchema})).To(
+				MatchError(ContainSubstring("publisher is required")))
+		})
+
+		It("should require unique publisher names", func() {
+			Expect(setup("outbox:\n  publishers:\n  - name: test\n    type: http\n    url: http://127.0.0.1/\n" +
+				"  - name: test\n    type: http\n    url: http://127.0.0.1/\n")).To(
+				MatchError(ContainSubstring("duplicated name")))
+		})
+	})
+
+	Describe("HTTP publisher", func() {
+		It("should post messages", func() {
+			var (
+				topic string
+				token string
+				body  map[string]interface{}
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				topic = r.Header.Get("X-Gohan-Topic")
+				token = r.Header.Get("X-Token")
+				json.NewDecoder(r.Body).Decode(&body)
+			}))
+			defer server.Close()
+
+			Expect(setup(fmt.Sprintf("outbox:\n  publishers:\n  - name: hook\n    type: http\n    url: %s\n    headers:\n      X-Token: secret\n", server.URL))).To(Succeed())
+			Expect(outbox.Enabled()).To(BeTrue())
+			publisher, ok := outbox.GetPublisher("hook")
+			Expect(ok).To(BeTrue())
+			Expect(publisher.Publish("networks", message)).To(Succeed())
+			Expect(topic).To(Equal("networks"))
+			Expect(token).To(Equal("secret"))
+			Expect(body).To(HaveKeyWithValue("id", "42"))
+			Expect(body).To(HaveKeyWithValue("path", "/v2.0/networks/red"))
+			Expect(body).To(HaveKeyWithValue("body", map[string]interface{}{"id": "red"}))
+		})
+
+		It("should fail on error responses", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			publisher, err := outbox.NewPublisher(map[string]interface{}{"type": "http", "url": server.URL})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(publisher.Publish("networks", message)).To(MatchError(ContainSubstring("503")))
+		})
+	})
+
+	Describe("Kafka publisher", func() {
+		It("should produce records keyed by path", func() {
+			var (
+				path        string
+				contentType string
+				body        map[string]interface{}
+			)
+			errorCode := "null"
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				contentType = r.Header.Get("Content-Type")
+				json.NewDecoder(r.Body).Decode(&body)
+				fmt.Fprintf(w, `{"offsets":[{"partition":0,"offset":1,"error_code":%s,"error":"broker down"}]}`, errorCode)
+			}))
+			defer server.Close()
+
+			publisher, err := outbox.NewPublisher(map[string]interface{}{"type": "kafka", "url": server.URL})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(publisher.Publish("networks", message)).To(Succeed())
+			Expect(path).To(Equal("/topics/networks"))
+			Expect(contentType).To(Equal("application/vnd.kafka.json.v2+json"))
+			records := body["records"].([]interface{})
+			Expect(records).To(HaveLen(1))
+			record := records[0].(map[string]interface{})
+			Expect(record).To(HaveKeyWithValue("key", "/v2.0/networks/red"))
+			Expect(record["value"]).To(HaveKeyWithValue("type", "create"))
+
+			errorCode = "50003"
+			Expect(publisher.Publish("networks", message)).To(MatchError(ContainSubstring("broker down")))
+		})
+	})
+
+	Describe("NATS publisher", func() {
+		It("should connect on the first message", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			address := listener.Addr().String()
+			listener.Close()
+
+			publisher, err := outbox.NewPublisher(map[string]interface{}{
+				"type":    "nats",
+				"url":     "nats://" + address,
+				"timeout": "100ms",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer publisher.Close()
+			Expect(publisher.Publish("gohan.networks", message)).NotTo(Succeed())
+		})
+
+		It("should publish to subjects", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+			received := make(chan string, 10)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSpace(line)
+					switch {
+					case line == "PING":
+						conn.Write([]byte("PONG\r\n"))
+					case strings.HasPrefix(line, "CONNECT"):
+						received <- line
+					case strings.HasPrefix(line, "PUB"):
+						var subject string
+						var size int
+						fmt.Sscanf(line, "PUB %s %d", &subject, &size)
+						payload := make([]byte, size+2)
+						if _, err := io.ReadFull(reader, payload); err != nil {
+							return
+						}
+						received <- subject + " " + strings.TrimSpace(string(payload))
+					}
+				}
+			}()
+
+			publisher, err := outbox.NewPublisher(map[string]interface{}{
+				"type": "nats",
+				"url":  "nats://gohan:secret@" + listener.Addr().String(),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer publisher.Close()
+
+			Expect(publisher.Publish("gohan.networks", message)).To(Succeed())
+			Expect(<-received).To(ContainSubstring(`"pass":"secret"`))
+			published := strings.SplitN(<-received, " ", 2)
+			Expect(published[0]).To(Equal("gohan.networks"))
+			var data map[string]interface{}
+			Expect(json.Unmarshal([]byte(published[1]), &data)).To(Succeed())
+			Expect(data).To(HaveKeyWithValue("id", "42"))
+
+			Expect(publisher.Publish("invalid subject", message)).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,366 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publisher delivers messages to an external system.
+// Publish returns only after the message is accepted by the receiver,
+// failed messages are published again later.
+type Publisher interface {
+	Publish(topic string, message *Message) error
+	Close() error
+}
+
+// PublisherFactory creates a publisher from its configuration
+type PublisherFactory func(config map[string]interface{}) (Publisher, error)
+
+var publisherFactories = map[string]PublisherFactory{
+	"amqp":  newAMQPPublisher,
+	"kafka": newKafkaPublisher,
+	"nats":  newNATSPublisher,
+	"http":  newHTTPPublisher,
+}
+
+// RegisterPublisher registers a factory of publishers configured with the given type
+func RegisterPublisher(publisherType string, factory PublisherFactory) {
+	publisherFactories[publisherType] = factory
+}
+
+// NewPublisher creates a publisher of the type given in its configuration
+func NewPublisher(config map[string]interface{}) (Publisher, error) {
+	publisherType, _ := config["type"].(string)
+	factory, ok := publisherFactories[publisherType]
+	if !ok {
+		return nil, fmt.Errorf("unknown publisher type %q", publisherType)
+	}
+	return factory(config)
+}
+
+func timeoutFromConfig(config map[string]interface{}) (time.Duration, error) {
+	rawTimeout, ok := config["timeout"].(string)
+	if !ok {
+		return 10 * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(rawTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %s", rawTimeout, err)
+	}
+	return timeout, nil
+}
+
+func headersFromConfig(config map[string]interface{}) map[string]string {
+	headers := map[string]string{}
+	if rawHeaders, ok := config["headers"].(map[string]interface{}); ok {
+		for key, value := range rawHeaders {
+			headers[key] = fmt.Sprint(value)
+		}
+	}
+	return headers
+}
+
+// httpPublisher posts messages to a webhook
+type httpPublisher struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPPublisher(config map[string]interface{}) (Publisher, error) {
+	url, _ := config["url"].(string)
+	if url == "" {
+		return nil, fmt.Errorf("url is required for http publisher")
+	}
+	timeout, err := timeoutFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &httpPublisher{
+		url:     url,
+		headers: headersFromConfig(config),
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (p *httpPublisher) Publish(topic string, message *Message) error {
+	body, err := message.JSON()
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gohan-Topic", topic)
+	request.Header.Set("X-Gohan-Message-Id", message.ID)
+	for key, value := range p.headers {
+		request.Header.Set(key, value)
+	}
+	return doRequest(p.client, request)
+}
+
+func (p *httpPublisher) Close() error {
+	return nil
+}
+
+func doRequest(client *http.Client, request *http.Request) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s responded with %s: %s", request.URL, response.Status, strings.TrimSpace(string(message)))
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	return nil
+}
+
+// kafkaPublisher produces messages to Kafka topics through a Kafka REST proxy,
+// messages are keyed by the resource path, so changes of a resource keep their order
+type kafkaPublisher struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newKafkaPublisher(config map[string]interface{}) (Publisher, error) {
+	url, _ := config["url"].(string)
+	if url == "" {
+		return nil, fmt.Errorf("url of a Kafka REST proxy is required for kafka publisher")
+	}
+	timeout, err := timeoutFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaPublisher{
+		url:     strings.TrimSuffix(url, "/"),
+		headers: headersFromConfig(config),
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (p *kafkaPublisher) Publish(topic string, message *Message) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []interface{}{
+			map[string]interface{}{
+				"key":   message.Path,
+				"value": message.Data(),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", p.url+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	request.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	for key, value := range p.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Kafka REST proxy responded with %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid response of Kafka REST proxy: %s", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("failed to produce to Kafka topic %s: %s", topic, offset.Error)
+		}
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	return nil
+}
+
+// natsPublisher publishes messages to NATS subjects.
+// Each message is followed by PING, so it is considered delivered once the server processed it.
+// The connection is opened by the first message.
+type natsPublisher struct {
+	mu      sync.Mutex
+	address string
+	connect map[string]interface{}
+	timeout time.Duration
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func newNATSPublisher(config map[string]interface{}) (Publisher, error) {
+	rawURL, _ := config["url"].(string)
+	if rawURL == "" {
+		return nil, fmt.Errorf("url is required for nats publisher")
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported scheme of NATS url %q", rawURL)
+	}
+	address := parsed.Host
+	if parsed.Port() == "" {
+		address = net.JoinHostPort(parsed.Hostname(), "4222")
+	}
+	timeout, err := timeoutFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	connect := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "gohan",
+		"lang":     "go",
+	}
+	if parsed.User != nil {
+		connect["user"] = parsed.User.Username()
+		if password, ok := parsed.User.Password(); ok {
+			connect["pass"] = password
+		}
+	}
+	if token, ok := config["token"].(string); ok {
+		connect["auth_token"] = token
+	}
+	return &natsPublisher{address: address, connect: connect, timeout: timeout}, nil
+}
+
+func (p *natsPublisher) dial() error {
+	conn, err := net.DialTimeout("tcp", p.address, p.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	reader := bufio.NewReader(conn)
+	info, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting of NATS server: %s", strings.TrimSpace(info))
+	}
+	connect, err := json.Marshal(p.connect)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn = conn
+	p.reader = reader
+	if err := p.roundTrip([]byte("CONNECT " + string(connect) + "\r\n")); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+// roundTrip sends data followed by PING and waits for PONG
+func (p *natsPublisher) roundTrip(data []byte) error {
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, err := p.conn.Write(append(data, "PING\r\n"...)); err != nil {
+		return err
+	}
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *natsPublisher) Publish(topic string, message *Message) error {
+	body, err := message.JSON()
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, " \t\r\n") {
+		return fmt.Errorf("invalid NATS subject %q", topic)
+	}
+	data := []byte(fmt.Sprintf("PUB %s %d\r\n", topic, len(body)))
+	data = append(append(data, body...), "\r\n"...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		if err = p.roundTrip(data); err == nil {
+			return nil
+		}
+		p.close()
+	}
+	// connect on the first message or reconnect once when the connection was lost,
+	// failed messages are published again later
+	if err := p.dial(); err != nil {
+		return err
+	}
+	return p.roundTrip(data)
+}
+
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.close()
+	return nil
+}
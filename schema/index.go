@@ -32,11 +32,23 @@ const (
 	None               = ""
 )
 
+// Index column orders
+const (
+	Ascending  = "ASC"
+	Descending = "DESC"
+)
+
 // Index is a definition of each Index
 type Index struct {
 	Name    string
 	Columns []string
-	Type    IndexType
+	// Orders holds the order of each column, empty for the default one
+	Orders []string
+	Type   IndexType
+	// Where is a condition limiting a partial index to matching rows
+	Where string
+	// Include lists non key columns stored in a covering index
+	Include []string
 }
 
 //NewIndex is a constructor for Index type
@@ -44,10 +56,47 @@ func NewIndex(name string, columns []string, indexType IndexType) Index {
 	return Index{
 		Name:    name,
 		Columns: columns,
+		Orders:  make([]string, len(columns)),
 		Type:    indexType,
 	}
 }
 
+func mapIndexOrder(rawOrder string) (string, error) {
+	order := strings.ToUpper(rawOrder)
+	switch order {
+	case Ascending, Descending, "":
+		return order, nil
+	default:
+		return "", fmt.Errorf("Unknown index column order: %s", rawOrder)
+	}
+}
+
+// parseIndexColumn parses a column given as "name", "name desc" or an object with column and order
+func parseIndexColumn(rawColumn interface{}) (string, string, error) {
+	switch column := rawColumn.(type) {
+	case string:
+		fields := strings.Fields(column)
+		if len(fields) == 0 || len(fields) > 2 {
+			return "", "", fmt.Errorf("Invalid index column: %q", column)
+		}
+		order := ""
+		if len(fields) == 2 {
+			order = fields[1]
+		}
+		order, err := mapIndexOrder(order)
+		return fields[0], order, err
+	case map[string]interface{}:
+		name, _ := column["column"].(string)
+		if name == "" {
+			return "", "", fmt.Errorf("Index column has to specify column")
+		}
+		rawOrder, _ := column["order"].(string)
+		order, err := mapIndexOrder(rawOrder)
+		return name, order, err
+	}
+	return "", "", fmt.Errorf("Invalid index column: %v", rawColumn)
+}
+
 func mapIndexType(rawIndexType string) (IndexType, error) {
 	indexType := IndexType(strings.ToUpper(rawIndexType))
 	switch indexType {
@@ -72,10 +121,24 @@ func NewIndexFromObj(name string, rawTypeData interface{}) (*Index, error) {
 	}
 
 	columns := []string{}
+	orders := []string{}
 	for _, rawColumn := range typeData["columns"].([]interface{}) {
-		columnName := rawColumn.(string)
+		columnName, order, err := parseIndexColumn(rawColumn)
+		if err != nil {
+			return nil, fmt.Errorf("%s in index %s", err, name)
+		}
 		columns = append(columns, columnName)
+		orders = append(orders, order)
 	}
 	index := NewIndex(name, columns, indexType)
+	index.Orders = orders
+	index.Where, _ = typeData["where"].(string)
+	if rawInclude, ok := typeData["include"].([]interface{}); ok {
+		for _, rawColumn := range rawInclude {
+			if column, ok := rawColumn.(string); ok {
+				index.Include = append(index.Include, column)
+			}
+		}
+	}
 	return &index, nil
 }
@@ -33,6 +33,8 @@ const (
 	ActionUpdate = "update"
 	// ActionDelete allows to delete a resource
 	ActionDelete = "delete"
+	// ActionRestore allows to restore a soft deleted resource
+	ActionRestore = "restore"
 
 	conditionIsOwner       = "is_owner"
 	conditionTypeBelongsTo = "belongs_to"
@@ -40,6 +42,7 @@ const (
 	conditionOr            = "or"
 	conditionAnd           = "and"
 	conditionMatch         = "match"
+	conditionExpression    = "expression"
 
 	globalRegexp = ".*"
 
@@ -112,6 +115,7 @@ type Policy struct {
 	actionTenantFilter                         map[string][]Tenant
 	actionPropertyConditionFilter              map[string][]map[string]interface{}
 	actionFilter                               *conditionFilter
+	actionExpressions                          map[string][]*policyExpression
 }
 
 //ResourcePolicy describes target resources
@@ -127,6 +131,22 @@ type Authorization interface {
 	AuthToken() string
 	Roles() []*Role
 	Catalog() []*Catalog
+	DomainID() string
+	DomainName() string
+}
+
+//UserAuthorization is implemented by authorizations which know the authorized user
+type UserAuthorization interface {
+	UserID() string
+	UserName() string
+}
+
+//AuthorizedUser returns ID and name of the authorized user, empty if unknown
+func AuthorizedUser(auth Authorization) (userID, userName string) {
+	if user, ok := auth.(UserAuthorization); ok {
+		return user.UserID(), user.UserName()
+	}
+	return "", ""
 }
 
 //BaseAuthorization is base struct for Authorization
@@ -136,6 +156,10 @@ type BaseAuthorization struct {
 	authToken  string
 	roles      []*Role
 	catalog    []*Catalog
+	userID     string
+	userName   string
+	domainID   string
+	domainName string
 }
 
 //NewAuthorization is a constructor for auth info
@@ -153,6 +177,22 @@ func NewAuthorization(tenantID, tenantName, authToken string, roleIDs []string,
 	}
 }
 
+//NewUserAuthorization is a constructor for auth info of a known user
+func NewUserAuthorization(userID, userName, tenantID, tenantName, authToken string, roleIDs []string, catalog []*Catalog) Authorization {
+	auth := NewAuthorization(tenantID, tenantName, authToken, roleIDs, catalog).(*BaseAuthorization)
+	auth.userID = userID
+	auth.userName = userName
+	return auth
+}
+
+//NewDomainAuthorization is a constructor for auth info of a known user of a tenant in a domain
+func NewDomainAuthorization(domainID, domainName, userID, userName, tenantID, tenantName, authToken string, roleIDs []string, catalog []*Catalog) Authorization {
+	auth := NewUserAuthorization(userID, userName, tenantID, tenantName, authToken, roleIDs, catalog).(*BaseAuthorization)
+	auth.domainID = domainID
+	auth.domainName = domainName
+	return auth
+}
+
 //Roles returns authorized roles
 func (auth *BaseAuthorization) Roles() []*Role {
 	return auth.roles
@@ -178,6 +218,26 @@ func (auth *BaseAuthorization) Catalog() []*Catalog {
 	return auth.catalog
 }
 
+//UserID returns authorized user, empty if unknown
+func (auth *BaseAuthorization) UserID() string {
+	return auth.userID
+}
+
+//UserName returns authorized user name, empty if unknown
+func (auth *BaseAuthorization) UserName() string {
+	return auth.userName
+}
+
+//DomainID returns domain of the authorized tenant, empty if unknown
+func (auth *BaseAuthorization) DomainID() string {
+	return auth.domainID
+}
+
+//DomainName returns domain name of the authorized tenant, empty if unknown
+func (auth *BaseAuthorization) DomainName() string {
+	return auth.domainName
+}
+
 //Role describes user role
 type Role struct {
 	Name string
@@ -289,6 +349,7 @@ func getStringSliceFromRawSlice(data []interface{}) []string {
 func (p *Policy) precomputeConditions() error {
 	p.actionTenantFilter = map[string][]Tenant{}
 	p.actionPropertyConditionFilter = map[string][]map[string]interface{}{}
+	p.actionExpressions = map[string][]*policyExpression{}
 	for _, condition := range p.Condition {
 		switch condition.(type) {
 		case string:
@@ -338,6 +399,22 @@ func (p *Policy) precomputeConditions() error {
 					for _, action := range actions {
 						p.AddPropertyConditionFilter(action, match)
 					}
+				case conditionExpression:
+					actions := AllActions
+					if action, ok := conditionObject["action"]; ok && action != ActionGlob {
+						actions = []string{action.(string)}
+					}
+					source, ok := conditionObject[conditionExpression].(string)
+					if !ok {
+						return fmt.Errorf("Missing expression of condition for policy '%s'", p.ID)
+					}
+					expression, err := parsePolicyExpression(source)
+					if err != nil {
+						return fmt.Errorf("Invalid expression '%s' for policy '%s': %s", source, p.ID, err)
+					}
+					for _, action := range actions {
+						p.actionExpressions[action] = append(p.actionExpressions[action], expression)
+					}
 				default:
 					panic(fmt.Sprintf("Unknown condition type '%s' for policy '%s'", conditionObject["type"], p.ID))
 				}
@@ -365,29 +442,43 @@ func NewEmptyPolicy() *Policy {
 	return &Policy{Resource: &ResourcePolicy{}}
 }
 
-func (p *Policy) match(action, path string, auth Authorization) *Role {
+// policyMismatch is the first condition of a policy a request doesn't match
+type policyMismatch int
+
+const (
+	noMismatch policyMismatch = iota
+	actionMismatch
+	pathMismatch
+	tenantIDMismatch
+	tenantNameMismatch
+	principalMismatch
+)
+
+// match returns the role matching the principal of the policy,
+// or which condition of the policy the request doesn't match
+func (p *Policy) match(action, path string, auth Authorization) (*Role, policyMismatch) {
 	if p.Action != "*" && action != p.Action {
-		return nil
+		return nil, actionMismatch
 	}
 	if !p.Resource.Path.MatchString(path) {
-		return nil
+		return nil, pathMismatch
 	}
 
 	if !p.TenantID.MatchString(auth.TenantID()) {
-		return nil
+		return nil, tenantIDMismatch
 	}
 
 	if !p.TenantName.MatchString(auth.TenantName()) {
-		return nil
+		return nil, tenantNameMismatch
 	}
 
 	roles := auth.Roles()
 	for _, role := range roles {
 		if role.Match(p.Principal) {
-			return role
+			return role, noMismatch
 		}
 	}
-	return nil
+	return nil, principalMismatch
 }
 
 func (p *Policy) isAllow() bool {
@@ -606,16 +697,35 @@ func addCustomFilters(f map[string]interface{}, tenantId string, conditionFilter
 		filters = append(filters, orFilter)
 	}
 	if conditionFilters.filterType == orFilter {
-		f["__or__"] = filters
+		mergeCondition(f, "__or__", filters)
 	} else {
-		f["__and__"] = filters
+		mergeCondition(f, "__and__", filters)
+	}
+}
+
+// mergeCondition adds filters under the condition key, conditions already
+// present in the filter (i.e. coming from query parameters) are preserved
+func mergeCondition(f map[string]interface{}, key string, filters []map[string]interface{}) {
+	existing, ok := f[key].([]map[string]interface{})
+	if !ok {
+		f[key] = filters
+		return
+	}
+	if key == "__and__" {
+		f[key] = append(existing, filters...)
+		return
 	}
+	delete(f, key)
+	andFilters, _ := f["__and__"].([]map[string]interface{})
+	f["__and__"] = append(andFilters,
+		map[string]interface{}{key: existing},
+		map[string]interface{}{key: filters})
 }
 
 //PolicyValidate validates api request using policy validation
 func PolicyValidate(action, path string, auth Authorization, policies []*Policy) (*Policy, *Role) {
 	for _, policy := range policies {
-		if role := policy.match(action, path, auth); role != nil {
+		if role, _ := policy.match(action, path, auth); role != nil {
 			return policy, role
 		}
 	}
@@ -0,0 +1,166 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PolicyEvaluation tells whether a policy matched a request and why it didn't
+type PolicyEvaluation struct {
+	ID        string   `json:"id"`
+	Principal string   `json:"principal"`
+	Action    string   `json:"action"`
+	Effect    string   `json:"effect"`
+	Path      string   `json:"path"`
+	Matched   bool     `json:"matched"`
+	Reasons   []string `json:"reasons,omitempty"`
+}
+
+// PolicyExplanation explains how policies authorize a request
+type PolicyExplanation struct {
+	Action   string             `json:"action"`
+	Path     string             `json:"path"`
+	SchemaID string             `json:"schema_id,omitempty"`
+	Allowed  bool               `json:"allowed"`
+	Policy   string             `json:"policy,omitempty"`
+	Role     string             `json:"role,omitempty"`
+	Policies []PolicyEvaluation `json:"policies"`
+	// Errors are reasons of rejecting the given resource by the matched policy
+	Errors            []string `json:"errors,omitempty"`
+	VisibleProperties []string `json:"visible_properties,omitempty"`
+	HiddenProperties  []string `json:"hidden_properties,omitempty"`
+	RequireOwner      bool     `json:"require_owner"`
+	// TenantFilter lists tenants whose resources are accessible, all tenants when empty
+	TenantFilter []string `json:"tenant_filter,omitempty"`
+	// ConditionFilter is added to filters of listed resources
+	ConditionFilter map[string]interface{} `json:"condition_filter,omitempty"`
+}
+
+// explainMatch returns the reason of the policy not matching the request
+func (p *Policy) explainMatch(action, path string, auth Authorization) []string {
+	_, mismatch := p.match(action, path, auth)
+	switch mismatch {
+	case actionMismatch:
+		return []string{fmt.Sprintf("action %s doesn't match %s", action, p.Action)}
+	case pathMismatch:
+		return []string{fmt.Sprintf("path %s doesn't match %s", path, p.Resource.Path)}
+	case tenantIDMismatch:
+		return []string{fmt.Sprintf("tenant ID %s doesn't match %s", auth.TenantID(), p.TenantID)}
+	case tenantNameMismatch:
+		return []string{fmt.Sprintf("tenant name %s doesn't match %s", auth.TenantName(), p.TenantName)}
+	case principalMismatch:
+		roles := []string{}
+		for _, role := range auth.Roles() {
+			roles = append(roles, role.Name)
+		}
+		return []string{fmt.Sprintf("principal %s isn't one of roles [%s]", p.Principal, strings.Join(roles, ", "))}
+	}
+	return nil
+}
+
+// ExplainPolicies explains which of policies authorizes the action on the path, like PolicyValidate does,
+// and what the matched policy allows. The resource is checked against the policy when given.
+func ExplainPolicies(action, path string, auth Authorization, resource map[string]interface{}, s *Schema, policies []*Policy) *PolicyExplanation {
+	explanation := &PolicyExplanation{
+		Action:   action,
+		Path:     path,
+		Policies: []PolicyEvaluation{},
+	}
+	if s != nil {
+		explanation.SchemaID = s.ID
+	}
+	var matched *Policy
+	for _, policy := range policies {
+		evaluation := PolicyEvaluation{
+			ID:        policy.ID,
+			Principal: policy.Principal,
+			Action:    policy.Action,
+			Effect:    policy.Effect,
+			Path:      policy.Resource.Path.String(),
+			Reasons:   policy.explainMatch(action, path, auth),
+		}
+		if len(evaluation.Reasons) == 0 {
+			if matched == nil {
+				matched = policy
+				evaluation.Matched = true
+			} else {
+				evaluation.Reasons = append(evaluation.Reasons, fmt.Sprintf("policy %s matched first", matched.ID))
+			}
+		}
+		explanation.Policies = append(explanation.Policies, evaluation)
+	}
+	if matched == nil {
+		explanation.Errors = []string{fmt.Sprintf("No matching policy: %s %s", action, path)}
+		return explanation
+	}
+	_, role := PolicyValidate(action, path, auth, []*Policy{matched})
+	explanation.Policy = matched.ID
+	explanation.Role = role.Name
+	explanation.Allowed = true
+
+	if resource != nil {
+		if err := matched.Check(action, auth, resource); err != nil {
+			explanation.Errors = append(explanation.Errors, err.Error())
+		}
+		if err := matched.ApplyPropertyConditionFilter(action, resource, nil); err != nil {
+			explanation.Errors = append(explanation.Errors, err.Error())
+		}
+		if err := matched.ApplyExpressionConditions(action, auth, resource, nil); err != nil {
+			explanation.Errors = append(explanation.Errors, err.Error())
+		}
+		explanation.Allowed = len(explanation.Errors) == 0
+	}
+
+	if s != nil {
+		for _, property := range s.Properties {
+			if matched.Resource.PropertiesFilter.IsForbidden(property.ID) {
+				explanation.HiddenProperties = append(explanation.HiddenProperties, property.ID)
+			} else {
+				explanation.VisibleProperties = append(explanation.VisibleProperties, property.ID)
+			}
+		}
+	}
+
+	explanation.RequireOwner = matched.RequireOwner()
+	explanation.TenantFilter = matched.GetTenantIDFilter(action, auth.TenantID())
+	conditionFilter := map[string]interface{}{}
+	matched.AddCustomFilters(conditionFilter, auth.TenantID())
+	matched.AddExpressionFilters(conditionFilter, s, action, auth)
+	if len(conditionFilter) > 0 {
+		explanation.ConditionFilter = conditionFilter
+	}
+	return explanation
+}
+
+// SchemaByPath returns the schema of resources at the path
+func (manager *Manager) SchemaByPath(path string) (*Schema, bool) {
+	var result *Schema
+	for _, s := range manager.Schemas() {
+		url := s.GetPluralURL()
+		if (path == url || strings.HasPrefix(path, url+"/")) && (result == nil || len(url) > len(result.GetPluralURL())) {
+			result = s
+		}
+	}
+	return result, result != nil
+}
+
+// ExplainPolicy explains how policies of the manager authorize the action on the path
+func (manager *Manager) ExplainPolicy(action, path string, auth Authorization, resource map[string]interface{}) *PolicyExplanation {
+	s, _ := manager.SchemaByPath(path)
+	return ExplainPolicies(action, path, auth, resource, s, manager.Policies())
+}
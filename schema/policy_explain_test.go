@@ -0,0 +1,99 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy explanation", func() {
+	const (
+		demoTenantID  = "12345678bbbbbbbbbbbb123456789012"
+		otherTenantID = "acf5662bbff44060b93ac3db3c25a590"
+	)
+
+	var (
+		manager    *Manager
+		memberAuth Authorization
+	)
+
+	BeforeEach(func() {
+		manager = GetManager()
+		Expect(manager.LoadSchemaFromFile("../tests/test_abstract_schema.yaml")).To(Succeed())
+		Expect(manager.LoadSchemaFromFile("../tests/test_schema.yaml")).To(Succeed())
+		memberAuth = NewAuthorization(demoTenantID, "demo", "", []string{"Member"}, nil)
+	})
+
+	AfterEach(func() {
+		ClearManager()
+	})
+
+	evaluation := func(explanation *PolicyExplanation, id string) PolicyEvaluation {
+		for _, evaluation := range explanation.Policies {
+			if evaluation.ID == id {
+				return evaluation
+			}
+		}
+		Fail("policy " + id + " not evaluated")
+		return PolicyEvaluation{}
+	}
+
+	It("explains the matched policy like PolicyValidate", func() {
+		explanation := manager.ExplainPolicy("read", "/v2.0/networks/red", memberAuth, nil)
+		policy, role := manager.PolicyValidate("read", "/v2.0/networks/red", memberAuth)
+		Expect(explanation.Allowed).To(BeTrue())
+		Expect(explanation.Policy).To(Equal(policy.ID))
+		Expect(explanation.Role).To(Equal(role.Name))
+		Expect(explanation.SchemaID).To(Equal("network"))
+		Expect(explanation.Policies).To(HaveLen(len(manager.Policies())))
+		Expect(evaluation(explanation, policy.ID).Matched).To(BeTrue())
+
+		Expect(explanation.VisibleProperties).To(ConsistOf("id", "description", "name", "tenant_id"))
+		Expect(explanation.HiddenProperties).To(ContainElement("shared"))
+		Expect(explanation.RequireOwner).To(BeTrue())
+		Expect(explanation.TenantFilter).To(ConsistOf(otherTenantID, demoTenantID))
+	})
+
+	It("explains why policies don't match", func() {
+		explanation := manager.ExplainPolicy("read", "/v2.0/networks/red", memberAuth, nil)
+		Expect(evaluation(explanation, "admin_statement").Reasons).To(ConsistOf("principal admin isn't one of roles [Member]"))
+		Expect(evaluation(explanation, "member_user_schemas").Reasons).To(ConsistOf("path /v2.0/networks/red doesn't match /v0.1/schema.*"))
+		Expect(evaluation(explanation, "power_user_statement").Reasons).To(ConsistOf(
+			"tenant ID 12345678bbbbbbbbbbbb123456789012 doesn't match acf5662bbff44060b93a.*"))
+
+		explanation = manager.ExplainPolicy("read", "/v2.0/network/test1/subnets", memberAuth, nil)
+		Expect(explanation.Allowed).To(BeFalse())
+		Expect(explanation.Policy).To(BeEmpty())
+		Expect(explanation.Errors).To(ConsistOf("No matching policy: read /v2.0/network/test1/subnets"))
+	})
+
+	It("checks the resource against the matched policy", func() {
+		explanation := manager.ExplainPolicy("create", "/v2.0/networks", memberAuth, map[string]interface{}{
+			"tenant_id": demoTenantID,
+			"name":      "red",
+		})
+		Expect(explanation.Allowed).To(BeTrue())
+		Expect(explanation.Errors).To(BeEmpty())
+
+		explanation = manager.ExplainPolicy("create", "/v2.0/networks", memberAuth, map[string]interface{}{
+			"tenant_id": "someone_else",
+			"shared":    true,
+		})
+		Expect(explanation.Allowed).To(BeFalse())
+		Expect(explanation.Errors).To(ConsistOf(ContainSubstring("is prohibited from operating on resources of tenant")))
+	})
+})
@@ -0,0 +1,994 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudwan/gohan/util"
+)
+
+// Condition expressions compare attributes of the resource, the request body,
+// the caller and the request, e.g.
+//
+//   resource.region in auth.catalog_regions && request.hour >= 9 && request.hour < 18
+//
+// Identifiers are resource.<property>, body.<property>, auth.<attribute> and request.<attribute>,
+// literals are numbers, strings, true, false, null and lists. Supported operators are
+// || && ! == != < <= > >= in + - * / % and the size() function.
+
+const (
+	expressionScopeResource = "resource"
+	expressionScopeBody     = "body"
+	expressionScopeAuth     = "auth"
+	expressionScopeRequest  = "request"
+)
+
+var expressionAttributes = map[string][]string{
+	expressionScopeAuth: {
+		"tenant_id", "tenant_name", "user_id", "user_name", "domain_id", "domain_name", "roles", "catalog_regions",
+	},
+	expressionScopeRequest: {"time", "hour", "weekday", "action"},
+}
+
+// policyTimeNow returns the time of the request evaluated by condition expressions
+var policyTimeNow = time.Now
+
+// policyExpression is a parsed condition expression
+type policyExpression struct {
+	source string
+	root   expressionNode
+}
+
+// expressionEnv holds values of identifiers, the resource is unknown while
+// translating an expression to a filter
+type expressionEnv struct {
+	action   string
+	auth     Authorization
+	resource map[string]interface{}
+	body     map[string]interface{}
+	now      time.Time
+}
+
+type expressionNode interface {
+	eval(env *expressionEnv) (interface{}, error)
+	String() string
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+type listNode struct {
+	items []expressionNode
+}
+
+type identifierNode struct {
+	scope string
+	path  []string
+}
+
+type unaryNode struct {
+	operator string
+	operand  expressionNode
+}
+
+type binaryNode struct {
+	operator    string
+	left, right expressionNode
+}
+
+type callNode struct {
+	function string
+	args     []expressionNode
+}
+
+// parsePolicyExpression parses a condition expression
+func parsePolicyExpression(source string) (*policyExpression, error) {
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &expressionParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %s at %d", token, token.position)
+	}
+	return &policyExpression{source: source, root: root}, nil
+}
+
+// evaluate tells whether the expression holds
+func (e *policyExpression) evaluate(env *expressionEnv) (bool, error) {
+	value, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %v instead of a boolean", value)
+	}
+	return result, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdentifier
+	tokenOperator
+)
+
+type expressionToken struct {
+	kind     tokenKind
+	text     string
+	value    interface{}
+	position int
+}
+
+func (t expressionToken) String() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+var expressionOperators = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",",
+}
+
+func tokenizeExpression(source string) ([]expressionToken, error) {
+	tokens := []expressionToken{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			text := string(runes[start:i])
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", text, start)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenNumber, text: text, value: value, position: start})
+		case r == '"' || r == '\'':
+			start := i
+			var value []rune
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, expressionToken{kind: tokenString, text: string(runes[start:i]), value: string(value), position: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: tokenIdentifier, text: string(runes[start:i]), position: start})
+		default:
+			operator := ""
+			for _, candidate := range expressionOperators {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character '%c' at %d", r, i)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenOperator, text: operator, position: i})
+			i += len(operator)
+		}
+	}
+	return append(tokens, expressionToken{kind: tokenEnd, position: len(runes)}), nil
+}
+
+type expressionParser struct {
+	tokens []expressionToken
+	index  int
+}
+
+func (p *expressionParser) peek() expressionToken {
+	return p.tokens[p.index]
+}
+
+func (p *expressionParser) next() expressionToken {
+	token := p.tokens[p.index]
+	if token.kind != tokenEnd {
+		p.index++
+	}
+	return token
+}
+
+// accept consumes the next token if it is one of the operators or keywords
+func (p *expressionParser) accept(texts ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator && token.kind != tokenIdentifier {
+		return "", false
+	}
+	for _, text := range texts {
+		if token.text == text {
+			p.next()
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func (p *expressionParser) expect(text string) error {
+	if _, ok := p.accept(text); !ok {
+		token := p.peek()
+		return fmt.Errorf("expected '%s' at %d, got %s", text, token.position, token)
+	}
+	return nil
+}
+
+func (p *expressionParser) parseBinary(operand func() (expressionNode, error), operators ...string) (expressionNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.accept(operators...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *expressionParser) parseOr() (expressionNode, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *expressionParser) parseAnd() (expressionNode, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *expressionParser) parseComparison() (expressionNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	operator, ok := p.accept("==", "!=", "<=", ">=", "<", ">", "in")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{operator: operator, left: left, right: right}, nil
+}
+
+func (p *expressionParser) parseAdditive() (expressionNode, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *expressionParser) parseMultiplicative() (expressionNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	if operator, ok := p.accept("!", "-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{operator: operator, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenNumber, tokenString:
+		return &literalNode{value: token.value}, nil
+	case tokenIdentifier:
+		switch token.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		case "size":
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return &callNode{function: token.text, args: []expressionNode{arg}}, nil
+		}
+		return newIdentifierNode(token)
+	case tokenOperator:
+		switch token.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			list := &listNode{}
+			if _, ok := p.accept("]"); ok {
+				return list, nil
+			}
+			for {
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if _, ok := p.accept(","); !ok {
+					return list, p.expect("]")
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", token, token.position)
+}
+
+func newIdentifierNode(token expressionToken) (expressionNode, error) {
+	path := strings.Split(token.text, ".")
+	scope := path[0]
+	switch scope {
+	case expressionScopeResource, expressionScopeBody:
+		if len(path) < 2 {
+			return nil, fmt.Errorf("missing property of %s at %d", scope, token.position)
+		}
+	case expressionScopeAuth, expressionScopeRequest:
+		if len(path) != 2 || !util.ContainsString(expressionAttributes[scope], path[1]) {
+			return nil, fmt.Errorf("unknown identifier %s at %d, %s has %s",
+				token.text, token.position, scope, strings.Join(expressionAttributes[scope], ", "))
+		}
+	default:
+		return nil, fmt.Errorf("unknown identifier %s at %d", token.text, token.position)
+	}
+	for _, segment := range path[1:] {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid identifier %s at %d", token.text, token.position)
+		}
+	}
+	return &identifierNode{scope: scope, path: path[1:]}, nil
+}
+
+func (n *literalNode) eval(env *expressionEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *literalNode) String() string {
+	switch value := n.value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(value)
+	case []interface{}:
+		items := []string{}
+		for _, item := range value {
+			items = append(items, (&literalNode{value: item}).String())
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(n.value)
+}
+
+func (n *listNode) eval(env *expressionEnv) (interface{}, error) {
+	result := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+func (n *listNode) String() string {
+	items := []string{}
+	for _, item := range n.items {
+		items = append(items, item.String())
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+func (n *identifierNode) eval(env *expressionEnv) (interface{}, error) {
+	switch n.scope {
+	case expressionScopeResource:
+		return lookupExpressionPath(env.resource, n.path), nil
+	case expressionScopeBody:
+		return lookupExpressionPath(env.body, n.path), nil
+	case expressionScopeAuth:
+		return authAttribute(env.auth, n.path[0]), nil
+	}
+	switch n.path[0] {
+	case "time":
+		return float64(env.now.Unix()), nil
+	case "hour":
+		return float64(env.now.UTC().Hour()), nil
+	case "weekday":
+		return float64(env.now.UTC().Weekday()), nil
+	}
+	return env.action, nil
+}
+
+func (n *identifierNode) String() string {
+	return n.scope + "." + strings.Join(n.path, ".")
+}
+
+func lookupExpressionPath(data map[string]interface{}, path []string) interface{} {
+	var value interface{} = data
+	for _, segment := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[segment]
+	}
+	return normalizeExpressionValue(value)
+}
+
+func authAttribute(auth Authorization, name string) interface{} {
+	if auth == nil {
+		return nil
+	}
+	switch name {
+	case "tenant_id":
+		return auth.TenantID()
+	case "tenant_name":
+		return auth.TenantName()
+	case "user_id":
+		userID, _ := AuthorizedUser(auth)
+		return userID
+	case "user_name":
+		_, userName := AuthorizedUser(auth)
+		return userName
+	case "domain_id":
+		return auth.DomainID()
+	case "domain_name":
+		return auth.DomainName()
+	case "roles":
+		roles := []interface{}{}
+		for _, role := range auth.Roles() {
+			roles = append(roles, role.Name)
+		}
+		return roles
+	}
+	regions := []interface{}{}
+	for _, catalog := range auth.Catalog() {
+		for _, endpoint := range catalog.Endpoints {
+			if endpoint.Region != "" && !containsExpressionValue(regions, endpoint.Region) {
+				regions = append(regions, endpoint.Region)
+			}
+		}
+	}
+	return regions
+}
+
+// normalizeExpressionValue converts numbers to float64 and slices to []interface{}
+func normalizeExpressionValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, float64, []interface{}, map[string]interface{}:
+		return value
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Slice, reflect.Array:
+		result := make([]interface{}, reflected.Len())
+		for i := range result {
+			result[i] = normalizeExpressionValue(reflected.Index(i).Interface())
+		}
+		return result
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflected.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflected.Uint())
+	}
+	return value
+}
+
+func containsExpressionValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(normalizeExpressionValue(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *unaryNode) eval(env *expressionEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.operator == "!" {
+		result, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s isn't a boolean", n.operand)
+		}
+		return !result, nil
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a number", n.operand)
+	}
+	return -number, nil
+}
+
+func (n *unaryNode) String() string {
+	return n.operator + n.operand.String()
+}
+
+func (n *binaryNode) eval(env *expressionEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.operator == "&&" || n.operator == "||" {
+		leftBool, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s isn't a boolean", n.left)
+		}
+		if leftBool == (n.operator == "||") {
+			return leftBool, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rightBool, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s isn't a boolean", n.right)
+		}
+		return rightBool, nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		return n.compare(left, right)
+	case "in":
+		switch container := right.(type) {
+		case nil:
+			return false, nil
+		case []interface{}:
+			return containsExpressionValue(container, left), nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			_, found := container[key]
+			return ok && found, nil
+		case string:
+			substring, ok := left.(string)
+			return ok && strings.Contains(container, substring), nil
+		}
+		return nil, fmt.Errorf("%s isn't a list, an object or a string", n.right)
+	case "+":
+		switch leftValue := left.(type) {
+		case string:
+			if rightValue, ok := right.(string); ok {
+				return leftValue + rightValue, nil
+			}
+		case []interface{}:
+			if rightValue, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, leftValue...), rightValue...), nil
+			}
+		}
+	}
+	leftNumber, leftOK := left.(float64)
+	rightNumber, rightOK := right.(float64)
+	if !leftOK || !rightOK {
+		return nil, fmt.Errorf("invalid operands of %s in %s", n.operator, n)
+	}
+	switch n.operator {
+	case "+":
+		return leftNumber + rightNumber, nil
+	case "-":
+		return leftNumber - rightNumber, nil
+	case "*":
+		return leftNumber * rightNumber, nil
+	}
+	if n.operator == "/" && rightNumber != 0 {
+		return leftNumber / rightNumber, nil
+	}
+	if n.operator == "%" && int64(rightNumber) != 0 {
+		return float64(int64(leftNumber) % int64(rightNumber)), nil
+	}
+	return nil, fmt.Errorf("division by zero in %s", n)
+}
+
+// compare orders numbers or strings, comparisons with null don't hold
+func (n *binaryNode) compare(left, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return false, nil
+	}
+	var order int
+	switch leftValue := left.(type) {
+	case float64:
+		rightValue, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid operands of %s in %s", n.operator, n)
+		}
+		if leftValue < rightValue {
+			order = -1
+		} else if leftValue > rightValue {
+			order = 1
+		}
+	case string:
+		rightValue, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid operands of %s in %s", n.operator, n)
+		}
+		order = strings.Compare(leftValue, rightValue)
+	default:
+		return nil, fmt.Errorf("invalid operands of %s in %s", n.operator, n)
+	}
+	switch n.operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	}
+	return order >= 0, nil
+}
+
+func (n *binaryNode) String() string {
+	return "(" + n.left.String() + " " + n.operator + " " + n.right.String() + ")"
+}
+
+func (n *callNode) eval(env *expressionEnv) (interface{}, error) {
+	value, err := n.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return float64(0), nil
+	case string:
+		return float64(len([]rune(v))), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	}
+	return nil, fmt.Errorf("size of %s isn't defined", n.args[0])
+}
+
+func (n *callNode) String() string {
+	return n.function + "(" + n.args[0].String() + ")"
+}
+
+// partial evaluates parts of the node not depending on the resource, a failing
+// evaluation is replaced by false as it would reject the resource
+func partial(node expressionNode, env *expressionEnv) expressionNode {
+	evalLiteral := func(node expressionNode) expressionNode {
+		value, err := node.eval(env)
+		if err != nil {
+			return &literalNode{value: false}
+		}
+		return &literalNode{value: value}
+	}
+	switch n := node.(type) {
+	case *identifierNode:
+		if n.scope == expressionScopeResource {
+			return n
+		}
+		return evalLiteral(n)
+	case *listNode:
+		items := make([]expressionNode, len(n.items))
+		known := true
+		for i, item := range n.items {
+			items[i] = partial(item, env)
+			_, isLiteral := items[i].(*literalNode)
+			known = known && isLiteral
+		}
+		if known {
+			return evalLiteral(&listNode{items: items})
+		}
+		return &listNode{items: items}
+	case *unaryNode:
+		operand := partial(n.operand, env)
+		if _, ok := operand.(*literalNode); ok {
+			return evalLiteral(&unaryNode{operator: n.operator, operand: operand})
+		}
+		return &unaryNode{operator: n.operator, operand: operand}
+	case *binaryNode:
+		left, right := partial(n.left, env), partial(n.right, env)
+		leftLiteral, leftKnown := left.(*literalNode)
+		rightLiteral, rightKnown := right.(*literalNode)
+		if leftKnown && rightKnown {
+			return evalLiteral(&binaryNode{operator: n.operator, left: left, right: right})
+		}
+		if n.operator == "&&" || n.operator == "||" {
+			absorbing := n.operator == "||"
+			for _, side := range []struct {
+				literal *literalNode
+				other   expressionNode
+			}{{leftLiteral, right}, {rightLiteral, left}} {
+				if side.literal == nil {
+					continue
+				}
+				value, ok := side.literal.value.(bool)
+				if !ok {
+					break
+				}
+				if value == absorbing {
+					return &literalNode{value: value}
+				}
+				return side.other
+			}
+		}
+		return &binaryNode{operator: n.operator, left: left, right: right}
+	case *callNode:
+		arg := partial(n.args[0], env)
+		if _, ok := arg.(*literalNode); ok {
+			return evalLiteral(&callNode{function: n.function, args: []expressionNode{arg}})
+		}
+		return &callNode{function: n.function, args: []expressionNode{arg}}
+	}
+	return node
+}
+
+var (
+	negatedFilterOperators = map[string]string{
+		"eq": "neq", "neq": "eq", "in": "not_in", "not_in": "in",
+		"lt": "gte", "lte": "gt", "gt": "lte", "gte": "lt",
+	}
+	comparisonFilterOperators = map[string]string{
+		"==": "eq", "!=": "neq", "<": "lt", "<=": "lte", ">": "gt", ">=": "gte", "in": "in",
+	}
+	flippedComparisons = map[string]string{
+		"==": "==", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<=",
+	}
+)
+
+// translateExpression translates a partially evaluated node to a filter of the schema,
+// it returns false when the node can't be translated. Conjunctions are translated loosely,
+// untranslatable operands are left to checking resources one by one, which is reported
+// by the returned filter not being exact.
+func translateExpression(node expressionNode, s *Schema, negate bool) (filter map[string]interface{}, exact, ok bool) {
+	switch n := node.(type) {
+	case *unaryNode:
+		if n.operator == "!" {
+			return translateExpression(n.operand, s, !negate)
+		}
+	case *identifierNode:
+		// ! applies only to booleans, so a negated property has to be false
+		filter, ok := translateComparison(&binaryNode{operator: "==", left: n, right: &literalNode{value: !negate}}, s, false)
+		return filter, ok, ok
+	case *binaryNode:
+		if n.operator != "&&" && n.operator != "||" {
+			filter, ok := translateComparison(n, s, negate)
+			return filter, ok, ok
+		}
+		conjunction := (n.operator == "&&") != negate
+		key := "__or__"
+		if conjunction {
+			key = "__and__"
+		}
+		filters := []map[string]interface{}{}
+		exact = true
+		for _, operand := range []expressionNode{n.left, n.right} {
+			filter, operandExact, ok := translateExpression(operand, s, negate)
+			if !ok {
+				if conjunction {
+					exact = false
+					continue
+				}
+				return nil, false, false
+			}
+			exact = exact && operandExact
+			filters = appendFilter(filters, key, filter)
+		}
+		switch len(filters) {
+		case 0:
+			return nil, false, false
+		case 1:
+			return filters[0], exact, true
+		}
+		return map[string]interface{}{key: filters}, exact, true
+	}
+	return nil, false, false
+}
+
+// appendFilter appends the filter to filters combined by the key,
+// nested filters combined the same way are flattened
+func appendFilter(filters []map[string]interface{}, key string, filter map[string]interface{}) []map[string]interface{} {
+	if nested, ok := filter[key].([]map[string]interface{}); ok && len(filter) == 1 {
+		return append(filters, nested...)
+	}
+	return append(filters, filter)
+}
+
+func translateComparison(n *binaryNode, s *Schema, negate bool) (map[string]interface{}, bool) {
+	identifier, ok := n.left.(*identifierNode)
+	literal, literalOK := n.right.(*literalNode)
+	operator := n.operator
+	if !ok && n.operator != "in" {
+		identifier, ok = n.right.(*identifierNode)
+		literal, literalOK = n.left.(*literalNode)
+		operator = flippedComparisons[n.operator]
+	}
+	if !ok || !literalOK || identifier.scope != expressionScopeResource || len(identifier.path) != 1 {
+		return nil, false
+	}
+	property := identifier.path[0]
+	if s == nil {
+		return nil, false
+	}
+	if _, err := s.GetPropertyByID(property); err != nil {
+		return nil, false
+	}
+	value := literal.value
+	filterOperator := comparisonFilterOperators[operator]
+	switch operator {
+	case "==", "!=":
+		if value == nil {
+			return map[string]interface{}{"property": property, "type": "is_null", "value": (operator == "==") != negate}, true
+		}
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+			return nil, false
+		}
+	case "in":
+		if _, ok := value.([]interface{}); !ok {
+			return nil, false
+		}
+	default:
+		// null doesn't satisfy negated ordering either, which a filter can't express simply
+		if negate {
+			return nil, false
+		}
+		switch value.(type) {
+		case float64, string:
+		default:
+			return nil, false
+		}
+	}
+	if negate {
+		filterOperator = negatedFilterOperators[filterOperator]
+	}
+	filter := map[string]interface{}{"property": property, "type": filterOperator, "value": value}
+	if filterOperator == "neq" || filterOperator == "not_in" {
+		// null differs from any value in expressions but not in SQL
+		return map[string]interface{}{"__or__": []map[string]interface{}{
+			filter,
+			{"property": property, "type": "is_null", "value": true},
+		}}, true
+	}
+	return filter, true
+}
+
+// ApplyExpressionConditions checks data against condition expressions of the action.
+// On update API pass the update in updateCandidateData, resource attributes are
+// evaluated on the stored data merged with the update and body attributes on the update.
+// On create API the created data is both the resource and the body.
+func (p *Policy) ApplyExpressionConditions(action string, auth Authorization, data, updateCandidateData map[string]interface{}) error {
+	expressions := p.actionExpressions[action]
+	if len(expressions) == 0 {
+		return nil
+	}
+	env := &expressionEnv{action: action, auth: auth, resource: data, body: updateCandidateData, now: policyTimeNow()}
+	switch {
+	case updateCandidateData != nil:
+		env.resource = map[string]interface{}{}
+		for key, value := range data {
+			env.resource[key] = value
+		}
+		for key, value := range updateCandidateData {
+			env.resource[key] = value
+		}
+	case action == ActionCreate:
+		env.body = data
+	}
+	for _, expression := range expressions {
+		result, err := expression.evaluate(env)
+		if err != nil {
+			return fmt.Errorf("Rejected by condition %s: %s", expression.source, err)
+		}
+		if !result {
+			return fmt.Errorf("Rejected by condition %s", expression.source)
+		}
+	}
+	return nil
+}
+
+// AddExpressionFilters adds filters selecting resources of the schema which may satisfy
+// condition expressions of the action performed by the caller. Parts of expressions which
+// can't be translated to filters are left out, so listed resources still have to be
+// checked with ApplyExpressionConditions unless ExpressionFiltersExact is true.
+func (p *Policy) AddExpressionFilters(filters map[string]interface{}, s *Schema, action string, auth Authorization) {
+	result, _ := p.expressionFilters(s, action, auth)
+	if len(result) > 0 {
+		mergeCondition(filters, "__and__", result)
+	}
+}
+
+// ExpressionFiltersExact checks if filters added by AddExpressionFilters select only
+// resources satisfying condition expressions of the action
+func (p *Policy) ExpressionFiltersExact(s *Schema, action string, auth Authorization) bool {
+	_, exact := p.expressionFilters(s, action, auth)
+	return exact
+}
+
+func (p *Policy) expressionFilters(s *Schema, action string, auth Authorization) ([]map[string]interface{}, bool) {
+	env := &expressionEnv{action: action, auth: auth, now: policyTimeNow()}
+	result := []map[string]interface{}{}
+	exact := true
+	for _, expression := range p.actionExpressions[action] {
+		node := partial(expression.root, env)
+		if literal, ok := node.(*literalNode); ok {
+			if literal.value != true {
+				result = append(result, map[string]interface{}{"property": "id", "type": "in", "value": []interface{}{}})
+			}
+			continue
+		}
+		filter, filterExact, ok := translateExpression(node, s, false)
+		if ok {
+			result = appendFilter(result, "__and__", filter)
+		}
+		exact = exact && ok && filterExact
+	}
+	return result, exact
+}
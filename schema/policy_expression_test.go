@@ -0,0 +1,220 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy condition expressions", func() {
+	var (
+		auth Authorization
+		now  time.Time
+	)
+
+	newExpressionPolicy := func(conditions ...interface{}) (*Policy, error) {
+		return NewPolicy(map[string]interface{}{
+			"action":    "*",
+			"effect":    "allow",
+			"id":        "expression_policy",
+			"principal": "Member",
+			"resource": map[string]interface{}{
+				"path": ".*",
+			},
+			"condition": conditions,
+		})
+	}
+
+	expression := func(action, source string) map[string]interface{} {
+		condition := map[string]interface{}{"type": "expression", "expression": source}
+		if action != "" {
+			condition["action"] = action
+		}
+		return condition
+	}
+
+	BeforeEach(func() {
+		catalog := []*Catalog{
+			NewCatalog("nova", "compute", []*Endpoint{
+				NewEndpoint("http://nova-east", "east", "public"),
+				NewEndpoint("http://nova-west", "west", "public"),
+			}),
+		}
+		auth = NewUserAuthorization("alice_id", "alice", "tenant", "demo", "", []string{"Member", "network-ops"}, catalog)
+		now = time.Date(2018, 6, 4, 10, 30, 0, 0, time.UTC)
+		policyTimeNow = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		policyTimeNow = time.Now
+	})
+
+	It("rejects invalid expressions when the policy is loaded", func() {
+		for _, source := range []string{
+			"resource.region ==",
+			"resource.region in [1, 2",
+			"auth.password == 'secret'",
+			"session.id == 1",
+			"resource.name == 'unterminated",
+			"size(resource.tags",
+			"resource.a # 1",
+		} {
+			_, err := newExpressionPolicy(expression("", source))
+			Expect(err).To(HaveOccurred(), source)
+		}
+		_, err := newExpressionPolicy(map[string]interface{}{"type": "expression"})
+		Expect(err).To(MatchError(ContainSubstring("Missing expression")))
+	})
+
+	It("checks resources against request and caller attributes", func() {
+		policy, err := newExpressionPolicy(
+			expression("read", "resource.region in auth.catalog_regions || resource.owner_group in auth.roles"),
+			expression("create", "size(body.ports) <= 2 && body.bandwidth * size(body.ports) <= 100"),
+			expression("update", "resource.tenant_id == auth.tenant_id && (body.status == null || body.status != 'ERROR')"),
+			expression("delete", "request.weekday >= 1 && request.weekday <= 5 && request.hour >= 9 && request.hour < 18"),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(policy.ApplyExpressionConditions("read", auth, map[string]interface{}{"region": "east"}, nil)).To(Succeed())
+		Expect(policy.ApplyExpressionConditions("read", auth, map[string]interface{}{"owner_group": "network-ops"}, nil)).To(Succeed())
+		Expect(policy.ApplyExpressionConditions("read", auth, map[string]interface{}{"region": "north"}, nil)).To(
+			MatchError(ContainSubstring("Rejected by condition")))
+
+		Expect(policy.ApplyExpressionConditions("create", auth, map[string]interface{}{
+			"ports": []string{"a", "b"}, "bandwidth": 50,
+		}, nil)).To(Succeed())
+		Expect(policy.ApplyExpressionConditions("create", auth, map[string]interface{}{
+			"ports": []string{"a", "b"}, "bandwidth": 51,
+		}, nil)).ToNot(Succeed())
+		Expect(policy.ApplyExpressionConditions("create", auth, map[string]interface{}{
+			"ports": []string{"a"}, "bandwidth": "fast",
+		}, nil)).To(MatchError(ContainSubstring("invalid operands")))
+
+		stored := map[string]interface{}{"tenant_id": "tenant", "status": "ACTIVE"}
+		Expect(policy.ApplyExpressionConditions("update", auth, stored, map[string]interface{}{"name": "red"})).To(Succeed())
+		Expect(policy.ApplyExpressionConditions("update", auth, stored, map[string]interface{}{"status": "ERROR"})).ToNot(Succeed())
+		Expect(policy.ApplyExpressionConditions("update", auth, map[string]interface{}{"tenant_id": "other"}, map[string]interface{}{"name": "red"})).ToNot(Succeed())
+		Expect(policy.ApplyExpressionConditions("update", auth, stored, map[string]interface{}{"tenant_id": "other"})).ToNot(Succeed())
+
+		Expect(policy.ApplyExpressionConditions("delete", auth, stored, nil)).To(Succeed())
+		now = time.Date(2018, 6, 9, 10, 30, 0, 0, time.UTC)
+		Expect(policy.ApplyExpressionConditions("delete", auth, stored, nil)).ToNot(Succeed())
+	})
+
+	It("leaves user attributes empty for authorizations without a user", func() {
+		policy, err := newExpressionPolicy(expression("read", "auth.user_id == '' && auth.tenant_id == 'tenant'"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policy.ApplyExpressionConditions("read", tenantAuthorization{}, map[string]interface{}{}, nil)).To(Succeed())
+		Expect(policy.ApplyExpressionConditions("read", auth, map[string]interface{}{}, nil)).ToNot(Succeed())
+	})
+
+	Describe("Filters", func() {
+		var networkSchema *Schema
+
+		BeforeEach(func() {
+			manager := GetManager()
+			Expect(manager.LoadSchemaFromFile("../tests/test_abstract_schema.yaml")).To(Succeed())
+			Expect(manager.LoadSchemaFromFile("../tests/test_schema.yaml")).To(Succeed())
+			networkSchema, _ = manager.Schema("network")
+		})
+
+		AfterEach(func() {
+			ClearManager()
+		})
+
+		filterOf := func(source string) map[string]interface{} {
+			policy, err := newExpressionPolicy(expression("read", source))
+			Expect(err).ToNot(HaveOccurred())
+			filter := map[string]interface{}{}
+			policy.AddExpressionFilters(filter, networkSchema, "read", auth)
+			return filter
+		}
+
+		It("translates comparisons of resource properties with known values", func() {
+			Expect(filterOf("resource.name in auth.roles && auth.tenant_id == resource.tenant_id && !resource.shared")).To(Equal(
+				map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"property": "name", "type": "in", "value": []interface{}{"Member", "network-ops"}},
+						{"property": "tenant_id", "type": "eq", "value": "tenant"},
+						{"property": "shared", "type": "eq", "value": false},
+					},
+				}))
+			Expect(filterOf("resource.name != 'red' || resource.description == null")).To(Equal(
+				map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"__or__": []map[string]interface{}{
+							{"property": "name", "type": "neq", "value": "red"},
+							{"property": "name", "type": "is_null", "value": true},
+							{"property": "description", "type": "is_null", "value": true},
+						}},
+					},
+				}))
+		})
+
+		It("leaves out parts which can't be translated", func() {
+			Expect(filterOf("resource.name == 'red' && size(resource.description) > 3")).To(Equal(
+				map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"property": "name", "type": "eq", "value": "red"},
+					},
+				}))
+			Expect(filterOf("resource.name == 'red' || size(resource.description) > 3")).To(BeEmpty())
+			Expect(filterOf("resource.unknown == 'red'")).To(BeEmpty())
+		})
+
+		It("reports whether filters select only resources satisfying the expressions", func() {
+			exact := func(source string) bool {
+				policy, err := newExpressionPolicy(expression("read", source))
+				Expect(err).ToNot(HaveOccurred())
+				return policy.ExpressionFiltersExact(networkSchema, "read", auth)
+			}
+			Expect(exact("resource.name != 'red' || !resource.shared")).To(BeTrue())
+			Expect(exact("request.hour < 9 && resource.name == 'red'")).To(BeTrue())
+			Expect(exact("resource.name == 'red' && size(resource.description) > 3")).To(BeFalse())
+			Expect(exact("resource.name == 'red' || size(resource.description) > 3")).To(BeFalse())
+		})
+
+		It("evaluates conditions not depending on resources", func() {
+			Expect(filterOf("request.hour >= 9 && request.hour < 18")).To(BeEmpty())
+			Expect(filterOf("request.hour < 9 && resource.name == 'red'")).To(Equal(
+				map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"property": "id", "type": "in", "value": []interface{}{}},
+					},
+				}))
+			Expect(filterOf("'admin' in auth.roles || resource.tenant_id == auth.tenant_id")).To(Equal(
+				map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"property": "tenant_id", "type": "eq", "value": "tenant"},
+					},
+				}))
+		})
+	})
+})
+
+// tenantAuthorization implements only the methods every Authorization has
+type tenantAuthorization struct{}
+
+func (tenantAuthorization) TenantID() string    { return "tenant" }
+func (tenantAuthorization) TenantName() string  { return "demo" }
+func (tenantAuthorization) AuthToken() string   { return "" }
+func (tenantAuthorization) Roles() []*Role      { return []*Role{{Name: "Member"}} }
+func (tenantAuthorization) Catalog() []*Catalog { return nil }
+func (tenantAuthorization) DomainID() string    { return "" }
+func (tenantAuthorization) DomainName() string  { return "" }
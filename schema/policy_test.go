@@ -506,6 +506,47 @@ var _ = Describe("Policies", func() {
 				}
 				Expect(filter).To(Equal(expected))
 			})
+			It("should preserve conditions already present in the filter", func() {
+				testPolicy["condition"] = []interface{}{
+					map[string]interface{}{
+						"or": []interface{}{
+							map[string]interface{}{
+								"match": map[string]interface{}{
+									"property": "status",
+									"type":     "eq",
+									"value":    "ACTIVE",
+								},
+							},
+						},
+					},
+				}
+
+				var err error
+				policy, err = NewPolicy(testPolicy)
+				Expect(err).ToNot(HaveOccurred())
+				query := []map[string]interface{}{
+					{
+						"property": "state",
+						"type":     "neq",
+						"value":    "DOWN",
+					},
+				}
+				filter := map[string]interface{}{"__or__": query}
+				policy.AddCustomFilters(filter, "test")
+				expected := map[string]interface{}{
+					"__and__": []map[string]interface{}{
+						{"__or__": query},
+						{"__or__": []map[string]interface{}{
+							{
+								"property": "status",
+								"type":     "eq",
+								"value":    "ACTIVE",
+							},
+						}},
+					},
+				}
+				Expect(filter).To(Equal(expected))
+			})
 			It("should work with string condition based on is_owner, con/disjunction property", func() {
 				testPolicy["condition"] = []interface{}{
 					map[string]interface{}{
@@ -29,6 +29,10 @@ type Property struct {
 	OnDeleteCascade        bool
 	Default                interface{}
 	Indexed                bool
+	// RenamedFrom is the previous ID of a renamed property, used by migration planning
+	RenamedFrom string
+	// Secret properties are masked in audit records
+	Secret bool
 }
 
 //PropertyMap is a map of Property
@@ -92,6 +96,8 @@ func NewPropertyFromObj(id string, rawTypeData interface{}, required bool) *Prop
 	indexed, _ := typeData["indexed"].(bool)
 	Property := NewProperty(id, title, description, typeID, format, relation, relationColumn, relationProperty,
 		sqlType, unique, nullable, cascade, properties, defaultValue, indexed)
+	Property.RenamedFrom, _ = typeData["renamed_from"].(string)
+	Property.Secret, _ = typeData["secret"].(bool)
 	return &Property
 }
 
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/cloudwan/gohan/util"
 	"github.com/flosch/pongo2"
@@ -458,6 +459,90 @@ func (schema *Schema) StateVersioning() bool {
 	return stateful
 }
 
+//Recoverable whether deleted resources of this schema are kept as tombstones, so they can be restored
+func (schema *Schema) Recoverable() bool {
+	recoverable, _ := schema.Metadata["recoverable"].(bool)
+	return recoverable
+}
+
+//History whether previous revisions of resources of this schema are kept
+func (schema *Schema) History() bool {
+	history, _ := schema.Metadata["history"].(bool)
+	return history
+}
+
+//CacheTTL how long list results of this schema are shared between transactions, zero disables the cache
+func (schema *Schema) CacheTTL() time.Duration {
+	switch ttl := schema.Metadata["cache_ttl"].(type) {
+	case int:
+		return time.Duration(ttl) * time.Second
+	case float64:
+		return time.Duration(ttl * float64(time.Second))
+	}
+	return 0
+}
+
+//CacheDependents returns schemas with cache_ttl whose list results might change when resources of this schema
+//are written: the schema itself and schemas joining it through relation properties. With deleted, schemas of
+//resources which might be deleted together by foreign keys or soft deletion are taken into account too.
+func (schema *Schema) CacheDependents(deleted bool) []*Schema {
+	schemas := GetManager().Schemas()
+	cached := []*Schema{}
+	for _, s := range schemas {
+		if s.CacheTTL() > 0 {
+			cached = append(cached, s)
+		}
+	}
+	if len(cached) == 0 {
+		return nil
+	}
+	changed := map[string]bool{schema.ID: true}
+	for queue := []string{schema.ID}; deleted && len(queue) > 0; queue = queue[1:] {
+		for _, s := range schemas {
+			if changed[s.ID] || s.IsAbstract() {
+				continue
+			}
+			for _, property := range s.Properties {
+				if property.Relation == queue[0] {
+					changed[s.ID] = true
+					queue = append(queue, s.ID)
+					break
+				}
+			}
+		}
+	}
+	dependents := []*Schema{}
+	for _, s := range cached {
+		if s.joins(changed, map[string]bool{}) {
+			dependents = append(dependents, s)
+		}
+	}
+	return dependents
+}
+
+// joins checks if list results of the schema include data of any of the schemas
+func (schema *Schema) joins(schemaIDs map[string]bool, visited map[string]bool) bool {
+	if schemaIDs[schema.ID] {
+		return true
+	}
+	visited[schema.ID] = true
+	for _, property := range schema.Properties {
+		if property.RelationProperty == "" || visited[property.Relation] {
+			continue
+		}
+		if related, ok := GetManager().Schema(property.Relation); ok && related.joins(schemaIDs, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+//ReadOnly whether resources of this schema can be only listed and shown by REST API
+func (schema *Schema) ReadOnly() bool {
+	readOnly, _ := schema.Metadata["read_only"].(bool)
+	return readOnly
+}
+
 //SyncKeyTemplate - for custom paths in etcd
 func (schema *Schema) SyncKeyTemplate() (syncKeyTemplate string, ok bool) {
 	syncKeyTemplateRaw, ok := schema.Metadata["sync_key_template"]
@@ -243,12 +243,34 @@ var _ = Describe("Schema", func() {
 					Expect(index.Columns).To(Equal([]string{"m1", "m3"}))
 					Expect(index.Name).To(Equal("fulltext_m1_m3"))
 				}
-				if index.Type == None {
+				if index.Name == "emptyType_m1_m2_m3" {
+					Expect(index.Type).To(Equal(IndexType(None)))
 					Expect(index.Columns).To(Equal([]string{"m1", "m2", "m3"}))
-					Expect(index.Name).To(Equal("emptyType_m1_m2_m3"))
+					Expect(index.Orders).To(Equal([]string{"", "", ""}))
 				}
 			}
 		})
+
+		It("Parse ordered, partial and covering indexes", func() {
+			var ordered *Index
+			for i := range todosSchema.Indexes {
+				if todosSchema.Indexes[i].Name == "ordered_m1_m3" {
+					ordered = &todosSchema.Indexes[i]
+				}
+			}
+			Expect(ordered).ToNot(BeNil())
+			Expect(ordered.Columns).To(Equal([]string{"m1", "m3"}))
+			Expect(ordered.Orders).To(Equal([]string{Ascending, Descending}))
+			Expect(ordered.Where).To(Equal("`m2` = 1"))
+			Expect(ordered.Include).To(Equal([]string{"m2"}))
+		})
+
+		It("Reject unknown index column orders", func() {
+			_, err := NewIndexFromObj("invalid", map[string]interface{}{
+				"columns": []interface{}{"m1 sideways"},
+			})
+			Expect(err).To(MatchError(ContainSubstring("Unknown index column order")))
+		})
 	})
 
 	Describe("Metadata", func() {
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
 	"github.com/cloudwan/gohan/extension"
 	"github.com/cloudwan/gohan/extension/goext"
 	"github.com/cloudwan/gohan/job"
@@ -29,6 +30,7 @@ import (
 	"github.com/cloudwan/gohan/server/middleware"
 	"github.com/cloudwan/gohan/server/resources"
 	"github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/util"
 	"github.com/drone/routes"
 	"github.com/go-martini/martini"
 	"github.com/mohae/deepcopy"
@@ -87,6 +89,8 @@ func problemToResponseCode(problem resources.ResourceProblem) int {
 		return http.StatusForbidden
 	case resources.ForeignKeyFailed:
 		return http.StatusBadRequest
+	case resources.PreconditionFailed:
+		return http.StatusPreconditionFailed
 	}
 	return http.StatusInternalServerError
 }
@@ -180,6 +184,80 @@ func handleError(writer http.ResponseWriter, err error) {
 		}
 	case *goext.Error:
 		middleware.HTTPJSONError(writer, err.Error(), err.Status)
+	case resources.BulkError:
+		message, code := errorResponse(err.Err)
+		middleware.HTTPJSONError(writer, fmt.Sprintf("Operation %d failed: %s", err.Index, message["error"]), code)
+	}
+}
+
+// errorResponse returns response body and status code of an error, as written by handleError
+func errorResponse(err error) (map[string]interface{}, int) {
+	switch err := err.(type) {
+	case resources.ResourceError:
+		return map[string]interface{}{"error": err.Message}, problemToResponseCode(err.Problem)
+	case extension.Error:
+		return unwrapExtensionException(err.ExceptionInfo)
+	case *goext.Error:
+		return map[string]interface{}{"error": err.Error()}, err.Status
+	}
+	log.Error(err.Error())
+	return map[string]interface{}{"error": ""}, http.StatusInternalServerError
+}
+
+// bulkRequest parses operations and mode of a bulk request
+func bulkRequest(s *schema.Schema, dataMap map[string]interface{}, maxOperations int) ([]resources.BulkOperation, bool, error) {
+	rawOperations, ok := dataMap["operations"].([]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("Bulk request has to contain a list of operations")
+	}
+	if len(rawOperations) > maxOperations {
+		return nil, false, fmt.Errorf("Bulk request can contain at most %d operations", maxOperations)
+	}
+	allOrNothing := true
+	switch dataMap["mode"] {
+	case nil, "all_or_nothing":
+	case "best_effort":
+		allOrNothing = false
+	default:
+		return nil, false, fmt.Errorf("Unknown bulk mode %v, has to be all_or_nothing or best_effort", dataMap["mode"])
+	}
+	operations, err := resources.BulkOperationsFromData(s, rawOperations)
+	return operations, allOrNothing, err
+}
+
+// bulkResponse converts results of bulk operations to the response
+func bulkResponse(operations []resources.BulkOperation, results []resources.BulkResult) map[string]interface{} {
+	responses := make([]interface{}, len(results))
+	for i, result := range results {
+		if result.Err != nil {
+			response, code := errorResponse(result.Err)
+			response["status"] = code
+			responses[i] = response
+			continue
+		}
+		response := map[string]interface{}{}
+		if data, ok := result.Response.(map[string]interface{}); ok {
+			for key, value := range data {
+				response[key] = value
+			}
+		}
+		switch operations[i].Action {
+		case schema.ActionCreate:
+			response["status"] = http.StatusCreated
+		case schema.ActionDelete:
+			response["status"] = http.StatusNoContent
+		default:
+			response["status"] = http.StatusOK
+		}
+		responses[i] = response
+	}
+	return map[string]interface{}{"results": responses}
+}
+
+// addETagHeader sets ETag header of a single resource response, if known
+func addETagHeader(w http.ResponseWriter, context middleware.Context) {
+	if etag, ok := context["etag"].(string); ok && etag != "" {
+		w.Header().Set("ETag", etag)
 	}
 }
 
@@ -236,6 +314,11 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 
 	//setup list route
 	getPluralFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+		if isWatchRequest(r) {
+			fillInContext(context, dataStore, r, w, s, p, server.sync, identityService, server.queue, nil)
+			serveWatch(w, r, context, dataStore, server.sync, s)
+			return
+		}
 		addJSONContentTypeHeader(w)
 		fillInContext(context, dataStore, r, w, s, p, server.sync, identityService, server.queue, nil)
 		if err := resources.GetMultipleResources(context, dataStore, s, r.URL.Query()); err != nil {
@@ -243,6 +326,9 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 			return
 		}
 		w.Header().Add("X-Total-Count", fmt.Sprint(context["total"]))
+		if marker, ok := context["next_marker"].(string); ok {
+			w.Header().Add("X-Next-Marker", marker)
+		}
 		routes.ServeJson(w, context["response"])
 	}
 	route.Get(pluralURL, middleware.Authorization(schema.ActionRead), getPluralFunc)
@@ -260,6 +346,13 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 			handleError(w, err)
 			return
 		}
+		addETagHeader(w, context)
+		if etag, ok := context["etag"].(string); ok && etag != "" {
+			if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && transaction.MatchETag(ifNoneMatch, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 		routes.ServeJson(w, context["response"])
 	}
 	route.Get(singleURL, middleware.Authorization(schema.ActionRead), getSingleFunc)
@@ -268,6 +361,29 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 		getSingleFunc(w, r, p, identityService, context)
 	})
 
+	//setup history route
+	if s.History() {
+		getHistoryFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+			addJSONContentTypeHeader(w)
+			fillInContext(context, dataStore, r, w, s, p, server.sync, identityService, server.queue, nil)
+			if err := resources.GetResourceHistory(context, dataStore, s, p["id"]); err != nil {
+				handleError(w, err)
+				return
+			}
+			routes.ServeJson(w, context["response"])
+		}
+		route.Get(singleURL+"/history", middleware.Authorization(schema.ActionRead), getHistoryFunc)
+		route.Get(singleURLWithParents+"/history", middleware.Authorization(schema.ActionRead),
+			func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+				addParamToQuery(r, schema.FormatParentID(s.Parent), p[s.Parent])
+				getHistoryFunc(w, r, p, identityService, context)
+			})
+	}
+
+	if s.ReadOnly() {
+		return
+	}
+
 	//setup delete route
 	deleteSingleFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
 		addJSONContentTypeHeader(w)
@@ -285,6 +401,25 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 		deleteSingleFunc(w, r, p, identityService, context)
 	})
 
+	//setup restore route
+	if s.Recoverable() {
+		restoreSingleFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+			addJSONContentTypeHeader(w)
+			fillInContext(context, dataStore, r, w, s, p, server.sync, identityService, server.queue, nil)
+			if err := resources.RestoreResource(context, dataStore, s, p["id"]); err != nil {
+				handleError(w, err)
+				return
+			}
+			routes.ServeJson(w, context["response"])
+		}
+		route.Post(singleURL+"/restore", middleware.Authorization(schema.ActionRestore), restoreSingleFunc)
+		route.Post(singleURLWithParents+"/restore", middleware.Authorization(schema.ActionRestore),
+			func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+				addParamToQuery(r, schema.FormatParentID(s.Parent), p[s.Parent])
+				restoreSingleFunc(w, r, p, identityService, context)
+			})
+	}
+
 	//setup create route
 	postPluralFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
 		addJSONContentTypeHeader(w)
@@ -308,6 +443,7 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 			handleError(w, err)
 			return
 		}
+		addETagHeader(w, context)
 		w.WriteHeader(http.StatusCreated)
 		routes.ServeJson(w, context["response"])
 	}
@@ -318,6 +454,43 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 			postPluralFunc(w, r, p, identityService, context)
 		})
 
+	//setup bulk route
+	bulkMaxOperations := util.GetConfig().GetInt("bulk/max_operations", 1000)
+	postBulkFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+		addJSONContentTypeHeader(w)
+		dataMap, err := middleware.ReadJSON(r)
+		if err != nil {
+			handleError(w, resources.NewResourceError(err, fmt.Sprintf("Failed to parse data: %s", err), resources.WrongData))
+			return
+		}
+		operations, allOrNothing, err := bulkRequest(s, dataMap, bulkMaxOperations)
+		if err != nil {
+			handleError(w, resources.NewResourceError(err, err.Error(), resources.WrongData))
+			return
+		}
+		if parentID := r.URL.Query().Get(s.ParentID()); s.Parent != "" && parentID != "" {
+			for _, operation := range operations {
+				if _, ok := operation.Resource[s.ParentID()]; operation.Action == schema.ActionCreate && !ok {
+					operation.Resource[s.ParentID()] = parentID
+				}
+			}
+		}
+		fillInContext(context, dataStore, r, w, s, p, server.sync, identityService, server.queue, nil)
+		results, err := resources.BulkResources(context, dataStore, identityService, s, operations, allOrNothing)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		routes.ServeJson(w, bulkResponse(operations, results))
+	}
+	// operations are authorized one by one with their own actions
+	route.Post(pluralURL+"/bulk", middleware.Authorization(schema.ActionCreate), postBulkFunc)
+	route.Post(pluralURLWithParents+"/bulk", middleware.Authorization(schema.ActionCreate),
+		func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
+			addParamToQuery(r, schema.FormatParentID(s.Parent), p[s.Parent])
+			postBulkFunc(w, r, p, identityService, context)
+		})
+
 	//setup create or update route
 	putSingleFunc := func(w http.ResponseWriter, r *http.Request, p martini.Params, identityService middleware.IdentityService, context middleware.Context) {
 		addJSONContentTypeHeader(w)
@@ -329,11 +502,13 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 		}
 		dataMap = removeResourceWrapper(s, dataMap)
 		fillInContext(context, dataStore, r, w, s, p, server.sync, identityService, server.queue, dataMap)
-		if isCreated, err := resources.CreateOrUpdateResource(
-			context, dataStore, identityService, s, id, dataMap); err != nil {
+		isCreated, err := resources.CreateOrUpdateResource(context, dataStore, identityService, s, id, dataMap)
+		if err != nil {
 			handleError(w, err)
 			return
-		} else if isCreated {
+		}
+		addETagHeader(w, context)
+		if isCreated {
 			w.WriteHeader(http.StatusCreated)
 		}
 		routes.ServeJson(w, context["response"])
@@ -361,6 +536,7 @@ func MapRouteBySchema(server *Server, dataStore db.DB, s *schema.Schema) {
 			handleError(w, err)
 			return
 		}
+		addETagHeader(w, context)
 		routes.ServeJson(w, context["response"])
 	}
 	route.Patch(singleURL, middleware.Authorization(schema.ActionUpdate), patchSingleFunc)
@@ -440,10 +616,15 @@ func MapRouteBySchemas(server *Server, dataStore db.DB) {
 			context["auth"] = auth
 			context["sync"] = server.sync
 
+			filter, err := resources.FilterFromQueryParameter(s, r.URL.Query())
+			if err != nil {
+				handleError(w, resources.NewResourceError(err, err.Error(), resources.WrongQuery))
+				return
+			}
 			if err := resources.GetResources(
 				context, dataStore,
 				s,
-				resources.FilterFromQueryParameter(s, r.URL.Query()),
+				filter,
 				nil,
 			); err != nil {
 				handleError(w, err)
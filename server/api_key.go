@@ -0,0 +1,379 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/extension"
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/cloudwan/gohan/server/resources"
+	"github.com/rackspace/gophercloud"
+)
+
+const (
+	// APIKeySchemaID is ID of the schema of API keys
+	APIKeySchemaID = "api_key"
+	// APIKeyPrefix starts every API key, it tells API keys from other tokens
+	APIKeyPrefix = "gak_"
+
+	apiKeySecretLength = 32
+	apiKeyPrefixLength = len(APIKeyPrefix) + 8
+)
+
+// GenerateAPIKey returns a new random API key
+func GenerateAPIKey() (string, error) {
+	secret := make([]byte, apiKeySecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashAPIKey returns the hash of an API key stored instead of the key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyIdentity authenticates clients using API keys stored in the database
+type APIKeyIdentity struct {
+	db db.DB
+	// TrustedProxies is the number of proxies in front of Gohan appending to X-Forwarded-For.
+	// The client address checked against allowed IPs of keys is the entry appended by
+	// the farthest of them, the address of the connection is used when it's zero.
+	TrustedProxies int
+}
+
+// NewAPIKeyIdentity creates an identity service verifying API keys stored in the database
+func NewAPIKeyIdentity(dataStore db.DB) *APIKeyIdentity {
+	return &APIKeyIdentity{db: dataStore}
+}
+
+// ClaimsToken tells whether the token is an API key
+func (identity *APIKeyIdentity) ClaimsToken(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// VerifyToken verifies an API key, keys restricted to allowed IPs are rejected
+func (identity *APIKeyIdentity) VerifyToken(token string) (schema.Authorization, error) {
+	return identity.VerifyRequestToken(token, nil)
+}
+
+// VerifyRequestToken verifies an API key used in the request
+func (identity *APIKeyIdentity) VerifyRequestToken(token string, req *http.Request) (schema.Authorization, error) {
+	auth, err := identity.verify(token, req)
+	if err != nil {
+		metrics.UpdateCounter(1, "api_key.verify.failed")
+		log.Debug("API key rejected: %s", err)
+		return nil, fmt.Errorf("Invalid API key")
+	}
+	metrics.UpdateCounter(1, "api_key.verify.ok")
+	return auth, nil
+}
+
+func (identity *APIKeyIdentity) verify(token string, req *http.Request) (schema.Authorization, error) {
+	if !identity.ClaimsToken(token) {
+		return nil, fmt.Errorf("not an API key")
+	}
+	apiKey, err := identity.findAPIKey(transaction.Filter{"key_hash": HashAPIKey(token)})
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == nil {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	data := apiKey.Data()
+	if enabled, _ := data["enabled"].(bool); !enabled {
+		return nil, fmt.Errorf("API key %s is disabled", apiKey.ID())
+	}
+	if expiresAt := apiKeyInt(data["expires_at"]); expiresAt > 0 && time.Now().Unix() >= expiresAt {
+		return nil, fmt.Errorf("API key %s expired", apiKey.ID())
+	}
+	if allowedIPs := apiKeyStrings(data["allowed_ips"]); len(allowedIPs) > 0 {
+		if req == nil {
+			return nil, fmt.Errorf("API key %s requires the client address", apiKey.ID())
+		}
+		clientIP := identity.clientIP(req)
+		if !apiKeyAllowsIP(allowedIPs, clientIP) {
+			return nil, fmt.Errorf("API key %s is not allowed from %s", apiKey.ID(), clientIP)
+		}
+	}
+	tenantID, _ := data["tenant_id"].(string)
+	tenantName, _ := data["tenant_name"].(string)
+	if tenantName == "" {
+		tenantName = tenantID
+	}
+	name, _ := data["name"].(string)
+	return schema.NewUserAuthorization(
+		APIKeyPrefix+apiKey.ID(), name, tenantID, tenantName, token, apiKeyStrings(data["roles"]), nil), nil
+}
+
+// findAPIKey returns the first API key matching the filter. Lookups are shared between requests
+// by the query cache for cache_ttl of the api_key schema, which commits changing keys invalidate.
+func (identity *APIKeyIdentity) findAPIKey(filter transaction.Filter) (*schema.Resource, error) {
+	apiKeySchema, ok := schema.GetManager().Schema(APIKeySchemaID)
+	if !ok {
+		return nil, fmt.Errorf("schema %s not found", APIKeySchemaID)
+	}
+	var apiKey *schema.Resource
+	err := db.Within(identity.db, func(tx transaction.Transaction) error {
+		apiKeys, _, err := tx.List(apiKeySchema, filter, nil, nil)
+		if err != nil {
+			return err
+		}
+		if len(apiKeys) > 0 {
+			apiKey = apiKeys[0]
+		}
+		return nil
+	})
+	return apiKey, err
+}
+
+// clientIP returns the address of the client of the request. Entries of X-Forwarded-For
+// left of the ones appended by trusted proxies are sent by the client, so they are skipped.
+func (identity *APIKeyIdentity) clientIP(req *http.Request) string {
+	if identity.TrustedProxies > 0 {
+		var forwardedFor []string
+		for _, header := range req.Header["X-Forwarded-For"] {
+			for _, address := range strings.Split(header, ",") {
+				forwardedFor = append(forwardedFor, strings.TrimSpace(address))
+			}
+		}
+		if len(forwardedFor) > 0 {
+			index := len(forwardedFor) - identity.TrustedProxies
+			if index < 0 {
+				index = 0
+			}
+			return forwardedFor[index]
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// GetTenantID returns the ID of a tenant of API keys
+func (identity *APIKeyIdentity) GetTenantID(tenantName string) (string, error) {
+	apiKey, err := identity.findAPIKey(transaction.Filter{"tenant_name": tenantName})
+	if err != nil {
+		return "", err
+	}
+	if apiKey == nil {
+		return "", fmt.Errorf("No API key of tenant %s", tenantName)
+	}
+	return apiKey.Get("tenant_id").(string), nil
+}
+
+// GetTenantName returns the name of a tenant of API keys
+func (identity *APIKeyIdentity) GetTenantName(tenantID string) (string, error) {
+	apiKey, err := identity.findAPIKey(transaction.Filter{"tenant_id": tenantID})
+	if err != nil {
+		return "", err
+	}
+	if apiKey == nil {
+		return "", fmt.Errorf("No API key of tenant %s", tenantID)
+	}
+	if tenantName, _ := apiKey.Get("tenant_name").(string); tenantName != "" {
+		return tenantName, nil
+	}
+	return tenantID, nil
+}
+
+// GetServiceAuthorization is not supported, API keys are credentials of clients only
+func (identity *APIKeyIdentity) GetServiceAuthorization() (schema.Authorization, error) {
+	return nil, fmt.Errorf("API key identity has no service authorization")
+}
+
+// GetClient returns nil, API keys aren't backed by an OpenStack service
+func (identity *APIKeyIdentity) GetClient() *gophercloud.ServiceClient {
+	return nil
+}
+
+func apiKeyAllowsIP(allowedIPs []string, clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range allowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func apiKeyStrings(raw interface{}) []string {
+	result := []string{}
+	switch values := raw.(type) {
+	case []string:
+		result = append(result, values...)
+	case []interface{}:
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+func apiKeyInt(raw interface{}) int64 {
+	switch value := raw.(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	}
+	return 0
+}
+
+// apiKeyEnvironment generates keys of created API keys and keeps their hashes out of responses
+type apiKeyEnvironment struct {
+}
+
+func (env *apiKeyEnvironment) LoadExtensionsForPath(extensions []*schema.Extension, timeLimit time.Duration, timeLimits []*schema.PathEventTimeLimit, path string) error {
+	return nil
+}
+
+func (env *apiKeyEnvironment) HandleEvent(event string, context map[string]interface{}) error {
+	switch event {
+	case "pre_create":
+		resource, _ := context["resource"].(map[string]interface{})
+		if err := checkAPIKeyRoles(context, resource); err != nil {
+			return err
+		}
+		return checkAllowedIPs(resource)
+	case "pre_create_in_transaction":
+		// properties without the create permission are set once the request is validated
+		resource, _ := context["resource"].(map[string]interface{})
+		key, err := GenerateAPIKey()
+		if err != nil {
+			return err
+		}
+		resource["key_hash"] = HashAPIKey(key)
+		resource["key_prefix"] = key[:apiKeyPrefixLength]
+		resource["tenant_name"] = apiKeyTenantName(context, resource)
+		context["api_key"] = key
+	case "pre_update":
+		resource, _ := context["resource"].(map[string]interface{})
+		if err := checkAPIKeyRoles(context, resource); err != nil {
+			return err
+		}
+		return checkAllowedIPs(resource)
+	case "post_create":
+		if apiKey := responseAPIKey(context); apiKey != nil {
+			apiKey["key"] = context["api_key"]
+		}
+	}
+	removeAPIKeyHashes(context)
+	return nil
+}
+
+func (env *apiKeyEnvironment) Clone() extension.Environment {
+	return env
+}
+
+func (env *apiKeyEnvironment) IsEventHandled(event string, context map[string]interface{}) bool {
+	switch event {
+	case "pre_create", "pre_create_in_transaction", "pre_update", "post_create", "post_update", "post_show", "post_list":
+		return true
+	}
+	return false
+}
+
+// checkAPIKeyRoles prevents non admins from granting roles they don't have
+func checkAPIKeyRoles(context map[string]interface{}, resource map[string]interface{}) error {
+	auth, ok := context["auth"].(schema.Authorization)
+	if !ok || resource == nil {
+		return nil
+	}
+	if resources.IsAdmin(auth) {
+		return nil
+	}
+	granted := map[string]bool{}
+	for _, role := range auth.Roles() {
+		granted[role.Name] = true
+	}
+	for _, role := range apiKeyStrings(resource["roles"]) {
+		if !granted[role] {
+			return extension.Errorf(http.StatusForbidden, "CustomException", fmt.Sprintf("Role %s can't be granted to API keys", role))
+		}
+	}
+	return nil
+}
+
+func checkAllowedIPs(resource map[string]interface{}) error {
+	for _, allowed := range apiKeyStrings(resource["allowed_ips"]) {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return extension.Errorf(http.StatusBadRequest, "CustomException", fmt.Sprintf("Invalid allowed IP %s", allowed))
+		}
+	}
+	return nil
+}
+
+func apiKeyTenantName(context map[string]interface{}, resource map[string]interface{}) string {
+	tenantID, _ := resource["tenant_id"].(string)
+	if identityService, ok := context["identity_service"].(middleware.IdentityService); ok && tenantID != "" {
+		if tenantName, err := identityService.GetTenantName(tenantID); err == nil {
+			return tenantName
+		}
+	}
+	if auth, ok := context["auth"].(schema.Authorization); ok && auth.TenantID() == tenantID {
+		return auth.TenantName()
+	}
+	return tenantID
+}
+
+func responseAPIKey(context map[string]interface{}) map[string]interface{} {
+	response, _ := context["response"].(map[string]interface{})
+	apiKey, _ := response["api_key"].(map[string]interface{})
+	return apiKey
+}
+
+func removeAPIKeyHashes(context map[string]interface{}) {
+	response, _ := context["response"].(map[string]interface{})
+	if apiKey, ok := response["api_key"].(map[string]interface{}); ok {
+		delete(apiKey, "key_hash")
+	}
+	if apiKeys, ok := response["api_keys"].([]interface{}); ok {
+		for _, rawAPIKey := range apiKeys {
+			if apiKey, ok := rawAPIKey.(map[string]interface{}); ok {
+				delete(apiKey, "key_hash")
+			}
+		}
+	}
+}
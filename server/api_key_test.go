@@ -0,0 +1,188 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	srv "github.com/cloudwan/gohan/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("API keys", func() {
+	apiKeysURL := baseURL + "/gohan/v0.1/api_keys"
+
+	createAPIKey := func(apiKey map[string]interface{}) (string, map[string]interface{}) {
+		result := testURL("POST", apiKeysURL, adminTokenID, apiKey, http.StatusCreated)
+		created := result.(map[string]interface{})["api_key"].(map[string]interface{})
+		return created["key"].(string), created
+	}
+
+	AfterEach(func() {
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			for _, schemaID := range []string{"network", srv.APIKeySchemaID} {
+				s, _ := schema.GetManager().Schema(schemaID)
+				Expect(clearTable(tx, s)).To(Succeed())
+			}
+			return nil
+		})).To(Succeed())
+	})
+
+	It("should return the key once and store its hash only", func() {
+		key, created := createAPIKey(map[string]interface{}{
+			"name":      "ci",
+			"tenant_id": "fc394f2ab2df4114bde39905f800dc57",
+			"roles":     []string{"admin"},
+		})
+		Expect(key).To(HavePrefix(srv.APIKeyPrefix))
+		Expect(created).To(HaveKeyWithValue("key_prefix", key[:len(srv.APIKeyPrefix)+8]))
+		Expect(created).To(HaveKeyWithValue("tenant_name", "demo"))
+		Expect(created).ToNot(HaveKey("key_hash"))
+
+		result := testURL("GET", apiKeysURL+"/"+created["id"].(string), adminTokenID, nil, http.StatusOK)
+		shown := result.(map[string]interface{})["api_key"].(map[string]interface{})
+		Expect(shown).ToNot(HaveKey("key"))
+		Expect(shown).ToNot(HaveKey("key_hash"))
+
+		result = testURL("GET", apiKeysURL, adminTokenID, nil, http.StatusOK)
+		listed := result.(map[string]interface{})["api_keys"].([]interface{})
+		Expect(listed).To(HaveLen(1))
+		Expect(listed[0]).ToNot(HaveKey("key_hash"))
+
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			s, _ := schema.GetManager().Schema(srv.APIKeySchemaID)
+			stored, err := tx.Fetch(s, transaction.IDFilter(created["id"].(string)), nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stored.Get("key_hash")).To(Equal(srv.HashAPIKey(key)))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("should authenticate requests with API keys next to keystone tokens", func() {
+		key, _ := createAPIKey(map[string]interface{}{
+			"name":      "ci",
+			"tenant_id": "fc394f2ab2df4114bde39905f800dc57",
+			"roles":     []string{"admin"},
+		})
+		testURL("GET", networkPluralURL, key, nil, http.StatusOK)
+		testURL("GET", networkPluralURL, adminTokenID, nil, http.StatusOK)
+		testURL("GET", networkPluralURL, srv.APIKeyPrefix+"unknown", nil, http.StatusUnauthorized)
+
+		network := testURL("POST", networkPluralURL, key, map[string]interface{}{"name": "ci"}, http.StatusCreated)
+		Expect(network.(map[string]interface{})["network"]).To(HaveKeyWithValue("tenant_id", "fc394f2ab2df4114bde39905f800dc57"))
+	})
+
+	It("should reject disabled and expired keys", func() {
+		key, created := createAPIKey(map[string]interface{}{
+			"tenant_id": "fc394f2ab2df4114bde39905f800dc57",
+			"roles":     []string{"admin"},
+		})
+		apiKeyURL := apiKeysURL + "/" + created["id"].(string)
+
+		testURL("PUT", apiKeyURL, adminTokenID, map[string]interface{}{"enabled": false}, http.StatusOK)
+		testURL("GET", networkPluralURL, key, nil, http.StatusUnauthorized)
+
+		testURL("PUT", apiKeyURL, adminTokenID, map[string]interface{}{
+			"enabled":    true,
+			"expires_at": time.Now().Add(-time.Minute).Unix(),
+		}, http.StatusOK)
+		testURL("GET", networkPluralURL, key, nil, http.StatusUnauthorized)
+
+		testURL("PUT", apiKeyURL, adminTokenID, map[string]interface{}{
+			"expires_at": time.Now().Add(time.Hour).Unix(),
+		}, http.StatusOK)
+		testURL("GET", networkPluralURL, key, nil, http.StatusOK)
+	})
+
+	It("should reject keys revoked after they were used", func() {
+		key, created := createAPIKey(map[string]interface{}{
+			"tenant_id": "fc394f2ab2df4114bde39905f800dc57",
+			"roles":     []string{"admin"},
+		})
+		apiKeyURL := apiKeysURL + "/" + created["id"].(string)
+
+		testURL("GET", networkPluralURL, key, nil, http.StatusOK)
+		testURL("PUT", apiKeyURL, adminTokenID, map[string]interface{}{"enabled": false}, http.StatusOK)
+		testURL("GET", networkPluralURL, key, nil, http.StatusUnauthorized)
+
+		testURL("PUT", apiKeyURL, adminTokenID, map[string]interface{}{"enabled": true}, http.StatusOK)
+		testURL("GET", networkPluralURL, key, nil, http.StatusOK)
+		testURL("DELETE", apiKeyURL, adminTokenID, nil, http.StatusNoContent)
+		testURL("GET", networkPluralURL, key, nil, http.StatusUnauthorized)
+	})
+
+	It("should accept keys from allowed IPs only", func() {
+		key, created := createAPIKey(map[string]interface{}{
+			"tenant_id":   "fc394f2ab2df4114bde39905f800dc57",
+			"roles":       []string{"admin"},
+			"allowed_ips": []string{"10.0.0.0/8"},
+		})
+		testURL("GET", networkPluralURL, key, nil, http.StatusUnauthorized)
+
+		testURL("PUT", apiKeysURL+"/"+created["id"].(string), adminTokenID, map[string]interface{}{
+			"allowed_ips": []string{"10.0.0.0/8", "127.0.0.1"},
+		}, http.StatusOK)
+		testURL("GET", networkPluralURL, key, nil, http.StatusOK)
+
+		testURL("PUT", apiKeysURL+"/"+created["id"].(string), adminTokenID, map[string]interface{}{
+			"allowed_ips": []string{"localhost"},
+		}, http.StatusBadRequest)
+	})
+
+	It("should take the client address from entries of trusted proxies", func() {
+		key, _ := createAPIKey(map[string]interface{}{
+			"tenant_id":   "fc394f2ab2df4114bde39905f800dc57",
+			"roles":       []string{"admin"},
+			"allowed_ips": []string{"10.0.0.0/8"},
+		})
+		verify := func(trustedProxies int, forwardedFor ...string) error {
+			identity := srv.NewAPIKeyIdentity(testDB)
+			identity.TrustedProxies = trustedProxies
+			request, _ := http.NewRequest("GET", networkPluralURL, nil)
+			request.RemoteAddr = "127.0.0.1:4000"
+			for _, header := range forwardedFor {
+				request.Header.Add("X-Forwarded-For", header)
+			}
+			_, err := identity.VerifyRequestToken(key, request)
+			return err
+		}
+		Expect(verify(0, "10.1.1.1")).ToNot(Succeed())
+		Expect(verify(1, "10.1.1.1")).To(Succeed())
+		Expect(verify(1, "10.1.1.1, 192.168.0.1")).ToNot(Succeed())
+		Expect(verify(2, "10.1.1.1, 192.168.0.1")).To(Succeed())
+		Expect(verify(2, "10.1.1.1", "192.168.0.1")).To(Succeed())
+		Expect(verify(2, "192.168.0.1, 10.1.1.1, 192.168.0.1")).To(Succeed())
+		Expect(verify(1, "10.1.1.1, 192.168.0.1, 192.168.0.2")).ToNot(Succeed())
+	})
+
+	It("should not let non admins grant roles they don't have", func() {
+		testURL("POST", apiKeysURL, memberTokenID, map[string]interface{}{
+			"roles": []string{"admin"},
+		}, http.StatusForbidden)
+
+		result := testURL("POST", apiKeysURL, memberTokenID, map[string]interface{}{
+			"roles": []string{"Member"},
+		}, http.StatusCreated)
+		created := result.(map[string]interface{})["api_key"].(map[string]interface{})
+		Expect(created).To(HaveKeyWithValue("tenant_id", "fc394f2ab2df4114bde39905f800dc57"))
+		testURL("GET", apiKeysURL, created["key"].(string), nil, http.StatusOK)
+	})
+})
@@ -40,6 +40,7 @@ import (
 	"github.com/cloudwan/gohan/extension/goplugin"
 	"github.com/cloudwan/gohan/extension/otto"
 	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/webhook"
 )
 
 func (server *Server) newEnvironment(name string) extension.Environment {
@@ -59,6 +60,12 @@ func (server *Server) newEnvironment(name string) extension.Environment {
 			envs = append(envs, env)
 		}
 	}
+	switch name {
+	case APIKeySchemaID:
+		envs = append(envs, &apiKeyEnvironment{})
+	case webhook.SubscriptionSchemaID:
+		envs = append(envs, &subscriptionEnvironment{})
+	}
 	return extension.NewEnvironment(envs)
 }
 
@@ -11,6 +11,12 @@ import (
 type CachedIdentityService struct {
 	inner IdentityService
 	cache *cache.Cache
+	ttl   time.Duration
+}
+
+// expiringAuthorization is an authorization which can't be used after its token expires
+type expiringAuthorization interface {
+	ExpiresAt() time.Time
 }
 
 func (c *CachedIdentityService) GetTenantID(tenantName string) (string, error) {
@@ -33,18 +39,35 @@ func (c *CachedIdentityService) GetTenantName(tenantID string) (string, error) {
 func (c *CachedIdentityService) VerifyToken(token string) (schema.Authorization, error) {
 	i, ok := c.cache.Get(token)
 	if ok {
-		return i.(schema.Authorization), nil
+		if expiring, ok := i.(expiringAuthorization); !ok || time.Now().Before(expiring.ExpiresAt()) {
+			return i.(schema.Authorization), nil
+		}
+		c.cache.Delete(token)
 	}
 	a, err := c.inner.VerifyToken(token)
 	if err != nil {
 		return nil, err
 	}
-	c.cache.Set(token, a, cache.DefaultExpiration)
+	expiration := cache.DefaultExpiration
+	if expiring, ok := a.(expiringAuthorization); ok {
+		untilExpired := time.Until(expiring.ExpiresAt())
+		if untilExpired <= 0 {
+			return a, nil
+		}
+		if untilExpired < c.ttl {
+			expiration = untilExpired
+		}
+	}
+	c.cache.Set(token, a, expiration)
 	return a, nil
 }
 
 func (c *CachedIdentityService) GetServiceAuthorization() (schema.Authorization, error) {
-	return c.VerifyToken(c.GetClient().TokenID)
+	client := c.GetClient()
+	if client == nil {
+		return c.inner.GetServiceAuthorization()
+	}
+	return c.VerifyToken(client.TokenID)
 }
 
 func (c *CachedIdentityService) GetClient() *gophercloud.ServiceClient {
@@ -56,5 +79,6 @@ func NewCachedIdentityService(inner IdentityService, ttl time.Duration) Identity
 	return &CachedIdentityService{
 		inner: inner,
 		cache: cache.New(ttl, cleanupInterval),
+		ttl:   ttl,
 	}
 }
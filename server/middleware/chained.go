@@ -0,0 +1,138 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/rackspace/gophercloud"
+)
+
+// RequestIdentityService is an identity service whose verification depends on the request,
+// e.g. on the address of the client
+type RequestIdentityService interface {
+	VerifyRequestToken(token string, req *http.Request) (schema.Authorization, error)
+}
+
+// TokenClaimer is implemented by identity services recognizing their own tokens,
+// tokens claimed by a service are verified by that service only
+type TokenClaimer interface {
+	ClaimsToken(token string) bool
+}
+
+// ChainedIdentityService accepts credentials of any of the chained identity services
+type ChainedIdentityService struct {
+	services []IdentityService
+}
+
+// NewChainedIdentityService creates an identity service trying services in the given order
+func NewChainedIdentityService(services ...IdentityService) *ChainedIdentityService {
+	return &ChainedIdentityService{services: services}
+}
+
+// GetTenantID returns the tenant ID known to the first service knowing the tenant
+func (c *ChainedIdentityService) GetTenantID(tenantName string) (string, error) {
+	var firstErr error
+	for _, service := range c.services {
+		tenantID, err := service.GetTenantID(tenantName)
+		if err == nil {
+			return tenantID, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", c.noService(firstErr)
+}
+
+// GetTenantName returns the tenant name known to the first service knowing the tenant
+func (c *ChainedIdentityService) GetTenantName(tenantID string) (string, error) {
+	var firstErr error
+	for _, service := range c.services {
+		tenantName, err := service.GetTenantName(tenantID)
+		if err == nil {
+			return tenantName, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", c.noService(firstErr)
+}
+
+// VerifyToken verifies the token with the services of the chain
+func (c *ChainedIdentityService) VerifyToken(token string) (schema.Authorization, error) {
+	return c.VerifyRequestToken(token, nil)
+}
+
+// VerifyRequestToken verifies the token with the service claiming it,
+// or with each service in turn until one accepts it
+func (c *ChainedIdentityService) VerifyRequestToken(token string, req *http.Request) (schema.Authorization, error) {
+	for _, service := range c.services {
+		if claimer, ok := service.(TokenClaimer); ok && claimer.ClaimsToken(token) {
+			return verifyRequestToken(service, token, req)
+		}
+	}
+	var firstErr error
+	for _, service := range c.services {
+		if _, ok := service.(TokenClaimer); ok {
+			continue
+		}
+		auth, err := verifyRequestToken(service, token, req)
+		if err == nil {
+			return auth, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, c.noService(firstErr)
+}
+
+// GetServiceAuthorization returns the service authorization of the first service
+func (c *ChainedIdentityService) GetServiceAuthorization() (schema.Authorization, error) {
+	if len(c.services) == 0 {
+		return nil, c.noService(nil)
+	}
+	return c.services[0].GetServiceAuthorization()
+}
+
+// GetClient returns the first client of the chained services
+func (c *ChainedIdentityService) GetClient() *gophercloud.ServiceClient {
+	for _, service := range c.services {
+		if client := service.GetClient(); client != nil {
+			return client
+		}
+	}
+	return nil
+}
+
+func (c *ChainedIdentityService) noService(err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("No identity service accepted the request")
+}
+
+// verifyRequestToken verifies the token, passing the request to services depending on it
+func verifyRequestToken(service IdentityService, token string, req *http.Request) (schema.Authorization, error) {
+	if requestService, ok := service.(RequestIdentityService); ok {
+		return requestService.VerifyRequestToken(token, req)
+	}
+	return service.VerifyToken(token)
+}
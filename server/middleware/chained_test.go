@@ -0,0 +1,98 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/golang/mock/gomock"
+	"github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// claimingIdentityService verifies tokens with its prefix using the request
+type claimingIdentityService struct {
+	*MockIdentityService
+	prefix  string
+	request *http.Request
+}
+
+func (c *claimingIdentityService) ClaimsToken(token string) bool {
+	return strings.HasPrefix(token, c.prefix)
+}
+
+func (c *claimingIdentityService) VerifyRequestToken(token string, req *http.Request) (schema.Authorization, error) {
+	c.request = req
+	return c.VerifyToken(token)
+}
+
+var _ = ginkgo.Describe("Chained identity service", func() {
+	var (
+		ctrl     *gomock.Controller
+		first    *MockIdentityService
+		claiming *claimingIdentityService
+		chained  *ChainedIdentityService
+		auth     schema.Authorization
+	)
+
+	ginkgo.BeforeEach(func() {
+		ctrl = gomock.NewController(ginkgo.GinkgoT())
+		first = NewMockIdentityService(ctrl)
+		claiming = &claimingIdentityService{MockIdentityService: NewMockIdentityService(ctrl), prefix: "key_"}
+		chained = NewChainedIdentityService(first, claiming)
+		auth = schema.NewAuthorization("tenant-id", "tenant-name", "token", []string{}, nil)
+	})
+
+	ginkgo.AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	ginkgo.It("Verifies claimed tokens with the claiming service only", func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		claiming.EXPECT().VerifyToken("key_abc").Return(auth, nil)
+		rv, err := chained.VerifyRequestToken("key_abc", req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rv).To(Equal(auth))
+		Expect(claiming.request).To(Equal(req))
+
+		claiming.EXPECT().VerifyToken("key_bad").Return(nil, fmt.Errorf("invalid"))
+		_, err = chained.VerifyToken("key_bad")
+		Expect(err).To(MatchError("invalid"))
+	})
+
+	ginkgo.It("Verifies other tokens with the services not claiming tokens", func() {
+		first.EXPECT().VerifyToken("token").Return(auth, nil)
+		rv, err := chained.VerifyToken("token")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rv).To(Equal(auth))
+
+		first.EXPECT().VerifyToken("bad").Return(nil, fmt.Errorf("invalid"))
+		_, err = chained.VerifyToken("bad")
+		Expect(err).To(MatchError("invalid"))
+	})
+
+	ginkgo.It("Asks services for tenants in order", func() {
+		first.EXPECT().GetTenantName("tenant-id").Return("", fmt.Errorf("unknown"))
+		claiming.EXPECT().GetTenantName("tenant-id").Return("tenant-name", nil)
+		Expect(chained.GetTenantName("tenant-id")).To(Equal("tenant-name"))
+
+		first.EXPECT().GetTenantID("tenant-name").Return("tenant-id", nil)
+		Expect(chained.GetTenantID("tenant-name")).To(Equal("tenant-id"))
+	})
+})
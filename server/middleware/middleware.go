@@ -22,15 +22,18 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cloudwan/gohan/cloud"
 	"github.com/cloudwan/gohan/metrics"
 	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/cloudwan/gohan/util"
 	"github.com/go-martini/martini"
 	"github.com/rackspace/gophercloud"
+	"github.com/twinj/uuid"
 )
 
 const webuiPATH = "/webui/"
@@ -80,6 +83,12 @@ func Logging() martini.Handler {
 		log.Debug("Request body: %s", string(reqData))
 
 		rw := res.(martini.ResponseWriter)
+		if watch, _ := strconv.ParseBool(req.URL.Query().Get("watch")); watch {
+			// streamed changes are not kept in memory for logging
+			c.Next()
+			log.Info("Completed watch %s in %v", req.URL.Path, time.Since(start))
+			return
+		}
 		rh := newResponseHijacker(rw)
 		c.MapTo(rh, (*http.ResponseWriter)(nil))
 		c.MapTo(rh, (*martini.ResponseWriter)(nil))
@@ -95,9 +104,11 @@ func Logging() martini.Handler {
 
 func Metrics() martini.Handler {
 	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+		start := time.Now()
 		c.Next()
 
 		rw := res.(martini.ResponseWriter)
+		metrics.UpdateTimer(start, "http.%s.duration.%d", req.Method, rw.Status())
 		metrics.UpdateCounter(1, "http.%s.status.%d", req.Method, rw.Status())
 		if 200 <= rw.Status() && rw.Status() < 300 {
 			metrics.UpdateCounter(1, "http.%s.ok", req.Method)
@@ -111,7 +122,7 @@ func Metrics() martini.Handler {
 func filterHeaders(headers http.Header) http.Header {
 	filtered := http.Header{}
 	for k, v := range headers {
-		if k == "X-Auth-Token" {
+		if k == "X-Auth-Token" || k == "Authorization" {
 			filtered[k] = []string{"***"}
 			continue
 		}
@@ -161,9 +172,58 @@ func CreateIdentityServiceFromConfig(config *util.Config) (IdentityService, erro
 		}
 		return keystoneIdentity, nil
 	}
+	if config.GetBool("oidc/use_oidc", false) {
+		log.Info("OIDC identity service configured")
+		return createOIDCIdentityServiceFromConfig(config)
+	}
 	return nil, fmt.Errorf("No identity service defined in config")
 }
 
+func createOIDCIdentityServiceFromConfig(config *util.Config) (IdentityService, error) {
+	refreshInterval, err := time.ParseDuration(config.GetString("oidc/jwks_refresh_interval", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse OIDC JWKS refresh interval: %s", err)
+	}
+	leeway, err := time.ParseDuration(config.GetString("oidc/leeway", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse OIDC leeway: %s", err)
+	}
+	defaults := DefaultOIDCClaims()
+	claims := OIDCClaims{
+		TenantID:   config.GetString("oidc/claims/tenant_id", defaults.TenantID),
+		TenantName: config.GetString("oidc/claims/tenant_name", defaults.TenantName),
+		Roles:      config.GetString("oidc/claims/roles", defaults.Roles),
+		DomainID:   config.GetString("oidc/claims/domain_id", defaults.DomainID),
+		DomainName: config.GetString("oidc/claims/domain_name", defaults.DomainName),
+		UserID:     config.GetString("oidc/claims/user_id", defaults.UserID),
+		UserName:   config.GetString("oidc/claims/user_name", defaults.UserName),
+	}
+	var oidcIdentity IdentityService
+	oidcIdentity, err = NewOIDCIdentity(OIDCConfig{
+		Issuer:            config.GetString("oidc/issuer", ""),
+		Audience:          config.GetString("oidc/audience", ""),
+		JWKSFile:          config.GetString("oidc/jwks_file", ""),
+		JWKSURL:           config.GetString("oidc/jwks_url", ""),
+		RefreshInterval:   refreshInterval,
+		Leeway:            leeway,
+		Claims:            claims,
+		ServiceTenantID:   config.GetString("oidc/service/tenant_id", "admin"),
+		ServiceTenantName: config.GetString("oidc/service/tenant_name", "admin"),
+		ServiceRoles:      config.GetStringList("oidc/service/roles", []string{"admin"}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create OIDC identity service: %s", err)
+	}
+	if config.GetBool("oidc/use_auth_cache", false) {
+		ttl, err := time.ParseDuration(config.GetString("oidc/cache_ttl", "5m"))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse OIDC cache TTL: %s", err)
+		}
+		oidcIdentity = NewCachedIdentityService(oidcIdentity, ttl)
+	}
+	return oidcIdentity, nil
+}
+
 //NobodyResourceService contains a definition of nobody resources (that do not require authorization)
 type NobodyResourceService interface {
 	VerifyResourcePath(string) bool
@@ -290,6 +350,9 @@ func Authentication() martini.Handler {
 		}
 
 		authToken := req.Header.Get("X-Auth-Token")
+		if authToken == "" {
+			authToken = bearerToken(req)
+		}
 
 		var targetIdentityService IdentityService
 
@@ -304,7 +367,7 @@ func Authentication() martini.Handler {
 			targetIdentityService = identityService
 		}
 
-		auth, err := targetIdentityService.VerifyToken(authToken)
+		auth, err := verifyRequestToken(targetIdentityService, authToken, req)
 
 		if err != nil {
 			HTTPJSONError(res, err.Error(), http.StatusUnauthorized)
@@ -316,6 +379,15 @@ func Authentication() martini.Handler {
 	}
 }
 
+// bearerToken returns the token of an Authorization header using the Bearer scheme
+func bearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return ""
+}
+
 //Context type
 type Context map[string]interface{}
 
@@ -326,11 +398,57 @@ func WithContext() martini.Handler {
 	}
 }
 
+//RequestIDHeader identifies a request in logs and audit records
+const RequestIDHeader = "X-Request-Id"
+
+//RequestID stores ID of the request in the context and the response,
+//the ID given by the client is used if present
+func RequestID() martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, context Context) {
+		requestID := req.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = uuid.NewV4().String()
+		}
+		context["request_id"] = requestID
+		res.Header().Set(RequestIDHeader, requestID)
+	}
+}
+
+//Tracing records a span of the request continuing the trace given in traceparent header,
+//the span is the current span of the request context
+func Tracing() martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context, context Context) {
+		span := tracing.StartSpanFromTraceparent(req.Header.Get(tracing.TraceparentHeader), "HTTP "+req.Method)
+		if span == nil {
+			c.Next()
+			return
+		}
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.Path)
+		if requestID, ok := context["request_id"].(string); ok {
+			span.SetAttribute("request_id", requestID)
+		}
+		restore := tracing.SetCurrentSpan(context, span)
+		defer restore()
+
+		c.Next()
+
+		status := res.(martini.ResponseWriter).Status()
+		span.SetAttribute("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%s", http.StatusText(status)))
+		}
+		span.Finish()
+	}
+}
+
 //Authorization checks user permissions against policy
 func Authorization(action string) martini.Handler {
 	return func(res http.ResponseWriter, req *http.Request, auth schema.Authorization, context Context) {
 		context["tenant_id"] = auth.TenantID()
 		context["tenant_name"] = auth.TenantName()
+		context["domain_id"] = auth.DomainID()
+		context["domain_name"] = auth.DomainName()
 		context["auth_token"] = auth.AuthToken()
 		context["catalog"] = auth.Catalog()
 		context["auth"] = auth
@@ -0,0 +1,591 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	// Register hashes of supported signature algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/patrickmn/go-cache"
+	"github.com/rackspace/gophercloud"
+)
+
+const (
+	defaultOIDCRefreshInterval = time.Hour
+	defaultOIDCLeeway          = 30 * time.Second
+	// minimum time between reloads of keys triggered by tokens signed with unknown keys
+	oidcUnknownKeyReloadInterval = 10 * time.Second
+	oidcHTTPTimeout              = 10 * time.Second
+	// names of tenants not seen in tokens for this long are forgotten
+	oidcTenantTTL = 24 * time.Hour
+)
+
+// OIDCClaims names claims of tokens mapped to the authorization, nested claims are separated by dots
+type OIDCClaims struct {
+	TenantID   string
+	TenantName string
+	Roles      string
+	DomainID   string
+	DomainName string
+	UserID     string
+	UserName   string
+}
+
+// DefaultOIDCClaims returns the default claim mapping
+func DefaultOIDCClaims() OIDCClaims {
+	return OIDCClaims{
+		TenantID:   "tenant_id",
+		TenantName: "tenant_name",
+		Roles:      "roles",
+		DomainID:   "domain_id",
+		DomainName: "domain_name",
+		UserID:     "sub",
+		UserName:   "preferred_username",
+	}
+}
+
+// OIDCConfig configures OIDCIdentity
+type OIDCConfig struct {
+	// Issuer is the expected iss claim, keys are discovered from it when no JWKS is given
+	Issuer string
+	// Audience is the expected aud claim
+	Audience string
+	// JWKSFile is a local file with the key set
+	JWKSFile string
+	// JWKSURL is the URL of the key set
+	JWKSURL string
+	// RefreshInterval is how often keys fetched from URL are reloaded
+	RefreshInterval time.Duration
+	// Leeway is the allowed clock skew when checking exp and nbf claims
+	Leeway time.Duration
+	Claims OIDCClaims
+	// Service authorization used by Gohan itself
+	ServiceTenantID   string
+	ServiceTenantName string
+	ServiceRoles      []string
+}
+
+// OIDCIdentity authenticates OpenID Connect bearer tokens signed by keys of a JWKS
+type OIDCIdentity struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	jwksURL string
+	keys    map[string]crypto.PublicKey
+	// fetchedAt is when keys were last fetched, successfully or not, reloads are limited by it
+	fetchedAt time.Time
+	// reloading is closed when keys being reloaded are stored, nil if they aren't reloaded
+	reloading chan struct{}
+	// tenants maps IDs of tenants seen in tokens to their names
+	tenants *cache.Cache
+}
+
+// oidcAuthorization is an authorization valid until its token expires
+type oidcAuthorization struct {
+	*schema.BaseAuthorization
+	expiresAt time.Time
+}
+
+// ExpiresAt returns the expiration of the token
+func (auth *oidcAuthorization) ExpiresAt() time.Time {
+	return auth.expiresAt
+}
+
+// NewOIDCIdentity creates an OIDC identity service and loads its keys
+func NewOIDCIdentity(config OIDCConfig) (*OIDCIdentity, error) {
+	if config.Issuer == "" {
+		return nil, fmt.Errorf("OIDC needs an issuer")
+	}
+	if config.Audience == "" {
+		return nil, fmt.Errorf("OIDC needs an audience")
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaultOIDCRefreshInterval
+	}
+	if config.Leeway < 0 {
+		config.Leeway = 0
+	}
+	identity := &OIDCIdentity{
+		config:    config,
+		client:    &http.Client{Timeout: oidcHTTPTimeout},
+		fetchedAt: time.Now(),
+		tenants:   cache.New(oidcTenantTTL, oidcTenantTTL),
+	}
+	keys, jwksURL, err := identity.fetchKeys(config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	identity.storeKeys(keys, jwksURL)
+	return identity, nil
+}
+
+// fetchKeys reads the key set from the file or the URL, which is discovered from the issuer when empty
+func (identity *OIDCIdentity) fetchKeys(jwksURL string) (map[string]crypto.PublicKey, string, error) {
+	var data []byte
+	var err error
+	if identity.config.JWKSFile != "" {
+		data, err = ioutil.ReadFile(identity.config.JWKSFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read JWKS: %s", err)
+		}
+	} else {
+		if jwksURL == "" {
+			if jwksURL, err = identity.discoverJWKSURL(); err != nil {
+				return nil, "", err
+			}
+		}
+		data, err = identity.get(jwksURL)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to fetch JWKS: %s", err)
+		}
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, jwksURL, nil
+}
+
+// storeKeys replaces the keys, mu has to be held once the identity is in use
+func (identity *OIDCIdentity) storeKeys(keys map[string]crypto.PublicKey, jwksURL string) {
+	identity.keys = keys
+	identity.jwksURL = jwksURL
+	metrics.UpdateCounter(1, "oidc.keys.loaded")
+}
+
+func (identity *OIDCIdentity) discoverJWKSURL() (string, error) {
+	data, err := identity.get(strings.TrimSuffix(identity.config.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", fmt.Errorf("failed to discover OIDC configuration: %s", err)
+	}
+	var configuration struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(data, &configuration); err != nil || configuration.JWKSURI == "" {
+		return "", fmt.Errorf("OIDC configuration of %s has no jwks_uri", identity.config.Issuer)
+	}
+	return configuration.JWKSURI, nil
+}
+
+func (identity *OIDCIdentity) get(url string) ([]byte, error) {
+	resp, err := identity.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// key returns the key with the ID, keys are reloaded when they are old or the key is unknown
+func (identity *OIDCIdentity) key(keyID string) (crypto.PublicKey, error) {
+	identity.mu.Lock()
+	defer identity.mu.Unlock()
+
+	age := time.Since(identity.fetchedAt)
+	key, ok := identity.findKey(keyID)
+	if (ok && identity.config.JWKSFile == "" && age > identity.config.RefreshInterval) ||
+		(!ok && age > oidcUnknownKeyReloadInterval) {
+		identity.reloadKeys()
+		key, ok = identity.findKey(keyID)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+	return key, nil
+}
+
+// reloadKeys fetches keys without holding mu, which is held when it's called and returned.
+// Callers arriving during a reload wait for it instead of fetching keys again.
+func (identity *OIDCIdentity) reloadKeys() {
+	if reloading := identity.reloading; reloading != nil {
+		identity.mu.Unlock()
+		<-reloading
+		identity.mu.Lock()
+		return
+	}
+	reloading := make(chan struct{})
+	identity.reloading = reloading
+	// failed fetches count too, so an unavailable issuer isn't asked on every request
+	identity.fetchedAt = time.Now()
+	jwksURL := identity.jwksURL
+	identity.mu.Unlock()
+
+	keys, jwksURL, err := identity.fetchKeys(jwksURL)
+
+	identity.mu.Lock()
+	if err != nil {
+		log.Warning("Failed to reload OIDC keys: %s", err)
+	} else {
+		identity.storeKeys(keys, jwksURL)
+	}
+	identity.reloading = nil
+	close(reloading)
+}
+
+func (identity *OIDCIdentity) findKey(keyID string) (crypto.PublicKey, bool) {
+	if keyID == "" && len(identity.keys) == 1 {
+		for _, key := range identity.keys {
+			return key, true
+		}
+	}
+	key, ok := identity.keys[keyID]
+	return key, ok
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns signature keys of a key set by their IDs
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %s", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %s", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the key, or nil for unsupported key types
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// verifySignature checks the JWS signature of the signed part of a token
+func verifySignature(algorithm string, key crypto.PublicKey, signed, signature []byte) error {
+	if len(algorithm) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	var hash crypto.Hash
+	switch algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch algorithm[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s needs an RSA key", algorithm)
+		}
+		if algorithm[0] == 'R' {
+			return rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature)
+		}
+		return rsa.VerifyPSS(rsaKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s needs an EC key", algorithm)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", algorithm)
+}
+
+// VerifyToken verifies the signature and claims of a token and maps its claims to authorization
+func (identity *OIDCIdentity) VerifyToken(token string) (schema.Authorization, error) {
+	auth, err := identity.verifyToken(token)
+	if err != nil {
+		metrics.UpdateCounter(1, "oidc.verify.failed")
+		return nil, fmt.Errorf("Invalid token: %s", err)
+	}
+	metrics.UpdateCounter(1, "oidc.verify.ok")
+	return auth, nil
+}
+
+func (identity *OIDCIdentity) verifyToken(token string) (schema.Authorization, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %s", err)
+	}
+	key, err := identity.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+	expiresAt, err := identity.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	return identity.authorization(token, claims, expiresAt)
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// checkClaims validates registered claims and returns the expiration of the token
+func (identity *OIDCIdentity) checkClaims(claims map[string]interface{}) (time.Time, error) {
+	now := time.Now()
+	leeway := identity.config.Leeway
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("token has no expiration")
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if now.After(expiresAt.Add(leeway)) {
+		return time.Time{}, fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return time.Time{}, fmt.Errorf("token is not valid yet")
+	}
+	if issuer := identity.config.Issuer; claims["iss"] != issuer {
+		return time.Time{}, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if audience := identity.config.Audience; !hasAudience(claims["aud"], audience) {
+		return time.Time{}, fmt.Errorf("token is not issued for %s", audience)
+	}
+	return expiresAt.Add(leeway), nil
+}
+
+func hasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, item := range aud {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimValue returns a claim by its name, nested claims are separated by dots
+func claimValue(claims map[string]interface{}, name string) interface{} {
+	if name == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claimValue(claims, name).(string)
+	return value
+}
+
+// claimStrings returns a claim given as a list or a space or comma separated string
+func claimStrings(claims map[string]interface{}, name string) []string {
+	var values []string
+	switch value := claimValue(claims, name).(type) {
+	case []interface{}:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	case string:
+		values = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+	}
+	return values
+}
+
+func (identity *OIDCIdentity) authorization(token string, claims map[string]interface{}, expiresAt time.Time) (schema.Authorization, error) {
+	mapping := identity.config.Claims
+	tenantID := claimString(claims, mapping.TenantID)
+	if tenantID == "" {
+		return nil, fmt.Errorf("token has no %s claim", mapping.TenantID)
+	}
+	tenantName := claimString(claims, mapping.TenantName)
+	if tenantName == "" {
+		tenantName = tenantID
+	}
+	identity.tenants.SetDefault(tenantID, tenantName)
+
+	auth := schema.NewDomainAuthorization(
+		claimString(claims, mapping.DomainID),
+		claimString(claims, mapping.DomainName),
+		claimString(claims, mapping.UserID),
+		claimString(claims, mapping.UserName),
+		tenantID,
+		tenantName,
+		token,
+		claimStrings(claims, mapping.Roles),
+		nil).(*schema.BaseAuthorization)
+	return &oidcAuthorization{BaseAuthorization: auth, expiresAt: expiresAt}, nil
+}
+
+// GetTenantID returns ID of a tenant seen in tokens or the service tenant
+func (identity *OIDCIdentity) GetTenantID(tenantName string) (string, error) {
+	if tenantName == identity.config.ServiceTenantName && identity.config.ServiceTenantID != "" {
+		return identity.config.ServiceTenantID, nil
+	}
+	for id, item := range identity.tenants.Items() {
+		if item.Object == tenantName {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("Tenant with name '%s' not found", tenantName)
+}
+
+// GetTenantName returns name of a tenant seen in tokens.
+// OIDC providers don't list tenants, so the ID is used as the name of other tenants.
+func (identity *OIDCIdentity) GetTenantName(tenantID string) (string, error) {
+	if tenantID == identity.config.ServiceTenantID && identity.config.ServiceTenantName != "" {
+		return identity.config.ServiceTenantName, nil
+	}
+	if name, ok := identity.tenants.Get(tenantID); ok {
+		return name.(string), nil
+	}
+	return tenantID, nil
+}
+
+// GetServiceAuthorization returns the configured authorization of Gohan itself
+func (identity *OIDCIdentity) GetServiceAuthorization() (schema.Authorization, error) {
+	return schema.NewAuthorization(identity.config.ServiceTenantID, identity.config.ServiceTenantName,
+		"", identity.config.ServiceRoles, nil), nil
+}
+
+// GetClient returns nil, as there is no Keystone client
+func (identity *OIDCIdentity) GetClient() *gophercloud.ServiceClient {
+	return nil
+}
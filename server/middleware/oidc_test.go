@@ -0,0 +1,334 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("OIDC identity service", func() {
+	const issuer = "https://issuer.example.com"
+
+	var (
+		rsaKey   *rsa.PrivateKey
+		ecKey    *ecdsa.PrivateKey
+		jwksFile string
+		config   OIDCConfig
+	)
+
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		Expect(err).ToNot(HaveOccurred())
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	sign := func(alg, kid string, claims map[string]interface{}) string {
+		signed := encode(map[string]interface{}{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+		var signature []byte
+		switch alg {
+		case "RS256":
+			digest := crypto.SHA256.New()
+			digest.Write([]byte(signed))
+			var err error
+			signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest.Sum(nil))
+			Expect(err).ToNot(HaveOccurred())
+		case "ES256":
+			digest := crypto.SHA256.New()
+			digest.Write([]byte(signed))
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest.Sum(nil))
+			Expect(err).ToNot(HaveOccurred())
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	keySet := func(rsaKid string) map[string]interface{} {
+		return map[string]interface{}{
+			"keys": []interface{}{
+				map[string]interface{}{
+					"kty": "RSA",
+					"kid": rsaKid,
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+				},
+				map[string]interface{}{
+					"kty": "EC",
+					"kid": "ec",
+					"crv": "P-256",
+					"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+					"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+				},
+			},
+		}
+	}
+
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                issuer,
+			"aud":                []interface{}{"gohan", "other"},
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"sub":                "user-id",
+			"preferred_username": "alice",
+			"project":            map[string]interface{}{"id": "tenant-id", "name": "demo"},
+			"realm_access":       map[string]interface{}{"roles": []interface{}{"Member", "viewer"}},
+			"domain_id":          "domain-id",
+		}
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		file, err := ioutil.TempFile("", "jwks")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.NewEncoder(file).Encode(keySet("rsa"))).To(Succeed())
+		file.Close()
+		jwksFile = file.Name()
+
+		mapping := DefaultOIDCClaims()
+		mapping.TenantID = "project.id"
+		mapping.TenantName = "project.name"
+		mapping.Roles = "realm_access.roles"
+		config = OIDCConfig{
+			Issuer:   issuer,
+			Audience: "gohan",
+			JWKSFile: jwksFile,
+			Claims:   mapping,
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		os.Remove(jwksFile)
+	})
+
+	ginkgo.It("Maps claims of verified tokens to authorization", func() {
+		identity, err := NewOIDCIdentity(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, token := range []string{sign("RS256", "rsa", claims()), sign("ES256", "ec", claims())} {
+			auth, err := identity.VerifyToken(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(auth.TenantID()).To(Equal("tenant-id"))
+			Expect(auth.TenantName()).To(Equal("demo"))
+			userID, userName := schema.AuthorizedUser(auth)
+			Expect(userID).To(Equal("user-id"))
+			Expect(userName).To(Equal("alice"))
+			Expect(auth.DomainID()).To(Equal("domain-id"))
+			Expect(auth.AuthToken()).To(Equal(token))
+			Expect(auth.Roles()).To(Equal([]*schema.Role{{Name: "Member"}, {Name: "viewer"}}))
+		}
+
+		Expect(identity.GetTenantName("tenant-id")).To(Equal("demo"))
+		Expect(identity.GetTenantID("demo")).To(Equal("tenant-id"))
+		Expect(identity.GetTenantName("unknown")).To(Equal("unknown"))
+	})
+
+	ginkgo.It("Requires an issuer and an audience", func() {
+		noIssuer := config
+		noIssuer.Issuer = ""
+		_, err := NewOIDCIdentity(noIssuer)
+		Expect(err).To(MatchError(ContainSubstring("issuer")))
+
+		noAudience := config
+		noAudience.Audience = ""
+		_, err = NewOIDCIdentity(noAudience)
+		Expect(err).To(MatchError(ContainSubstring("audience")))
+	})
+
+	ginkgo.It("Rejects invalid tokens", func() {
+		identity, err := NewOIDCIdentity(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		expired := claims()
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+		otherIssuer := claims()
+		otherIssuer["iss"] = "https://other.example.com"
+		otherAudience := claims()
+		otherAudience["aud"] = "other"
+		noTenant := claims()
+		delete(noTenant, "project")
+		valid := sign("RS256", "rsa", claims())
+
+		for _, token := range []string{
+			sign("RS256", "rsa", expired),
+			sign("RS256", "rsa", otherIssuer),
+			sign("RS256", "rsa", otherAudience),
+			sign("RS256", "rsa", noTenant),
+			sign("RS256", "unknown", claims()),
+			sign("ES256", "rsa", claims()),
+			valid[:len(valid)-4] + "AAAA",
+			encode(map[string]interface{}{"alg": "none"}) + "." + encode(claims()) + ".",
+			"not-a-token",
+		} {
+			_, err := identity.VerifyToken(token)
+			Expect(err).To(HaveOccurred(), token)
+		}
+	})
+
+	ginkgo.It("Discovers keys of the issuer and reloads them for unknown keys", func() {
+		var jwks map[string]interface{}
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/.well-known/openid-configuration":
+				json.NewEncoder(w).Encode(map[string]interface{}{"jwks_uri": server.URL + "/keys"})
+			case "/keys":
+				json.NewEncoder(w).Encode(jwks)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		jwks = keySet("old")
+		config.JWKSFile = ""
+		config.Issuer = server.URL
+		identity, err := NewOIDCIdentity(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		tokenClaims := claims()
+		tokenClaims["iss"] = server.URL
+		_, err = identity.VerifyToken(sign("RS256", "old", tokenClaims))
+		Expect(err).ToNot(HaveOccurred())
+
+		jwks = keySet("rotated")
+		identity.fetchedAt = time.Now().Add(-time.Minute)
+		_, err = identity.VerifyToken(sign("RS256", "rotated", tokenClaims))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	ginkgo.It("Limits reloads of keys which fail", func() {
+		var fetches int32
+		var failing int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(keySet("rsa"))
+		}))
+		defer server.Close()
+
+		config.JWKSFile = ""
+		config.JWKSURL = server.URL
+		identity, err := NewOIDCIdentity(config)
+		Expect(err).ToNot(HaveOccurred())
+		atomic.StoreInt32(&failing, 1)
+
+		identity.fetchedAt = time.Now().Add(-time.Minute)
+		for i := 0; i < 3; i++ {
+			_, err = identity.VerifyToken(sign("RS256", "unknown", claims()))
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(atomic.LoadInt32(&fetches)).To(BeNumerically("==", 2))
+
+		identity.fetchedAt = time.Now().Add(-2 * defaultOIDCRefreshInterval)
+		for i := 0; i < 3; i++ {
+			_, err = identity.VerifyToken(sign("ES256", "ec", claims()))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(atomic.LoadInt32(&fetches)).To(BeNumerically("==", 3))
+	})
+
+	ginkgo.It("Verifies tokens signed by known keys while keys are reloaded", func() {
+		fetching := make(chan struct{}, 1)
+		release := make(chan struct{})
+		var blocking bool
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if blocking {
+				fetching <- struct{}{}
+				<-release
+			}
+			json.NewEncoder(w).Encode(keySet("rsa"))
+		}))
+		defer server.Close()
+
+		config.JWKSFile = ""
+		config.JWKSURL = server.URL
+		identity, err := NewOIDCIdentity(config)
+		Expect(err).ToNot(HaveOccurred())
+		blocking = true
+		identity.fetchedAt = time.Now().Add(-time.Minute)
+
+		reloaded := make(chan error)
+		go func() {
+			_, err := identity.VerifyToken(sign("RS256", "unknown", claims()))
+			reloaded <- err
+		}()
+		Eventually(fetching).Should(Receive())
+
+		_, err = identity.VerifyToken(sign("RS256", "rsa", claims()))
+		Expect(err).ToNot(HaveOccurred())
+		close(release)
+		Eventually(reloaded).Should(Receive(HaveOccurred()))
+	})
+
+	ginkgo.It("Caches authorization until the token expires", func() {
+		identity, err := NewOIDCIdentity(config)
+		Expect(err).ToNot(HaveOccurred())
+		cached := NewCachedIdentityService(identity, time.Hour)
+
+		expiring := claims()
+		expiring["exp"] = time.Now().Add(2 * time.Second).Unix()
+		token := sign("RS256", "rsa", expiring)
+		_, err = cached.VerifyToken(token)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cached.VerifyToken(token)).ToNot(BeNil())
+
+		Eventually(func() error {
+			_, err := cached.VerifyToken(token)
+			return err
+		}, 5*time.Second, 200*time.Millisecond).Should(MatchError(ContainSubstring("expired")))
+
+		service, err := cached.GetServiceAuthorization()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(service.Roles()).To(BeEmpty())
+	})
+
+	ginkgo.It("Reads bearer tokens", func() {
+		request, _ := http.NewRequest("GET", "/v2.0/networks", nil)
+		Expect(bearerToken(request)).To(BeEmpty())
+		request.Header.Set("Authorization", "Bearer abc.def.ghi")
+		Expect(bearerToken(request)).To(Equal("abc.def.ghi"))
+		request.Header.Set("Authorization", "Basic YWxpY2U6c2VjcmV0")
+		Expect(bearerToken(request)).To(BeEmpty())
+	})
+})
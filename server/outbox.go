@@ -0,0 +1,190 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/pagination"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/outbox"
+	"github.com/cloudwan/gohan/schema"
+)
+
+// enqueueOutbox stores deliveries of an event to publishers routed in outbox metadata of the resource schema.
+// It runs in the transaction deleting the event, so each event is published at least once.
+func enqueueOutbox(tx transaction.Transaction, event *schema.Resource) error {
+	if !outbox.Enabled() {
+		return nil
+	}
+	resourcePath := event.Get("path").(string)
+	resourceSchema := schema.GetSchemaByURLPath(resourcePath)
+	if resourceSchema == nil {
+		return nil
+	}
+	routes := outbox.Routes(resourceSchema)
+	if len(routes) == 0 {
+		return nil
+	}
+	deliverySchema, _ := schema.GetManager().Schema(outbox.DeliverySchemaID)
+	body := event.Get("body").(string)
+	for _, route := range routes {
+		if _, ok := outbox.GetPublisher(route.Publisher); !ok {
+			// routes are checked on startup, so the event is kept until the publisher is configured
+			return fmt.Errorf("outbox publisher %s of schema %s is not configured", route.Publisher, resourceSchema.ID)
+		}
+		content := body
+		if route.Property != "" {
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(body), &data); err != nil {
+				return fmt.Errorf("failed to unmarshal body on outbox: %s", err)
+			}
+			encoded, err := json.Marshal(data[route.Property])
+			if err != nil {
+				return err
+			}
+			content = string(encoded)
+		}
+		delivery, err := schema.NewResource(deliverySchema, map[string]interface{}{
+			"event_id":     fmt.Sprint(event.Get("id")),
+			"publisher":    route.Publisher,
+			"topic":        route.Topic,
+			"type":         event.Get("type"),
+			"schema_id":    resourceSchema.ID,
+			"path":         resourcePath,
+			"version":      toInt64(event.Get("version")),
+			"timestamp":    toInt64(event.Get("timestamp")),
+			"body":         content,
+			"attempts":     0,
+			"next_attempt": 0,
+			"last_error":   "",
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(delivery); err != nil {
+			return fmt.Errorf("failed to store outbox delivery: %s", err)
+		}
+	}
+	return nil
+}
+
+// Dispatch publishes messages waiting in the outbox.
+// Messages of a publisher are published in order, so the first one waiting
+// for retry holds back the following ones until it is delivered or moved to dead letters.
+func (writer *SyncWriter) Dispatch() (dispatched int, err error) {
+	if !outbox.Enabled() {
+		return 0, nil
+	}
+	deliverySchema, _ := schema.GetManager().Schema(outbox.DeliverySchemaID)
+	var deliveries []*schema.Resource
+	if err = db.Within(writer.db, func(tx transaction.Transaction) error {
+		paginator, _ := pagination.NewPaginator(
+			pagination.OptionKey(deliverySchema, "id"),
+			pagination.OptionOrder(pagination.ASC),
+			pagination.OptionLimit(eventPollingLimit))
+		deliveries, _, err = tx.List(deliverySchema, nil, nil, paginator)
+		return err
+	}); err != nil {
+		return
+	}
+
+	queueOf := func(delivery *schema.Resource) (string, bool) {
+		publisherName := delivery.Get("publisher").(string)
+		_, ok := outbox.GetPublisher(publisherName)
+		return publisherName, ok
+	}
+	return attemptInOrder(deliveries, queueOf, func(delivery *schema.Resource) (error, error) {
+		publisherName := delivery.Get("publisher").(string)
+		publisher, _ := outbox.GetPublisher(publisherName)
+		message := &outbox.Message{
+			ID:        delivery.Get("event_id").(string),
+			Type:      delivery.Get("type").(string),
+			SchemaID:  delivery.Get("schema_id").(string),
+			Path:      delivery.Get("path").(string),
+			Version:   toInt64(delivery.Get("version")),
+			Timestamp: toInt64(delivery.Get("timestamp")),
+			Body:      json.RawMessage(delivery.Get("body").(string)),
+		}
+		publishErr := publisher.Publish(delivery.Get("topic").(string), message)
+		if publishErr != nil {
+			log.Warning("failed to publish %s to outbox publisher %s: %s", message.Path, publisherName, publishErr)
+		}
+		return publishErr, writer.finishDelivery(delivery, publishErr)
+	})
+}
+
+// finishDelivery removes a delivered message, or schedules its retry
+// and moves it to dead letters once all attempts failed
+func (writer *SyncWriter) finishDelivery(delivery *schema.Resource, publishErr error) error {
+	deliverySchema := delivery.Schema()
+	return db.Within(writer.db, func(tx transaction.Transaction) error {
+		if publishErr == nil {
+			return tx.Delete(deliverySchema, delivery.Get("id"))
+		}
+		data := delivery.Data()
+		attempts := int(toInt64(data["attempts"])) + 1
+		if nextAttempt, ok := outbox.Retry().NextAttempt(attempts); ok {
+			retry, err := schema.NewResource(deliverySchema, map[string]interface{}{
+				"id":           data["id"],
+				"attempts":     attempts,
+				"next_attempt": nextAttempt,
+				"last_error":   publishErr.Error(),
+			})
+			if err != nil {
+				return err
+			}
+			return tx.Update(retry)
+		}
+		log.Error("giving up publishing %s to outbox publisher %s after %d attempts: %s",
+			data["path"], data["publisher"], attempts, publishErr)
+		deadLetterSchema, _ := schema.GetManager().Schema(outbox.DeadLetterSchemaID)
+		deadLetterData := map[string]interface{}{}
+		for _, property := range deadLetterSchema.Properties {
+			if value, ok := data[property.ID]; ok && property.ID != "id" {
+				deadLetterData[property.ID] = value
+			}
+		}
+		deadLetterData["attempts"] = attempts
+		deadLetterData["last_error"] = publishErr.Error()
+		deadLetterData["failed_at"] = time.Now().Unix()
+		deadLetter, err := schema.NewResource(deadLetterSchema, deadLetterData)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(deadLetter); err != nil {
+			return err
+		}
+		return tx.Delete(deliverySchema, delivery.Get("id"))
+	})
+}
+
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	}
+	return 0
+}
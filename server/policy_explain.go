@@ -0,0 +1,84 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/cloudwan/gohan/server/resources"
+	"github.com/drone/routes"
+	"github.com/go-martini/martini"
+)
+
+const policyExplainPath = "/gohan/v0.1/policy/explain"
+
+// ExplainPolicy explains how loaded policies authorize the request described by the data,
+// roles, tenant_id, tenant_name, user_id and user_name describe the principal,
+// action and path are required and resource is checked against the matched policy when given
+func ExplainPolicy(data map[string]interface{}) (*schema.PolicyExplanation, error) {
+	action, _ := data["action"].(string)
+	path, _ := data["path"].(string)
+	if action == "" || path == "" {
+		return nil, fmt.Errorf("action and path are required")
+	}
+	var resource map[string]interface{}
+	if rawResource, ok := data["resource"]; ok && rawResource != nil {
+		if resource, ok = rawResource.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("resource should be an object")
+		}
+	}
+	tenantID, _ := data["tenant_id"].(string)
+	tenantName, _ := data["tenant_name"].(string)
+	userID, _ := data["user_id"].(string)
+	userName, _ := data["user_name"].(string)
+	roles := []string{}
+	if rawRoles, ok := data["roles"].([]interface{}); ok {
+		for _, rawRole := range rawRoles {
+			role, ok := rawRole.(string)
+			if !ok {
+				return nil, fmt.Errorf("roles should be a list of strings")
+			}
+			roles = append(roles, role)
+		}
+	}
+	auth := schema.NewUserAuthorization(userID, userName, tenantID, tenantName, "", roles, nil)
+	return schema.GetManager().ExplainPolicy(action, path, auth, resource), nil
+}
+
+// mapPolicyExplainRoute maps the route explaining policies to admins
+func mapPolicyExplainRoute(route martini.Router) {
+	route.Post(policyExplainPath, func(w http.ResponseWriter, r *http.Request, auth schema.Authorization) {
+		addJSONContentTypeHeader(w)
+		if !resources.IsAdmin(auth) {
+			middleware.HTTPJSONError(w, "Only admins can explain policies", http.StatusForbidden)
+			return
+		}
+		dataMap, err := middleware.ReadJSON(r)
+		if err != nil {
+			middleware.HTTPJSONError(w, fmt.Sprintf("Failed to parse data: %s", err), http.StatusBadRequest)
+			return
+		}
+		explanation, err := ExplainPolicy(dataMap)
+		if err != nil {
+			middleware.HTTPJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		routes.ServeJson(w, explanation)
+	})
+}
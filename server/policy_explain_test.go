@@ -0,0 +1,57 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy explain", func() {
+	explainURL := baseURL + "/gohan/v0.1/policy/explain"
+
+	It("should explain the policy matching a request", func() {
+		result := testURL("POST", explainURL, adminTokenID, map[string]interface{}{
+			"roles":     []string{"Member"},
+			"tenant_id": "fc394f2ab2df4114bde39905f800dc57",
+			"action":    "update",
+			"path":      "/v2.0/networks/red",
+			"resource": map[string]interface{}{
+				"tenant_id": "fc394f2ab2df4114bde39905f800dc57",
+				"shared":    true,
+			},
+		}, http.StatusOK)
+		explanation := result.(map[string]interface{})
+		Expect(explanation).To(HaveKeyWithValue("policy", "member_statement"))
+		Expect(explanation).To(HaveKeyWithValue("schema_id", "network"))
+		Expect(explanation).To(HaveKeyWithValue("allowed", false))
+		Expect(explanation).To(HaveKeyWithValue("errors", ConsistOf("shared is prohibited for this user")))
+		Expect(explanation).To(HaveKeyWithValue("hidden_properties", ContainElement("shared")))
+		Expect(explanation).To(HaveKeyWithValue("tenant_filter", ConsistOf("acf5662bbff44060b93ac3db3c25a590", "fc394f2ab2df4114bde39905f800dc57")))
+		Expect(explanation["policies"]).ToNot(BeEmpty())
+	})
+
+	It("should reject invalid requests and non admins", func() {
+		testURL("POST", explainURL, adminTokenID, map[string]interface{}{"roles": []string{"Member"}}, http.StatusBadRequest)
+		testURL("POST", explainURL, memberTokenID, map[string]interface{}{
+			"roles":  []string{"admin"},
+			"action": "read",
+			"path":   "/v2.0/networks",
+		}, http.StatusForbidden)
+	})
+})
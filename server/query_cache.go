@@ -0,0 +1,123 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/schema"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+)
+
+// cacheInvalidationPrefix is the sync path updated when a schema with cache_ttl changes
+const cacheInvalidationPrefix = "/gohan/cache"
+
+type queryCacheInvalidator interface {
+	InvalidateQueryCache(schemaID string)
+}
+
+// invalidateQueryCache drops list results of the schema shared between transactions of the data store
+func invalidateQueryCache(dataStore db.DB, schemaID string) {
+	if wrapper, ok := dataStore.(*DbSyncWrapper); ok {
+		dataStore = wrapper.DB
+	}
+	if invalidator, ok := dataStore.(queryCacheInvalidator); ok {
+		invalidator.InvalidateQueryCache(schemaID)
+	}
+}
+
+func cachedSchemas() []*schema.Schema {
+	var cached []*schema.Schema
+	for _, s := range schema.GetManager().Schemas() {
+		if s.CacheTTL() > 0 {
+			cached = append(cached, s)
+		}
+	}
+	return cached
+}
+
+// publishCacheInvalidations notifies all processes about committed changes of schemas with cache_ttl
+func publishCacheInvalidations(sync gohan_sync.Sync, changed map[string]bool) {
+	if sync == nil {
+		return
+	}
+	for schemaID := range changed {
+		value, _ := json.Marshal(map[string]interface{}{"timestamp": time.Now().UnixNano()})
+		if err := sync.Update(cacheInvalidationPrefix+"/"+schemaID, string(value)); err != nil {
+			log.Warning("Failed to publish cache invalidation of %s: %s", schemaID, err)
+		}
+	}
+}
+
+// CacheInvalidationWatcher keeps query caches of processes coherent.
+// Every process watches changes of schemas with cache_ttl published by committed transactions
+// and drops its cached results of the changed schemas.
+type CacheInvalidationWatcher struct {
+	sync    gohan_sync.Sync
+	db      db.DB
+	backoff time.Duration
+}
+
+// NewCacheInvalidationWatcher creates a new instance of CacheInvalidationWatcher.
+func NewCacheInvalidationWatcher(sync gohan_sync.Sync, db db.DB) *CacheInvalidationWatcher {
+	return &CacheInvalidationWatcher{
+		sync:    sync,
+		db:      db,
+		backoff: time.Second * 5,
+	}
+}
+
+// Run watches cache invalidations until the ctx is canceled
+func (watcher *CacheInvalidationWatcher) Run(ctx context.Context) error {
+	for {
+		err := watcher.watch(ctx)
+		if err != nil {
+			log.Error("cache invalidation watch interrupted: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watcher.backoff):
+		}
+	}
+}
+
+func (watcher *CacheInvalidationWatcher) watch(ctx context.Context) error {
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+	respCh := watcher.sync.WatchContext(watchCtx, cacheInvalidationPrefix, gohan_sync.RevisionCurrent)
+
+	// changes made while the watch wasn't running are unknown
+	for _, s := range cachedSchemas() {
+		invalidateQueryCache(watcher.db, s.ID)
+	}
+
+	for response := range respCh {
+		if response.Err != nil {
+			return response.Err
+		}
+		schemaID := strings.TrimPrefix(response.Key, cacheInvalidationPrefix+"/")
+		metrics.UpdateCounter(1, "cache.invalidation.%s.received", schemaID)
+		invalidateQueryCache(watcher.db, schemaID)
+	}
+	return nil
+}
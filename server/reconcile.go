@@ -0,0 +1,616 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/pagination"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/schema"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/util"
+)
+
+const (
+	reconcileLockPath = lockPath + "/reconcile"
+
+	defaultReconcileBatchSize = 100
+)
+
+// Kinds of differences between resources in the database and keys in the sync backend
+const (
+	// SyncKeyMissing is a resource without its sync key
+	SyncKeyMissing = "missing"
+	// SyncKeyStale is a sync key with a value not matching its resource
+	SyncKeyStale = "stale"
+	// SyncKeyOrphaned is a config, state or monitoring key of a resource which doesn't exist
+	SyncKeyOrphaned = "orphaned"
+)
+
+// SyncDifference is a sync key which doesn't match the database
+type SyncDifference struct {
+	Kind     string
+	SchemaID string
+	Key      string
+
+	resource *schema.Resource
+	// path is the sync path of an orphaned key without prefixes
+	path string
+}
+
+// SyncDiff lists differences between resources in the database and keys in the sync backend
+type SyncDiff struct {
+	Differences []SyncDifference
+}
+
+// Empty whether the sync backend matches the database
+func (diff *SyncDiff) Empty() bool {
+	return len(diff.Differences) == 0
+}
+
+// Count returns the number of differences of the kind
+func (diff *SyncDiff) Count(kind string) int {
+	count := 0
+	for _, difference := range diff.Differences {
+		if difference.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+func (diff *SyncDiff) String() string {
+	if diff.Empty() {
+		return "Sync backend matches database\n"
+	}
+	var out strings.Builder
+	for _, difference := range diff.Differences {
+		fmt.Fprintf(&out, "%-9s %-20s %s\n", difference.Kind, difference.SchemaID, difference.Key)
+	}
+	fmt.Fprintf(&out, "%d missing, %d stale, %d orphaned\n",
+		diff.Count(SyncKeyMissing), diff.Count(SyncKeyStale), diff.Count(SyncKeyOrphaned))
+	return out.String()
+}
+
+// ReconcilerOptions configures Reconciler
+type ReconcilerOptions struct {
+	// BatchSize is the maximum number of resources read or fixed at once
+	BatchSize int
+	// Schemas limits reconciliation to the schemas, all synced schemas are reconciled when empty
+	Schemas []string
+}
+
+// Reconciler detects and fixes drift between the database and the sync backend.
+// Missing and stale keys are fixed by re-emitting events of their resources, so they are
+// written by SyncWriter in order with other changes. Orphaned keys are deleted directly
+// once a new transaction confirms their resources don't exist.
+type Reconciler struct {
+	sync      gohan_sync.Sync
+	db        db.DB
+	batchSize int
+	schemas   map[string]bool
+}
+
+// NewReconciler creates a new instance of Reconciler.
+func NewReconciler(sync gohan_sync.Sync, dataStore db.DB, options ReconcilerOptions) *Reconciler {
+	if wrapper, ok := dataStore.(*DbSyncWrapper); ok {
+		dataStore = wrapper.DB
+	}
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultReconcileBatchSize
+	}
+	schemas := map[string]bool{}
+	for _, schemaID := range options.Schemas {
+		schemas[schemaID] = true
+	}
+	return &Reconciler{
+		sync:      sync,
+		db:        dataStore,
+		batchSize: batchSize,
+		schemas:   schemas,
+	}
+}
+
+// syncedSchema whether resources of the schema are written to the sync backend
+func syncedSchema(s *schema.Schema) bool {
+	return !s.IsAbstract() && s.Metadata["type"] != "metaschema" && s.Metadata["nosync"] != true
+}
+
+// schemaSyncState is the state of keys of a schema in the sync backend and the database
+type schemaSyncState struct {
+	schema       *schema.Schema
+	configPrefix string
+	// keys maps config, state and monitoring keys of the schema to their values
+	keys map[string]string
+	// resources maps sync paths without prefixes to resources in the database
+	resources map[string]*schema.Resource
+	// contents maps sync paths to expected values of config keys
+	contents map[string]string
+}
+
+// Diff compares resources of synced schemas with keys in the sync backend.
+// Keys are read before resources, and pending events after them,
+// so keys of resources changed during the comparison aren't reported.
+func (r *Reconciler) Diff() (*SyncDiff, error) {
+	var states []*schemaSyncState
+	for _, s := range schema.GetManager().OrderedSchemas() {
+		if !syncedSchema(s) || (len(r.schemas) > 0 && !r.schemas[s.ID]) {
+			continue
+		}
+		state, err := r.readKeys(s)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	for _, state := range states {
+		if err := r.readResources(state); err != nil {
+			return nil, err
+		}
+	}
+	pending, err := r.pendingKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &SyncDiff{}
+	for _, state := range states {
+		state.compare(diff, pending)
+	}
+	return diff, nil
+}
+
+// syncScanPath returns the path all sync paths of the schema start with
+func syncScanPath(s *schema.Schema) string {
+	template, ok := s.SyncKeyTemplate()
+	if !ok {
+		return s.URL
+	}
+	var static []string
+	for _, part := range strings.Split(template, "/") {
+		if strings.Contains(part, "{{") {
+			break
+		}
+		static = append(static, part)
+	}
+	return strings.Join(static, "/")
+}
+
+// ownsSyncPath whether the sync path without prefixes belongs to a resource of the schema
+func ownsSyncPath(s *schema.Schema, path string) bool {
+	if _, ok := s.SyncKeyTemplate(); ok {
+		return schema.GetSchemaByPath(path) == s
+	}
+	id := strings.TrimPrefix(path, s.URL+"/")
+	return id != path && id != "" && !strings.Contains(id, "/")
+}
+
+func (r *Reconciler) readKeys(s *schema.Schema) (*schemaSyncState, error) {
+	state := &schemaSyncState{
+		schema:       s,
+		configPrefix: configPrefix,
+		keys:         map[string]string{},
+		resources:    map[string]*schema.Resource{},
+		contents:     map[string]string{},
+	}
+	if s.SkipConfigPrefix() {
+		state.configPrefix = ""
+	}
+	scanPath := syncScanPath(s)
+	for _, prefix := range []string{state.configPrefix, statePrefix, monitoringPrefix} {
+		node, err := r.sync.Fetch(prefix + scanPath)
+		if err != nil {
+			if isKeyNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to fetch keys of %s: %s", s.ID, err)
+		}
+		collectLeaves(node, state.keys)
+	}
+	return state, nil
+}
+
+// isKeyNotFound whether Fetch failed as there is no key, all sync backends report it the same way
+func isKeyNotFound(err error) bool {
+	return strings.HasPrefix(err.Error(), "Key not found")
+}
+
+func collectLeaves(node *gohan_sync.Node, leaves map[string]string) {
+	if len(node.Children) == 0 {
+		leaves[node.Key] = node.Value
+		return
+	}
+	for _, child := range node.Children {
+		collectLeaves(child, leaves)
+	}
+}
+
+// readResources reads resources of the schema in batches and computes values of their keys.
+// Batches follow the last read id, so resources deleted meanwhile don't shift later ones out of the read.
+func (r *Reconciler) readResources(state *schemaSyncState) error {
+	s := state.schema
+	marker := ""
+	for {
+		var list []*schema.Resource
+		paginator, err := pagination.NewPaginator(
+			pagination.OptionKey(s, "id"),
+			pagination.OptionOrder(pagination.ASC),
+			pagination.OptionLimit(uint64(r.batchSize)),
+			pagination.OptionMarker(marker))
+		if err != nil {
+			return err
+		}
+		err = db.Within(r.db, func(tx transaction.Transaction) error {
+			list, _, err = tx.List(s, nil, nil, paginator)
+			if err != nil {
+				return err
+			}
+			for _, resource := range list {
+				if err := state.addResource(tx, resource); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list resources of %s: %s", s.ID, err)
+		}
+		marker = paginator.NextMarker(list)
+		if marker == "" {
+			return nil
+		}
+	}
+}
+
+func (state *schemaSyncState) addResource(tx transaction.Transaction, resource *schema.Resource) error {
+	s := state.schema
+	body, err := resource.JSONString()
+	if err != nil {
+		return err
+	}
+	path := syncBasePath(s, resource.Path(), body)
+	state.resources[path] = resource
+
+	version := 0
+	if s.StateVersioning() {
+		resourceState, err := tx.StateFetch(s, transaction.IDFilter(resource.ID()))
+		if err != nil {
+			return err
+		}
+		version = int(resourceState.ConfigVersion)
+	}
+	content, err := syncContent(body, schemaSyncPlain(s), schemaSyncProperty(s), version)
+	if err != nil {
+		log.Warning("Can't compare sync key of %s: %s", resource.Path(), err)
+		return nil
+	}
+	state.contents[path] = content
+	return nil
+}
+
+// pendingKeys returns config keys of events which aren't synced yet
+func (r *Reconciler) pendingKeys() (map[string]bool, error) {
+	writer := NewSyncWriter(r.sync, r.db)
+	events, err := writer.listEvents(nil)
+	if err != nil {
+		return nil, err
+	}
+	pending := map[string]bool{}
+	for _, event := range events {
+		pending[generatePath(event.Get("path").(string), event.Get("body").(string))] = true
+	}
+	return pending, nil
+}
+
+func (state *schemaSyncState) compare(diff *SyncDiff, pending map[string]bool) {
+	s := state.schema
+	paths := make([]string, 0, len(state.resources))
+	for path := range state.resources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		key := state.configPrefix + path
+		if pending[key] {
+			continue
+		}
+		value, ok := state.keys[key]
+		expected, comparable := state.contents[path]
+		if !ok {
+			diff.add(SyncKeyMissing, s, key, state.resources[path])
+		} else if comparable && !sameSyncContent(value, expected, schemaSyncPlain(s), s.StateVersioning()) {
+			diff.add(SyncKeyStale, s, key, state.resources[path])
+		}
+	}
+
+	keys := make([]string, 0, len(state.keys))
+	for key := range state.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := key
+		for _, prefix := range []string{statePrefix, monitoringPrefix, state.configPrefix} {
+			if prefix != "" && strings.HasPrefix(key, prefix+"/") {
+				path = strings.TrimPrefix(key, prefix)
+				break
+			}
+		}
+		if pending[state.configPrefix+path] || !ownsSyncPath(s, path) {
+			continue
+		}
+		if _, ok := state.resources[path]; !ok {
+			diff.Differences = append(diff.Differences, SyncDifference{Kind: SyncKeyOrphaned, SchemaID: s.ID, Key: key, path: path})
+		}
+	}
+}
+
+func (diff *SyncDiff) add(kind string, s *schema.Schema, key string, resource *schema.Resource) {
+	diff.Differences = append(diff.Differences, SyncDifference{
+		Kind:     kind,
+		SchemaID: s.ID,
+		Key:      key,
+		resource: resource,
+	})
+}
+
+// sameSyncContent compares values of a config key ignoring formatting of JSON,
+// versions are compared only for schemas with state versioning
+func sameSyncContent(actual, expected string, syncPlain, compareVersion bool) bool {
+	if syncPlain {
+		return actual == expected || sameJSON(actual, expected)
+	}
+	var actualContent, expectedContent struct {
+		Body    string `json:"body"`
+		Version int    `json:"version"`
+	}
+	if json.Unmarshal([]byte(actual), &actualContent) != nil || json.Unmarshal([]byte(expected), &expectedContent) != nil {
+		return false
+	}
+	if compareVersion && actualContent.Version != expectedContent.Version {
+		return false
+	}
+	return sameJSON(actualContent.Body, expectedContent.Body)
+}
+
+// sameJSON compares JSON documents treating null properties as missing
+func sameJSON(a, b string) bool {
+	var aValue, bValue interface{}
+	if json.Unmarshal([]byte(a), &aValue) != nil || json.Unmarshal([]byte(b), &bValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(withoutNulls(aValue), withoutNulls(bValue))
+}
+
+func withoutNulls(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			if item != nil {
+				result[key] = withoutNulls(item)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = withoutNulls(item)
+		}
+		return result
+	}
+	return value
+}
+
+// Reconcile fixes the differences in batches and returns the number of fixed keys.
+// Events re-emitted for missing and stale keys are written by SyncWriter.
+func (r *Reconciler) Reconcile(diff *SyncDiff) (fixed int, err error) {
+	var resync []*schema.Resource
+	var orphans []SyncDifference
+	for _, difference := range diff.Differences {
+		if difference.Kind == SyncKeyOrphaned {
+			orphans = append(orphans, difference)
+		} else {
+			resync = append(resync, difference.resource)
+		}
+	}
+	orphans, err = r.confirmOrphans(orphans)
+	if err != nil {
+		return 0, err
+	}
+	var operations []gohan_sync.Operation
+	for _, orphan := range orphans {
+		operations = append(operations, gohan_sync.Operation{Key: orphan.Key, Delete: true})
+	}
+
+	for start := 0; start < len(resync); start += r.batchSize {
+		end := start + r.batchSize
+		if end > len(resync) {
+			end = len(resync)
+		}
+		emitted, err := r.resync(resync[start:end])
+		fixed += emitted
+		if err != nil {
+			return fixed, err
+		}
+	}
+
+	batchSize := r.batchSize
+	if batcher, ok := r.sync.(gohan_sync.Batcher); ok && batcher.MaxBatchSize() > 0 && batcher.MaxBatchSize() < batchSize {
+		batchSize = batcher.MaxBatchSize()
+	}
+	for start := 0; start < len(operations); start += batchSize {
+		end := start + batchSize
+		if end > len(operations) {
+			end = len(operations)
+		}
+		if err := gohan_sync.ApplyBatch(r.sync, operations[start:end]); err != nil {
+			return fixed, fmt.Errorf("failed to delete orphaned keys: %s", err)
+		}
+		fixed += end - start
+	}
+	return fixed, nil
+}
+
+// confirmOrphans returns orphaned keys whose resources still don't exist, read in a new transaction,
+// so keys of resources created since Diff aren't deleted
+func (r *Reconciler) confirmOrphans(orphans []SyncDifference) (confirmed []SyncDifference, err error) {
+	if len(orphans) == 0 {
+		return nil, nil
+	}
+	err = db.Within(r.db, func(tx transaction.Transaction) error {
+		confirmed = nil
+		// sync paths of existing resources of schemas with sync key templates
+		paths := map[string]map[string]bool{}
+		for _, orphan := range orphans {
+			s, ok := schema.GetManager().Schema(orphan.SchemaID)
+			if !ok {
+				continue
+			}
+			exists, err := syncPathExists(tx, s, orphan.path, paths)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				confirmed = append(confirmed, orphan)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check orphaned keys: %s", err)
+	}
+	return confirmed, nil
+}
+
+// syncPathExists whether a resource of the schema has the sync path. Resources of schemas
+// with sync key templates are read once and their paths are kept in paths.
+func syncPathExists(tx transaction.Transaction, s *schema.Schema, path string, paths map[string]map[string]bool) (bool, error) {
+	if _, ok := s.SyncKeyTemplate(); !ok {
+		_, err := tx.Fetch(s, transaction.IDFilter(strings.TrimPrefix(path, s.URL+"/")), nil)
+		if err == transaction.ErrResourceNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	existing, ok := paths[s.ID]
+	if !ok {
+		list, _, err := tx.List(s, nil, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		existing = map[string]bool{}
+		for _, resource := range list {
+			body, err := resource.JSONString()
+			if err != nil {
+				return false, err
+			}
+			existing[syncBasePath(s, resource.Path(), body)] = true
+		}
+		paths[s.ID] = existing
+	}
+	return existing[path], nil
+}
+
+// resync re-emits events of resources which still exist
+func (r *Reconciler) resync(resources []*schema.Resource) (emitted int, err error) {
+	err = db.Within(&DbSyncWrapper{DB: r.db}, func(tx transaction.Transaction) error {
+		tl, ok := tx.(*transactionEventLogger)
+		if !ok {
+			return fmt.Errorf("unexpected transaction %T", tx)
+		}
+		emitted = 0
+		for _, resource := range resources {
+			current, err := tl.Fetch(resource.Schema(), transaction.IDFilter(resource.ID()), nil)
+			if err == transaction.ErrResourceNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := tl.Resync(current); err != nil {
+				return err
+			}
+			emitted++
+		}
+		return nil
+	})
+	return
+}
+
+// Run reconciles periodically until the ctx is canceled, only one process reconciles at once
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := r.sync.Lock(reconcileLockPath, false); err != nil {
+			continue
+		}
+		if err := r.reconcileOnce(); err != nil {
+			log.Error("Sync reconciliation failed: %s", err)
+		}
+		r.sync.Unlock(reconcileLockPath)
+	}
+}
+
+func (r *Reconciler) reconcileOnce() error {
+	defer metrics.UpdateTimer(time.Now(), "sync.reconcile")
+	diff, err := r.Diff()
+	if err != nil {
+		return err
+	}
+	for _, kind := range []string{SyncKeyMissing, SyncKeyStale, SyncKeyOrphaned} {
+		metrics.UpdateGauge(int64(diff.Count(kind)), "sync.reconcile.%s", kind)
+	}
+	if diff.Empty() {
+		return nil
+	}
+	fixed, err := r.Reconcile(diff)
+	log.Info("Sync reconciliation fixed %d keys", fixed)
+	return err
+}
+
+func startSyncReconcileProcess(server *Server) {
+	config := util.GetConfig()
+	rawInterval := config.GetString("sync_reconcile/interval", "")
+	if rawInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(rawInterval)
+	if err != nil {
+		log.Fatalf("Invalid sync_reconcile/interval %q: %s", rawInterval, err)
+	}
+	reconciler := NewReconciler(server.sync, server.db, ReconcilerOptions{
+		BatchSize: config.GetInt("sync_reconcile/batch_size", defaultReconcileBatchSize),
+	})
+	log.Info("Started sync reconcile process, interval %s", interval)
+	go reconciler.Run(server.masterCtx, interval)
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	srv "github.com/cloudwan/gohan/server"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	gohan_etcd "github.com/cloudwan/gohan/sync/etcdv3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sync reconciliation", func() {
+	var (
+		networkSchema *schema.Schema
+		network       *schema.Resource
+		sync          gohan_sync.Sync
+		reconciler    *srv.Reconciler
+		configKey     string
+	)
+
+	clear := func() {
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			eventSchema, _ := schema.GetManager().Schema("event")
+			for _, s := range []*schema.Schema{networkSchema, eventSchema} {
+				if err := clearTable(tx, s); err != nil {
+					return err
+				}
+			}
+			return nil
+		})).To(Succeed())
+		for _, prefix := range []string{"/config", "/state_watch/state", "/state_watch/monitoring"} {
+			Expect(sync.Delete(prefix+networkSchema.URL, true)).To(Succeed())
+		}
+	}
+
+	kinds := func(diff *srv.SyncDiff) map[string]string {
+		result := map[string]string{}
+		for _, difference := range diff.Differences {
+			result[difference.Key] = difference.Kind
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		var err error
+		sync, err = gohan_etcd.NewSync([]string{"http://127.0.0.1:2379"}, time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		networkSchema, _ = schema.GetManager().Schema("network")
+		clear()
+
+		network, err = schema.GetManager().LoadResource("network", getNetwork("Red", "red"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Within(&srv.DbSyncWrapper{DB: testDB}, func(tx transaction.Transaction) error {
+			return tx.Create(network)
+		})).To(Succeed())
+		Expect(srv.SyncPendingEvents(testDB, sync)).To(Equal(1))
+
+		configKey = "/config" + network.Path()
+		reconciler = srv.NewReconciler(sync, testDB, srv.ReconcilerOptions{BatchSize: 2, Schemas: []string{"network"}})
+	})
+
+	AfterEach(func() {
+		clear()
+	})
+
+	It("should find no differences after sync", func() {
+		diff, err := reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Empty()).To(BeTrue(), diff.String())
+	})
+
+	It("should fix missing and stale keys", func() {
+		blue, err := schema.GetManager().LoadResource("network", getNetwork("Blue", "red"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Within(&srv.DbSyncWrapper{DB: testDB}, func(tx transaction.Transaction) error {
+			return tx.Create(blue)
+		})).To(Succeed())
+		Expect(srv.SyncPendingEvents(testDB, sync)).To(Equal(1))
+		blueKey := "/config" + blue.Path()
+
+		Expect(sync.Delete(configKey, false)).To(Succeed())
+		Expect(sync.Update(blueKey, `{"body": "{\"id\": \"networkBlue\"}", "version": 0}`)).To(Succeed())
+
+		diff, err := reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kinds(diff)).To(Equal(map[string]string{
+			configKey: srv.SyncKeyMissing,
+			blueKey:   srv.SyncKeyStale,
+		}))
+
+		Expect(reconciler.Reconcile(diff)).To(Equal(2))
+		Expect(srv.SyncPendingEvents(testDB, sync)).To(Equal(2))
+		diff, err = reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Empty()).To(BeTrue(), diff.String())
+	})
+
+	It("should delete orphaned keys", func() {
+		orphanedKeys := []string{
+			"/config" + networkSchema.URL + "/orphan",
+			"/state_watch/state" + networkSchema.URL + "/orphan",
+			"/state_watch/monitoring" + networkSchema.URL + "/orphan",
+		}
+		for _, key := range orphanedKeys {
+			Expect(sync.Update(key, "{}")).To(Succeed())
+		}
+		Expect(sync.Update("/state_watch/state"+network.Path(), "{}")).To(Succeed())
+
+		diff, err := reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kinds(diff)).To(Equal(map[string]string{
+			orphanedKeys[0]: srv.SyncKeyOrphaned,
+			orphanedKeys[1]: srv.SyncKeyOrphaned,
+			orphanedKeys[2]: srv.SyncKeyOrphaned,
+		}))
+
+		Expect(reconciler.Reconcile(diff)).To(Equal(3))
+		for _, key := range orphanedKeys {
+			_, err := sync.Fetch(key)
+			Expect(err).To(HaveOccurred())
+		}
+		_, err = sync.Fetch(configKey)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should keep orphaned keys of resources created after the comparison", func() {
+		orphan, err := schema.GetManager().LoadResource("network", getNetwork("Orphan", "red"))
+		Expect(err).ToNot(HaveOccurred())
+		orphanKey := "/config" + orphan.Path()
+		Expect(sync.Update(orphanKey, "{}")).To(Succeed())
+
+		diff, err := reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kinds(diff)).To(Equal(map[string]string{orphanKey: srv.SyncKeyOrphaned}))
+
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			return tx.Create(orphan)
+		})).To(Succeed())
+		Expect(reconciler.Reconcile(diff)).To(Equal(0))
+		_, err = sync.Fetch(orphanKey)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should read resources in more batches", func() {
+		for _, color := range []string{"Blue", "Green", "Yellow"} {
+			resource, err := schema.GetManager().LoadResource("network", getNetwork(color, "red"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(db.Within(&srv.DbSyncWrapper{DB: testDB}, func(tx transaction.Transaction) error {
+				return tx.Create(resource)
+			})).To(Succeed())
+		}
+		Expect(srv.SyncPendingEvents(testDB, sync)).To(Equal(3))
+
+		diff, err := reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Empty()).To(BeTrue(), diff.String())
+	})
+
+	It("should skip keys with pending events", func() {
+		Expect(db.Within(&srv.DbSyncWrapper{DB: testDB}, func(tx transaction.Transaction) error {
+			return tx.Delete(networkSchema, network.ID())
+		})).To(Succeed())
+
+		diff, err := reconciler.Diff()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Empty()).To(BeTrue(), diff.String())
+	})
+})
@@ -0,0 +1,83 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"context"
+
+	"github.com/cloudwan/gohan/audit"
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/mohae/deepcopy"
+)
+
+const auditRecordsContextKey = "audit_records"
+
+func newAuditRecord(ctx middleware.Context, action string, resourceSchema *schema.Schema, resourceID string) *audit.Record {
+	auth, _ := ctx["auth"].(schema.Authorization)
+	requestID, _ := ctx["request_id"].(string)
+	return audit.NewRecord(requestID, auth, action, resourceSchema, resourceID)
+}
+
+// auditInTransaction stores an audit record of a change made in the transaction of the context.
+// The record is passed to audit sinks once the transaction is committed.
+func auditInTransaction(ctx middleware.Context, action string, resourceSchema *schema.Schema, resourceID string, before, after map[string]interface{}) error {
+	if !audit.Enabled() || resourceSchema.ID == audit.SchemaID {
+		return nil
+	}
+	record := newAuditRecord(ctx, action, resourceSchema, resourceID)
+	record.SetResources(resourceSchema, before, after)
+	tx := ctx["transaction"].(transaction.Transaction)
+	if err := audit.Store(context.Background(), tx, record); err != nil {
+		return ResourceError{err, "Failed to store audit record", InternalServerError}
+	}
+	records, _ := ctx[auditRecordsContextKey].([]*audit.Record)
+	ctx[auditRecordsContextKey] = append(records, record)
+	return nil
+}
+
+// emitAuditRecords passes records of a committed transaction to audit sinks
+func emitAuditRecords(ctx middleware.Context) {
+	records, _ := ctx[auditRecordsContextKey].([]*audit.Record)
+	delete(ctx, auditRecordsContextKey)
+	audit.Emit(records...)
+}
+
+// auditAction stores and emits an audit record of a custom action.
+// Actions manage transactions on their own and have already run, so a record
+// which can't be stored is only logged and still passed to audit sinks.
+func auditAction(ctx middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, action schema.Action, resourceID string, input interface{}) {
+	if !audit.Enabled() {
+		return
+	}
+	record := newAuditRecord(ctx, action.ID, resourceSchema, resourceID)
+	record.Input, _ = deepcopy.Copy(input).(map[string]interface{})
+	if err := db.Within(dataStore, func(tx transaction.Transaction) error {
+		return audit.Store(context.Background(), tx, record)
+	}); err != nil {
+		log.Error("Failed to store audit record of action %s on %s: %s", action.ID, resourceID, err)
+	}
+	audit.Emit(record)
+}
+
+func copyResourceData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	return deepcopy.Copy(data).(map[string]interface{})
+}
@@ -0,0 +1,261 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/mohae/deepcopy"
+)
+
+// BulkOperation is a single operation of a bulk request
+type BulkOperation struct {
+	// Action is one of schema.ActionCreate, schema.ActionUpdate or schema.ActionDelete
+	Action string
+	// ID of the updated or deleted resource
+	ID string
+	// Resource holds data of the created or updated resource
+	Resource map[string]interface{}
+}
+
+// BulkResult is a result of a single bulk operation
+type BulkResult struct {
+	// Response is the same as the response of the corresponding single resource request,
+	// nil for delete
+	Response interface{}
+	Err      error
+}
+
+// BulkError is returned when an all-or-nothing bulk request fails
+type BulkError struct {
+	Index int
+	Err   error
+}
+
+func (e BulkError) Error() string {
+	return fmt.Sprintf("Operation %d failed: %s", e.Index, e.Err)
+}
+
+// BulkOperationsFromData parses operations given in a bulk request
+func BulkOperationsFromData(resourceSchema *schema.Schema, data []interface{}) ([]BulkOperation, error) {
+	operations := make([]BulkOperation, len(data))
+	for i, rawOperation := range data {
+		operation, ok := rawOperation.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Operation %d has to be an object", i)
+		}
+		action, _ := operation["action"].(string)
+		id, _ := operation["id"].(string)
+		resource, _ := operation["resource"].(map[string]interface{})
+		switch action {
+		case schema.ActionCreate:
+			if resource == nil {
+				return nil, fmt.Errorf("Operation %d: resource is required for %s", i, action)
+			}
+		case schema.ActionUpdate:
+			if id == "" || resource == nil {
+				return nil, fmt.Errorf("Operation %d: id and resource are required for %s", i, action)
+			}
+		case schema.ActionDelete:
+			if id == "" {
+				return nil, fmt.Errorf("Operation %d: id is required for %s", i, action)
+			}
+		default:
+			return nil, fmt.Errorf("Operation %d: unknown action %q, has to be one of create, update or delete", i, action)
+		}
+		if wrapped, ok := resource[resourceSchema.Singular].(map[string]interface{}); ok {
+			resource = wrapped
+		}
+		operations[i] = BulkOperation{Action: action, ID: id, Resource: resource}
+	}
+	return operations, nil
+}
+
+// BulkResources runs create, update and delete operations on resources of a single schema.
+// In all-or-nothing mode all operations are stored in one transaction and the first failure
+// rolls back all of them and is returned as BulkError. Otherwise each operation is
+// run in its own transaction and its failure is only reported in its result.
+func BulkResources(
+	context middleware.Context,
+	dataStore db.DB, identityService middleware.IdentityService,
+	resourceSchema *schema.Schema,
+	operations []BulkOperation, allOrNothing bool,
+) ([]BulkResult, error) {
+	defer measureRequestTime(time.Now(), "bulk", resourceSchema.ID)
+
+	contexts := make([]middleware.Context, len(operations))
+	for i, operation := range operations {
+		contexts[i] = bulkOperationContext(context, operation)
+	}
+	results := make([]BulkResult, len(operations))
+
+	if !allOrNothing {
+		for i, operation := range operations {
+			err := authorizeBulkOperation(contexts[i], resourceSchema, operation)
+			if err == nil {
+				err = runBulkOperation(contexts[i], dataStore, identityService, resourceSchema, operation)
+			}
+			results[i] = BulkResult{Response: contexts[i]["response"], Err: err}
+		}
+		return results, nil
+	}
+
+	for i, operation := range operations {
+		if err := authorizeBulkOperation(contexts[i], resourceSchema, operation); err != nil {
+			return nil, BulkError{i, err}
+		}
+	}
+	inTransaction := make([]func() error, len(operations))
+	level := transaction.ReadUncommitted
+	for i, operation := range operations {
+		fn, err := prepareBulkOperation(contexts[i], dataStore, identityService, resourceSchema, operation)
+		if err != nil {
+			return nil, BulkError{i, err}
+		}
+		inTransaction[i] = fn
+		level = strongerIsolationLevel(level, transaction.GetIsolationLevel(resourceSchema, operation.Action))
+	}
+
+	if err := resourceTransactionWithContexts(contexts, dataStore, level, func() error {
+		for i, fn := range inTransaction {
+			if err := fn(); err != nil {
+				return BulkError{i, err}
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// resources are already committed, so failures of post events are reported per operation
+	for i, operation := range operations {
+		err := finishBulkOperation(contexts[i], resourceSchema, operation)
+		results[i] = BulkResult{Response: contexts[i]["response"], Err: err}
+	}
+	return results, nil
+}
+
+// bulkOperationContext creates a context of a single operation from the context of the bulk request
+func bulkOperationContext(context middleware.Context, operation BulkOperation) middleware.Context {
+	operationContext := middleware.Context{}
+	for key, value := range context {
+		operationContext[key] = value
+	}
+	delete(operationContext, "response")
+	// query parameters and precondition headers of the bulk request
+	// don't describe any single operation
+	delete(operationContext, "http_request")
+	requestData := map[string]interface{}{}
+	if operation.Resource != nil {
+		requestData = deepcopy.Copy(operation.Resource).(map[string]interface{})
+	}
+	operationContext["request_data"] = requestData
+	return operationContext
+}
+
+// authorizeBulkOperation checks that a policy allows the caller to run the operation with its own action
+func authorizeBulkOperation(context middleware.Context, resourceSchema *schema.Schema, operation BulkOperation) error {
+	path := resourceSchema.GetPluralURL()
+	if operation.Action != schema.ActionCreate {
+		path = strings.Replace(resourceSchema.GetSingleURL(), ":id", operation.ID, 1)
+	}
+	_, err := loadPolicy(context, operation.Action, path, context["auth"].(schema.Authorization))
+	return err
+}
+
+func runBulkOperation(
+	context middleware.Context,
+	dataStore db.DB, identityService middleware.IdentityService,
+	resourceSchema *schema.Schema, operation BulkOperation,
+) error {
+	switch operation.Action {
+	case schema.ActionCreate:
+		return CreateResource(context, dataStore, identityService, resourceSchema, operation.Resource)
+	case schema.ActionUpdate:
+		return UpdateResource(context, dataStore, identityService, resourceSchema, operation.ID, operation.Resource)
+	case schema.ActionDelete:
+		return DeleteResource(context, dataStore, resourceSchema, operation.ID)
+	}
+	return fmt.Errorf("Unknown bulk action %q", operation.Action)
+}
+
+// prepareBulkOperation runs the part of an operation preceding the transaction
+// and returns the part which has to be run in the transaction
+func prepareBulkOperation(
+	context middleware.Context,
+	dataStore db.DB, identityService middleware.IdentityService,
+	resourceSchema *schema.Schema, operation BulkOperation,
+) (func() error, error) {
+	switch operation.Action {
+	case schema.ActionCreate:
+		resource, err := prepareCreateResource(context, identityService, resourceSchema, operation.Resource)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return CreateResourceInTransaction(context, resourceSchema, resource)
+		}, nil
+	case schema.ActionUpdate:
+		dataMap, tenantIDs, err := prepareUpdateResource(context, identityService, resourceSchema, operation.ID, operation.Resource)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return UpdateResourceInTransaction(context, resourceSchema, operation.ID, dataMap, tenantIDs)
+		}, nil
+	case schema.ActionDelete:
+		if err := prepareDeleteResource(context, dataStore, resourceSchema, operation.ID); err != nil {
+			return nil, err
+		}
+		return func() error {
+			return DeleteResourceInTransaction(context, resourceSchema, operation.ID)
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown bulk action %q", operation.Action)
+}
+
+func finishBulkOperation(context middleware.Context, resourceSchema *schema.Schema, operation BulkOperation) error {
+	switch operation.Action {
+	case schema.ActionCreate:
+		return finishCreateResource(context, resourceSchema)
+	case schema.ActionUpdate:
+		return finishUpdateResource(context, resourceSchema)
+	case schema.ActionDelete:
+		delete(context, "response")
+		return finishDeleteResource(context, resourceSchema)
+	}
+	return fmt.Errorf("Unknown bulk action %q", operation.Action)
+}
+
+var isolationLevelStrength = map[transaction.Type]int{
+	transaction.ReadUncommitted: 0,
+	transaction.ReadCommited:    1,
+	transaction.RepeatableRead:  2,
+	transaction.Serializable:    3,
+}
+
+func strongerIsolationLevel(a, b transaction.Type) transaction.Type {
+	if isolationLevelStrength[b] > isolationLevelStrength[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package resources
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server/middleware"
+)
+
+// HistorySuffix is appended to the singular name of a schema in history responses
+const HistorySuffix = "_history"
+
+// GetResourceHistory returns all recorded versions of a resource of a schema with history enabled
+func GetResourceHistory(context middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, resourceID string) error {
+	defer measureRequestTime(time.Now(), "get.history", resourceSchema.ID)
+
+	context["id"] = resourceID
+	if err := checkHistory(resourceSchema); err != nil {
+		return err
+	}
+	auth := context["auth"].(schema.Authorization)
+	policy, err := loadPolicy(context, schema.ActionRead, strings.Replace(resourceSchema.GetSingleURL(), ":id", resourceID, 1), auth)
+	if err != nil {
+		return err
+	}
+	tenantIDs := policy.GetTenantIDFilter(schema.ActionRead, auth.TenantID())
+
+	return resourceTransactionWithContext(
+		context, dataStore,
+		transaction.GetIsolationLevel(resourceSchema, schema.ActionRead),
+		func() error {
+			mainTransaction := context["transaction"].(transaction.Transaction)
+			versions, err := mainTransaction.ListVersions(resourceSchema, resourceID)
+			if err != nil {
+				return ResourceError{err, "Error when fetching resource history", InternalServerError}
+			}
+			if len(versions) == 0 {
+				err := transaction.ErrResourceNotFound
+				return ResourceError{err, "Resource not found", NotFound}
+			}
+			if err := checkHistoryReadable(context, mainTransaction, resourceSchema, resourceID, tenantIDs); err != nil {
+				return err
+			}
+			history := make([]interface{}, 0, len(versions))
+			for _, version := range versions {
+				data := version.Data()
+				if resource, ok := data["resource"].(map[string]interface{}); ok && resource != nil {
+					data["resource"] = policy.RemoveHiddenProperty(resource)
+				}
+				history = append(history, data)
+			}
+			context["response"] = map[string]interface{}{
+				resourceSchema.Singular + HistorySuffix: history,
+			}
+			return nil
+		},
+	)
+}
+
+// historyPoint returns the value of the at query parameter
+func historyPoint(context middleware.Context) string {
+	r, ok := context["http_request"].(*http.Request)
+	if !ok {
+		return ""
+	}
+	return r.URL.Query().Get("at")
+}
+
+// fetchResourceAt returns a resource as it was at the given version number, RFC3339 time
+// or unix time prefixed with @, so times can't be taken for version numbers
+func fetchResourceAt(
+	context middleware.Context, tx transaction.Transaction, resourceSchema *schema.Schema,
+	resourceID, at string, tenantIDs []string,
+) (*schema.Resource, error) {
+	if err := checkHistory(resourceSchema); err != nil {
+		return nil, err
+	}
+	if err := checkHistoryReadable(context, tx, resourceSchema, resourceID, tenantIDs); err != nil {
+		return nil, err
+	}
+	var version *transaction.ResourceVersion
+	if number, err := strconv.ParseInt(at, 10, 64); err == nil {
+		version, err = tx.FetchVersion(resourceSchema, resourceID, number)
+		if err != nil && err != transaction.ErrResourceNotFound {
+			return nil, ResourceError{err, "Error when fetching resource version", InternalServerError}
+		}
+	} else {
+		point, err := parseHistoryTime(at)
+		if err != nil {
+			err := fmt.Errorf("Invalid at parameter %q, has to be a version number, an RFC3339 time or @ followed by unix time", at)
+			return nil, ResourceError{err, err.Error(), WrongQuery}
+		}
+		versions, err := tx.ListVersions(resourceSchema, resourceID)
+		if err != nil {
+			return nil, ResourceError{err, "Error when fetching resource history", InternalServerError}
+		}
+		version = transaction.VersionAt(versions, point)
+	}
+	if version == nil || version.Deleted || !visibleForTenants([]*transaction.ResourceVersion{version}, tenantIDs) {
+		err := transaction.ErrResourceNotFound
+		return nil, ResourceError{err, "Resource not found", NotFound}
+	}
+	return version.Resource, nil
+}
+
+// parseHistoryTime parses an RFC3339 time or unix time prefixed with @
+func parseHistoryTime(at string) (time.Time, error) {
+	if strings.HasPrefix(at, "@") {
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(at, "@"), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, at)
+}
+
+// checkHistoryReadable checks that the caller can read the resource the history belongs to,
+// using the same filters as reads of the resource, so history isn't readable for resources
+// hidden from the caller
+func checkHistoryReadable(
+	context middleware.Context, tx transaction.Transaction, resourceSchema *schema.Schema,
+	resourceID string, tenantIDs []string,
+) error {
+	auth := context["auth"].(schema.Authorization)
+	policy := context["policy"].(*schema.Policy)
+	notFound := ResourceError{transaction.ErrResourceNotFound, "Resource not found", NotFound}
+
+	filter := transaction.IDFilter(resourceID)
+	if tenantIDs != nil {
+		filter["tenant_id"] = tenantIDs
+	}
+	policy.AddCustomFilters(filter, auth.TenantID())
+	policy.AddExpressionFilters(filter, resourceSchema, schema.ActionRead, auth)
+	options := &transaction.ViewOptions{ShowDeleted: resourceSchema.Recoverable()}
+
+	var data map[string]interface{}
+	resource, err := tx.Fetch(resourceSchema, filter, options)
+	switch err {
+	case nil:
+		data = resource.Data()
+	case transaction.ErrResourceNotFound:
+		if _, err := tx.Fetch(resourceSchema, transaction.IDFilter(resourceID), options); err != transaction.ErrResourceNotFound {
+			if err != nil {
+				return ResourceError{err, "Error when fetching resource", InternalServerError}
+			}
+			return notFound
+		}
+		// the resource is deleted, so its last recorded state is checked,
+		// which can't be done for conditions applied only by queries
+		customFilters := map[string]interface{}{}
+		policy.AddCustomFilters(customFilters, auth.TenantID())
+		if len(customFilters) > 0 {
+			return notFound
+		}
+		versions, err := tx.ListVersions(resourceSchema, resourceID)
+		if err != nil {
+			return ResourceError{err, "Error when fetching resource history", InternalServerError}
+		}
+		last := lastRecordedResource(versions)
+		if last == nil || !visibleForTenants(versions, tenantIDs) {
+			return notFound
+		}
+		data = last.Data()
+	default:
+		return ResourceError{err, "Error when fetching resource", InternalServerError}
+	}
+	if err := policy.ApplyPropertyConditionFilter(schema.ActionRead, data, nil); err != nil {
+		return notFound
+	}
+	if err := policy.ApplyExpressionConditions(schema.ActionRead, auth, data, nil); err != nil {
+		return notFound
+	}
+	return nil
+}
+
+// lastRecordedResource returns the last recorded state of a resource, which isn't a deletion
+func lastRecordedResource(versions []*transaction.ResourceVersion) *schema.Resource {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Resource != nil {
+			return versions[i].Resource
+		}
+	}
+	return nil
+}
+
+func checkHistory(resourceSchema *schema.Schema) error {
+	if !resourceSchema.History() {
+		err := fmt.Errorf("Resource '%s' doesn't keep history", resourceSchema.ID)
+		return ResourceError{err, err.Error(), WrongQuery}
+	}
+	return nil
+}
+
+// visibleForTenants checks if the last stored state of a resource belongs to one of the tenants
+func visibleForTenants(versions []*transaction.ResourceVersion, tenantIDs []string) bool {
+	if tenantIDs == nil {
+		return true
+	}
+	last := lastRecordedResource(versions)
+	if last == nil {
+		return false
+	}
+	tenantID, _ := last.Data()["tenant_id"].(string)
+	for _, allowed := range tenantIDs {
+		if tenantID == allowed {
+			return true
+		}
+	}
+	return false
+}
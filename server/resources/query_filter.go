@@ -0,0 +1,147 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+)
+
+// filterKeyPattern matches query parameters like size[gte] or config.vlan.id[eq]
+var filterKeyPattern = regexp.MustCompile(`^([^.\[\]]+)(?:\.([^\[\]]+))?\[([^\[\]]+)\]$`)
+
+// parseFilterKey splits query parameter key into property, JSON path and operator
+func parseFilterKey(key string) (property, path, operator string, ok bool) {
+	matches := filterKeyPattern.FindStringSubmatch(key)
+	if matches == nil {
+		return "", "", "", false
+	}
+	return matches[1], matches[2], matches[3], true
+}
+
+func operatorFilterFromQuery(property *schema.Property, path, operator string, values []string) (map[string]interface{}, error) {
+	if err := transaction.CheckOperator(operator); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if property.Type != "object" {
+			return nil, fmt.Errorf("JSON path can't be used with %s property of type %s", property.ID, property.Type)
+		}
+		if _, err := transaction.SplitPath(path); err != nil {
+			return nil, err
+		}
+	}
+	predicate := map[string]interface{}{
+		"property": property.ID,
+		"type":     operator,
+	}
+	if path != "" {
+		predicate["path"] = path
+	}
+
+	switch operator {
+	case transaction.In, transaction.NotIn:
+		converted := make([]interface{}, len(values))
+		for i, value := range values {
+			v, err := queryValue(property, path, value)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = v
+		}
+		predicate["value"] = converted
+		return predicate, nil
+	}
+
+	if len(values) != 1 {
+		return nil, fmt.Errorf("Filter %s[%s] expects exactly one value", property.ID, operator)
+	}
+	value := values[0]
+	switch operator {
+	case transaction.IsNull:
+		isNull, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("Filter %s[%s] expects a boolean value", property.ID, operator)
+		}
+		predicate["value"] = isNull
+	case transaction.Like, transaction.ILike, transaction.Prefix:
+		predicate["value"] = value
+	default:
+		v, err := queryValue(property, path, value)
+		if err != nil {
+			return nil, err
+		}
+		predicate["value"] = v
+	}
+	return predicate, nil
+}
+
+// queryValue converts query parameter to the type of compared property,
+// values under JSON path are typed based on their format
+func queryValue(property *schema.Property, path, value string) (interface{}, error) {
+	if path != "" {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f, nil
+		}
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, nil
+		}
+		return value, nil
+	}
+	var (
+		converted interface{}
+		err       error
+	)
+	switch property.Type {
+	case "integer":
+		converted, err = strconv.Atoi(value)
+	case "number":
+		converted, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		converted, err = strconv.ParseBool(value)
+	default:
+		converted = value
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value %q for %s property of type %s", value, property.ID, property.Type)
+	}
+	return converted, nil
+}
+
+// removeHiddenFilters removes filters on properties hidden by the policy
+func removeHiddenFilters(policy *schema.Policy, filter transaction.Filter) transaction.Filter {
+	conditions, _ := filter[transaction.AndCondition].([]map[string]interface{})
+	result := transaction.Filter(policy.RemoveHiddenProperty(filter))
+	delete(result, transaction.AndCondition)
+	var visible []map[string]interface{}
+	for _, condition := range conditions {
+		if property, ok := condition["property"].(string); ok && policy.Resource.PropertiesFilter.IsForbidden(property) {
+			continue
+		}
+		visible = append(visible, condition)
+	}
+	if len(visible) > 0 {
+		result[transaction.AndCondition] = visible
+	}
+	return result
+}
@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -32,7 +33,9 @@ import (
 	"github.com/cloudwan/gohan/metrics"
 	"github.com/cloudwan/gohan/schema"
 	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
 	"github.com/mattn/go-sqlite3"
 	"github.com/twinj/uuid"
 )
@@ -52,6 +55,7 @@ const (
 	Unauthorized
 	Forbidden
 	ForeignKeyFailed
+	PreconditionFailed
 
 	goValidationContextKey = "go_validation"
 )
@@ -87,6 +91,11 @@ func isForeignKeyFailed(err error) bool {
 			return true
 		}
 	}
+	if pqError, ok := err.(*pq.Error); ok {
+		if pqError.Code == "23503" {
+			return true
+		}
+	}
 	return false
 }
 
@@ -96,33 +105,61 @@ func measureRequestTime(timeStarted time.Time, requestType string, schemaID stri
 
 //resourceTransactionWithContext executes function in the db transaction and set it to the context
 func resourceTransactionWithContext(ctx middleware.Context, dataStore db.DB, level transaction.Type, fn func() error) error {
-	if ctx["transaction"] != nil {
-		return fmt.Errorf("cannot create nested transaction")
-	}
+	return resourceTransactionWithContexts([]middleware.Context{ctx}, dataStore, level, fn)
+}
 
+//readOnlyTransactionWithContext executes function in the db transaction, which may be routed to a read replica
+func readOnlyTransactionWithContext(ctx middleware.Context, dataStore db.DB, level transaction.Type, fn func() error) error {
+	return transactionWithContexts([]middleware.Context{ctx}, dataStore, &transaction.TxOptions{IsolationLevel: level, ReadOnly: true}, fn)
+}
+
+//resourceTransactionWithContexts executes function in the db transaction and set it to all the contexts
+func resourceTransactionWithContexts(contexts []middleware.Context, dataStore db.DB, level transaction.Type, fn func() error) error {
+	return transactionWithContexts(contexts, dataStore, &transaction.TxOptions{IsolationLevel: level}, fn)
+}
+
+func transactionWithContexts(contexts []middleware.Context, dataStore db.DB, options *transaction.TxOptions, fn func() error) error {
 	// note:
-	// context must stay the same for each retried transaction
-	// so it is stored in a temporary variable and restored before each iteration
-	originalCtx := middleware.Context{}
+	// contexts must stay the same for each retried transaction
+	// so they are stored in temporary variables and restored before each iteration
+	originalContexts := make([]middleware.Context, len(contexts))
+	for i, ctx := range contexts {
+		if ctx["transaction"] != nil {
+			return fmt.Errorf("cannot create nested transaction")
+		}
+		originalContexts[i] = middleware.Context{}
+		for k, v := range ctx {
+			originalContexts[i][k] = v
+		}
+	}
 
-	for k, v := range ctx {
-		originalCtx[k] = v
+	// queries of the transaction are traced as children of the current span of the request
+	txContext := context.Background()
+	if len(contexts) > 0 {
+		txContext = tracing.ContextWithSpan(txContext, tracing.CurrentSpan(contexts[0]))
 	}
+	if err := db.WithinTx(txContext, dataStore, options, func(tx transaction.Transaction) error {
+		for i, ctx := range contexts {
+			for k := range ctx {
+				delete(ctx, k)
+			}
 
-	return db.WithinTx(context.Background(), dataStore, &transaction.TxOptions{IsolationLevel: level}, func(tx transaction.Transaction) error {
-		for k := range ctx {
-			delete(ctx, k)
-		}
+			for k, v := range originalContexts[i] {
+				ctx[k] = v
+			}
 
-		for k, v := range originalCtx {
-			ctx[k] = v
+			ctx["transaction"] = tx
+			defer delete(ctx, "transaction")
 		}
 
-		ctx["transaction"] = tx
-		defer delete(ctx, "transaction")
-
 		return fn()
-	})
+	}); err != nil {
+		return err
+	}
+	for _, ctx := range contexts {
+		emitAuditRecords(ctx)
+	}
+	return nil
 }
 
 // ApplyPolicyForResources applies policy filtering for response
@@ -140,12 +177,16 @@ func ApplyPolicyForResources(context middleware.Context, resourceSchema *schema.
 	if !ok {
 		return nil
 	}
+	auth, _ := context["auth"].(schema.Authorization)
 	data := []interface{}{}
 	for _, resource := range resources {
 		resourceMap := resource.(map[string]interface{})
 		if err := policy.ApplyPropertyConditionFilter(schema.ActionRead, resourceMap, nil); err != nil {
 			continue
 		}
+		if err := policy.ApplyExpressionConditions(schema.ActionRead, auth, resourceMap, nil); err != nil {
+			continue
+		}
 		data = append(data, policy.RemoveHiddenProperty(resourceMap))
 	}
 	response[resourceSchema.Plural] = data
@@ -171,6 +212,10 @@ func ApplyPolicyForResource(context middleware.Context, resourceSchema *schema.S
 	if err := policy.ApplyPropertyConditionFilter(schema.ActionRead, resourceMap, nil); err != nil {
 		return err
 	}
+	auth, _ := context["auth"].(schema.Authorization)
+	if err := policy.ApplyExpressionConditions(schema.ActionRead, auth, resourceMap, nil); err != nil {
+		return err
+	}
 	response[resourceSchema.Singular] = policy.RemoveHiddenProperty(resourceMap)
 
 	return nil
@@ -179,7 +224,7 @@ func ApplyPolicyForResource(context middleware.Context, resourceSchema *schema.S
 //GetResources returns specified resources without calling non in_transaction events
 func GetResources(context middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, filter map[string]interface{}, paginator *pagination.Paginator) error {
 	defer measureRequestTime(time.Now(), "get.resources", resourceSchema.ID)
-	return resourceTransactionWithContext(
+	return readOnlyTransactionWithContext(
 		context, dataStore,
 		transaction.GetIsolationLevel(resourceSchema, schema.ActionRead),
 		func() error {
@@ -209,12 +254,7 @@ func GetResourcesInTransaction(context middleware.Context, resourceSchema *schem
 	if ok {
 		o = listOptionsFromQueryParameter(r.URL.Query())
 	}
-	list, total, err := mainTransaction.List(
-		resourceSchema,
-		filter,
-		o,
-		paginator,
-	)
+	list, total, err := listReadableResources(context, mainTransaction, resourceSchema, filter, o, paginator)
 	if err != nil {
 		response[resourceSchema.Plural] = []interface{}{}
 		context["response"] = response
@@ -229,6 +269,11 @@ func GetResourcesInTransaction(context middleware.Context, resourceSchema *schem
 
 	context["response"] = response
 	context["total"] = total
+	if policy, ok := context["policy"].(*schema.Policy); paginator != nil && (!ok || sortKeyVisible(policy, paginator)) {
+		if marker := paginator.NextMarker(list); marker != "" {
+			context["next_marker"] = marker
+		}
+	}
 
 	if err := extension.HandleEvent(context, environment, "post_list_in_transaction", resourceSchema.ID); err != nil {
 		return err
@@ -236,24 +281,163 @@ func GetResourcesInTransaction(context middleware.Context, resourceSchema *schem
 	return nil
 }
 
+// readableResourcesBatchSize is the number of resources read at once when they are checked
+// against read conditions of the caller
+const readableResourcesBatchSize = 100
+
+// listReadableResources lists a page of resources. When read conditions of the caller couldn't be
+// fully translated to the filter, resources are read in batches and checked until the page is full,
+// so pages aren't shortened by resources filtered out later. The total counts readable resources
+// when the batches read from the first resource reached the last one, otherwise resources matching
+// the filter, which might include ones the caller can't read.
+func listReadableResources(
+	context middleware.Context, tx transaction.Transaction, resourceSchema *schema.Schema,
+	filter transaction.Filter, options *transaction.ViewOptions, paginator *pagination.Paginator,
+) ([]*schema.Resource, uint64, error) {
+	policy, ok := context["policy"].(*schema.Policy)
+	auth, _ := context["auth"].(schema.Authorization)
+	if !ok || auth == nil || policy.ExpressionFiltersExact(resourceSchema, schema.ActionRead, auth) {
+		return tx.List(resourceSchema, filter, options, paginator)
+	}
+	readable := func(list []*schema.Resource) []*schema.Resource {
+		result := []*schema.Resource{}
+		for _, resource := range list {
+			if policy.ApplyExpressionConditions(schema.ActionRead, auth, resource.Data(), nil) == nil {
+				result = append(result, resource)
+			}
+		}
+		return result
+	}
+	if paginator == nil {
+		list, _, err := tx.List(resourceSchema, filter, options, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = readable(list)
+		return list, uint64(len(list)), nil
+	}
+
+	batch := *paginator
+	batch.Limit = readableResourcesBatchSize
+	batch.Offset = 0
+	skip := paginator.Offset
+	page := []*schema.Resource{}
+	var total, readableCount uint64
+	for first := true; ; first = false {
+		list, count, err := tx.List(resourceSchema, filter, options, &batch)
+		if err != nil {
+			return nil, 0, err
+		}
+		if first {
+			total = count
+		}
+		checked := readable(list)
+		readableCount += uint64(len(checked))
+		for _, resource := range checked {
+			if uint64(len(page)) == paginator.Limit {
+				break
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			page = append(page, resource)
+		}
+		next := batch.NextMarker(list)
+		if next == "" {
+			if paginator.Marker == "" {
+				total = readableCount
+			}
+			return page, total, nil
+		}
+		if uint64(len(page)) == paginator.Limit {
+			return page, total, nil
+		}
+		batch.Marker = next
+	}
+}
+
+// sortKeyVisible checks if the policy allows the caller to see the property resources are sorted by
+func sortKeyVisible(policy *schema.Policy, paginator *pagination.Paginator) bool {
+	return !policy.Resource.PropertiesFilter.IsForbidden(paginator.SortKey())
+}
+
 //FilterFromQueryParameter makes list filter from query.
-func FilterFromQueryParameter(resourceSchema *schema.Schema, queryParameters map[string][]string) transaction.Filter {
+//Parameters like size[gte]=10 are translated to filters with operators.
+func FilterFromQueryParameter(resourceSchema *schema.Schema, queryParameters map[string][]string) (transaction.Filter, error) {
 	filter := transaction.Filter{}
-	for key, value := range queryParameters {
-		if _, err := resourceSchema.GetPropertyByID(key); err != nil {
-			log.Debug("Resource '%s' does not have %q property, ignoring filter", resourceSchema.ID, key)
-		} else {
+	keys := make([]string, 0, len(queryParameters))
+	for key := range queryParameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var conditions []map[string]interface{}
+	for _, key := range keys {
+		value := queryParameters[key]
+		propertyID, path, operator, isOperator := parseFilterKey(key)
+		if !isOperator {
+			propertyID = key
+		}
+		property, err := resourceSchema.GetPropertyByID(propertyID)
+		if err != nil {
+			log.Debug("Resource '%s' does not have %q property, ignoring filter", resourceSchema.ID, propertyID)
+			continue
+		}
+		if !isOperator {
 			filter[key] = value
+			continue
 		}
+		condition, err := operatorFilterFromQuery(property, path, operator, value)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) > 0 {
+		filter[transaction.AndCondition] = conditions
 	}
-	return filter
+	return filter, nil
 }
 
 func listOptionsFromQueryParameter(v url.Values) *transaction.ViewOptions {
 	return &transaction.ViewOptions{
-		Details: parseBool(v.Get("_details"), true),
-		Fields:  v["_fields"],
+		Details:     parseBool(v.Get("_details"), true),
+		Fields:      v["_fields"],
+		ShowDeleted: parseBool(v.Get("show_deleted"), false),
+	}
+}
+
+// adminRole is the role allowed to see soft deleted resources, metrics and other admin only APIs
+const adminRole = "admin"
+
+// IsAdmin checks if the caller has the admin role
+func IsAdmin(auth schema.Authorization) bool {
+	for _, role := range auth.Roles() {
+		if role.Name == adminRole {
+			return true
+		}
 	}
+	return false
+}
+
+// checkShowDeleted verifies the show_deleted query parameter
+func checkShowDeleted(context middleware.Context, resourceSchema *schema.Schema) error {
+	r, ok := context["http_request"].(*http.Request)
+	if !ok || r.URL.Query().Get("show_deleted") == "" {
+		return nil
+	}
+	if !resourceSchema.Recoverable() {
+		err := fmt.Errorf("Resource '%s' is not recoverable, show_deleted is not supported", resourceSchema.ID)
+		return ResourceError{err, err.Error(), WrongQuery}
+	}
+	if !parseBool(r.URL.Query().Get("show_deleted"), false) {
+		return nil
+	}
+	if !IsAdmin(context["auth"].(schema.Authorization)) {
+		err := fmt.Errorf("Only admin can show deleted resources")
+		return ResourceError{err, err.Error(), Forbidden}
+	}
+	return nil
 }
 
 func parseBool(s string, d bool) bool {
@@ -269,30 +453,72 @@ func parseBool(s string, d bool) bool {
 	return b
 }
 
-// GetMultipleResources returns all resources specified by the schema and query parameters
-func GetMultipleResources(context middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, queryParameters map[string][]string) error {
-	defer measureRequestTime(time.Now(), "get.resources.multiple", resourceSchema.ID)
-	log.Debug("Start get multiple resources!!")
+// readableResourcesFilter loads the read policy of the caller and returns it with the filter
+// selecting resources the caller can list with the given query parameters
+func readableResourcesFilter(context middleware.Context, resourceSchema *schema.Schema, queryParameters map[string][]string) (*schema.Policy, transaction.Filter, error) {
 	auth := context["auth"].(schema.Authorization)
 	policy, err := loadPolicy(context, "read", resourceSchema.GetPluralURL(), auth)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	filter, err := FilterFromQueryParameter(resourceSchema, queryParameters)
+	if err != nil {
+		return nil, nil, ResourceError{err, err.Error(), WrongQuery}
 	}
-	filter := FilterFromQueryParameter(resourceSchema, queryParameters)
 	if policy.RequireOwner() {
 		filter["tenant_id"] = policy.GetTenantIDFilter(schema.ActionRead, auth.TenantID())
 	}
-	filter = policy.RemoveHiddenProperty(filter)
+	filter = removeHiddenFilters(policy, filter)
 	policy.AddCustomFilters(filter, auth.TenantID())
+	policy.AddExpressionFilters(filter, resourceSchema, schema.ActionRead, auth)
+	return policy, filter, nil
+}
+
+// WatchResourcesFilter returns the read policy of the caller and the filter of resources
+// the caller can watch with the given query parameters
+func WatchResourcesFilter(context middleware.Context, resourceSchema *schema.Schema, queryParameters map[string][]string) (*schema.Policy, transaction.Filter, error) {
+	policy, filter, err := readableResourcesFilter(context, resourceSchema, queryParameters)
+	if err != nil {
+		return nil, nil, err
+	}
+	unverified := map[string][]string{}
+	for key, value := range queryParameters {
+		unverified[key] = value
+	}
+	delete(unverified, "watch")
+	delete(unverified, "revision")
+	if err := verifyQueryParams(resourceSchema, unverified); err != nil {
+		return nil, nil, ResourceError{err, err.Error(), WrongQuery}
+	}
+	return policy, filter, nil
+}
+
+// GetMultipleResources returns all resources specified by the schema and query parameters
+func GetMultipleResources(context middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, queryParameters map[string][]string) error {
+	defer measureRequestTime(time.Now(), "get.resources.multiple", resourceSchema.ID)
+	log.Debug("Start get multiple resources!!")
+	policy, filter, err := readableResourcesFilter(context, resourceSchema, queryParameters)
+	if err != nil {
+		return err
+	}
 	paginator, err := pagination.FromURLQuery(resourceSchema, queryParameters)
 	if err != nil {
 		return ResourceError{err, err.Error(), WrongQuery}
 	}
+	// markers carry the sort key value of the last resource of a page,
+	// so they can't be used with properties hidden from the caller
+	if paginator.Marker != "" && !sortKeyVisible(policy, paginator) {
+		err := fmt.Errorf("Resources can't be sorted by %s", paginator.SortKey())
+		return ResourceError{err, err.Error(), WrongQuery}
+	}
 
 	err = verifyQueryParams(resourceSchema, queryParameters)
 	if err != nil {
 		return ResourceError{err, err.Error(), WrongQuery}
 	}
+	if err := checkShowDeleted(context, resourceSchema); err != nil {
+		return err
+	}
 
 	environmentManager := extension.GetManager()
 	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
@@ -328,10 +554,20 @@ func verifyQueryParams(resourceSchema *schema.Schema, queryParameters map[string
 	for _, key := range resourceSchema.Properties {
 		delete(queryParameters, key.ID)
 	}
+	for key := range queryParameters {
+		if property, _, _, ok := parseFilterKey(key); ok {
+			if _, err := resourceSchema.GetPropertyByID(property); err == nil {
+				delete(queryParameters, key)
+			}
+		}
+	}
 	delete(queryParameters, "sort_key")
 	delete(queryParameters, "sort_order")
 	delete(queryParameters, "limit")
 	delete(queryParameters, "offset")
+	delete(queryParameters, "marker")
+
+	delete(queryParameters, "show_deleted")
 
 	delete(queryParameters, "_details")
 	delete(queryParameters, "_fields")
@@ -351,6 +587,9 @@ func GetSingleResource(context middleware.Context, dataStore db.DB, resourceSche
 	if err != nil {
 		return err
 	}
+	if err := checkShowDeleted(context, resourceSchema); err != nil {
+		return err
+	}
 
 	environmentManager := extension.GetManager()
 	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
@@ -367,7 +606,7 @@ func GetSingleResource(context middleware.Context, dataStore db.DB, resourceSche
 		return fmt.Errorf("extension returned invalid JSON: %v", rawResponse)
 	}
 
-	if err := resourceTransactionWithContext(
+	if err := readOnlyTransactionWithContext(
 		context, dataStore,
 		transaction.GetIsolationLevel(resourceSchema, schema.ActionRead),
 		func() error {
@@ -420,18 +659,29 @@ func GetSingleResourceInTransaction(context middleware.Context, resourceSchema *
 	policy := context["policy"].(*schema.Policy)
 	policy.AddCustomFilters(filter, auth.TenantID())
 
-	object, err := mainTransaction.Fetch(resourceSchema, filter, options)
-	if object == nil {
-		switch err {
-		case transaction.ErrResourceNotFound:
-			log.Info("Fetch failed: %v", err)
-			return ResourceError{err, "Resource not found", NotFound}
-		default:
-			log.Error("Fetch failed: %v", err)
-			return ResourceError{err, "Error when fetching resource", InternalServerError}
+	var object *schema.Resource
+	at := historyPoint(context)
+	if at != "" {
+		if object, err = fetchResourceAt(context, mainTransaction, resourceSchema, resourceID, at, tenantIDs); err != nil {
+			return err
+		}
+	} else {
+		object, err = mainTransaction.Fetch(resourceSchema, filter, options)
+		if object == nil {
+			switch err {
+			case transaction.ErrResourceNotFound:
+				log.Info("Fetch failed: %v", err)
+				return ResourceError{err, "Resource not found", NotFound}
+			default:
+				log.Error("Fetch failed: %v", err)
+				return ResourceError{err, "Error when fetching resource", InternalServerError}
+			}
 		}
 	}
 
+	if at == "" && (options == nil || (len(options.Fields) == 0 && !options.ShowDeleted)) {
+		context["etag"] = transaction.ETag(resourceSchema, object.Data())
+	}
 	response := map[string]interface{}{}
 	response[resourceSchema.Singular] = object.Data()
 	context["response"] = response
@@ -483,6 +733,9 @@ func CreateOrUpdateResource(
 		return false, preTxErr
 	}
 
+	if err := checkCreateOrUpdatePrecondition(context, exists); err != nil {
+		return false, err
+	}
 	if !exists {
 		dataMap["id"] = resourceID
 		if err := CreateResource(context, dataStore, identityService, resourceSchema, dataMap); err != nil {
@@ -494,6 +747,41 @@ func CreateOrUpdateResource(
 	return false, UpdateResource(context, dataStore, identityService, resourceSchema, resourceID, dataMap)
 }
 
+// checkCreateOrUpdatePrecondition verifies If-Match and If-None-Match headers
+// which don't depend on the content of the resource
+func checkCreateOrUpdatePrecondition(context middleware.Context, exists bool) error {
+	r, ok := context["http_request"].(*http.Request)
+	if !ok {
+		return nil
+	}
+	if !exists && r.Header.Get("If-Match") != "" {
+		return ResourceError{transaction.ErrPreconditionFailed, "Resource does not exist", PreconditionFailed}
+	}
+	if exists && r.Header.Get("If-None-Match") == "*" {
+		return ResourceError{transaction.ErrPreconditionFailed, "Resource already exists", PreconditionFailed}
+	}
+	return nil
+}
+
+// ifMatchRequested checks if the request is conditional on an ETag given in If-Match header
+func ifMatchRequested(context middleware.Context) bool {
+	r, ok := context["http_request"].(*http.Request)
+	return ok && r.Header.Get("If-Match") != ""
+}
+
+// checkIfMatch verifies that resource wasn't modified since the ETag given in If-Match header was read
+func checkIfMatch(context middleware.Context, resource *schema.Resource) error {
+	r, ok := context["http_request"].(*http.Request)
+	if !ok {
+		return nil
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || transaction.MatchETag(ifMatch, transaction.ETag(resource.Schema(), resource.Data())) {
+		return nil
+	}
+	return ResourceError{transaction.ErrPreconditionFailed, "Resource was modified, fetch it again and retry", PreconditionFailed}
+}
+
 func checkIfResourceExistsForTenant(
 	tenantID,
 	resourceID string,
@@ -532,20 +820,45 @@ func CreateResource(
 	dataMap map[string]interface{},
 ) error {
 	defer measureRequestTime(time.Now(), "create", resourceSchema.ID)
+	resource, err := prepareCreateResource(context, identityService, resourceSchema, dataMap)
+	if err != nil {
+		return err
+	}
+
+	if err := resourceTransactionWithContext(
+		context, dataStore,
+		transaction.GetIsolationLevel(resourceSchema, schema.ActionCreate),
+		func() error {
+			return CreateResourceInTransaction(context, resourceSchema, resource)
+		},
+	); err != nil {
+		return err
+	}
+
+	return finishCreateResource(context, resourceSchema)
+}
+
+// prepareCreateResource checks policy, handles pre_create event and validates the resource to be created
+func prepareCreateResource(
+	context middleware.Context,
+	identityService middleware.IdentityService,
+	resourceSchema *schema.Schema,
+	dataMap map[string]interface{},
+) (*schema.Resource, error) {
 	manager := schema.GetManager()
 	// Load environment
 	environmentManager := extension.GetManager()
 	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
 
 	if !ok {
-		return fmt.Errorf("No environment for schema")
+		return nil, fmt.Errorf("No environment for schema")
 	}
 	auth := context["auth"].(schema.Authorization)
 
 	//LoadPolicy
 	policy, err := loadPolicy(context, "create", resourceSchema.GetPluralURL(), auth)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = resourceSchema.GetPropertyByID("tenant_id")
@@ -556,21 +869,25 @@ func CreateResource(
 	if tenantID, ok := dataMap["tenant_id"]; ok && tenantID != nil {
 		dataMap["tenant_name"], err = identityService.GetTenantName(tenantID.(string))
 		if err != nil {
-			return ResourceError{err, err.Error(), Unauthorized}
+			return nil, ResourceError{err, err.Error(), Unauthorized}
 		}
 	}
 
 	//Apply policy for api input
 	err = policy.Check(schema.ActionCreate, auth, dataMap)
 	if err != nil {
-		return ResourceError{err, err.Error(), Unauthorized}
+		return nil, ResourceError{err, err.Error(), Unauthorized}
 	}
 	delete(dataMap, "tenant_name")
 
 	// apply property filter
 	err = policy.ApplyPropertyConditionFilter(schema.ActionCreate, dataMap, nil)
 	if err != nil {
-		return ResourceError{err, err.Error(), Unauthorized}
+		return nil, ResourceError{err, err.Error(), Unauthorized}
+	}
+	err = policy.ApplyExpressionConditions(schema.ActionCreate, auth, dataMap, nil)
+	if err != nil {
+		return nil, ResourceError{err, err.Error(), Unauthorized}
 	}
 	context["resource"] = dataMap
 	if id, ok := dataMap["id"]; !ok || id == "" {
@@ -580,7 +897,7 @@ func CreateResource(
 	context["schema_id"] = resourceSchema.ID
 
 	if err := extension.HandleEvent(context, environment, "pre_create", resourceSchema.ID); err != nil {
-		return err
+		return nil, err
 	}
 
 	if resourceData, ok := context["resource"].(map[string]interface{}); ok {
@@ -592,36 +909,36 @@ func CreateResource(
 	if _, ok := context[goValidationContextKey]; ok {
 		err = resourceSchema.ValidateGoOnCreate(dataMap)
 		if err != nil {
-			return ResourceError{err, fmt.Sprintf("Validation error: %s", err), WrongData}
+			return nil, ResourceError{err, fmt.Sprintf("Validation error: %s", err), WrongData}
 		}
 	} else {
 		err = resourceSchema.ValidateOnCreate(dataMap)
 		if err != nil {
-			return ResourceError{err, fmt.Sprintf("Validation error: %s", err), WrongData}
+			return nil, ResourceError{err, fmt.Sprintf("Validation error: %s", err), WrongData}
 		}
 	}
 
 	resource, err := manager.LoadResource(resourceSchema.ID, dataMap)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//Fillup default
 	err = resource.PopulateDefaults()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	context["resource"] = resource.Data()
+	return resource, nil
+}
 
-	if err := resourceTransactionWithContext(
-		context, dataStore,
-		transaction.GetIsolationLevel(resourceSchema, schema.ActionCreate),
-		func() error {
-			return CreateResourceInTransaction(context, resourceSchema, resource)
-		},
-	); err != nil {
-		return err
+// finishCreateResource handles post_create event and applies policy for the response
+func finishCreateResource(context middleware.Context, resourceSchema *schema.Schema) error {
+	environmentManager := extension.GetManager()
+	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
+	if !ok {
+		return fmt.Errorf("No environment for schema")
 	}
 
 	if err := extension.HandleEvent(context, environment, "post_create", resourceSchema.ID); err != nil {
@@ -668,7 +985,11 @@ func CreateResourceInTransaction(context middleware.Context, resourceSchema *sch
 			fmt.Sprintf("Failed to store data in database: %v", err),
 			CreateFailed}
 	}
+	if err := auditInTransaction(context, schema.ActionCreate, resourceSchema, resource.ID(), nil, resource.Data()); err != nil {
+		return err
+	}
 
+	context["etag"] = transaction.ETag(resourceSchema, resource.Data())
 	response := map[string]interface{}{}
 	response[resourceSchema.Singular] = resource.Data()
 	context["response"] = response
@@ -688,13 +1009,39 @@ func UpdateResource(
 	resourceID string, dataMap map[string]interface{},
 ) error {
 	defer measureRequestTime(time.Now(), "update", resourceSchema.ID)
+	dataMap, tenantIDs, err := prepareUpdateResource(context, identityService, resourceSchema, resourceID, dataMap)
+	if err != nil {
+		return err
+	}
+
+	if err := resourceTransactionWithContext(
+		context, dataStore,
+		transaction.GetIsolationLevel(resourceSchema, schema.ActionUpdate),
+		func() error {
+			return UpdateResourceInTransaction(context, resourceSchema, resourceID, dataMap, tenantIDs)
+		},
+	); err != nil {
+		return err
+	}
+
+	return finishUpdateResource(context, resourceSchema)
+}
+
+// prepareUpdateResource checks policy and handles pre_update event,
+// it returns the data to be updated and tenants allowed to update the resource
+func prepareUpdateResource(
+	context middleware.Context,
+	identityService middleware.IdentityService,
+	resourceSchema *schema.Schema,
+	resourceID string, dataMap map[string]interface{},
+) (map[string]interface{}, []string, error) {
 	context["id"] = resourceID
 
 	//load environment
 	environmentManager := extension.GetManager()
 	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
 	if !ok {
-		return fmt.Errorf("No environment for schema")
+		return nil, nil, fmt.Errorf("No environment for schema")
 	}
 
 	auth := context["auth"].(schema.Authorization)
@@ -702,14 +1049,14 @@ func UpdateResource(
 	//load policy
 	policy, err := loadPolicy(context, "update", strings.Replace(resourceSchema.GetSingleURL(), ":id", resourceID, 1), auth)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	//fillup default values
 	if tenantID, ok := dataMap["tenant_id"]; ok && tenantID != nil {
 		dataMap["tenant_name"], err = identityService.GetTenantName(tenantID.(string))
 		if err != nil {
-			return ResourceError{err, err.Error(), Unauthorized}
+			return nil, nil, ResourceError{err, err.Error(), Unauthorized}
 		}
 	}
 
@@ -717,7 +1064,7 @@ func UpdateResource(
 	err = policy.Check(schema.ActionUpdate, auth, dataMap)
 	delete(dataMap, "tenant_name")
 	if err != nil {
-		return ResourceError{err, err.Error(), Unauthorized}
+		return nil, nil, ResourceError{err, err.Error(), Unauthorized}
 	}
 	needsDelete := false
 	if _, ok := dataMap["id"]; !ok {
@@ -726,7 +1073,7 @@ func UpdateResource(
 	}
 	context["resource"] = dataMap
 	if err := extension.HandleEvent(context, environment, "pre_update", resourceSchema.ID); err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	if resourceData, ok := context["resource"].(map[string]interface{}); ok {
@@ -735,15 +1082,15 @@ func UpdateResource(
 		}
 		dataMap = resourceData
 	}
+	return dataMap, policy.GetTenantIDFilter(schema.ActionUpdate, auth.TenantID()), nil
+}
 
-	if err := resourceTransactionWithContext(
-		context, dataStore,
-		transaction.GetIsolationLevel(resourceSchema, schema.ActionUpdate),
-		func() error {
-			return UpdateResourceInTransaction(context, resourceSchema, resourceID, dataMap, policy.GetTenantIDFilter(schema.ActionUpdate, auth.TenantID()))
-		},
-	); err != nil {
-		return err
+// finishUpdateResource handles post_update event and applies policy for the response
+func finishUpdateResource(context middleware.Context, resourceSchema *schema.Schema) error {
+	environmentManager := extension.GetManager()
+	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
+	if !ok {
+		return fmt.Errorf("No environment for schema")
 	}
 
 	if err := extension.HandleEvent(context, environment, "post_update", resourceSchema.ID); err != nil {
@@ -777,7 +1124,13 @@ func UpdateResourceInTransaction(
 
 	var resource *schema.Resource
 	var err error
-	switch resourceSchema.GetLockingPolicy("update") {
+	lockingPolicy := resourceSchema.GetLockingPolicy("update")
+	if lockingPolicy == schema.NoLocking && ifMatchRequested(context) {
+		// the row is locked until commit, so concurrent conditional updates
+		// can't both pass the check against the same version
+		lockingPolicy = schema.SkipRelatedResources
+	}
+	switch lockingPolicy {
 	case schema.NoLocking:
 		resource, err = mainTransaction.Fetch(resourceSchema, filter, nil)
 	case schema.LockRelatedResources:
@@ -786,9 +1139,15 @@ func UpdateResourceInTransaction(
 		resource, err = mainTransaction.LockFetch(resourceSchema, filter, schema.SkipRelatedResources, nil)
 	}
 
+	if err == transaction.ErrResourceNotFound {
+		return ResourceError{err, "Resource not found", NotFound}
+	}
 	if err != nil {
 		return ResourceError{err, err.Error(), WrongQuery}
 	}
+	if err := checkIfMatch(context, resource); err != nil {
+		return err
+	}
 
 	policy := context["policy"].(*schema.Policy)
 	// apply property filter
@@ -796,6 +1155,11 @@ func UpdateResourceInTransaction(
 	if err != nil {
 		return ResourceError{err, "", Unauthorized}
 	}
+	auth, _ := context["auth"].(schema.Authorization)
+	err = policy.ApplyExpressionConditions(schema.ActionUpdate, auth, resource.Data(), dataMap)
+	if err != nil {
+		return ResourceError{err, "", Unauthorized}
+	}
 
 	if _, ok := context[goValidationContextKey]; ok {
 		// Go compiler fills fields which are of primitive type with 'zero value' if any golang extension
@@ -816,6 +1180,7 @@ func UpdateResourceInTransaction(
 		}
 	}
 
+	before := copyResourceData(resource.Data())
 	err = resource.Update(dataMap)
 	if err != nil {
 		return ResourceError{err, err.Error(), WrongData}
@@ -849,7 +1214,11 @@ func UpdateResourceInTransaction(
 			UpdateFailed,
 		}
 	}
+	if err := auditInTransaction(context, schema.ActionUpdate, resourceSchema, resourceID, before, resource.Data()); err != nil {
+		return err
+	}
 
+	context["etag"] = transaction.ETag(resourceSchema, resource.Data())
 	response := map[string]interface{}{}
 	response[resourceSchema.Singular] = resource.Data()
 	context["response"] = response
@@ -868,6 +1237,24 @@ func DeleteResource(context middleware.Context,
 	resourceID string,
 ) error {
 	defer measureRequestTime(time.Now(), "delete", resourceSchema.ID)
+	if err := prepareDeleteResource(context, dataStore, resourceSchema, resourceID); err != nil {
+		return err
+	}
+
+	if err := resourceTransactionWithContext(
+		context, dataStore,
+		transaction.GetIsolationLevel(resourceSchema, schema.ActionDelete),
+		func() error {
+			return DeleteResourceInTransaction(context, resourceSchema, resourceID)
+		},
+	); err != nil {
+		return err
+	}
+	return finishDeleteResource(context, resourceSchema)
+}
+
+// prepareDeleteResource handles pre_delete event and checks if the resource can be deleted
+func prepareDeleteResource(context middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, resourceID string) error {
 	context["id"] = resourceID
 	environmentManager := extension.GetManager()
 	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
@@ -892,21 +1279,19 @@ func DeleteResource(context middleware.Context,
 	if resource != nil {
 		context["resource"] = resource.Data()
 	}
-	if err := resourceTransactionWithContext(
-		context, dataStore,
-		transaction.GetIsolationLevel(resourceSchema, schema.ActionDelete),
-		func() error {
-			return DeleteResourceInTransaction(context, resourceSchema, resourceID)
-		},
-	); err != nil {
-		return err
-	}
-	if err := extension.HandleEvent(context, environment, "post_delete", resourceSchema.ID); err != nil {
-		return err
-	}
 	return nil
 }
 
+// finishDeleteResource handles post_delete event
+func finishDeleteResource(context middleware.Context, resourceSchema *schema.Schema) error {
+	environmentManager := extension.GetManager()
+	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
+	if !ok {
+		return fmt.Errorf("No environment for schema")
+	}
+	return extension.HandleEvent(context, environment, "post_delete", resourceSchema.ID)
+}
+
 func fetchResource(resourceID string, resourceSchema *schema.Schema, tx transaction.Transaction, context middleware.Context) (*schema.Resource, error) {
 	auth := context["auth"].(schema.Authorization)
 	resource, fetchErr := fetchResourceForAction(schema.ActionDelete, auth, resourceID, resourceSchema, tx, context)
@@ -994,15 +1379,22 @@ func DeleteResourceInTransaction(context middleware.Context, resourceSchema *sch
 	if err != nil {
 		return ResourceError{err, "", Unauthorized}
 	}
+	err = policy.ApplyExpressionConditions(schema.ActionDelete, auth, resource.Data(), nil)
+	if err != nil {
+		return ResourceError{err, "", Unauthorized}
+	}
 
 	if err := extension.HandleEvent(context, environment, "pre_delete_in_transaction", resourceSchema.ID); err != nil {
 		return err
 	}
 
-	err = mainTransaction.Delete(resourceSchema, resourceID)
+	err = mainTransaction.DeleteContext(deletedByContext(auth), resourceSchema, resourceID)
 	if err != nil {
 		return ResourceError{err, "", DeleteFailed}
 	}
+	if err := auditInTransaction(context, schema.ActionDelete, resourceSchema, resourceID, resource.Data(), nil); err != nil {
+		return err
+	}
 
 	if err := extension.HandleEvent(context, environment, "post_delete_in_transaction", resourceSchema.ID); err != nil {
 		return err
@@ -1010,6 +1402,109 @@ func DeleteResourceInTransaction(context middleware.Context, resourceSchema *sch
 	return nil
 }
 
+// deletedByContext returns a context recording who deleted a recoverable resource,
+// the user or the tenant when the user is unknown
+func deletedByContext(auth schema.Authorization) context.Context {
+	deletedBy, _ := schema.AuthorizedUser(auth)
+	if deletedBy == "" {
+		deletedBy = auth.TenantID()
+	}
+	return transaction.ContextWithDeletedBy(context.Background(), deletedBy)
+}
+
+// spanContext returns a context tracing queries as children of the current span of the request
+func spanContext(ctx middleware.Context) context.Context {
+	return tracing.ContextWithSpan(context.Background(), tracing.CurrentSpan(ctx))
+}
+
+// RestoreResource restores a soft deleted resource of a recoverable schema
+func RestoreResource(context middleware.Context, dataStore db.DB, resourceSchema *schema.Schema, resourceID string) error {
+	defer measureRequestTime(time.Now(), "restore", resourceSchema.ID)
+	context["id"] = resourceID
+	if !resourceSchema.Recoverable() {
+		err := fmt.Errorf("Resource '%s' is not recoverable", resourceSchema.ID)
+		return ResourceError{err, err.Error(), WrongQuery}
+	}
+	auth := context["auth"].(schema.Authorization)
+	policy, err := loadPolicy(context, schema.ActionRestore, strings.Replace(resourceSchema.GetSingleURL(), ":id", resourceID, 1), auth)
+	if err != nil {
+		return err
+	}
+
+	if err := resourceTransactionWithContext(
+		context, dataStore,
+		transaction.GetIsolationLevel(resourceSchema, schema.ActionUpdate),
+		func() error {
+			return RestoreResourceInTransaction(context, resourceSchema, resourceID, policy.GetTenantIDFilter(schema.ActionRestore, auth.TenantID()))
+		},
+	); err != nil {
+		return err
+	}
+	return finishUpdateResource(context, resourceSchema)
+}
+
+// RestoreResourceInTransaction restores a soft deleted resource in a transaction,
+// the restored resource is stored again, so it's synced and handled by update events
+func RestoreResourceInTransaction(context middleware.Context, resourceSchema *schema.Schema, resourceID string, tenantIDs []string) error {
+	defer measureRequestTime(time.Now(), "restore.in_tx", resourceSchema.ID)
+	mainTransaction := context["transaction"].(transaction.Transaction)
+	environmentManager := extension.GetManager()
+	environment, ok := environmentManager.GetEnvironment(resourceSchema.ID)
+	if !ok {
+		return fmt.Errorf("No environment for schema")
+	}
+
+	auth := context["auth"].(schema.Authorization)
+	policy := context["policy"].(*schema.Policy)
+	filter := transaction.IDFilter(resourceID)
+	if tenantIDs != nil {
+		filter["tenant_id"] = tenantIDs
+	}
+	policy.AddCustomFilters(filter, auth.TenantID())
+
+	resource, err := mainTransaction.Fetch(resourceSchema, filter, &transaction.ViewOptions{ShowDeleted: true})
+	if err != nil {
+		if err == transaction.ErrResourceNotFound {
+			return ResourceError{err, "Resource not found", NotFound}
+		}
+		return ResourceError{err, "Error when fetching resource", InternalServerError}
+	}
+	data := resource.Data()
+	deletedAt := data[transaction.DeletedAtKey]
+	if deletedAt == nil {
+		err := fmt.Errorf("Resource '%s' is not deleted", resourceID)
+		return ResourceError{err, err.Error(), UpdateFailed}
+	}
+	delete(data, transaction.DeletedAtKey)
+	delete(data, transaction.DeletedByKey)
+	if err := db.RestoreDeleted(spanContext(context), mainTransaction, resourceSchema, resourceID, deletedAt); err != nil {
+		return ResourceError{err, "", UpdateFailed}
+	}
+
+	context["resource"] = data
+	if err := extension.HandleEvent(context, environment, "pre_update_in_transaction", resourceSchema.ID); err != nil {
+		return err
+	}
+	data, ok = context["resource"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Resource not JSON")
+	}
+	restored, err := schema.GetManager().LoadResource(resourceSchema.ID, data)
+	if err != nil {
+		return fmt.Errorf("Loading Resource failed: %s", err)
+	}
+	if err := mainTransaction.Update(restored); err != nil {
+		return ResourceError{err, "", UpdateFailed}
+	}
+	if err := auditInTransaction(context, schema.ActionRestore, resourceSchema, resourceID, nil, restored.Data()); err != nil {
+		return err
+	}
+	context["response"] = map[string]interface{}{
+		resourceSchema.Singular: restored.Data(),
+	}
+	return extension.HandleEvent(context, environment, "post_update_in_transaction", resourceSchema.ID)
+}
+
 // ActionResource runs custom action on resource
 func ActionResource(context middleware.Context, dataStore db.DB, identityService middleware.IdentityService,
 	resourceSchema *schema.Schema, action schema.Action, resourceID string, data interface{},
@@ -1038,6 +1533,7 @@ func ActionResource(context middleware.Context, dataStore db.DB, identityService
 	}
 
 	if _, ok := context["response"]; ok {
+		auditAction(context, dataStore, resourceSchema, action, resourceID, data)
 		return nil
 	}
 
@@ -1045,6 +1541,11 @@ func ActionResource(context middleware.Context, dataStore db.DB, identityService
 }
 
 func loadPolicy(context middleware.Context, action, path string, auth schema.Authorization) (*schema.Policy, error) {
+	span := tracing.StartSpan(tracing.CurrentSpan(context), "policy")
+	span.SetAttribute("action", action)
+	span.SetAttribute("path", path)
+	defer span.Finish()
+
 	manager := schema.GetManager()
 	policy, role := manager.PolicyValidate(action, path, auth)
 	if policy == nil {
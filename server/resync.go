@@ -29,18 +29,8 @@ func Resync(dbConn db.DB, sync sync.Sync) (err error) {
 
 	tl := tx.(*transactionEventLogger)
 	for _, schemaType := range schemaManager.OrderedSchemas() {
-		if schemaType.IsAbstract() {
-			log.Debug("Skip abstract schema %s", schemaType.ID)
-			continue
-		}
-
-		if schemaType.Metadata["type"] == "metaschema" {
-			log.Debug("Skip metaschema %s", schemaType.ID)
-			continue
-		}
-
-		if schemaType.Metadata["nosync"] == true {
-			log.Debug("Skip nosync schema %s", schemaType.ID)
+		if !syncedSchema(schemaType) {
+			log.Debug("Skip schema %s", schemaType.ID)
 			continue
 		}
 
@@ -61,19 +51,27 @@ func Resync(dbConn db.DB, sync sync.Sync) (err error) {
 	}
 	committed = true
 
+	totallySynced, err := SyncPendingEvents(dbConn, sync)
+	if err != nil {
+		return err
+	}
+	log.Info("Resync completed, synced %d resources", totallySynced)
+
+	return
+}
+
+// SyncPendingEvents writes all events waiting in the event table to the sync backend
+func SyncPendingEvents(dbConn db.DB, sync sync.Sync) (int, error) {
 	syncWriter := NewSyncWriter(sync, dbConn)
 	totallySynced := 0
 	for {
 		synced, err := syncWriter.Sync()
 		if err != nil {
-			return fmt.Errorf("Error when syncing events: %s", err)
+			return totallySynced, fmt.Errorf("Error when syncing events: %s", err)
 		}
 		if synced == 0 {
-			break
+			return totallySynced, nil
 		}
 		totallySynced += synced
 	}
-	log.Info("Resync completed, synced %d resources", totallySynced)
-
-	return
 }
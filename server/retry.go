@@ -0,0 +1,55 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/cloudwan/gohan/schema"
+)
+
+// attemptInOrder attempts deliveries which are due, keeping the order of deliveries of each queue:
+// a delivery waiting for retry or failing holds back the following ones of its queue.
+// queueOf returns the queue of a delivery, or false when the delivery can't be attempted now.
+// attempt returns the error of the attempt, and an error which stops the dispatch.
+func attemptInOrder(
+	deliveries []*schema.Resource,
+	queueOf func(delivery *schema.Resource) (string, bool),
+	attempt func(delivery *schema.Resource) (attemptErr, err error),
+) (succeeded int, err error) {
+	now := time.Now().Unix()
+	blocked := map[string]bool{}
+	for _, delivery := range deliveries {
+		queue, ok := queueOf(delivery)
+		if !ok || blocked[queue] {
+			continue
+		}
+		if toInt64(delivery.Get("next_attempt")) > now {
+			blocked[queue] = true
+			continue
+		}
+		attemptErr, err := attempt(delivery)
+		if err != nil {
+			return succeeded, err
+		}
+		if attemptErr != nil {
+			blocked[queue] = true
+		} else {
+			succeeded++
+		}
+	}
+	return succeeded, nil
+}
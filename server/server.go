@@ -32,6 +32,7 @@ import (
 	"time"
 
 	"github.com/braintree/manners"
+	"github.com/cloudwan/gohan/audit"
 	"github.com/cloudwan/gohan/db"
 	"github.com/cloudwan/gohan/db/migration"
 	"github.com/cloudwan/gohan/db/options"
@@ -40,12 +41,16 @@ import (
 	"github.com/cloudwan/gohan/job"
 	l "github.com/cloudwan/gohan/log"
 	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/outbox"
 	"github.com/cloudwan/gohan/schema"
 	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/cloudwan/gohan/server/resources"
 	"github.com/cloudwan/gohan/sync"
 	sync_util "github.com/cloudwan/gohan/sync/util"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/cloudwan/gohan/util"
 	"github.com/cloudwan/gohan/version"
+	"github.com/cloudwan/gohan/webhook"
 	"github.com/drone/routes"
 	"github.com/go-martini/martini"
 	"github.com/lestrrat/go-server-starter/listener"
@@ -79,6 +84,8 @@ func (server *Server) mapRoutes() {
 	schemaManager := schema.GetManager()
 	MapNamespacesRoutes(server.martini)
 	MapRouteBySchemas(server, server.db)
+	mapPolicyExplainRoute(server.martini)
+	mapPrometheusRoute(server.martini)
 
 	if txErr := db.Within(server.db, func(tx transaction.Transaction) error {
 		coreSchema, _ := schemaManager.Schema("schema")
@@ -146,6 +153,22 @@ func (server *Server) addPprofRoutes() {
 	})
 }
 
+// mapPrometheusRoute maps the Prometheus endpoint to admins, unless it's served on a separate listener
+func mapPrometheusRoute(route martini.Router) {
+	path := metrics.PrometheusPath()
+	if path == "" {
+		return
+	}
+	prometheusHandler := metrics.PrometheusHandler()
+	route.Get(path, func(w http.ResponseWriter, r *http.Request, auth schema.Authorization) {
+		if !resources.IsAdmin(auth) {
+			middleware.HTTPJSONError(w, "Only admins can read metrics", http.StatusForbidden)
+			return
+		}
+		prometheusHandler.ServeHTTP(w, r)
+	})
+}
+
 func (server *Server) resetRouter() {
 	router := martini.NewRouter()
 	server.martini.Router = router
@@ -167,7 +190,7 @@ func (server *Server) connectDB() error {
 	if server.sync == nil {
 		server.db = dbConn
 	} else {
-		server.db = &DbSyncWrapper{dbConn}
+		server.db = &DbSyncWrapper{DB: dbConn, Sync: server.sync}
 	}
 	return err
 }
@@ -220,6 +243,8 @@ func NewServer(configFile string) (*Server, error) {
 	m.Use(martini.Recovery())
 	m.Use(middleware.JSONURLs())
 	m.Use(middleware.WithContext())
+	m.Use(middleware.RequestID())
+	m.Use(middleware.Tracing())
 
 	server.martini = m
 
@@ -294,6 +319,22 @@ func NewServer(configFile string) (*Server, error) {
 		return nil, err
 	}
 
+	if err = audit.Setup(config); err != nil {
+		return nil, err
+	}
+
+	if err = tracing.Setup(config); err != nil {
+		return nil, err
+	}
+
+	if err = outbox.Setup(config); err != nil {
+		return nil, err
+	}
+
+	if err = webhook.Setup(config); err != nil {
+		return nil, err
+	}
+
 	if config.GetList("database/initial_data", nil) != nil {
 		initialDataList := config.GetList("database/initial_data", nil)
 		for _, initialData := range initialDataList {
@@ -311,8 +352,25 @@ func NewServer(configFile string) (*Server, error) {
 
 	m.Map(middleware.NewNobodyResourceService(manager.NobodyResourcePaths()))
 
-	if config.GetBool("keystone/use_keystone", false) {
-		server.keystoneIdentity, err = middleware.CreateIdentityServiceFromConfig(config)
+	identityServices := []middleware.IdentityService{}
+	if config.GetBool("keystone/use_keystone", false) || config.GetBool("oidc/use_oidc", false) {
+		identityService, err := middleware.CreateIdentityServiceFromConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		identityServices = append(identityServices, identityService)
+	}
+	if config.GetBool("api_keys/enabled", false) {
+		log.Info("API key identity service configured")
+		apiKeyIdentity := NewAPIKeyIdentity(server.db)
+		apiKeyIdentity.TrustedProxies = config.GetInt("api_keys/trusted_proxies", 0)
+		identityServices = append(identityServices, apiKeyIdentity)
+	}
+	if len(identityServices) > 0 {
+		server.keystoneIdentity = identityServices[0]
+		if len(identityServices) > 1 {
+			server.keystoneIdentity = middleware.NewChainedIdentityService(identityServices...)
+		}
 		m.MapTo(server.keystoneIdentity, (*middleware.IdentityService)(nil))
 		m.Use(middleware.Authentication())
 	} else {
@@ -336,8 +394,8 @@ func NewServer(configFile string) (*Server, error) {
 		}
 		server.martini.Use(func(rw http.ResponseWriter, r *http.Request) {
 			rw.Header().Add("Access-Control-Allow-Origin", cors)
-			rw.Header().Add("Access-Control-Allow-Headers", "X-Auth-Token, Content-Type")
-			rw.Header().Add("Access-Control-Expose-Headers", "X-Total-Count")
+			rw.Header().Add("Access-Control-Allow-Headers", "X-Auth-Token, Authorization, Content-Type, traceparent")
+			rw.Header().Add("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Marker, X-Request-Id")
 			rw.Header().Add("Access-Control-Allow-Methods", "GET,PUT,POST,DELETE")
 		})
 	}
@@ -461,6 +519,8 @@ func (server *Server) Stop() {
 	stopCRONProcess(server)
 	manners.Close()
 	server.queue.Stop()
+	tracing.Close()
+	outbox.Close()
 }
 
 //Queue returns servers build-in queue
@@ -506,10 +566,23 @@ func RunServer(configFile string) {
 		stateWatcher := NewStateWatcher(server.sync, server.db, server.keystoneIdentity)
 		go stateWatcher.Run(server.masterCtx)
 
-		syncWriter := NewSyncWriter(server.sync, server.db)
+		config := util.GetConfig()
+		syncWriter := NewSyncWriterWithOptions(server.sync, server.db, SyncWriterOptions{
+			Shards:    config.GetInt("sync_writer/shards", 1),
+			BatchSize: config.GetInt("sync_writer/batch_size", defaultSyncBatchSize),
+		})
 		go syncWriter.Run(server.masterCtx)
 
-		config := util.GetConfig()
+		if len(cachedSchemas()) > 0 {
+			cacheInvalidationWatcher := NewCacheInvalidationWatcher(server.sync, server.db)
+			go cacheInvalidationWatcher.Run(server.masterCtx)
+		}
+
+		if _, ok := schema.GetManager().Schema(webhook.SubscriptionSchemaID); ok {
+			webhookDispatcher := NewWebhookDispatcher(server.sync, server.db)
+			go webhookDispatcher.Run(server.masterCtx)
+		}
+
 		keys := config.GetStringList("watch/keys", []string{})
 		events := config.GetStringList("watch/events", []string{})
 		extensions := map[string]extension.Environment{}
@@ -524,10 +597,13 @@ func RunServer(configFile string) {
 		syncWatcher := NewSyncWatcher(server.sync, keys, events, extensions)
 		go syncWatcher.Run(server.masterCtx)
 
+		startSyncReconcileProcess(server)
+
 	}
 	startAMQPProcess(server)
 	startSNMPProcess(server)
 	startCRONProcess(server)
+	startTombstonePurgeProcess(server)
 	metrics.StartMetricsProcess()
 	err = server.Start()
 	if err != nil {
@@ -75,5 +75,7 @@ var _ = Describe("Suit set up and tear down", func() {
 	var _ = AfterSuite(func() {
 		schema.ClearManager()
 		os.Remove(conn)
+		os.Remove("./test_audit.log")
+		os.Remove("./test_spans.log")
 	})
 })
@@ -17,18 +17,24 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/pagination"
+	"github.com/cloudwan/gohan/db/sql"
 	"github.com/cloudwan/gohan/db/transaction"
 	"github.com/cloudwan/gohan/schema"
 	srv "github.com/cloudwan/gohan/server"
@@ -42,20 +48,23 @@ import (
 )
 
 var (
-	server                  *srv.Server
-	baseURL                 = "http://localhost:19090"
-	schemaURL               = baseURL + "/gohan/v0.1/schemas"
-	networkPluralURL        = baseURL + "/v2.0/networks"
-	subnetPluralURL         = baseURL + "/v2.0/subnets"
-	serverPluralURL         = baseURL + "/v2.0/servers"
-	testPluralURL           = baseURL + "/v2.0/tests"
-	parentsPluralURL        = baseURL + "/v1.0/parents"
-	childrenPluralURL       = baseURL + "/v1.0/children"
-	schoolsPluralURL        = baseURL + "/v1.0/schools"
-	citiesPluralURL         = baseURL + "/v1.0/cities"
-	profilingURL            = baseURL + "/debug/pprof/"
-	filterTestPluralURL     = baseURL + "/v2.0/filter_tests"
-	visibilityTestPluralURL = baseURL + "/v2.0/visible_properties_tests"
+	server                    *srv.Server
+	baseURL                   = "http://localhost:19090"
+	schemaURL                 = baseURL + "/gohan/v0.1/schemas"
+	networkPluralURL          = baseURL + "/v2.0/networks"
+	subnetPluralURL           = baseURL + "/v2.0/subnets"
+	serverPluralURL           = baseURL + "/v2.0/servers"
+	testPluralURL             = baseURL + "/v2.0/tests"
+	parentsPluralURL          = baseURL + "/v1.0/parents"
+	childrenPluralURL         = baseURL + "/v1.0/children"
+	schoolsPluralURL          = baseURL + "/v1.0/schools"
+	citiesPluralURL           = baseURL + "/v1.0/cities"
+	profilingURL              = baseURL + "/debug/pprof/"
+	filterTestPluralURL       = baseURL + "/v2.0/filter_tests"
+	visibilityTestPluralURL   = baseURL + "/v2.0/visible_properties_tests"
+	recoverablePluralURL      = baseURL + "/v2.0/recoverable_resources"
+	recoverableChildPluralURL = baseURL + "/v2.0/recoverable_children"
+	versionedPluralURL        = baseURL + "/v2.0/versioned_resources"
 )
 
 var _ = Describe("Server package test", func() {
@@ -272,6 +281,625 @@ var _ = Describe("Server package test", func() {
 		})
 	})
 
+	Describe("Filter operators", func() {
+		listNetworkIDs := func(query string) []string {
+			result := testURL("GET", networkPluralURL+"?"+query, adminTokenID, nil, http.StatusOK)
+			ids := []string{}
+			for _, network := range result.(map[string]interface{})["networks"].([]interface{}) {
+				ids = append(ids, network.(map[string]interface{})["id"].(string))
+			}
+			return ids
+		}
+
+		BeforeEach(func() {
+			networkRed := getNetwork("red", "red")
+			testURL("POST", networkPluralURL, adminTokenID, networkRed, http.StatusCreated)
+			networkBlue := getNetwork("blue", "blue")
+			networkBlue["providor_networks"] = map[string]interface{}{"segmentation_id": 20, "segmentation_type": "vxlan"}
+			testURL("POST", networkPluralURL, adminTokenID, networkBlue, http.StatusCreated)
+		})
+
+		It("should filter using operators in query", func() {
+			Expect(listNetworkIDs("tenant_id[neq]=red")).To(ConsistOf("networkblue"))
+			Expect(listNetworkIDs("tenant_id[in]=red&tenant_id[in]=green")).To(ConsistOf("networkred"))
+			Expect(listNetworkIDs("name[like]=Network%25")).To(ConsistOf("networkred", "networkblue"))
+			Expect(listNetworkIDs("name[prefix]=Networkb")).To(ConsistOf("networkblue"))
+			Expect(listNetworkIDs("name[ilike]=%25RED")).To(ConsistOf("networkred"))
+			Expect(listNetworkIDs("providor_networks.segmentation_id[gte]=15")).To(ConsistOf("networkblue"))
+			Expect(listNetworkIDs("providor_networks.segmentation_type[eq]=vlan")).To(ConsistOf("networkred"))
+			Expect(listNetworkIDs("tenant_id=red&name[prefix]=Network")).To(ConsistOf("networkred"))
+		})
+
+		It("should reject invalid filters", func() {
+			testURLErrorMessage("GET", networkPluralURL+"?name[regexp]=red", adminTokenID, nil,
+				http.StatusBadRequest, `Unknown filter operator "regexp", has to be one of [eq, neq, lt, lte, gt, gte, in, not_in, like, ilike, prefix, is_null]`)
+			testURL("GET", networkPluralURL+"?name[is_null]=maybe", adminTokenID, nil, http.StatusBadRequest)
+			testURL("GET", networkPluralURL+"?shared[eq]=maybe", adminTokenID, nil, http.StatusBadRequest)
+			testURL("GET", networkPluralURL+"?name.first[eq]=red", adminTokenID, nil, http.StatusBadRequest)
+			testURL("GET", networkPluralURL+"?unknown[eq]=red", adminTokenID, nil, http.StatusBadRequest)
+		})
+	})
+
+	Describe("Marker pagination", func() {
+		BeforeEach(func() {
+			for _, tenant := range []string{"red", "blue", "green"} {
+				testURL("POST", networkPluralURL, adminTokenID, getNetwork(tenant, tenant), http.StatusCreated)
+			}
+		})
+
+		It("should return pages following the next marker", func() {
+			ids := []string{}
+			query := "?limit=2&sort_key=name"
+			for page := 0; page < 3; page++ {
+				result, resp := httpRequest("GET", networkPluralURL+query, adminTokenID, nil)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("X-Total-Count")).To(Equal("3"))
+				for _, network := range result.(map[string]interface{})["networks"].([]interface{}) {
+					ids = append(ids, network.(map[string]interface{})["id"].(string))
+				}
+				marker := resp.Header.Get("X-Next-Marker")
+				if marker == "" {
+					break
+				}
+				query = "?limit=2&sort_key=name&marker=" + marker
+			}
+			Expect(ids).To(Equal([]string{"networkblue", "networkgreen", "networkred"}))
+		})
+
+		It("should not return next marker on the last page", func() {
+			_, resp := httpRequest("GET", networkPluralURL+"?limit=5", adminTokenID, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Next-Marker")).To(BeEmpty())
+		})
+
+		It("should reject invalid markers", func() {
+			testURL("GET", networkPluralURL+"?limit=2&marker=invalid", adminTokenID, nil, http.StatusBadRequest)
+			testURL("GET", networkPluralURL+"?limit=2&offset=1&marker=WyJhIiwiYSJd", adminTokenID, nil, http.StatusBadRequest)
+		})
+
+		It("should not use markers with properties hidden from the caller", func() {
+			_, resp := httpRequest("GET", networkPluralURL+"?limit=1&sort_key=shared", memberTokenID, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Next-Marker")).To(BeEmpty())
+			marker := pagination.EncodeMarker(false, "networkblue")
+			testURL("GET", networkPluralURL+"?limit=1&sort_key=shared&marker="+marker, memberTokenID, nil, http.StatusBadRequest)
+			_, resp = httpRequest("GET", networkPluralURL+"?limit=1&sort_key=name", memberTokenID, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("ETag", func() {
+		conditionalRequest := func(method, url, header, etag string, postData interface{}) (interface{}, *http.Response) {
+			var reader io.Reader
+			if postData != nil {
+				jsonByte, err := json.Marshal(postData)
+				Expect(err).ToNot(HaveOccurred())
+				reader = bytes.NewBuffer(jsonByte)
+			}
+			request, err := http.NewRequest(method, url, reader)
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("X-Auth-Token", adminTokenID)
+			request.Header.Set(header, etag)
+			resp, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			var data interface{}
+			json.NewDecoder(resp.Body).Decode(&data)
+			return data, resp
+		}
+
+		var etag string
+
+		BeforeEach(func() {
+			_, resp := httpRequest("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"))
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			etag = resp.Header.Get("ETag")
+			Expect(etag).ToNot(BeEmpty())
+		})
+
+		It("should return the same ETag until the resource is modified", func() {
+			_, resp := httpRequest("GET", getNetworkSingularURL("red"), adminTokenID, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("ETag")).To(Equal(etag))
+
+			_, resp = httpRequest("PATCH", getNetworkSingularURL("red"), adminTokenID, map[string]interface{}{"name": "Renamed"})
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			newETag := resp.Header.Get("ETag")
+			Expect(newETag).ToNot(Equal(etag))
+
+			_, resp = httpRequest("GET", getNetworkSingularURL("red"), adminTokenID, nil)
+			Expect(resp.Header.Get("ETag")).To(Equal(newETag))
+		})
+
+		It("should return not modified when ETag matches If-None-Match", func() {
+			_, resp := conditionalRequest("GET", getNetworkSingularURL("red"), "If-None-Match", etag, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+			Expect(resp.Header.Get("ETag")).To(Equal(etag))
+
+			_, resp = conditionalRequest("GET", getNetworkSingularURL("red"), "If-None-Match", `"stale"`, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should update only when ETag matches If-Match", func() {
+			_, resp := conditionalRequest("PATCH", getNetworkSingularURL("red"), "If-Match", etag, map[string]interface{}{"name": "First"})
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			_, resp = conditionalRequest("PATCH", getNetworkSingularURL("red"), "If-Match", etag, map[string]interface{}{"name": "Second"})
+			Expect(resp.StatusCode).To(Equal(http.StatusPreconditionFailed))
+			_, resp = conditionalRequest("PUT", getNetworkSingularURL("red"), "If-Match", etag, map[string]interface{}{"name": "Second"})
+			Expect(resp.StatusCode).To(Equal(http.StatusPreconditionFailed))
+
+			result := testURL("GET", getNetworkSingularURL("red"), adminTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("network", HaveKeyWithValue("name", "First")))
+		})
+
+		It("should use the same ETag for resources with related resources", func() {
+			serverURL := serverPluralURL + "/serverred"
+			testURL("POST", serverPluralURL, adminTokenID, map[string]interface{}{
+				"id":         "serverred",
+				"name":       "Server Red",
+				"tenant_id":  "red",
+				"network_id": "networkred",
+			}, http.StatusCreated)
+
+			result, resp := httpRequest("GET", serverURL, adminTokenID, nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(result).To(HaveKeyWithValue("server", HaveKey("network")))
+			serverETag := resp.Header.Get("ETag")
+
+			_, resp = conditionalRequest("PATCH", serverURL, "If-Match", serverETag, map[string]interface{}{"name": "First"})
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			serverETag = resp.Header.Get("ETag")
+
+			_, resp = httpRequest("GET", serverURL, adminTokenID, nil)
+			Expect(resp.Header.Get("ETag")).To(Equal(serverETag))
+
+			_, resp = conditionalRequest("PUT", serverURL, "If-Match", serverETag, map[string]interface{}{"name": "Second"})
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should check existence for PUT preconditions", func() {
+			_, resp := conditionalRequest("PUT", getNetworkSingularURL("red"), "If-None-Match", "*", map[string]interface{}{"name": "Other"})
+			Expect(resp.StatusCode).To(Equal(http.StatusPreconditionFailed))
+
+			_, resp = conditionalRequest("PUT", getNetworkSingularURL("blue"), "If-Match", etag, getNetwork("blue", "red"))
+			Expect(resp.StatusCode).To(Equal(http.StatusPreconditionFailed))
+
+			_, resp = conditionalRequest("PUT", getNetworkSingularURL("blue"), "If-None-Match", "*", getNetwork("blue", "red"))
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Describe("Soft delete", func() {
+		recoverableURL := recoverablePluralURL + "/recoverable"
+
+		BeforeEach(func() {
+			testURL("POST", recoverablePluralURL, memberTokenID, map[string]interface{}{
+				"id":        "recoverable",
+				"name":      "Recoverable",
+				"tenant_id": memberTenantID,
+			}, http.StatusCreated)
+			testURL("DELETE", recoverableURL, memberTokenID, nil, http.StatusNoContent)
+		})
+
+		It("should hide deleted resources", func() {
+			testURL("GET", recoverableURL, memberTokenID, nil, http.StatusNotFound)
+			result := testURL("GET", recoverablePluralURL, adminTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resources", BeEmpty()))
+		})
+
+		It("should show deleted resources to admin", func() {
+			result := testURL("GET", recoverablePluralURL+"?show_deleted=true", adminTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resources", ConsistOf(SatisfyAll(
+				HaveKeyWithValue("id", "recoverable"),
+				HaveKeyWithValue("deleted_by", "demo"),
+				HaveKeyWithValue("deleted_at", BeNumerically(">", 0)),
+			))))
+			testURL("GET", recoverableURL+"?show_deleted=true", adminTokenID, nil, http.StatusOK)
+		})
+
+		It("should not show deleted resources to members", func() {
+			testURL("GET", recoverablePluralURL+"?show_deleted=true", memberTokenID, nil, http.StatusForbidden)
+			testURL("GET", recoverableURL+"?show_deleted=true", memberTokenID, nil, http.StatusForbidden)
+		})
+
+		It("should reject show_deleted for not recoverable resources", func() {
+			testURL("GET", networkPluralURL+"?show_deleted=true", adminTokenID, nil, http.StatusBadRequest)
+		})
+
+		It("should restore deleted resources", func() {
+			result := testURL("POST", recoverableURL+"/restore", memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resource", HaveKeyWithValue("name", "Recoverable")))
+			result = testURL("GET", recoverableURL, memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resource", HaveKeyWithValue("name", "Recoverable")))
+			testURL("POST", recoverableURL+"/restore", memberTokenID, nil, http.StatusConflict)
+		})
+
+		It("should not restore unknown resources", func() {
+			testURL("POST", recoverablePluralURL+"/unknown/restore", memberTokenID, nil, http.StatusNotFound)
+		})
+
+		It("should not update deleted resources", func() {
+			testURL("PATCH", recoverableURL, memberTokenID, map[string]interface{}{"name": "Updated"}, http.StatusNotFound)
+			testURL("GET", recoverableURL, memberTokenID, nil, http.StatusNotFound)
+			result := testURL("GET", recoverableURL+"?show_deleted=true", adminTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resource", SatisfyAll(
+				HaveKeyWithValue("name", "Recoverable"),
+				HaveKeyWithValue("deleted_at", BeNumerically(">", 0)),
+			)))
+		})
+
+		It("should create resources again with the id of a deleted one", func() {
+			result := testURL("POST", recoverablePluralURL, memberTokenID, map[string]interface{}{
+				"id":        "recoverable",
+				"name":      "Recreated",
+				"tenant_id": memberTenantID,
+			}, http.StatusCreated)
+			Expect(result).To(HaveKeyWithValue("recoverable_resource", HaveKeyWithValue("name", "Recreated")))
+			testURL("POST", recoverableURL+"/restore", memberTokenID, nil, http.StatusConflict)
+		})
+
+		It("should delete and restore children together with their parent", func() {
+			parentURL := recoverablePluralURL + "/parent"
+			childURL := recoverableChildPluralURL + "/child"
+			testURL("POST", recoverablePluralURL, memberTokenID, map[string]interface{}{
+				"id":        "parent",
+				"tenant_id": memberTenantID,
+			}, http.StatusCreated)
+			testURL("POST", recoverableChildPluralURL, memberTokenID, map[string]interface{}{
+				"id":                      "child",
+				"recoverable_resource_id": "parent",
+				"tenant_id":               memberTenantID,
+			}, http.StatusCreated)
+
+			testURL("DELETE", parentURL, memberTokenID, nil, http.StatusNoContent)
+			testURL("GET", childURL, memberTokenID, nil, http.StatusNotFound)
+
+			testURL("POST", parentURL+"/restore", memberTokenID, nil, http.StatusOK)
+			testURL("GET", childURL, memberTokenID, nil, http.StatusOK)
+		})
+
+		It("should purge old tombstones", func() {
+			Expect(db.PurgeDeleted(context.Background(), testDB, time.Now().Add(-time.Hour))).To(Succeed())
+			result := testURL("GET", recoverablePluralURL+"?show_deleted=true", adminTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resources", HaveLen(1)))
+
+			Expect(db.PurgeDeleted(context.Background(), testDB, time.Now().Add(time.Hour))).To(Succeed())
+			result = testURL("GET", recoverablePluralURL+"?show_deleted=true", adminTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("recoverable_resources", BeEmpty()))
+		})
+	})
+
+	Describe("Resource history", func() {
+		versionedURL := versionedPluralURL + "/versioned"
+
+		BeforeEach(func() {
+			testURL("POST", versionedPluralURL, memberTokenID, map[string]interface{}{
+				"id":        "versioned",
+				"name":      "first",
+				"tenant_id": memberTenantID,
+			}, http.StatusCreated)
+			testURL("PUT", versionedURL, memberTokenID, map[string]interface{}{"name": "second"}, http.StatusOK)
+			testURL("PUT", versionedURL, memberTokenID, map[string]interface{}{"name": "third"}, http.StatusOK)
+		})
+
+		It("should list all versions", func() {
+			result := testURL("GET", versionedURL+"/history", memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("versioned_resource_history", HaveLen(3)))
+			history := result.(map[string]interface{})["versioned_resource_history"].([]interface{})
+			for i, name := range []string{"first", "second", "third"} {
+				Expect(history[i]).To(SatisfyAll(
+					HaveKeyWithValue("version", BeNumerically("==", i+1)),
+					HaveKeyWithValue("deleted", false),
+					HaveKeyWithValue("resource", HaveKeyWithValue("name", name)),
+				))
+			}
+		})
+
+		It("should return a resource at the given version", func() {
+			result := testURL("GET", versionedURL+"?at=1", memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("versioned_resource", HaveKeyWithValue("name", "first")))
+			result = testURL("GET", versionedURL+"?at=2", memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("versioned_resource", HaveKeyWithValue("name", "second")))
+			testURL("GET", versionedURL+"?at=4", memberTokenID, nil, http.StatusNotFound)
+		})
+
+		It("should return a resource at the given time", func() {
+			at := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+			result := testURL("GET", versionedURL+"?at="+at, memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("versioned_resource", HaveKeyWithValue("name", "third")))
+			at = url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+			testURL("GET", versionedURL+"?at="+at, memberTokenID, nil, http.StatusNotFound)
+		})
+
+		It("should return a resource at the given unix time", func() {
+			at := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+			result := testURL("GET", versionedURL+"?at=@"+at, memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("versioned_resource", HaveKeyWithValue("name", "third")))
+			testURL("GET", versionedURL+"?at="+at, memberTokenID, nil, http.StatusNotFound)
+			testURL("GET", versionedURL+"?at=@"+strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), memberTokenID, nil, http.StatusNotFound)
+			testURL("GET", versionedURL+"?at=@soon", memberTokenID, nil, http.StatusBadRequest)
+		})
+
+		It("should keep history of deleted resources", func() {
+			testURL("DELETE", versionedURL, memberTokenID, nil, http.StatusNoContent)
+			result := testURL("GET", versionedURL+"/history", memberTokenID, nil, http.StatusOK)
+			Expect(result).To(HaveKeyWithValue("versioned_resource_history", HaveLen(4)))
+			history := result.(map[string]interface{})["versioned_resource_history"].([]interface{})
+			Expect(history[3]).To(HaveKeyWithValue("deleted", true))
+			Expect(history[3]).To(HaveKeyWithValue("version", BeNumerically("==", 4)))
+			testURL("GET", versionedURL+"?at=4", memberTokenID, nil, http.StatusNotFound)
+			testURL("GET", versionedURL+"?at=3", memberTokenID, nil, http.StatusOK)
+		})
+
+		It("should hide history from other tenants", func() {
+			testURL("GET", versionedURL+"/history", powerUserTokenID, nil, http.StatusNotFound)
+			testURL("GET", versionedURL+"?at=1", powerUserTokenID, nil, http.StatusNotFound)
+		})
+
+		It("should hide history of resources filtered by policy conditions", func() {
+			testURL("GET", versionedURL+"/history", "visible_token", nil, http.StatusOK)
+			testURL("GET", versionedURL+"?at=1", "visible_token", nil, http.StatusOK)
+
+			testURL("PUT", versionedURL, memberTokenID, map[string]interface{}{"name": "secret"}, http.StatusOK)
+			testURL("GET", versionedURL+"/history", "visible_token", nil, http.StatusNotFound)
+			testURL("GET", versionedURL+"?at=1", "visible_token", nil, http.StatusNotFound)
+
+			testURL("DELETE", versionedURL, memberTokenID, nil, http.StatusNoContent)
+			testURL("GET", versionedURL+"/history", "visible_token", nil, http.StatusNotFound)
+			testURL("GET", versionedURL+"/history", memberTokenID, nil, http.StatusOK)
+		})
+
+		It("should reject invalid requests", func() {
+			testURL("GET", versionedURL+"?at=yesterday", memberTokenID, nil, http.StatusBadRequest)
+			testURL("GET", versionedPluralURL+"/unknown/history", memberTokenID, nil, http.StatusNotFound)
+			testURL("GET", networkPluralURL+"/unknown?at=1", adminTokenID, nil, http.StatusBadRequest)
+		})
+	})
+
+	Describe("Prometheus metrics", func() {
+		getMetrics := func(token string) *http.Response {
+			request, err := http.NewRequest("GET", baseURL+"/metrics", nil)
+			Expect(err).ToNot(HaveOccurred())
+			if token != "" {
+				request.Header.Set("X-Auth-Token", token)
+			}
+			resp, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		It("should be served only to admins", func() {
+			for token, status := range map[string]int{"": http.StatusUnauthorized, memberTokenID: http.StatusForbidden} {
+				resp := getMetrics(token)
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(status))
+			}
+		})
+
+		It("should expose metrics", func() {
+			testURL("GET", networkPluralURL, adminTokenID, nil, http.StatusOK)
+			resp := getMetrics(adminTokenID)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`gohan_http_requests_total{method="GET",status="200"}`))
+			Expect(string(body)).To(ContainSubstring(`gohan_resource_request_duration_seconds_count{operation="get.resources.multiple",schema="network"}`))
+		})
+	})
+
+	Describe("Tracing", func() {
+		It("should continue a trace given in traceparent header", func() {
+			traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+			request, err := http.NewRequest("GET", networkPluralURL, nil)
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("X-Auth-Token", adminTokenID)
+			request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			resp, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			spanNames := func() []string {
+				content, _ := ioutil.ReadFile("./test_spans.log")
+				names := []string{}
+				for _, line := range strings.Split(string(content), "\n") {
+					var span map[string]interface{}
+					if json.Unmarshal([]byte(line), &span) == nil && span["trace_id"] == traceID {
+						names = append(names, span["name"].(string))
+					}
+				}
+				return names
+			}
+			Eventually(spanNames, 5*time.Second).Should(ContainElement("HTTP GET"))
+			Eventually(spanNames, 5*time.Second).Should(ContainElement("sql"))
+			Eventually(spanNames, 5*time.Second).Should(ContainElement("extension.pre_list"))
+		})
+	})
+
+	Describe("Audit log", func() {
+		auditLogsURL := baseURL + "/gohan/v0.1/audit_logs"
+
+		auditLogs := func(resourceID string) map[string]interface{} {
+			result := testURL("GET", auditLogsURL+"?resource_id="+resourceID, adminTokenID, nil, http.StatusOK)
+			logs := map[string]interface{}{}
+			for _, auditLog := range result.(map[string]interface{})["audit_logs"].([]interface{}) {
+				logs[auditLog.(map[string]interface{})["action"].(string)] = auditLog
+			}
+			return logs
+		}
+
+		It("should record changes of resources", func() {
+			network := map[string]interface{}{
+				"id":        "networkred",
+				"name":      "Networkred",
+				"tenant_id": memberTenantID,
+			}
+			_, resp := httpRequest("POST", networkPluralURL, memberTokenID, network)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			requestID := resp.Header.Get("X-Request-Id")
+			Expect(requestID).ToNot(BeEmpty())
+			testURL("PUT", getNetworkSingularURL("red"), memberTokenID, map[string]interface{}{"name": "Updated"}, http.StatusOK)
+			testURL("DELETE", getNetworkSingularURL("red"), memberTokenID, nil, http.StatusNoContent)
+
+			logs := auditLogs("networkred")
+			Expect(logs).To(HaveLen(3))
+			Expect(logs["create"]).To(SatisfyAll(
+				HaveKeyWithValue("request_id", requestID),
+				HaveKeyWithValue("tenant_id", memberTenantID),
+				HaveKeyWithValue("user_name", "demo"),
+				HaveKeyWithValue("roles", ConsistOf("Member")),
+				HaveKeyWithValue("schema_id", "network"),
+				HaveKeyWithValue("path", "/v2.0/networks/networkred"),
+				HaveKeyWithValue("after", HaveKeyWithValue("name", "Networkred")),
+			))
+			Expect(logs["update"]).To(SatisfyAll(
+				HaveKeyWithValue("before", HaveKeyWithValue("name", "Networkred")),
+				HaveKeyWithValue("after", HaveKeyWithValue("name", "Updated")),
+				HaveKeyWithValue("changes", Equal(map[string]interface{}{
+					"name": map[string]interface{}{"before": "Networkred", "after": "Updated"},
+				})),
+			))
+			Expect(logs["delete"]).To(HaveKeyWithValue("before", HaveKeyWithValue("name", "Updated")))
+		})
+
+		It("should record custom actions", func() {
+			responderPluralURL := baseURL + "/v2.0/responders"
+			testURL("POST", baseURL+"/v2.0/responder_parents", adminTokenID, map[string]interface{}{"id": "p1"}, http.StatusCreated)
+			testURL("POST", responderPluralURL, adminTokenID, map[string]interface{}{
+				"id":                  "r1",
+				"pattern":             "Hello %s!",
+				"tenant_id":           memberTenantID,
+				"responder_parent_id": "p1",
+			}, http.StatusCreated)
+			testURL("POST", responderPluralURL+"/r1/hello", memberTokenID, map[string]interface{}{"name": "Heisenberg"}, http.StatusOK)
+
+			logs := auditLogs("r1")
+			Expect(logs).To(HaveLen(2))
+			Expect(logs["hello"]).To(HaveKeyWithValue("input", HaveKeyWithValue("name", "Heisenberg")))
+		})
+
+		It("should protect audit log", func() {
+			testURL("GET", auditLogsURL, memberTokenID, nil, http.StatusUnauthorized)
+			testURL("POST", auditLogsURL, adminTokenID, map[string]interface{}{"action": "create"}, http.StatusNotFound)
+		})
+	})
+
+	Describe("Bulk operations", func() {
+		bulkURL := networkPluralURL + "/bulk"
+
+		BeforeEach(func() {
+			testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		})
+
+		statuses := func(result interface{}) []interface{} {
+			codes := []interface{}{}
+			for _, item := range result.(map[string]interface{})["results"].([]interface{}) {
+				codes = append(codes, item.(map[string]interface{})["status"])
+			}
+			return codes
+		}
+
+		It("should run all operations in one request", func() {
+			result := testURL("POST", bulkURL, adminTokenID, map[string]interface{}{
+				"operations": []interface{}{
+					map[string]interface{}{"action": "create", "resource": getNetwork("blue", "red")},
+					map[string]interface{}{"action": "update", "id": "networkblue", "resource": map[string]interface{}{"name": "Updated"}},
+					map[string]interface{}{"action": "delete", "id": "networkred"},
+				},
+			}, http.StatusOK)
+			Expect(statuses(result)).To(Equal([]interface{}{float64(201), float64(200), float64(204)}))
+			items := result.(map[string]interface{})["results"].([]interface{})
+			Expect(items[1]).To(HaveKeyWithValue("network", HaveKeyWithValue("name", "Updated")))
+
+			testURL("GET", getNetworkSingularURL("red"), adminTokenID, nil, http.StatusNotFound)
+			network := testURL("GET", getNetworkSingularURL("blue"), adminTokenID, nil, http.StatusOK)
+			Expect(network).To(HaveKeyWithValue("network", HaveKeyWithValue("name", "Updated")))
+		})
+
+		It("should roll back all operations when one fails", func() {
+			result := testURL("POST", bulkURL, adminTokenID, map[string]interface{}{
+				"operations": []interface{}{
+					map[string]interface{}{"action": "create", "resource": getNetwork("blue", "red")},
+					map[string]interface{}{"action": "create", "resource": getNetwork("red", "red")},
+				},
+			}, http.StatusConflict)
+			Expect(result).To(HaveKeyWithValue("error", HavePrefix("Operation 1 failed: ")))
+			testURL("GET", getNetworkSingularURL("blue"), adminTokenID, nil, http.StatusNotFound)
+		})
+
+		It("should report failures per operation in best effort mode", func() {
+			result := testURL("POST", bulkURL, adminTokenID, map[string]interface{}{
+				"mode": "best_effort",
+				"operations": []interface{}{
+					map[string]interface{}{"action": "create", "resource": getNetwork("blue", "red")},
+					map[string]interface{}{"action": "delete", "id": "networkgreen"},
+					map[string]interface{}{"action": "update", "id": "networkred", "resource": map[string]interface{}{"name": "Updated"}},
+				},
+			}, http.StatusOK)
+			Expect(statuses(result)).To(Equal([]interface{}{float64(201), float64(404), float64(200)}))
+			testURL("GET", getNetworkSingularURL("blue"), adminTokenID, nil, http.StatusOK)
+		})
+
+		It("should reject invalid requests", func() {
+			testURL("POST", bulkURL, adminTokenID, map[string]interface{}{}, http.StatusBadRequest)
+			testURL("POST", bulkURL, adminTokenID, map[string]interface{}{
+				"mode":       "sometimes",
+				"operations": []interface{}{},
+			}, http.StatusBadRequest)
+			testURL("POST", bulkURL, adminTokenID, map[string]interface{}{
+				"operations": []interface{}{map[string]interface{}{"action": "show", "id": "networkred"}},
+			}, http.StatusBadRequest)
+			testURL("POST", bulkURL, memberTokenID, map[string]interface{}{
+				"operations": []interface{}{map[string]interface{}{"action": "delete", "id": "networkred"}},
+			}, http.StatusNotFound)
+			testURL("GET", getNetworkSingularURL("red"), adminTokenID, nil, http.StatusOK)
+		})
+
+		It("should not check headers of the bulk request against each operation", func() {
+			jsonByte, err := json.Marshal(map[string]interface{}{
+				"operations": []interface{}{
+					map[string]interface{}{"action": "create", "resource": getNetwork("blue", "red")},
+					map[string]interface{}{"action": "update", "id": "networkred", "resource": map[string]interface{}{"name": "First"}},
+					map[string]interface{}{"action": "update", "id": "networkblue", "resource": map[string]interface{}{"name": "Second"}},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			request, err := http.NewRequest("POST", bulkURL, bytes.NewBuffer(jsonByte))
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("X-Auth-Token", adminTokenID)
+			request.Header.Set("If-Match", `"stale"`)
+			resp, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var result interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+			Expect(statuses(result)).To(Equal([]interface{}{float64(201), float64(200), float64(200)}))
+		})
+
+		It("should authorize each operation with its own action", func() {
+			// visible role may create and update, but not delete
+			operations := []interface{}{
+				map[string]interface{}{"action": "create", "resource": map[string]interface{}{"id": "visible", "a": "a"}},
+				map[string]interface{}{"action": "delete", "id": "visible"},
+			}
+			result := testURL("POST", visibilityTestPluralURL+"/bulk", "visible_token", map[string]interface{}{
+				"operations": operations,
+			}, http.StatusUnauthorized)
+			Expect(result).To(HaveKeyWithValue("error", HavePrefix("Operation 1 failed: ")))
+			testURL("GET", visibilityTestPluralURL+"/visible", adminTokenID, nil, http.StatusNotFound)
+
+			result = testURL("POST", visibilityTestPluralURL+"/bulk", "visible_token", map[string]interface{}{
+				"mode":       "best_effort",
+				"operations": operations,
+			}, http.StatusOK)
+			Expect(statuses(result)).To(Equal([]interface{}{float64(201), float64(401)}))
+			testURL("GET", visibilityTestPluralURL+"/visible", adminTokenID, nil, http.StatusOK)
+		})
+	})
+
 	Describe("TwoSameResourceRelations", func() {
 		It("should work", func() {
 			By("creating 2 cities")
@@ -431,8 +1059,10 @@ var _ = Describe("Server package test", func() {
 			Expect(result).To(HaveKeyWithValue("network", networkExpected))
 
 			result = testURL("GET", baseURL+"/_all", memberTokenID, nil, http.StatusOK)
-			Expect(result).To(HaveLen(6))
+			Expect(result).To(HaveLen(11))
 			Expect(result).To(HaveKeyWithValue("networks", []interface{}{networkExpected}))
+			Expect(result).To(HaveKey("api_keys"))
+			Expect(result).To(HaveKey("subscriptions"))
 			Expect(result).To(HaveKey("schemas"))
 			Expect(result).To(HaveKey("tests"))
 
@@ -683,6 +1313,59 @@ var _ = Describe("Server package test", func() {
 				testURL("DELETE", visibilityTestPluralURL+"/test", memberTokenID, nil, http.StatusUnauthorized)
 			})
 		})
+
+		Context("Expression based policy condition", func() {
+			const visibleTokenID = "visible_token"
+
+			BeforeEach(func() {
+				for _, resource := range []map[string]interface{}{
+					{"id": "a_down", "state": "DOWN", "level": 1},
+					{"id": "b_up", "state": "UP", "level": 3},
+					{"id": "c_up", "state": "UP", "level": 1},
+					{"id": "d_degraded", "state": "DEGRADED", "level": 2},
+				} {
+					testURL("POST", filterTestPluralURL, adminTokenID, resource, http.StatusCreated)
+				}
+			})
+
+			It("should fill pages with resources checked one by one", func() {
+				res, resp := httpRequest("GET", filterTestPluralURL+"?sort_key=id&limit=2", visibleTokenID, nil)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(res).To(HaveKeyWithValue("filter_tests", ConsistOf(
+					HaveKeyWithValue("id", "c_up"),
+					HaveKeyWithValue("id", "d_degraded"))))
+				Expect(resp.Header.Get("X-Total-Count")).To(Equal("2"))
+
+				res, resp = httpRequest("GET", filterTestPluralURL+"?sort_key=id&limit=1&offset=1", visibleTokenID, nil)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(res).To(HaveKeyWithValue("filter_tests", ConsistOf(
+					HaveKeyWithValue("id", "d_degraded"))))
+				Expect(resp.Header.Get("X-Total-Count")).To(Equal("2"))
+			})
+
+			It("should continue pages checked one by one after markers", func() {
+				res, resp := httpRequest("GET", filterTestPluralURL+"?sort_key=id&limit=1", visibleTokenID, nil)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(res).To(HaveKeyWithValue("filter_tests", ConsistOf(HaveKeyWithValue("id", "c_up"))))
+				marker := resp.Header.Get("X-Next-Marker")
+				Expect(marker).ToNot(BeEmpty())
+
+				res, resp = httpRequest("GET", filterTestPluralURL+"?sort_key=id&limit=1&marker="+marker, visibleTokenID, nil)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(res).To(HaveKeyWithValue("filter_tests", ConsistOf(HaveKeyWithValue("id", "d_degraded"))))
+				// rows before the marker aren't read, so resources matching the translated filter are counted
+				Expect(resp.Header.Get("X-Total-Count")).To(Equal("3"))
+			})
+
+			It("should check single resources", func() {
+				testURL("GET", filterTestPluralURL+"/c_up", visibleTokenID, nil, http.StatusOK)
+				testURL("GET", filterTestPluralURL+"/b_up", visibleTokenID, nil, http.StatusNotFound)
+				testURL("POST", filterTestPluralURL, visibleTokenID, map[string]interface{}{"state": "UP", "level": 2}, http.StatusCreated)
+				testURL("POST", filterTestPluralURL, visibleTokenID, map[string]interface{}{"state": "UP", "level": 3}, http.StatusUnauthorized)
+				testURL("PUT", filterTestPluralURL+"/d_degraded", visibleTokenID, map[string]interface{}{"level": 1}, http.StatusUnauthorized)
+				testURL("PUT", filterTestPluralURL+"/d_degraded", visibleTokenID, map[string]interface{}{"level": 2}, http.StatusOK)
+			})
+		})
 	})
 
 	Describe("StringQueries", func() {
@@ -1363,5 +2046,13 @@ func clearTable(tx transaction.Transaction, s *schema.Schema) error {
 			return err
 		}
 	}
+	if s.History() {
+		if err := tx.Exec("DELETE FROM " + s.GetDbTableName() + "_history"); err != nil {
+			return err
+		}
+	}
+	if s.Recoverable() {
+		return sql.PurgeDeletedContext(context.Background(), tx, s, time.Now().Add(time.Hour))
+	}
 	return nil
 }
@@ -29,6 +29,7 @@ import (
 	l "github.com/cloudwan/gohan/log"
 	"github.com/cloudwan/gohan/metrics"
 	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/tracing"
 	"github.com/cloudwan/gohan/util"
 )
 
@@ -254,12 +255,27 @@ func (watcher *SyncWatcher) processSyncWatch(ctx context.Context, path string) e
 
 	watchCtx, watchCancel := context.WithCancel(ctx)
 	defer watchCancel()
-	fromRevision := watcher.fetchStoredRevision(path) + 1
+	fromRevision := watcher.fetchStoredRevision(path)
+	if fromRevision != gohan_sync.RevisionCurrent {
+		fromRevision++
+	}
 	respCh := watcher.sync.WatchContext(watchCtx, path, fromRevision)
 	watchErr := make(chan error, 1)
 	go func() {
 		watchErr <- func() error {
-			for response := range respCh {
+			for {
+				response, ok := <-respCh
+				if !ok {
+					return nil
+				}
+				if response.Err == gohan_sync.ErrCompacted && fromRevision != gohan_sync.RevisionCurrent {
+					// changes since the stored revision are lost, watch again from the current state
+					log.Warning("Changes of path `%s` since revision `%d` are compacted, watching the current state", path, fromRevision)
+					watcher.sync.Delete(SyncWatchRevisionPrefix+path, false)
+					fromRevision = gohan_sync.RevisionCurrent
+					respCh = watcher.sync.WatchContext(watchCtx, path, fromRevision)
+					continue
+				}
 				if response.Err != nil {
 					return response.Err
 				}
@@ -270,7 +286,6 @@ func (watcher *SyncWatcher) processSyncWatch(ctx context.Context, path string) e
 					return err
 				}
 			}
-			return nil
 		}()
 	}()
 
@@ -336,7 +351,14 @@ func (watcher *SyncWatcher) runExtensionOnSync(response *gohan_sync.Event, env e
 		"data":   response.Data,
 		"key":    response.Key,
 	}
+	span := tracing.StartSpan(nil, "sync.watch")
+	span.SetAttribute("key", response.Key)
+	span.SetAttribute("action", response.Action)
+	defer span.Finish()
+	tracing.SetCurrentSpan(context, span)
+
 	if err := env.HandleEvent("notification", context); err != nil {
+		span.SetError(err)
 		log.Warning(fmt.Sprintf("extension error: %s", err))
 		return
 	}
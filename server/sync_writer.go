@@ -19,42 +19,89 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sync"
 	"time"
 
 	"github.com/cloudwan/gohan/db"
 	"github.com/cloudwan/gohan/db/pagination"
 	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/outbox"
 	"github.com/cloudwan/gohan/schema"
 	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/tracing"
 )
 
 const (
-	syncPath = "/gohan/cluster/sync"
-	lockPath = "/gohan/cluster/lock"
+	syncPath      = "/gohan/cluster/sync"
+	syncShardPath = "/gohan/cluster/sync_shard"
+	lockPath      = "/gohan/cluster/lock"
+	outboxPath    = "/gohan/cluster/outbox"
 
 	configPrefix = "/config"
 
 	eventPollingTime  = 30 * time.Second
 	eventPollingLimit = 10000
+	// eventPartitions is the number of partitions of resource paths stored with events,
+	// a sync writer can't have more shards than partitions
+	eventPartitions = 1024
+
+	defaultSyncBatchSize = 100
 )
 
+// SyncWriterOptions configures partitioning and batching of events written by SyncWriter
+type SyncWriterOptions struct {
+	// Shards is the number of partitions of events. Events are partitioned by resource path,
+	// so changes of a resource are written in order. Each shard is written by the holder of its lock,
+	// all processes have to use the same number of shards.
+	Shards int
+	// BatchSize is the maximum number of events written to the sync backend at once
+	BatchSize int
+}
+
 // SyncWriter copies data from the RDBMS to the sync layer.
 // All changes happens in the RDBMS will be synchronized into the
 // sync layer by SyncWriter.
 // SyncWriter gets items to sync from the event table.
 type SyncWriter struct {
-	sync    gohan_sync.Sync
-	db      db.DB
-	backoff time.Duration
+	sync      gohan_sync.Sync
+	db        db.DB
+	backoff   time.Duration
+	shards    int
+	batchSize int
+	// synced wakes up the outbox dispatcher after events are written
+	synced chan struct{}
 }
 
 // NewSyncWriter creates a new instance of SyncWriter.
 func NewSyncWriter(sync gohan_sync.Sync, db db.DB) *SyncWriter {
-	return &SyncWriter{
-		sync:    sync,
-		db:      db,
-		backoff: time.Second * 5,
+	return NewSyncWriterWithOptions(sync, db, SyncWriterOptions{
+		Shards:    1,
+		BatchSize: defaultSyncBatchSize,
+	})
+}
+
+// NewSyncWriterWithOptions creates a new instance of SyncWriter with sharding and batching options.
+func NewSyncWriterWithOptions(sync gohan_sync.Sync, db db.DB, options SyncWriterOptions) *SyncWriter {
+	writer := &SyncWriter{
+		sync:      sync,
+		db:        db,
+		backoff:   time.Second * 5,
+		shards:    options.Shards,
+		batchSize: options.BatchSize,
+		synced:    make(chan struct{}, 1),
+	}
+	if writer.shards < 1 {
+		writer.shards = 1
+	}
+	if writer.shards > eventPartitions {
+		writer.shards = eventPartitions
 	}
+	if writer.batchSize < 1 {
+		writer.batchSize = 1
+	}
+	return writer
 }
 
 // NewSyncWriterFromServer is a helper method for test.
@@ -63,20 +110,74 @@ func NewSyncWriterFromServer(server *Server) *SyncWriter {
 	return NewSyncWriter(server.sync, server.db)
 }
 
-// Run starts a loop to keep running Sync().
+// Run starts a loop to keep running Sync() for each shard.
 // This method blocks until the ctx is canceled.
 func (writer *SyncWriter) Run(ctx context.Context) error {
-	pollingTicker := time.Tick(eventPollingTime)
+	// each commit wakes up writers of all shards
 	committed := transactionCommitInformer()
+	notifications := make([]chan int, writer.shards)
+	for shard := range notifications {
+		notifications[shard] = make(chan int, 1)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-committed:
+				for _, notification := range notifications {
+					select {
+					case notification <- 1:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	if outbox.Enabled() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer.runDispatcher(ctx)
+		}()
+	}
+	for shard := 1; shard < writer.shards; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			writer.runShard(ctx, shard, notifications[shard])
+		}(shard)
+	}
+	err := writer.runShard(ctx, 0, notifications[0])
+	wg.Wait()
+	return err
+}
+
+// lockPath returns the path locked by the writer of a shard.
+// A single shard uses the same lock as writers without sharding.
+func (writer *SyncWriter) lockPath(shard int) string {
+	if writer.shards == 1 {
+		return syncPath
+	}
+	return fmt.Sprintf("%s/%d", syncShardPath, shard)
+}
+
+// runShard keeps running SyncShard() while holding the lock of the shard.
+func (writer *SyncWriter) runShard(ctx context.Context, shard int, committed <-chan int) error {
+	pollingTicker := time.NewTicker(eventPollingTime)
+	defer pollingTicker.Stop()
 
 	recentlySynced := false
 	for {
 		err := func() error {
-			lost, err := writer.sync.Lock(syncPath, true)
+			path := writer.lockPath(shard)
+			lost, err := writer.sync.Lock(path, true)
 			if err != nil {
 				return err
 			}
-			defer writer.sync.Unlock(syncPath)
+			defer writer.sync.Unlock(path)
 
 			for {
 				select {
@@ -84,7 +185,7 @@ func (writer *SyncWriter) Run(ctx context.Context) error {
 					return fmt.Errorf("lost lock for sync")
 				case <-ctx.Done():
 					return nil
-				case <-pollingTicker:
+				case <-pollingTicker.C:
 					if recentlySynced {
 						recentlySynced = false
 						continue
@@ -92,15 +193,63 @@ func (writer *SyncWriter) Run(ctx context.Context) error {
 				case <-committed:
 					recentlySynced = true
 				}
-				_, err := writer.Sync()
+				synced, err := writer.SyncShard(shard)
 				if err != nil {
 					return err
 				}
+				if synced > 0 {
+					select {
+					case writer.synced <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+
+		if err != nil {
+			log.Error("sync writer of shard %d is intrupted: %s", shard, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(writer.backoff):
+		}
+	}
+}
+
+// runDispatcher keeps running Dispatch() while holding the outbox lock,
+// so a publisher waiting for a broker doesn't hold back writing events to the sync backend.
+func (writer *SyncWriter) runDispatcher(ctx context.Context) error {
+	dispatchTicker := time.NewTicker(outbox.PollingInterval())
+	defer dispatchTicker.Stop()
+
+	for {
+		err := func() error {
+			lost, err := writer.sync.Lock(outboxPath, true)
+			if err != nil {
+				return err
+			}
+			defer writer.sync.Unlock(outboxPath)
+
+			for {
+				if _, err := writer.Dispatch(); err != nil {
+					return err
+				}
+				select {
+				case <-lost:
+					return fmt.Errorf("lost lock for outbox")
+				case <-ctx.Done():
+					return nil
+				case <-writer.synced:
+				case <-dispatchTicker.C:
+					// retry messages which couldn't be published
+				}
 			}
 		}()
 
 		if err != nil {
-			log.Error("sync writer is intrupted: %s", err)
+			log.Error("outbox dispatcher is interrupted: %s", err)
 		}
 
 		select {
@@ -114,21 +263,136 @@ func (writer *SyncWriter) Run(ctx context.Context) error {
 // Sync runs a synchronization iteration, which
 // executes requests in the event table.
 func (writer *SyncWriter) Sync() (synced int, err error) {
-	resourceList, err := writer.listEvents()
+	return writer.syncEvents(-1)
+}
+
+// SyncShard runs a synchronization iteration of a single shard
+func (writer *SyncWriter) SyncShard(shard int) (synced int, err error) {
+	if shard < 0 || shard >= writer.shards {
+		return 0, fmt.Errorf("invalid shard %d, sync writer has %d shards", shard, writer.shards)
+	}
+	return writer.syncEvents(shard)
+}
+
+// eventPartition returns the partition stored with events of the resource path,
+// partitions are distributed among shards of sync writers
+func eventPartition(resourcePath string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(resourcePath))
+	return int(hash.Sum32() % eventPartitions)
+}
+
+// Shard returns the shard which events of the resource path belong to
+func (writer *SyncWriter) Shard(resourcePath string) int {
+	return eventPartition(resourcePath) % writer.shards
+}
+
+// shardFilter selects events of the shard by their partitions, or all events when shard is negative
+func (writer *SyncWriter) shardFilter(shard int) transaction.Filter {
+	if shard < 0 || writer.shards == 1 {
+		return nil
+	}
+	partitions := []int{}
+	for partition := shard; partition < eventPartitions; partition += writer.shards {
+		partitions = append(partitions, partition)
+	}
+	return transaction.Filter{"path_partition": partitions}
+}
+
+// syncEvents writes events of the shard, or of all shards when shard is negative
+func (writer *SyncWriter) syncEvents(shard int) (synced int, err error) {
+	events, err := writer.listEvents(writer.shardFilter(shard))
 	if err != nil {
 		return
 	}
-	for _, resource := range resourceList {
-		err = writer.syncEvent(resource)
+	writer.reportLag(shard, events)
+
+	maxOperations := 0
+	if batcher, ok := writer.sync.(gohan_sync.Batcher); ok {
+		maxOperations = batcher.MaxBatchSize()
+	}
+	var (
+		batch      []*schema.Resource
+		operations []gohan_sync.Operation
+		keys       = map[string]bool{}
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := writer.writeBatch(batch, operations); err != nil {
+			return err
+		}
+		synced += len(batch)
+		batch, operations, keys = nil, nil, map[string]bool{}
+		return nil
+	}
+	for _, resource := range events {
+		var eventOperations []gohan_sync.Operation
+		eventOperations, err = writer.eventOperations(resource)
 		if err != nil {
 			return
 		}
-		synced++
+		// a batch can't change a key twice, as etcd rejects such transactions
+		full := len(batch) >= writer.batchSize ||
+			(maxOperations > 0 && len(operations)+len(eventOperations) > maxOperations)
+		for _, operation := range eventOperations {
+			full = full || keys[operation.Key]
+		}
+		if full {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+		batch = append(batch, resource)
+		for _, operation := range eventOperations {
+			operations = append(operations, operation)
+			keys[operation.Key] = true
+		}
+	}
+	if err = flush(); err != nil {
+		return
+	}
+	if len(events) < eventPollingLimit {
+		writer.reportLag(shard, nil)
 	}
 	return
 }
 
-func (writer *SyncWriter) listEvents() ([]*schema.Resource, error) {
+// reportLag updates metrics of events waiting in the shard, or in each shard when shard is negative
+func (writer *SyncWriter) reportLag(shard int, events []*schema.Resource) {
+	pending := map[int]int64{}
+	oldest := map[int]int64{}
+	if shard >= 0 {
+		pending[shard] = 0
+	} else {
+		for i := 0; i < writer.shards; i++ {
+			pending[i] = 0
+		}
+	}
+	for _, resource := range events {
+		eventShard := shard
+		if eventShard < 0 {
+			eventShard = writer.Shard(resource.Get("path").(string))
+		}
+		pending[eventShard]++
+		if timestamp := toInt64(resource.Get("timestamp")); oldest[eventShard] == 0 || timestamp < oldest[eventShard] {
+			oldest[eventShard] = timestamp
+		}
+	}
+	now := time.Now().Unix()
+	for eventShard, count := range pending {
+		var lag int64
+		if count > 0 && oldest[eventShard] > 0 {
+			lag = now - oldest[eventShard]
+		}
+		metrics.UpdateGauge(count, "sync.writer.%d.pending", eventShard)
+		metrics.UpdateGauge(lag, "sync.writer.%d.lag", eventShard)
+	}
+}
+
+// listEvents returns the oldest events matching the filter
+func (writer *SyncWriter) listEvents(filter transaction.Filter) ([]*schema.Resource, error) {
 	var resourceList []*schema.Resource
 	if dbErr := db.Within(writer.db, func(tx transaction.Transaction) error {
 		schemaManager := schema.GetManager()
@@ -137,7 +401,7 @@ func (writer *SyncWriter) listEvents() ([]*schema.Resource, error) {
 			pagination.OptionKey(eventSchema, "id"),
 			pagination.OptionOrder(pagination.ASC),
 			pagination.OptionLimit(eventPollingLimit))
-		res, _, err := tx.List(eventSchema, nil, nil, paginator)
+		res, _, err := tx.List(eventSchema, filter, nil, paginator)
 		resourceList = res
 		return err
 	}); dbErr != nil {
@@ -147,110 +411,146 @@ func (writer *SyncWriter) listEvents() ([]*schema.Resource, error) {
 	return resourceList, nil
 }
 
-func (writer *SyncWriter) syncEvent(resource *schema.Resource) error {
+// writeBatch applies operations of events to the sync backend at once,
+// then removes the events in a single transaction
+func (writer *SyncWriter) writeBatch(events []*schema.Resource, operations []gohan_sync.Operation) error {
+	shard := writer.Shard(events[0].Get("path").(string))
+	span := tracing.StartSpan(nil, "sync.write")
+	span.SetAttribute("events", len(events))
+	span.SetAttribute("shard", shard)
+	defer span.Finish()
+	defer metrics.UpdateTimer(time.Now(), "sync.writer.%d.batch", shard)
+
+	err := gohan_sync.ApplyBatch(writer.sync, operations)
+	if err != nil {
+		err = fmt.Errorf("Update() failed on sync: %s", err)
+	} else {
+		err = writer.deleteEvents(events)
+	}
+	span.SetError(err)
+	if err == nil {
+		metrics.UpdateCounter(int64(len(events)), "sync.writer.%d.events", shard)
+	}
+	return err
+}
+
+func (writer *SyncWriter) deleteEvents(events []*schema.Resource) error {
 	schemaManager := schema.GetManager()
 	eventSchema, _ := schemaManager.Schema("event")
 	return db.Within(writer.db, func(tx transaction.Transaction) error {
-		var err error
-		eventType := resource.Get("type").(string)
-		resourcePath := resource.Get("path").(string)
-		body := resource.Get("body").(string)
-		syncPlain := resource.Get("sync_plain").(bool)
-		syncProperty := resource.Get("sync_property").(string)
+		for _, resource := range events {
+			if err := enqueueOutbox(tx, resource); err != nil {
+				return err
+			}
+			log.Debug("delete event %d", resource.Get("id"))
+			if err := tx.Delete(eventSchema, resource.Get("id")); err != nil {
+				return fmt.Errorf("delete failed: %s", err)
+			}
+		}
+		return nil
+	})
+}
 
-		path := generatePath(resourcePath, body)
+// eventOperations returns changes of the sync backend made by an event
+func (writer *SyncWriter) eventOperations(resource *schema.Resource) ([]gohan_sync.Operation, error) {
+	var err error
+	eventType := resource.Get("type").(string)
+	resourcePath := resource.Get("path").(string)
+	body := resource.Get("body").(string)
+	syncPlain := resource.Get("sync_plain").(bool)
+	syncProperty := resource.Get("sync_property").(string)
 
-		version, ok := resource.Get("version").(int)
-		if !ok {
-			log.Debug("cannot cast version value in int for %s", path)
-		}
-		log.Debug("event %s", eventType)
+	path := generatePath(resourcePath, body)
 
-		if eventType == "create" || eventType == "update" {
-			log.Debug("set %s on sync", path)
+	version, ok := resource.Get("version").(int)
+	if !ok {
+		log.Debug("cannot cast version value in int for %s", path)
+	}
+	log.Debug("event %s", eventType)
 
-			content := body
+	if eventType == "create" || eventType == "update" {
+		log.Debug("set %s on sync", path)
 
+		content, err := syncContent(body, syncPlain, syncProperty, version)
+		if err != nil {
+			return nil, err
+		}
+		return []gohan_sync.Operation{{Key: path, Value: content}}, nil
+	} else if eventType == "delete" {
+		log.Debug("delete %s", resourcePath)
+		deletePath := resourcePath
+		resourceSchema := schema.GetSchemaByURLPath(resourcePath)
+		if _, ok := resourceSchema.SyncKeyTemplate(); ok {
 			var data map[string]interface{}
-			if syncProperty != "" {
-				err = json.Unmarshal(([]byte)(body), &data)
-				if err != nil {
-					return fmt.Errorf("failed to unmarshal body on sync: %s", err)
-				}
-				target, ok := data[syncProperty]
-				if !ok {
-					return fmt.Errorf("could not find property `%s`", syncProperty)
-				}
-				jsonData, err := json.Marshal(target)
-				if err != nil {
-					return err
-				}
-				content = string(jsonData)
+			json.Unmarshal(([]byte)(body), &data)
+			deletePath, err = resourceSchema.GenerateCustomPath(data)
+			if err != nil {
+				return nil, fmt.Errorf("Delete from sync failed %s - generating of custom path failed", err)
 			}
+		}
+		log.Debug("deleting %s, %s and %s", statePrefix+deletePath, monitoringPrefix+deletePath, path)
+		return []gohan_sync.Operation{
+			{Key: statePrefix + deletePath, Delete: true},
+			{Key: monitoringPrefix + deletePath, Delete: true},
+			{Key: path, Delete: true},
+		}, nil
+	}
+	return nil, nil
+}
 
-			if syncPlain {
-				var target interface{}
-				json.Unmarshal([]byte(content), &target)
-				switch target.(type) {
-				case string:
-					content = fmt.Sprintf("%v", target)
-				}
-			} else {
-				data, err := json.Marshal(map[string]interface{}{
-					"body":    content,
-					"version": version,
-				})
-				if err != nil {
-					return fmt.Errorf("failed to marshal marshalling sync object: %s", err)
-				}
-				content = string(data)
-			}
+// syncContent returns the value of the sync key of a resource with the body
+func syncContent(body string, syncPlain bool, syncProperty string, version int) (string, error) {
+	content := body
 
-			err = writer.sync.Update(path, content)
-			if err != nil {
-				return fmt.Errorf("Update() failed on sync: %s", err)
-			}
-		} else if eventType == "delete" {
-			log.Debug("delete %s", resourcePath)
-			deletePath := resourcePath
-			resourceSchema := schema.GetSchemaByURLPath(resourcePath)
-			if _, ok := resourceSchema.SyncKeyTemplate(); ok {
-				var data map[string]interface{}
-				json.Unmarshal(([]byte)(body), &data)
-				deletePath, err = resourceSchema.GenerateCustomPath(data)
-				if err != nil {
-					return fmt.Errorf("Delete from sync failed %s - generating of custom path failed", err)
-				}
-			}
-			log.Debug("deleting %s", statePrefix+deletePath)
-			err = writer.sync.Delete(statePrefix+deletePath, false)
-			if err != nil {
-				log.Error(fmt.Sprintf("Delete from sync failed %s", err))
-			}
-			log.Debug("deleting %s", monitoringPrefix+deletePath)
-			err = writer.sync.Delete(monitoringPrefix+deletePath, false)
-			if err != nil {
-				log.Error(fmt.Sprintf("Delete from sync failed %s", err))
-			}
-			log.Debug("deleting %s", resourcePath)
-			err = writer.sync.Delete(path, false)
-			if err != nil {
-				return fmt.Errorf("delete from sync failed %s", err)
-			}
+	var data map[string]interface{}
+	if syncProperty != "" {
+		err := json.Unmarshal(([]byte)(body), &data)
+		if err != nil {
+			return "", fmt.Errorf("failed to unmarshal body on sync: %s", err)
+		}
+		target, ok := data[syncProperty]
+		if !ok {
+			return "", fmt.Errorf("could not find property `%s`", syncProperty)
 		}
-		log.Debug("delete event %d", resource.Get("id"))
-		id := resource.Get("id")
-		err = tx.Delete(eventSchema, id)
+		jsonData, err := json.Marshal(target)
 		if err != nil {
-			return fmt.Errorf("delete failed: %s", err)
+			return "", err
 		}
+		content = string(jsonData)
+	}
 
-		return nil
-	})
+	if syncPlain {
+		var target interface{}
+		json.Unmarshal([]byte(content), &target)
+		switch target.(type) {
+		case string:
+			content = fmt.Sprintf("%v", target)
+		}
+	} else {
+		data, err := json.Marshal(map[string]interface{}{
+			"body":    content,
+			"version": version,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal marshalling sync object: %s", err)
+		}
+		content = string(data)
+	}
+	return content, nil
 }
 
 func generatePath(resourcePath string, body string) string {
 	var curSchema = schema.GetSchemaByURLPath(resourcePath)
+	path := syncBasePath(curSchema, resourcePath, body)
+	if !curSchema.SkipConfigPrefix() {
+		path = configPrefix + path
+	}
+	log.Info("Generated path: %s", path)
+	return path
+}
+
+// syncBasePath returns the sync path of a resource without the config prefix
+func syncBasePath(curSchema *schema.Schema, resourcePath string, body string) string {
 	path := resourcePath
 	if _, ok := curSchema.SyncKeyTemplate(); ok {
 		var data map[string]interface{}
@@ -265,9 +565,5 @@ func generatePath(resourcePath string, body string) string {
 			}
 		}
 	}
-	if !curSchema.SkipConfigPrefix() {
-		path = configPrefix + path
-	}
-	log.Info("Generated path: %s", path)
 	return path
 }
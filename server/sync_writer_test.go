@@ -17,11 +17,18 @@ package server_test
 
 import (
 	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/outbox"
 	"github.com/cloudwan/gohan/schema"
 	srv "github.com/cloudwan/gohan/server"
 	gohan_etcd "github.com/cloudwan/gohan/sync/etcdv3"
+	gohan_memory "github.com/cloudwan/gohan/sync/memory"
 	"github.com/cloudwan/gohan/util"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -74,6 +81,159 @@ var _ = Describe("Server package test", func() {
 			Expect(err).To(HaveOccurred(), "Failed to sync db resource deletion to sync backend")
 		})
 
+		Context("With shards", func() {
+			It("should write events of each shard in batches", func() {
+				manager := schema.GetManager()
+				networkSchema, _ := manager.Schema("network")
+				sync := gohan_memory.NewSync()
+				writer := srv.NewSyncWriterWithOptions(sync, testDB, srv.SyncWriterOptions{Shards: 3, BatchSize: 2})
+				testDB1 := &srv.DbSyncWrapper{DB: testDB}
+
+				colors := []string{"Red", "Green", "Blue", "Yellow", "Black", "White"}
+				expected := map[int]int{}
+				var networks []*schema.Resource
+				tx, err := testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				for _, color := range colors {
+					network, err := manager.LoadResource("network", getNetwork(color, "red"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(tx.Create(network)).To(Succeed())
+					networks = append(networks, network)
+					expected[writer.Shard(network.Path())]++
+				}
+				// the second change of the same key has to be written after the first one
+				Expect(networks[0].Update(map[string]interface{}{"name": "Updated"})).To(Succeed())
+				Expect(tx.Update(networks[0])).To(Succeed())
+				expected[writer.Shard(networks[0].Path())]++
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				_, err = writer.SyncShard(3)
+				Expect(err).To(HaveOccurred())
+				for shard := 0; shard < 3; shard++ {
+					Expect(writer.SyncShard(shard)).To(Equal(expected[shard]))
+				}
+
+				for _, network := range networks {
+					writtenConfig, err := sync.Fetch("/config" + network.Path())
+					Expect(err).ToNot(HaveOccurred())
+					var configContents map[string]interface{}
+					Expect(json.Unmarshal([]byte(writtenConfig.Value), &configContents)).To(Succeed())
+					var configNetwork map[string]interface{}
+					Expect(json.Unmarshal([]byte(configContents["body"].(string)), &configNetwork)).To(Succeed())
+					Expect(configNetwork).To(HaveKeyWithValue("name", network.Get("name")))
+				}
+
+				tx, err = testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				for _, network := range networks {
+					Expect(tx.Delete(networkSchema, network.ID())).To(Succeed())
+				}
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				Expect(writer.Sync()).To(Equal(len(colors)))
+				for _, network := range networks {
+					_, err = sync.Fetch("/config" + network.Path())
+					Expect(err).To(HaveOccurred(), "Failed to sync db resource deletion to sync backend")
+				}
+			})
+		})
+
+		Context("With cache_ttl", func() {
+			It("should publish invalidation of the schema cache on commit", func() {
+				manager := schema.GetManager()
+				networkSchema, _ := manager.Schema("network")
+				networkSchema.Metadata["cache_ttl"] = 60
+				defer delete(networkSchema.Metadata, "cache_ttl")
+
+				sync, err := gohan_etcd.NewSync([]string{"http://127.0.0.1:2379"}, time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sync.Delete("/gohan/cache/network", false)).To(Succeed())
+
+				networkResource, err := manager.LoadResource("network", getNetwork("Red", "red"))
+				Expect(err).ToNot(HaveOccurred())
+				testDB1 := &srv.DbSyncWrapper{DB: testDB, Sync: sync}
+				tx, err := testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tx.Create(networkResource)).To(Succeed())
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				_, err = sync.Fetch("/gohan/cache/network")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sync.Delete("/gohan/cache/network", false)).To(Succeed())
+
+				tx, err = testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tx.StateUpdate(networkResource, &transaction.ResourceState{ConfigVersion: 1, StateVersion: 1})).To(Succeed())
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				_, err = sync.Fetch("/gohan/cache/network")
+				Expect(err).ToNot(HaveOccurred())
+
+				tx, err = testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tx.Delete(networkSchema, networkResource.ID())).To(Succeed())
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				writer := srv.NewSyncWriterFromServer(server)
+				Expect(writer.Sync()).To(Equal(2))
+			})
+
+			It("should publish invalidation of schemas joining the changed one and after raw statements", func() {
+				manager := schema.GetManager()
+				networkSchema, _ := manager.Schema("network")
+				serverSchema, _ := manager.Schema("server")
+				serverSchema.Metadata["cache_ttl"] = 60
+				defer delete(serverSchema.Metadata, "cache_ttl")
+
+				sync, err := gohan_etcd.NewSync([]string{"http://127.0.0.1:2379"}, time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sync.Delete("/gohan/cache/server", false)).To(Succeed())
+
+				networkResource, err := manager.LoadResource("network", getNetwork("Red", "red"))
+				Expect(err).ToNot(HaveOccurred())
+				testDB1 := &srv.DbSyncWrapper{DB: testDB, Sync: sync}
+				tx, err := testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tx.Create(networkResource)).To(Succeed())
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				_, err = sync.Fetch("/gohan/cache/server")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = sync.Fetch("/gohan/cache/network")
+				Expect(err).To(HaveOccurred())
+				Expect(sync.Delete("/gohan/cache/server", false)).To(Succeed())
+
+				tx, err = testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tx.Exec("UPDATE `networks` SET `name` = ?", "Renamed")).To(Succeed())
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				_, err = sync.Fetch("/gohan/cache/server")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sync.Delete("/gohan/cache/server", false)).To(Succeed())
+
+				tx, err = testDB1.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tx.Delete(networkSchema, networkResource.ID())).To(Succeed())
+				Expect(tx.Commit()).To(Succeed())
+				tx.Close()
+
+				_, err = sync.Fetch("/gohan/cache/server")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sync.Delete("/gohan/cache/server", false)).To(Succeed())
+
+				writer := srv.NewSyncWriterFromServer(server)
+				Expect(writer.Sync()).To(Equal(2))
+			})
+		})
+
 		Context("With sync_property", func() {
 			It("should write only speficied property", func() {
 				manager := schema.GetManager()
@@ -244,4 +404,144 @@ var _ = Describe("Server package test", func() {
 			})
 		})
 	})
+
+	Describe("Outbox", func() {
+		type received struct {
+			topic   string
+			message map[string]interface{}
+		}
+
+		var (
+			listener net.Listener
+			mu       sync.Mutex
+			messages []received
+			failing  bool
+		)
+
+		receivedMessages := func() []received {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]received{}, messages...)
+		}
+
+		countResources := func(schemaID string) func() int {
+			return func() int {
+				var count uint64
+				Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+					s, _ := schema.GetManager().Schema(schemaID)
+					var err error
+					_, count, err = tx.List(s, nil, nil, nil)
+					return err
+				})).To(Succeed())
+				return int(count)
+			}
+		}
+
+		setFailing := func(value bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			failing = value
+		}
+
+		createResource := func(id string) {
+			resource, err := schema.GetManager().LoadResource(
+				"with_outbox", map[string]interface{}{
+					"id": id, "p0": "property0",
+				})
+			Expect(err).ToNot(HaveOccurred())
+			testDB1 := &srv.DbSyncWrapper{DB: testDB}
+			tx, err := testDB1.Begin()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tx.Create(resource)).To(Succeed())
+			Expect(tx.Commit()).To(Succeed())
+			tx.Close()
+		}
+
+		BeforeEach(func() {
+			messages = nil
+			failing = false
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:19092")
+			Expect(err).ToNot(HaveOccurred())
+			go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if failing {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				var message map[string]interface{}
+				if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				messages = append(messages, received{topic: r.Header.Get("X-Gohan-Topic"), message: message})
+			}))
+		})
+
+		AfterEach(func() {
+			listener.Close()
+			Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+				for _, schemaID := range []string{"with_outbox", "event", outbox.DeliverySchemaID, outbox.DeadLetterSchemaID} {
+					s, _ := schema.GetManager().Schema(schemaID)
+					Expect(clearTable(tx, s)).To(Succeed())
+				}
+				return nil
+			})).To(Succeed())
+		})
+
+		It("should publish changes to routed publishers", func() {
+			createResource("r0")
+			writer := srv.NewSyncWriterFromServer(server)
+			Expect(writer.Sync()).To(Equal(1))
+			Expect(countResources(outbox.DeliverySchemaID)()).To(Equal(2))
+			Expect(writer.Dispatch()).To(Equal(2))
+
+			published := receivedMessages()
+			Expect(published).To(HaveLen(2))
+			Expect(published[0].topic).To(Equal("outbox.resource"))
+			Expect(published[0].message).To(HaveKeyWithValue("type", "create"))
+			Expect(published[0].message).To(HaveKeyWithValue("schema_id", "with_outbox"))
+			Expect(published[0].message).To(HaveKeyWithValue("path", "/v2.0/with_outboxes/r0"))
+			Expect(published[0].message["body"]).To(util.MatchAsJSON(map[string]interface{}{
+				"id": "r0", "p0": "property0",
+			}))
+			Expect(published[1].topic).To(Equal("with_outbox"))
+			Expect(published[1].message).To(HaveKeyWithValue("body", "property0"))
+			Expect(published[1].message["id"]).To(Equal(published[0].message["id"]))
+			Expect(countResources(outbox.DeliverySchemaID)()).To(BeZero())
+		})
+
+		It("should retry failed messages", func() {
+			setFailing(true)
+			createResource("r0")
+			writer := srv.NewSyncWriterFromServer(server)
+			Expect(writer.Sync()).To(Equal(1))
+			Expect(writer.Dispatch()).To(BeZero())
+			Expect(countResources(outbox.DeliverySchemaID)()).To(Equal(2))
+
+			setFailing(false)
+			Expect(writer.Dispatch()).To(Equal(2))
+			Expect(receivedMessages()).To(HaveLen(2))
+			Expect(receivedMessages()[0].topic).To(Equal("outbox.resource"))
+			Expect(countResources(outbox.DeliverySchemaID)()).To(BeZero())
+			Expect(countResources(outbox.DeadLetterSchemaID)()).To(BeZero())
+		})
+
+		It("should move messages to dead letters after all attempts failed", func() {
+			setFailing(true)
+			createResource("r0")
+			writer := srv.NewSyncWriterFromServer(server)
+			Expect(writer.Sync()).To(Equal(1))
+			// messages of a publisher are published in order, so the second one
+			// is attempted after the first one is moved to dead letters
+			for i := 0; i < 2*outbox.MaxAttempts(); i++ {
+				Expect(writer.Dispatch()).To(BeZero())
+			}
+
+			Expect(countResources(outbox.DeliverySchemaID)()).To(BeZero())
+			Expect(countResources(outbox.DeadLetterSchemaID)()).To(Equal(2))
+			Expect(receivedMessages()).To(BeEmpty())
+		})
+	})
 })
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/util"
+)
+
+const (
+	defaultTombstonePurgeInterval = time.Hour
+	tombstonePurgeLockPath        = lockPath + "/tombstone_purge"
+)
+
+// startTombstonePurgeProcess periodically purges soft deleted resources
+// older than soft_delete/retention
+func startTombstonePurgeProcess(server *Server) {
+	config := util.GetConfig()
+	rawRetention := config.GetString("soft_delete/retention", "")
+	if rawRetention == "" {
+		return
+	}
+	retention, err := time.ParseDuration(rawRetention)
+	if err != nil {
+		log.Fatalf("Invalid soft_delete/retention %q: %s", rawRetention, err)
+	}
+	interval := defaultTombstonePurgeInterval
+	if rawInterval := config.GetString("soft_delete/purge_interval", ""); rawInterval != "" {
+		interval, err = time.ParseDuration(rawInterval)
+		if err != nil {
+			log.Fatalf("Invalid soft_delete/purge_interval %q: %s", rawInterval, err)
+		}
+	}
+	switch config.GetString("database/type", "sqlite3") {
+	case "json", "yaml":
+		log.Warning("Soft delete is not supported by file databases, tombstone purge is not started")
+		return
+	}
+	log.Info("Started tombstone purge process, retention %s", retention)
+	go runTombstonePurge(server.masterCtx, server.sync, server.db, retention, interval)
+}
+
+// runTombstonePurge purges tombstones periodically, only one process purges at once
+func runTombstonePurge(ctx context.Context, sync gohan_sync.Sync, dataStore db.DB, retention, interval time.Duration) {
+	purge := func() {
+		if err := db.PurgeDeleted(ctx, dataStore, time.Now().Add(-retention)); err != nil {
+			log.Error("Failed to purge deleted resources: %s", err)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if sync == nil {
+			purge()
+		} else if _, err := sync.Lock(tombstonePurgeLockPath, false); err == nil {
+			purge()
+			sync.Unlock(tombstonePurgeLockPath)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
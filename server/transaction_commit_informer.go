@@ -24,6 +24,8 @@ import (
 	"github.com/cloudwan/gohan/db"
 	"github.com/cloudwan/gohan/db/transaction"
 	"github.com/cloudwan/gohan/schema"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/webhook"
 )
 
 var (
@@ -41,6 +43,8 @@ func transactionCommitInformer() chan int {
 //DbSyncWrapper wraps db.DB so it logs events in database on every transaction.
 type DbSyncWrapper struct {
 	db.DB
+	// Sync, if set, receives invalidations of query caches published by committed transactions
+	Sync gohan_sync.Sync
 }
 
 // Begin wraps transaction object with sync
@@ -49,7 +53,7 @@ func (sw *DbSyncWrapper) Begin() (transaction.Transaction, error) {
 	if err != nil {
 		return nil, err
 	}
-	return syncTransactionWrap(tx), nil
+	return sw.wrap(tx), nil
 }
 
 // BeginTx wraps transaction object with sync
@@ -58,16 +62,58 @@ func (sw *DbSyncWrapper) BeginTx(ctx context.Context, options *transaction.TxOpt
 	if err != nil {
 		return nil, err
 	}
-	return syncTransactionWrap(tx), nil
+	return sw.wrap(tx), nil
+}
+
+func (sw *DbSyncWrapper) wrap(tx transaction.Transaction) *transactionEventLogger {
+	tl := syncTransactionWrap(tx)
+	tl.sync = sw.Sync
+	return tl
 }
 
 type transactionEventLogger struct {
 	transaction.Transaction
-	eventLogged bool
+	eventLogged    bool
+	webhooksQueued bool
+
+	sync gohan_sync.Sync
+	// cacheChanged holds schemas with cache_ttl whose list results were changed by the transaction
+	cacheChanged map[string]bool
 }
 
 func syncTransactionWrap(tx transaction.Transaction) *transactionEventLogger {
-	return &transactionEventLogger{tx, false}
+	return &transactionEventLogger{Transaction: tx}
+}
+
+// markCacheChanged records schemas with cache_ttl whose list results might include data of s changed by the transaction
+func (tl *transactionEventLogger) markCacheChanged(s *schema.Schema, deleted bool) {
+	for _, dependent := range s.CacheDependents(deleted) {
+		if tl.cacheChanged == nil {
+			tl.cacheChanged = map[string]bool{}
+		}
+		tl.cacheChanged[dependent.ID] = true
+	}
+}
+
+func (tl *transactionEventLogger) queueWebhooks(ctx context.Context, eventType string, resource *schema.Resource, state *transaction.ResourceState) error {
+	queued, err := queueWebhooks(ctx, tl.Transaction, eventType, resource, state)
+	if err != nil {
+		return err
+	}
+	tl.webhooksQueued = tl.webhooksQueued || queued
+	return nil
+}
+
+// schemaSyncPlain whether resources of the schema are synced without the version envelope
+func schemaSyncPlain(s *schema.Schema) bool {
+	syncPlain, _ := s.Metadata["sync_plain"].(bool)
+	return syncPlain
+}
+
+// schemaSyncProperty returns the property synced instead of the whole resource, if any
+func schemaSyncProperty(s *schema.Schema) string {
+	syncProperty, _ := s.Metadata["sync_property"].(string)
+	return syncProperty
 }
 
 func (tl *transactionEventLogger) logEvent(ctx context.Context, eventType string, resource *schema.Resource, version int64) error {
@@ -84,35 +130,21 @@ func (tl *transactionEventLogger) logEvent(ctx context.Context, eventType string
 
 	body, err := resource.JSONString()
 
-	syncPlain := false
-	syncPlainRaw, ok := resource.Schema().Metadata["sync_plain"]
-	if ok {
-		syncPlainBool, ok := syncPlainRaw.(bool)
-		if ok {
-			syncPlain = syncPlainBool
-		}
-	}
-
-	syncProperty := ""
-	syncPropertyRaw, ok := resource.Schema().Metadata["sync_property"]
-	if ok {
-		syncPropertyStr, ok := syncPropertyRaw.(string)
-		if ok {
-			syncProperty = syncPropertyStr
-		}
-	}
+	syncPlain := schemaSyncPlain(resource.Schema())
+	syncProperty := schemaSyncProperty(resource.Schema())
 
 	if err != nil {
 		return fmt.Errorf("Error during event resource deserialisation: %s", err.Error())
 	}
 	eventResource, err := schema.NewResource(eventSchema, map[string]interface{}{
-		"type":          eventType,
-		"path":          resource.Path(),
-		"version":       version,
-		"body":          body,
-		"sync_plain":    syncPlain,
-		"sync_property": syncProperty,
-		"timestamp":     int64(time.Now().Unix()),
+		"type":           eventType,
+		"path":           resource.Path(),
+		"path_partition": eventPartition(resource.Path()),
+		"version":        version,
+		"body":           body,
+		"sync_plain":     syncPlain,
+		"sync_property":  syncProperty,
+		"timestamp":      int64(time.Now().Unix()),
 	})
 	tl.eventLogged = true
 	return tl.Transaction.CreateContext(ctx, eventResource)
@@ -127,26 +159,57 @@ func (tl *transactionEventLogger) CreateContext(ctx context.Context, resource *s
 	if err != nil {
 		return err
 	}
-	return tl.logEvent(ctx, "create", resource, 1)
+	tl.markCacheChanged(resource.Schema(), false)
+	if err := tl.logEvent(ctx, "create", resource, 1); err != nil {
+		return err
+	}
+	return tl.queueWebhooks(ctx, "create", resource, nil)
 }
 
 func (tl *transactionEventLogger) Update(resource *schema.Resource) error {
 	return tl.UpdateContext(context.Background(), resource)
 }
 
+func (tl *transactionEventLogger) UpdateIfMatch(resource *schema.Resource, etag string) error {
+	return tl.UpdateIfMatchContext(context.Background(), resource, etag)
+}
+
+// UpdateIfMatchContext goes through UpdateContext, so the update is logged
+func (tl *transactionEventLogger) UpdateIfMatchContext(ctx context.Context, resource *schema.Resource, etag string) error {
+	return transaction.UpdateIfMatch(ctx, tl, resource, etag)
+}
+
 func (tl *transactionEventLogger) UpdateContext(ctx context.Context, resource *schema.Resource) error {
 	err := tl.Transaction.UpdateContext(ctx, resource)
 	if err != nil {
 		return err
 	}
-	if !resource.Schema().StateVersioning() {
-		return tl.logEvent(ctx, "update", resource, 0)
+	tl.markCacheChanged(resource.Schema(), false)
+	version := int64(0)
+	if resource.Schema().StateVersioning() {
+		state, err := tl.StateFetch(resource.Schema(), transaction.IDFilter(resource.ID()))
+		if err != nil {
+			return err
+		}
+		version = state.ConfigVersion
 	}
-	state, err := tl.StateFetch(resource.Schema(), transaction.IDFilter(resource.ID()))
+	if err := tl.logEvent(ctx, "update", resource, version); err != nil {
+		return err
+	}
+	return tl.queueWebhooks(ctx, "update", resource, nil)
+}
+
+func (tl *transactionEventLogger) StateUpdate(resource *schema.Resource, state *transaction.ResourceState) error {
+	return tl.StateUpdateContext(context.Background(), resource, state)
+}
+
+func (tl *transactionEventLogger) StateUpdateContext(ctx context.Context, resource *schema.Resource, state *transaction.ResourceState) error {
+	err := tl.Transaction.StateUpdateContext(ctx, resource, state)
 	if err != nil {
 		return err
 	}
-	return tl.logEvent(ctx, "update", resource, state.ConfigVersion)
+	tl.markCacheChanged(resource.Schema(), false)
+	return tl.queueWebhooks(ctx, webhook.EventState, resource, state)
 }
 
 func (tl *transactionEventLogger) Resync(resource *schema.Resource) error {
@@ -160,6 +223,24 @@ func (tl *transactionEventLogger) Resync(resource *schema.Resource) error {
 	return tl.logEvent(context.Background(), "update", resource, state.ConfigVersion)
 }
 
+func (tl *transactionEventLogger) Exec(query string, args ...interface{}) error {
+	return tl.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext runs a raw statement, which might have changed any schema with cache_ttl
+func (tl *transactionEventLogger) ExecContext(ctx context.Context, query string, args ...interface{}) error {
+	if err := tl.Transaction.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	for _, s := range cachedSchemas() {
+		if tl.cacheChanged == nil {
+			tl.cacheChanged = map[string]bool{}
+		}
+		tl.cacheChanged[s.ID] = true
+	}
+	return nil
+}
+
 func (tl *transactionEventLogger) Delete(s *schema.Schema, resourceID interface{}) error {
 	return tl.DeleteContext(context.Background(), s, resourceID)
 }
@@ -181,7 +262,11 @@ func (tl *transactionEventLogger) DeleteContext(ctx context.Context, s *schema.S
 	if err != nil {
 		return err
 	}
-	return tl.logEvent(ctx, "delete", resource, configVersion)
+	tl.markCacheChanged(s, true)
+	if err := tl.logEvent(ctx, "delete", resource, configVersion); err != nil {
+		return err
+	}
+	return tl.queueWebhooks(ctx, "delete", resource, nil)
 }
 
 func (tl *transactionEventLogger) Commit() error {
@@ -189,6 +274,13 @@ func (tl *transactionEventLogger) Commit() error {
 	if err != nil {
 		return err
 	}
+	publishCacheInvalidations(tl.sync, tl.cacheChanged)
+	if tl.webhooksQueued {
+		select {
+		case webhookQueued <- 1:
+		default:
+		}
+	}
 	if !tl.eventLogged {
 		return nil
 	}
@@ -0,0 +1,508 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/schema"
+	"github.com/cloudwan/gohan/server/middleware"
+	"github.com/cloudwan/gohan/server/resources"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/util"
+)
+
+const watchKeepAliveInterval = 30 * time.Second
+
+// The types of watch events
+const (
+	WatchCreate     = "create"
+	WatchUpdate     = "update"
+	WatchDelete     = "delete"
+	WatchState      = "state"
+	WatchMonitoring = "monitoring"
+	// WatchResync is sent when changes since the cursor are no longer available,
+	// clients have to list resources again and continue with the following events
+	WatchResync = "resync"
+)
+
+// WatchCursor is the position of a watch: the last revision received from each of the merged
+// key prefixes, configs, states and monitoring, which are watched and ordered independently
+type WatchCursor [3]int64
+
+// CurrentWatchCursor starts a watch at the current revision
+var CurrentWatchCursor = WatchCursor{gohan_sync.RevisionCurrent, gohan_sync.RevisionCurrent, gohan_sync.RevisionCurrent}
+
+func (cursor WatchCursor) String() string {
+	return fmt.Sprintf("%d,%d,%d", cursor[0], cursor[1], cursor[2])
+}
+
+// ParseWatchCursor parses a cursor of comma separated revisions,
+// a single revision is the position in all key prefixes
+func ParseWatchCursor(raw string) (WatchCursor, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) == 1 {
+		parts = []string{raw, raw, raw}
+	}
+	var cursor WatchCursor
+	if len(parts) != len(cursor) {
+		return cursor, fmt.Errorf("Invalid cursor %q", raw)
+	}
+	for i, part := range parts {
+		revision, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || revision < 0 {
+			return cursor, fmt.Errorf("Invalid cursor %q", raw)
+		}
+		cursor[i] = revision
+	}
+	return cursor, nil
+}
+
+// WatchEvent is a change of a resource streamed to watching clients
+type WatchEvent struct {
+	Type string `json:"type"`
+	// Revision of the sync backend the change was written in
+	Revision int64 `json:"revision"`
+	// Cursor to resume the watch after this event
+	Cursor string `json:"cursor,omitempty"`
+	ID     string `json:"id"`
+	// Resource as returned by the show API, set for create and update
+	Resource map[string]interface{} `json:"resource,omitempty"`
+	// Status as reported by the agent, set for state and monitoring
+	Status map[string]interface{} `json:"status,omitempty"`
+}
+
+// resourceWatch turns changes written to the sync backend into events
+// of resources the caller can read
+type resourceWatch struct {
+	schema *schema.Schema
+	policy *schema.Policy
+	auth   schema.Authorization
+	db     db.DB
+	// context and queryParameters of the request without pagination, resources are read through the list API with them
+	context         middleware.Context
+	queryParameters map[string][]string
+	// visible holds IDs of resources known to the caller,
+	// so that only deletions of those are reported
+	visible map[string]bool
+}
+
+// watchPrefix returns the common prefix of sync keys of resources of a schema, without the config prefix
+func watchPrefix(s *schema.Schema) string {
+	if template, ok := s.SyncKeyTemplate(); ok {
+		return strings.SplitN(template, "{{", 2)[0]
+	}
+	return s.URL + "/"
+}
+
+// watchConfigPrefix returns the prefix of config keys of resources of a schema
+func watchConfigPrefix(s *schema.Schema) string {
+	if s.SkipConfigPrefix() {
+		return ""
+	}
+	return configPrefix
+}
+
+// watchKeyPrefixes returns prefixes of keys merged into a watch, in the order of revisions of a WatchCursor
+func watchKeyPrefixes(s *schema.Schema) []string {
+	prefix := watchPrefix(s)
+	return []string{watchConfigPrefix(s) + prefix, statePrefix + prefix, monitoringPrefix + prefix}
+}
+
+// WatchResources streams changes of resources the caller can read, starting after the given cursor
+// or at the current revision with CurrentWatchCursor. When the changes since the cursor are no longer
+// available a WatchResync event is sent and the watch continues from the current revision.
+// The channel is closed when ctx is canceled or watching fails, clients are expected to resume
+// from the cursor of the last event.
+func WatchResources(
+	ctx context.Context, requestContext middleware.Context,
+	dataStore db.DB, sync gohan_sync.Sync,
+	resourceSchema *schema.Schema, queryParameters map[string][]string, cursor WatchCursor,
+) (<-chan *WatchEvent, error) {
+	if sync == nil || resourceSchema.Metadata["nosync"] == true {
+		err := fmt.Errorf("Resources of schema '%s' can't be watched, they are not synced", resourceSchema.ID)
+		return nil, resources.NewResourceError(err, err.Error(), resources.WrongQuery)
+	}
+	policy, _, err := resources.WatchResourcesFilter(requestContext, resourceSchema, queryParameters)
+	if err != nil {
+		return nil, err
+	}
+	listParameters := map[string][]string{}
+	for key, value := range queryParameters {
+		listParameters[key] = value
+	}
+	// changed resources are fetched one by one, pagination of the list request doesn't apply to them
+	for _, key := range []string{"watch", "revision", "limit", "offset", "marker", "sort_key", "sort_order"} {
+		delete(listParameters, key)
+	}
+	watch := &resourceWatch{
+		schema:          resourceSchema,
+		policy:          policy,
+		auth:            requestContext["auth"].(schema.Authorization),
+		db:              dataStore,
+		context:         requestContext,
+		queryParameters: listParameters,
+	}
+	if cursor == CurrentWatchCursor {
+		if cursor, err = currentWatchCursor(sync); err != nil {
+			return nil, err
+		}
+	}
+	if err := watch.loadVisible(); err != nil {
+		return nil, err
+	}
+
+	events := make(chan *WatchEvent)
+	go func() {
+		defer close(events)
+		resync := false
+		for {
+			err := watch.run(ctx, sync, cursor, resync, events)
+			if err != gohan_sync.ErrCompacted {
+				if err != nil {
+					log.Warning("Watch of %s failed: %s", resourceSchema.ID, err)
+				}
+				return
+			}
+			log.Info("Changes of %s since %s are compacted, resyncing", resourceSchema.ID, cursor)
+			if cursor, err = currentWatchCursor(sync); err != nil {
+				log.Warning("Watch of %s failed: %s", resourceSchema.ID, err)
+				return
+			}
+			resync = true
+		}
+	}()
+	return events, nil
+}
+
+// currentWatchCursor returns the cursor of the current revision when the sync backend reports it,
+// otherwise CurrentWatchCursor
+func currentWatchCursor(sync gohan_sync.Sync) (WatchCursor, error) {
+	revisioner, ok := sync.(gohan_sync.Revisioner)
+	if !ok {
+		return CurrentWatchCursor, nil
+	}
+	revision, err := revisioner.CurrentRevision()
+	if err != nil {
+		return CurrentWatchCursor, err
+	}
+	return WatchCursor{revision, revision, revision}, nil
+}
+
+// streamEvent is an event received from one of the merged key prefixes
+type streamEvent struct {
+	stream int
+	event  *gohan_sync.Event
+}
+
+// run watches changes after the cursor and sends them to events until ctx is canceled
+// or watching fails. With resync, resources are loaded again and WatchResync is sent first.
+func (watch *resourceWatch) run(ctx context.Context, sync gohan_sync.Sync, cursor WatchCursor, resync bool, events chan<- *WatchEvent) error {
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+	merged := make(chan streamEvent)
+	for stream, path := range watchKeyPrefixes(watch.schema) {
+		revision := cursor[stream]
+		if revision != gohan_sync.RevisionCurrent {
+			revision++
+		}
+		go func(stream int, path string, revision int64) {
+			for event := range sync.WatchContext(watchCtx, path, revision) {
+				select {
+				case merged <- streamEvent{stream: stream, event: event}:
+				case <-watchCtx.Done():
+					return
+				}
+			}
+			watchCancel()
+		}(stream, path, revision)
+	}
+
+	if resync {
+		if err := watch.loadVisible(); err != nil {
+			return err
+		}
+		select {
+		case events <- &WatchEvent{Type: WatchResync}:
+		case <-watchCtx.Done():
+			return nil
+		}
+	}
+
+	// latest is the newest revision received, the position of prefixes watched from the current
+	// revision of backends which don't report it until they receive a change
+	latest := int64(0)
+	for {
+		var received streamEvent
+		select {
+		case <-watchCtx.Done():
+			return nil
+		case received = <-merged:
+		}
+		event := received.event
+		if event.Err != nil {
+			return event.Err
+		}
+		if event.Revision > cursor[received.stream] {
+			cursor[received.stream] = event.Revision
+		}
+		if event.Revision > latest {
+			latest = event.Revision
+		}
+		// existing keys are skipped as the caller is expected to list resources first
+		if event.Action == "get" {
+			continue
+		}
+		watchEvent, err := watch.process(event)
+		if err != nil {
+			return err
+		}
+		if watchEvent == nil {
+			continue
+		}
+		position := cursor
+		for i := range position {
+			if position[i] == gohan_sync.RevisionCurrent {
+				position[i] = latest
+			}
+		}
+		watchEvent.Cursor = position.String()
+		select {
+		case events <- watchEvent:
+		case <-watchCtx.Done():
+			return nil
+		}
+	}
+}
+
+// loadVisible loads IDs of resources the caller can currently read
+func (watch *resourceWatch) loadVisible() error {
+	list, err := watch.list(watch.queryParameters)
+	if err != nil {
+		return err
+	}
+	watch.visible = map[string]bool{}
+	for _, resource := range list {
+		if id, ok := resource.(map[string]interface{})["id"].(string); ok {
+			watch.visible[id] = true
+		}
+	}
+	return nil
+}
+
+// list returns resources as the list API returns them to the caller, including changes made by
+// pre_list and post_list extensions
+func (watch *resourceWatch) list(queryParameters map[string][]string) ([]interface{}, error) {
+	context := middleware.Context{}
+	for key, value := range watch.context {
+		context[key] = value
+	}
+	delete(context, "response")
+	delete(context, "total")
+	delete(context, "next_marker")
+	if err := resources.GetMultipleResources(context, watch.db, watch.schema, queryParameters); err != nil {
+		return nil, err
+	}
+	response, _ := context["response"].(map[string]interface{})
+	list, _ := response[watch.schema.Plural].([]interface{})
+	return list, nil
+}
+
+// readable checks if the read policy allowed the caller to read a deleted resource
+// with the last synced value of it
+func (watch *resourceWatch) readable(value map[string]interface{}) bool {
+	data := value
+	// values of resources which aren't synced plain are wrapped with their version
+	if body, ok := value["body"].(string); ok {
+		if err := json.Unmarshal([]byte(body), &data); err != nil {
+			return false
+		}
+	}
+	if data == nil {
+		return false
+	}
+	if tenantIDs := watch.policy.GetTenantIDFilter(schema.ActionRead, watch.auth.TenantID()); tenantIDs != nil {
+		if tenantID, ok := data["tenant_id"].(string); !ok || !util.ContainsString(tenantIDs, tenantID) {
+			return false
+		}
+	}
+	return watch.policy.ApplyPropertyConditionFilter(schema.ActionRead, data, nil) == nil &&
+		watch.policy.ApplyExpressionConditions(schema.ActionRead, watch.auth, data, nil) == nil
+}
+
+// resourceID returns ID of the resource the key belongs to, or an empty string
+// if the key doesn't belong to a resource of the watched schema
+func (watch *resourceWatch) resourceID(path string) string {
+	if _, ok := watch.schema.SyncKeyTemplate(); ok {
+		if schema.GetSchemaByPath(path) != watch.schema {
+			return ""
+		}
+		return watch.schema.GetResourceIDFromPath(path)
+	}
+	id := strings.TrimPrefix(path, watchPrefix(watch.schema))
+	if strings.Contains(id, "/") {
+		return ""
+	}
+	return id
+}
+
+func (watch *resourceWatch) process(event *gohan_sync.Event) (*WatchEvent, error) {
+	for _, prefix := range []string{statePrefix, monitoringPrefix} {
+		if !strings.HasPrefix(event.Key, prefix+"/") {
+			continue
+		}
+		id := watch.resourceID(strings.TrimPrefix(event.Key, prefix))
+		if id == "" || !watch.visible[id] || event.Action == "delete" {
+			return nil, nil
+		}
+		eventType := WatchState
+		if prefix == monitoringPrefix {
+			eventType = WatchMonitoring
+		}
+		return &WatchEvent{Type: eventType, Revision: event.Revision, ID: id, Status: event.Data}, nil
+	}
+
+	id := watch.resourceID(strings.TrimPrefix(event.Key, watchConfigPrefix(watch.schema)))
+	if id == "" {
+		return nil, nil
+	}
+	var resource map[string]interface{}
+	if event.Action != "delete" {
+		var err error
+		if resource, err = watch.fetch(id); err != nil {
+			return nil, err
+		}
+	}
+	if resource == nil {
+		// deletes replayed on resume are of resources unknown to the loaded visible set,
+		// they are reported when the caller could read the last synced value
+		if !watch.visible[id] && !(event.Action == "delete" && watch.readable(event.PrevData)) {
+			return nil, nil
+		}
+		delete(watch.visible, id)
+		return &WatchEvent{Type: WatchDelete, Revision: event.Revision, ID: id}, nil
+	}
+	eventType := WatchCreate
+	if watch.visible[id] {
+		eventType = WatchUpdate
+	}
+	watch.visible[id] = true
+	return &WatchEvent{Type: eventType, Revision: event.Revision, ID: id, Resource: resource}, nil
+}
+
+// fetch returns the current data of a resource as listed by the caller, or nil if the caller can't read it.
+// Only the resource is read, filtered by the policy and the query of the watch.
+func (watch *resourceWatch) fetch(id string) (map[string]interface{}, error) {
+	queryParameters := map[string][]string{}
+	for key, value := range watch.queryParameters {
+		queryParameters[key] = value
+	}
+	if ids, ok := queryParameters["id"]; ok && !util.ContainsString(ids, id) {
+		return nil, nil
+	}
+	queryParameters["id"] = []string{id}
+	queryParameters["limit"] = []string{"1"}
+	list, err := watch.list(queryParameters)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0].(map[string]interface{}), nil
+}
+
+// isWatchRequest checks if a list request asks for a stream of changes
+func isWatchRequest(r *http.Request) bool {
+	watch, _ := strconv.ParseBool(r.URL.Query().Get("watch"))
+	return watch
+}
+
+// watchCursor returns the cursor a watch resumes after, given in the Last-Event-ID header
+// sent by reconnecting event sources or in the revision query parameter
+func watchCursor(r *http.Request) (WatchCursor, error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("revision")
+	}
+	if raw == "" {
+		return CurrentWatchCursor, nil
+	}
+	cursor, err := ParseWatchCursor(raw)
+	if err != nil {
+		return cursor, resources.NewResourceError(err, err.Error(), resources.WrongQuery)
+	}
+	return cursor, nil
+}
+
+// serveWatch streams changes of resources as server-sent events
+func serveWatch(w http.ResponseWriter, r *http.Request, context middleware.Context, dataStore db.DB, sync gohan_sync.Sync, s *schema.Schema) {
+	cursor, err := watchCursor(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	events, err := WatchResources(r.Context(), context, dataStore, sync, s, r.URL.Query(), cursor)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Error("Failed to marshal watch event: %s", err)
+				return
+			}
+			// without a cursor clients keep the last one
+			if event.Cursor != "" {
+				if _, err := fmt.Fprintf(w, "id: %s\n", event.Cursor); err != nil {
+					return
+				}
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
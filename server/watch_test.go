@@ -0,0 +1,272 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	srv "github.com/cloudwan/gohan/server"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	gohan_etcd "github.com/cloudwan/gohan/sync/etcdv3"
+	etcd "github.com/coreos/etcd/clientv3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+	type watchEvent struct {
+		id    string
+		event string
+		data  srv.WatchEvent
+	}
+
+	var (
+		sync   gohan_sync.Sync
+		writer *srv.SyncWriter
+		stops  []func()
+	)
+
+	// watch opens a stream of changes and returns a channel of received events
+	watch := func(url, token, lastEventID string) <-chan watchEvent {
+		request, err := http.NewRequest("GET", url, nil)
+		Expect(err).ToNot(HaveOccurred())
+		request.Header.Set("X-Auth-Token", token)
+		if lastEventID != "" {
+			request.Header.Set("Last-Event-ID", lastEventID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+		stops = append(stops, func() { response.Body.Close() })
+
+		events := make(chan watchEvent, 16)
+		go func() {
+			defer GinkgoRecover()
+			defer close(events)
+			reader := bufio.NewReader(response.Body)
+			var event watchEvent
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case line == "":
+					if event.event != "" {
+						events <- event
+					}
+					event = watchEvent{}
+				case strings.HasPrefix(line, "id: "):
+					event.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					event.event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					Expect(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data)).To(Succeed())
+				}
+			}
+		}()
+		return events
+	}
+
+	receive := func(events <-chan watchEvent) watchEvent {
+		var event watchEvent
+		EventuallyWithOffset(1, events, 5*time.Second).Should(Receive(&event))
+		return event
+	}
+
+	BeforeEach(func() {
+		var err error
+		sync, err = gohan_etcd.NewSync([]string{"http://127.0.0.1:2379"}, time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		writer = srv.NewSyncWriter(sync, testDB)
+		stops = nil
+	})
+
+	AfterEach(func() {
+		for _, stop := range stops {
+			stop()
+		}
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			for _, schemaID := range []string{"network", "event"} {
+				s, _ := schema.GetManager().Schema(schemaID)
+				Expect(clearTable(tx, s)).To(Succeed())
+			}
+			return nil
+		})).To(Succeed())
+		sync.Delete("/config/v2.0/networks", true)
+		sync.Delete("/watch_test", true)
+		sync.Close()
+	})
+
+	It("should stream changes of resources of the tenant of the caller", func() {
+		events := watch(networkPluralURL+"?watch=true", memberTokenID, "")
+
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", memberTenantID), http.StatusCreated)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "blue"), http.StatusCreated)
+		testURL("PUT", getNetworkSingularURL("red"), adminTokenID, map[string]interface{}{"name": "Renamed"}, http.StatusOK)
+		_, err := writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+
+		created := receive(events)
+		Expect(created.event).To(Equal(srv.WatchCreate))
+		Expect(created.id).To(Equal(created.data.Cursor))
+		Expect(created.data.ID).To(Equal("networkred"))
+		Expect(created.data.Resource).To(HaveKeyWithValue("tenant_id", memberTenantID))
+
+		updated := receive(events)
+		Expect(updated.event).To(Equal(srv.WatchUpdate))
+		Expect(updated.data.ID).To(Equal("networkred"))
+		Expect(updated.data.Resource).To(HaveKeyWithValue("name", "Renamed"))
+
+		Expect(sync.Update("/state_watch/state/v2.0/networks/networkred", `{"version": 1, "state": "up"}`)).To(Succeed())
+		state := receive(events)
+		Expect(state.event).To(Equal(srv.WatchState))
+		Expect(state.data.Status).To(HaveKeyWithValue("state", "up"))
+
+		testURL("DELETE", getNetworkSingularURL("blue"), adminTokenID, nil, http.StatusNoContent)
+		testURL("DELETE", getNetworkSingularURL("red"), adminTokenID, nil, http.StatusNoContent)
+		_, err = writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+
+		deleted := receive(events)
+		Expect(deleted.event).To(Equal(srv.WatchDelete))
+		Expect(deleted.data.ID).To(Equal("networkred"))
+		Consistently(events, 500*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should report changes of resources beyond the page of the list request", func() {
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "blue"), http.StatusCreated)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		_, err := writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+
+		events := watch(networkPluralURL+"?watch=true&limit=1&sort_key=id", adminTokenID, "")
+		testURL("PUT", getNetworkSingularURL("red"), adminTokenID, map[string]interface{}{"name": "Renamed"}, http.StatusOK)
+		_, err = writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+
+		updated := receive(events)
+		Expect(updated.event).To(Equal(srv.WatchUpdate))
+		Expect(updated.data.ID).To(Equal("networkred"))
+		Expect(updated.data.Resource).To(HaveKeyWithValue("name", "Renamed"))
+	})
+
+	It("should resume after the last received revision", func() {
+		events := watch(networkPluralURL+"?watch=true", adminTokenID, "")
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		_, err := writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+		created := receive(events)
+		Expect(created.data.ID).To(Equal("networkred"))
+		stops[0]()
+
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "blue"), http.StatusCreated)
+		_, err = writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+
+		resumed := watch(networkPluralURL+"?watch=true", adminTokenID, created.id)
+		event := receive(resumed)
+		Expect(event.data.ID).To(Equal("networkblue"))
+		Expect(event.event).To(Equal(srv.WatchUpdate))
+		Consistently(resumed, 500*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should replay deletes of resources the caller could read on resume", func() {
+		events := watch(networkPluralURL+"?watch=true", memberTokenID, "")
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", memberTenantID), http.StatusCreated)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "blue"), http.StatusCreated)
+		_, err := writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+		created := receive(events)
+		Expect(created.data.ID).To(Equal("networkred"))
+		stops[0]()
+
+		testURL("DELETE", getNetworkSingularURL("red"), adminTokenID, nil, http.StatusNoContent)
+		testURL("DELETE", getNetworkSingularURL("blue"), adminTokenID, nil, http.StatusNoContent)
+		_, err = writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+
+		resumed := watch(networkPluralURL+"?watch=true", memberTokenID, created.id)
+		deleted := receive(resumed)
+		Expect(deleted.event).To(Equal(srv.WatchDelete))
+		Expect(deleted.data.ID).To(Equal("networkred"))
+		Consistently(resumed, 500*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should keep a cursor of every watched prefix", func() {
+		events := watch(networkPluralURL+"?watch=true", adminTokenID, "")
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		_, err := writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+		created := receive(events)
+
+		Expect(sync.Update("/state_watch/state/v2.0/networks/networkred", `{"version": 1, "state": "up"}`)).To(Succeed())
+		state := receive(events)
+		Expect(state.event).To(Equal(srv.WatchState))
+		cursor, err := srv.ParseWatchCursor(state.id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cursor[0]).To(Equal(created.data.Revision))
+		Expect(cursor[1]).To(Equal(state.data.Revision))
+		stops[0]()
+
+		// a change of the config written before the state is still delivered after the state cursor
+		resumed := watch(networkPluralURL+"?watch=true", adminTokenID, created.id)
+		Expect(receive(resumed).event).To(Equal(srv.WatchState))
+	})
+
+	It("should ask clients to resync when changes since the cursor are compacted", func() {
+		events := watch(networkPluralURL+"?watch=true", adminTokenID, "")
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		_, err := writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+		created := receive(events)
+		stops[0]()
+
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "blue"), http.StatusCreated)
+		_, err = writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+		client, err := etcd.New(etcd.Config{Endpoints: []string{"http://127.0.0.1:2379"}, DialTimeout: time.Second})
+		Expect(err).ToNot(HaveOccurred())
+		defer client.Close()
+		current, err := client.Put(context.Background(), "/watch_test/compacted", "{}")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Compact(context.Background(), current.Header.Revision)
+		Expect(err).ToNot(HaveOccurred())
+
+		resumed := watch(networkPluralURL+"?watch=true", adminTokenID, created.id)
+		Expect(receive(resumed).event).To(Equal(srv.WatchResync))
+		testURL("PUT", getNetworkSingularURL("blue"), adminTokenID, map[string]interface{}{"name": "Renamed"}, http.StatusOK)
+		_, err = writer.Sync()
+		Expect(err).ToNot(HaveOccurred())
+		updated := receive(resumed)
+		Expect(updated.event).To(Equal(srv.WatchUpdate))
+		Expect(updated.data.ID).To(Equal("networkblue"))
+	})
+
+	It("should reject schemas which aren't synced", func() {
+		testURL("GET", baseURL+"/gohan/v0.1/subscriptions?watch=true", adminTokenID, nil, http.StatusBadRequest)
+	})
+})
@@ -0,0 +1,396 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/pagination"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/extension"
+	"github.com/cloudwan/gohan/schema"
+	gohan_sync "github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/util"
+	"github.com/cloudwan/gohan/webhook"
+	"github.com/twinj/uuid"
+)
+
+const (
+	webhookLockPath     = "/gohan/cluster/webhook"
+	webhookPollingLimit = 1000
+	webhookPurgeTime    = time.Hour
+)
+
+// webhookQueued wakes up the webhook dispatcher when a transaction queueing deliveries is committed
+var webhookQueued = make(chan int, 1)
+
+// queueWebhooks stores deliveries of a change of a resource to matching subscriptions.
+// Deliveries are created in the transaction making the change, so they are sent only when it is committed.
+func queueWebhooks(ctx context.Context, tx transaction.Transaction, eventType string, resource *schema.Resource, state *transaction.ResourceState) (bool, error) {
+	schemaManager := schema.GetManager()
+	subscriptionSchema, ok := schemaManager.Schema(webhook.SubscriptionSchemaID)
+	if !ok || resource.Schema().Metadata["type"] == "metaschema" {
+		return false, nil
+	}
+	deliverySchema, _ := schemaManager.Schema(webhook.DeliverySchemaID)
+	subscriptions, _, err := tx.ListContext(ctx, subscriptionSchema, transaction.Filter{"enabled": true}, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to list webhook subscriptions: %s", err)
+	}
+
+	tenantID, _ := resource.Get("tenant_id").(string)
+	eventID := uuid.NewV4().String()
+	queued := false
+	for _, subscription := range subscriptions {
+		if !webhook.Matches(subscription.Data(), eventType, resource.Schema().ID, tenantID) {
+			continue
+		}
+		data := subscriberData(subscription, resource)
+		if data == nil {
+			continue
+		}
+		now := time.Now().Unix()
+		payload := map[string]interface{}{
+			"id":              eventID,
+			"subscription_id": subscription.ID(),
+			"event":           eventType,
+			"schema_id":       resource.Schema().ID,
+			"resource_id":     resource.ID(),
+			"path":            resource.Path(),
+			"timestamp":       now,
+			"resource":        data,
+		}
+		if state != nil {
+			payload["state"] = map[string]interface{}{
+				"config_version": state.ConfigVersion,
+				"state_version":  state.StateVersion,
+				"error":          state.Error,
+				"state":          state.State,
+				"monitoring":     state.Monitoring,
+			}
+		}
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return false, err
+		}
+		delivery, err := schema.NewResource(deliverySchema, map[string]interface{}{
+			"subscription_id": subscription.ID(),
+			"tenant_id":       subscription.Get("tenant_id"),
+			"event_id":        eventID,
+			"event_type":      eventType,
+			"schema_id":       resource.Schema().ID,
+			"resource_id":     resource.ID(),
+			"path":            resource.Path(),
+			"status":          webhook.StatePending,
+			"attempts":        0,
+			"next_attempt":    0,
+			"response_status": 0,
+			"last_error":      "",
+			"created_at":      now,
+			"delivered_at":    0,
+			"payload":         string(encoded),
+		})
+		if err != nil {
+			return false, err
+		}
+		if err := tx.CreateContext(ctx, delivery); err != nil {
+			return false, fmt.Errorf("failed to queue webhook delivery: %s", err)
+		}
+		queued = true
+	}
+	return queued, nil
+}
+
+// subscriberData returns data of the resource filtered by the read policy of the owner of the subscription,
+// as it would be returned by the API, or nil when the owner can't read the resource
+func subscriberData(subscription, resource *schema.Resource) map[string]interface{} {
+	tenantID, _ := subscription.Get("tenant_id").(string)
+	roles := []string{}
+	for _, role := range util.MaybeList(subscription.Get("owner_roles")) {
+		roles = append(roles, util.MaybeString(role))
+	}
+	auth := schema.NewAuthorization(tenantID, "", "", roles, nil)
+	policy, _ := schema.GetManager().PolicyValidate(schema.ActionRead, resource.Path(), auth)
+	if policy == nil {
+		return nil
+	}
+	data := resource.Data()
+	if policy.ApplyPropertyConditionFilter(schema.ActionRead, data, nil) != nil ||
+		policy.ApplyExpressionConditions(schema.ActionRead, auth, data, nil) != nil {
+		return nil
+	}
+	return policy.RemoveHiddenProperty(data)
+}
+
+// subscriptionEnvironment validates URLs of subscriptions, records roles of their owners
+// and keeps their secrets out of responses
+type subscriptionEnvironment struct {
+}
+
+func (env *subscriptionEnvironment) LoadExtensionsForPath(extensions []*schema.Extension, timeLimit time.Duration, timeLimits []*schema.PathEventTimeLimit, path string) error {
+	return nil
+}
+
+func (env *subscriptionEnvironment) HandleEvent(event string, context map[string]interface{}) error {
+	switch event {
+	case "pre_create", "pre_update":
+		resource, _ := context["resource"].(map[string]interface{})
+		if rawURL, ok := resource["url"].(string); ok {
+			if err := webhook.ValidateURL(rawURL); err != nil {
+				return extension.Errorf(http.StatusBadRequest, "CustomException", fmt.Sprintf("Invalid URL: %s", err))
+			}
+		}
+	case "pre_create_in_transaction":
+		// changes are delivered as the owner can read them
+		resource, _ := context["resource"].(map[string]interface{})
+		roles := []interface{}{}
+		if auth, ok := context["auth"].(schema.Authorization); ok {
+			for _, role := range auth.Roles() {
+				roles = append(roles, role.Name)
+			}
+		}
+		resource["owner_roles"] = roles
+	}
+	removeSubscriptionSecrets(context)
+	return nil
+}
+
+func (env *subscriptionEnvironment) Clone() extension.Environment {
+	return env
+}
+
+func (env *subscriptionEnvironment) IsEventHandled(event string, context map[string]interface{}) bool {
+	switch event {
+	case "pre_create", "pre_create_in_transaction", "pre_update", "post_create", "post_update", "post_show", "post_list":
+		return true
+	}
+	return false
+}
+
+func removeSubscriptionSecrets(context map[string]interface{}) {
+	response, _ := context["response"].(map[string]interface{})
+	if subscription, ok := response["subscription"].(map[string]interface{}); ok {
+		delete(subscription, "secret")
+	}
+	if subscriptions, ok := response["subscriptions"].([]interface{}); ok {
+		for _, rawSubscription := range subscriptions {
+			if subscription, ok := rawSubscription.(map[string]interface{}); ok {
+				delete(subscription, "secret")
+			}
+		}
+	}
+}
+
+// WebhookDispatcher sends changes queued for webhook subscriptions.
+// Deliveries of a subscription are sent in order, so a delivery waiting for retry
+// holds back the following ones.
+type WebhookDispatcher struct {
+	sync    gohan_sync.Sync
+	db      db.DB
+	backoff time.Duration
+}
+
+// NewWebhookDispatcher creates a new instance of WebhookDispatcher.
+// When sync is given, only the process holding the webhook lock sends deliveries.
+func NewWebhookDispatcher(sync gohan_sync.Sync, db db.DB) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		sync:    sync,
+		db:      db,
+		backoff: time.Second * 5,
+	}
+}
+
+// Run keeps running Dispatch() until the ctx is canceled
+func (dispatcher *WebhookDispatcher) Run(ctx context.Context) error {
+	pollingTicker := time.NewTicker(webhook.PollingInterval())
+	defer pollingTicker.Stop()
+	purgeTicker := time.NewTicker(webhookPurgeTime)
+	defer purgeTicker.Stop()
+
+	for {
+		err := func() error {
+			var lost chan struct{}
+			if dispatcher.sync != nil {
+				var err error
+				lost, err = dispatcher.sync.Lock(webhookLockPath, true)
+				if err != nil {
+					return err
+				}
+				defer dispatcher.sync.Unlock(webhookLockPath)
+			}
+
+			for {
+				if _, err := dispatcher.Dispatch(); err != nil {
+					return err
+				}
+				select {
+				case <-lost:
+					return fmt.Errorf("lost lock for webhooks")
+				case <-ctx.Done():
+					return nil
+				case <-purgeTicker.C:
+					if err := dispatcher.PurgeHistory(); err != nil {
+						log.Error("Failed to purge webhook delivery history: %s", err)
+					}
+				case <-pollingTicker.C:
+				case <-webhookQueued:
+				}
+			}
+		}()
+
+		if err != nil {
+			log.Error("webhook dispatcher is interrupted: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dispatcher.backoff):
+		}
+	}
+}
+
+// Dispatch sends pending deliveries which are due
+func (dispatcher *WebhookDispatcher) Dispatch() (delivered int, err error) {
+	schemaManager := schema.GetManager()
+	subscriptionSchema, ok := schemaManager.Schema(webhook.SubscriptionSchemaID)
+	if !ok {
+		return 0, nil
+	}
+	deliverySchema, _ := schemaManager.Schema(webhook.DeliverySchemaID)
+
+	var subscriptions, deliveries []*schema.Resource
+	if err = db.Within(dispatcher.db, func(tx transaction.Transaction) error {
+		subscriptions, _, err = tx.List(subscriptionSchema, transaction.Filter{"enabled": true}, nil, nil)
+		if err != nil || len(subscriptions) == 0 {
+			return err
+		}
+		paginator, _ := pagination.NewPaginator(
+			pagination.OptionKey(deliverySchema, "id"),
+			pagination.OptionOrder(pagination.ASC),
+			pagination.OptionLimit(webhookPollingLimit))
+		deliveries, _, err = tx.List(deliverySchema, transaction.Filter{"status": webhook.StatePending}, nil, paginator)
+		return err
+	}); err != nil {
+		return
+	}
+
+	enabled := map[string]*schema.Resource{}
+	for _, subscription := range subscriptions {
+		enabled[subscription.ID()] = subscription
+	}
+	queueOf := func(delivery *schema.Resource) (string, bool) {
+		_, ok := enabled[delivery.ParentID()]
+		return delivery.ParentID(), ok
+	}
+	return attemptInOrder(deliveries, queueOf, func(delivery *schema.Resource) (error, error) {
+		subscriptionID := delivery.ParentID()
+		subscription := enabled[subscriptionID]
+		status, deliverErr := webhook.Deliver(
+			subscription.Get("url").(string),
+			subscription.Get("secret").(string),
+			delivery.Get("event_type").(string),
+			delivery.Get("event_id").(string),
+			[]byte(delivery.Get("payload").(string)))
+		if deliverErr != nil {
+			log.Warning("failed to deliver %s to webhook subscription %s: %s", delivery.Get("path"), subscriptionID, deliverErr)
+		}
+		return deliverErr, dispatcher.finishDelivery(subscription, delivery, status, deliverErr)
+	})
+}
+
+// finishDelivery records the result of a delivery attempt in the delivery history and the subscription
+func (dispatcher *WebhookDispatcher) finishDelivery(subscription, delivery *schema.Resource, status int, deliverErr error) error {
+	now := time.Now().Unix()
+	attempts := int(toInt64(delivery.Get("attempts"))) + 1
+	deliveryData := map[string]interface{}{
+		"id":              delivery.Get("id"),
+		"subscription_id": subscription.ID(),
+		"attempts":        attempts,
+		"response_status": status,
+	}
+	failureCount := int(toInt64(subscription.Get("failure_count")))
+	subscriptionData := map[string]interface{}{
+		"id": subscription.ID(),
+	}
+	if deliverErr == nil {
+		deliveryData["status"] = webhook.StateDelivered
+		deliveryData["delivered_at"] = now
+		deliveryData["last_error"] = ""
+		if failureCount == 0 {
+			subscriptionData = nil
+		} else {
+			subscriptionData["failure_count"] = 0
+		}
+	} else {
+		deliveryData["last_error"] = deliverErr.Error()
+		if nextAttempt, ok := webhook.Retry().NextAttempt(attempts); ok {
+			deliveryData["next_attempt"] = nextAttempt
+		} else {
+			deliveryData["status"] = webhook.StateFailed
+		}
+		failureCount++
+		subscriptionData["failure_count"] = failureCount
+		subscriptionData["last_error"] = deliverErr.Error()
+		if disableAfter := webhook.DisableAfter(); disableAfter > 0 && failureCount >= disableAfter {
+			log.Warning("disabling webhook subscription %s after %d consecutive failures", subscription.ID(), failureCount)
+			subscriptionData["enabled"] = false
+			subscriptionData["last_error"] = fmt.Sprintf("disabled after %d consecutive failures: %s", failureCount, deliverErr)
+		}
+	}
+	return db.Within(dispatcher.db, func(tx transaction.Transaction) error {
+		updatedDelivery, err := schema.NewResource(delivery.Schema(), deliveryData)
+		if err != nil {
+			return err
+		}
+		if err := tx.Update(updatedDelivery); err != nil {
+			return err
+		}
+		if subscriptionData == nil {
+			return nil
+		}
+		updatedSubscription, err := schema.NewResource(subscription.Schema(), subscriptionData)
+		if err != nil {
+			return err
+		}
+		if err := tx.Update(updatedSubscription); err != nil {
+			return err
+		}
+		for key, value := range subscriptionData {
+			subscription.Data()[key] = value
+		}
+		return nil
+	})
+}
+
+// PurgeHistory removes delivered and failed deliveries older than the configured retention
+func (dispatcher *WebhookDispatcher) PurgeHistory() error {
+	deliverySchema, ok := schema.GetManager().Schema(webhook.DeliverySchemaID)
+	if !ok {
+		return nil
+	}
+	before := time.Now().Add(-webhook.HistoryRetention()).Unix()
+	return db.Within(dispatcher.db, func(tx transaction.Transaction) error {
+		return tx.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE status IN (?, ?) AND created_at < ?", deliverySchema.GetDbTableName()),
+			webhook.StateDelivered, webhook.StateFailed, before)
+	})
+}
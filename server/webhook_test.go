@@ -0,0 +1,263 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/cloudwan/gohan/audit"
+	"github.com/cloudwan/gohan/db"
+	"github.com/cloudwan/gohan/db/transaction"
+	"github.com/cloudwan/gohan/schema"
+	srv "github.com/cloudwan/gohan/server"
+	"github.com/cloudwan/gohan/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webhooks", func() {
+	type received struct {
+		header  http.Header
+		body    []byte
+		payload map[string]interface{}
+	}
+
+	var (
+		listener        net.Listener
+		mu              sync.Mutex
+		requests        []received
+		failing         bool
+		subscriptionURL string
+	)
+
+	subscriptionsURL := baseURL + "/gohan/v0.1/subscriptions"
+	deliveriesURL := baseURL + "/gohan/v0.1/subscription_deliveries"
+
+	receivedRequests := func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received{}, requests...)
+	}
+
+	setFailing := func(value bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		failing = value
+	}
+
+	dispatch := func() int {
+		delivered, err := srv.NewWebhookDispatcher(nil, testDB).Dispatch()
+		Expect(err).ToNot(HaveOccurred())
+		return delivered
+	}
+
+	deliveries := func() []interface{} {
+		result := testURL("GET", deliveriesURL+"?sort_key=id", adminTokenID, nil, http.StatusOK)
+		return result.(map[string]interface{})["subscription_deliveries"].([]interface{})
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		failing = false
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:19093")
+		Expect(err).ToNot(HaveOccurred())
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failing {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			var payload map[string]interface{}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			requests = append(requests, received{header: r.Header, body: body, payload: payload})
+		}))
+
+		subscription := testURL("POST", subscriptionsURL, adminTokenID, map[string]interface{}{
+			"tenant_id": "red",
+			"url":       "http://127.0.0.1:19093/hook",
+			"schemas":   []string{"network"},
+			"secret":    "secret",
+		}, http.StatusCreated)
+		subscriptionID := subscription.(map[string]interface{})["subscription"].(map[string]interface{})["id"].(string)
+		subscriptionURL = subscriptionsURL + "/" + subscriptionID
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			for _, schemaID := range []string{"network", "event", webhook.DeliverySchemaID, webhook.SubscriptionSchemaID} {
+				s, _ := schema.GetManager().Schema(schemaID)
+				Expect(clearTable(tx, s)).To(Succeed())
+			}
+			return nil
+		})).To(Succeed())
+	})
+
+	It("should post signed changes of resources of the subscribed tenant", func() {
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "blue"), http.StatusCreated)
+		testURL("DELETE", getNetworkSingularURL("red"), adminTokenID, nil, http.StatusNoContent)
+
+		Expect(dispatch()).To(Equal(2))
+		Expect(dispatch()).To(Equal(0))
+
+		requests := receivedRequests()
+		Expect(requests).To(HaveLen(2))
+		for i, eventType := range []string{"create", "delete"} {
+			Expect(requests[i].header.Get("X-Gohan-Event")).To(Equal(eventType))
+			Expect(requests[i].header.Get(webhook.SignatureHeader)).To(Equal(webhook.Sign("secret", requests[i].body)))
+			Expect(requests[i].payload).To(HaveKeyWithValue("event", eventType))
+			Expect(requests[i].payload).To(HaveKeyWithValue("schema_id", "network"))
+			Expect(requests[i].payload).To(HaveKeyWithValue("resource_id", "networkred"))
+			Expect(requests[i].payload["resource"]).To(HaveKeyWithValue("name", "Networkred"))
+		}
+
+		history := deliveries()
+		Expect(history).To(HaveLen(2))
+		for _, delivery := range history {
+			Expect(delivery).To(HaveKeyWithValue("status", webhook.StateDelivered))
+			Expect(delivery).To(HaveKeyWithValue("response_status", BeNumerically("==", http.StatusOK)))
+			Expect(delivery).To(HaveKeyWithValue("attempts", BeNumerically("==", 1)))
+		}
+	})
+
+	It("should keep secrets out of responses", func() {
+		subscription := testURL("GET", subscriptionURL, adminTokenID, nil, http.StatusOK).(map[string]interface{})["subscription"]
+		Expect(subscription).To(HaveKeyWithValue("url", "http://127.0.0.1:19093/hook"))
+		Expect(subscription).NotTo(HaveKey("secret"))
+		subscriptions := testURL("GET", subscriptionsURL, adminTokenID, nil, http.StatusOK).(map[string]interface{})["subscriptions"]
+		Expect(subscriptions).To(HaveLen(1))
+		Expect(subscriptions.([]interface{})[0]).NotTo(HaveKey("secret"))
+
+		updated := testURL("PUT", subscriptionURL, adminTokenID, map[string]interface{}{"secret": "changed"}, http.StatusOK)
+		Expect(updated.(map[string]interface{})["subscription"]).NotTo(HaveKey("secret"))
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		Expect(dispatch()).To(Equal(1))
+		request := receivedRequests()[0]
+		Expect(request.header.Get(webhook.SignatureHeader)).To(Equal(webhook.Sign("changed", request.body)))
+	})
+
+	It("should keep secrets out of audit records", func() {
+		testURL("PUT", subscriptionURL, adminTokenID, map[string]interface{}{"secret": "rotated"}, http.StatusOK)
+
+		result := testURL("GET", baseURL+"/gohan/v0.1/audit_logs?resource_id="+path.Base(subscriptionURL), adminTokenID, nil, http.StatusOK)
+		records := result.(map[string]interface{})["audit_logs"].([]interface{})
+		Expect(records).To(HaveLen(2))
+		for _, record := range records {
+			Expect(record.(map[string]interface{})["after"]).To(HaveKeyWithValue("secret", audit.SecretMask))
+		}
+		stored, err := json.Marshal(records)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stored)).NotTo(ContainSubstring(`"secret":"secret"`))
+		Expect(string(stored)).NotTo(ContainSubstring("rotated"))
+
+		emitted, err := ioutil.ReadFile("./test_audit.log")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(emitted)).NotTo(ContainSubstring("rotated"))
+	})
+
+	It("should deliver resources as the owner of the subscription can read them", func() {
+		memberTenantID := "fc394f2ab2df4114bde39905f800dc57"
+		testURL("POST", subscriptionsURL, memberTokenID, map[string]interface{}{
+			"tenant_id": memberTenantID,
+			"url":       "http://127.0.0.1:19093/member",
+			"schemas":   []string{"network"},
+		}, http.StatusCreated)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", memberTenantID), http.StatusCreated)
+
+		Expect(dispatch()).To(Equal(1))
+		requests := receivedRequests()
+		Expect(requests).To(HaveLen(1))
+		resource := requests[0].payload["resource"]
+		Expect(resource).To(HaveKeyWithValue("name", "Networkred"))
+		Expect(resource).NotTo(HaveKey("route_targets"))
+		Expect(deliveries()[0]).To(HaveKeyWithValue("payload", Not(ContainSubstring("route_targets"))))
+	})
+
+	It("should record only the status of failed responses", func() {
+		setFailing(true)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		Expect(dispatch()).To(Equal(0))
+		Expect(deliveries()[0]).To(HaveKeyWithValue("last_error", "responded with status 503"))
+		subscription := testURL("GET", subscriptionURL, adminTokenID, nil, http.StatusOK).(map[string]interface{})["subscription"]
+		Expect(subscription).To(HaveKeyWithValue("last_error", "responded with status 503"))
+	})
+
+	It("should purge old deliveries", func() {
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("red", "red"), http.StatusCreated)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("blue", "red"), http.StatusCreated)
+		Expect(dispatch()).To(Equal(2))
+		Expect(db.Within(testDB, func(tx transaction.Transaction) error {
+			deliverySchema, _ := schema.GetManager().Schema(webhook.DeliverySchemaID)
+			return tx.Exec(fmt.Sprintf("UPDATE %s SET created_at = 1 WHERE resource_id = ?", deliverySchema.GetDbTableName()), "networkred")
+		})).To(Succeed())
+
+		Expect(srv.NewWebhookDispatcher(nil, testDB).PurgeHistory()).To(Succeed())
+		history := deliveries()
+		Expect(history).To(HaveLen(1))
+		Expect(history[0]).To(HaveKeyWithValue("resource_id", "networkblue"))
+	})
+
+	It("should retry failed deliveries and disable the subscription after repeated failures", func() {
+		setFailing(true)
+		for _, color := range []string{"red", "green", "yellow"} {
+			testURL("POST", networkPluralURL, adminTokenID, getNetwork(color, "red"), http.StatusCreated)
+		}
+
+		for i := 0; i < webhook.MaxAttempts(); i++ {
+			Expect(dispatch()).To(Equal(0))
+		}
+		history := deliveries()
+		Expect(history[0]).To(HaveKeyWithValue("status", webhook.StateFailed))
+		Expect(history[0]).To(HaveKeyWithValue("attempts", BeNumerically("==", webhook.MaxAttempts())))
+		Expect(history[0]).To(HaveKeyWithValue("response_status", BeNumerically("==", http.StatusServiceUnavailable)))
+		Expect(history[1]).To(HaveKeyWithValue("status", webhook.StatePending))
+
+		setFailing(false)
+		Expect(dispatch()).To(Equal(2))
+		subscription := testURL("GET", subscriptionURL, adminTokenID, nil, http.StatusOK).(map[string]interface{})["subscription"]
+		Expect(subscription).To(HaveKeyWithValue("failure_count", BeNumerically("==", 0)))
+
+		setFailing(true)
+		for _, color := range []string{"blue", "orange"} {
+			testURL("POST", networkPluralURL, adminTokenID, getNetwork(color, "red"), http.StatusCreated)
+		}
+		for i := 0; i < webhook.DisableAfter(); i++ {
+			dispatch()
+		}
+		subscription = testURL("GET", subscriptionURL, adminTokenID, nil, http.StatusOK).(map[string]interface{})["subscription"]
+		Expect(subscription).To(HaveKeyWithValue("enabled", false))
+		Expect(subscription).To(HaveKeyWithValue("failure_count", BeNumerically("==", webhook.DisableAfter())))
+		Expect(subscription).To(HaveKeyWithValue("last_error", ContainSubstring("disabled after")))
+
+		setFailing(false)
+		testURL("POST", networkPluralURL, adminTokenID, getNetwork("white", "red"), http.StatusCreated)
+		Expect(dispatch()).To(Equal(0))
+		Expect(receivedRequests()).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,682 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	syn "sync"
+	"time"
+
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/sync"
+	"github.com/streamrail/concurrent-map"
+	"github.com/twinj/uuid"
+)
+
+const (
+	sessionTTL = 10 * time.Second
+	// watchWait is the maximum duration of a blocking query
+	watchWait = 5 * time.Minute
+	// maxTxnOps is the maximum number of operations in a Consul transaction
+	maxTxnOps = 64
+)
+
+var (
+	errNotFound = errors.New("key not found")
+	errClosed   = errors.New("sync is closed")
+)
+
+// Sync is struct for Consul based sync.
+// Gohan keys are stored under the configured prefix with the leading slash removed,
+// e.g. /config/networks/net1 is stored as gohan/config/networks/net1 with prefix gohan.
+type Sync struct {
+	address   string
+	token     string
+	prefix    string
+	timeout   time.Duration
+	client    *http.Client
+	processID string
+	// locks maps locked paths to IDs of sessions holding them
+	locks     cmap.ConcurrentMap
+	closed    chan struct{}
+	closeOnce syn.Once
+}
+
+// NewSync initialize new Consul sync
+func NewSync(address, token, prefix string, timeout time.Duration) (*Sync, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	hostname, _ := os.Hostname()
+	s := &Sync{
+		address:   strings.TrimSuffix(address, "/"),
+		token:     token,
+		prefix:    prefix,
+		timeout:   timeout,
+		client:    &http.Client{},
+		processID: hostname + uuid.NewV4().String(),
+		locks:     cmap.New(),
+		closed:    make(chan struct{}),
+	}
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	if _, err := s.do(ctx, "GET", "/v1/status/leader", nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sync) withTimeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// GetProcessID returns processID
+func (s *Sync) GetProcessID() string {
+	return s.processID
+}
+
+func measureTime(timeStarted time.Time, action string) {
+	metrics.UpdateTimer(timeStarted, "sync.consul.%s", action)
+}
+
+func updateCounter(delta int64, counter string) {
+	metrics.UpdateCounter(delta, "sync.consul.%s", counter)
+}
+
+func (s *Sync) consulKey(key string) string {
+	return s.prefix + strings.TrimPrefix(key, "/")
+}
+
+func (s *Sync) gohanKey(key string) string {
+	return "/" + strings.TrimPrefix(key, s.prefix)
+}
+
+// do sends a request to the Consul HTTP API, decodes the response to result
+// and returns the X-Consul-Index header of the response
+func (s *Sync) do(ctx context.Context, method, endpoint string, query url.Values, body, result interface{}) (uint64, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	requestURL := s.address + endpoint
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, requestURL, reader)
+	if err != nil {
+		return 0, err
+	}
+	request = request.WithContext(ctx)
+	if s.token != "" {
+		request.Header.Set("X-Consul-Token", s.token)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	index, _ := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if response.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, response.Body)
+		return index, errNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return index, fmt.Errorf("consul %s %s responded with %s: %s", method, endpoint, response.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		io.Copy(ioutil.Discard, response.Body)
+		return index, nil
+	}
+	return index, json.NewDecoder(response.Body).Decode(result)
+}
+
+// kvPair is an entry of the Consul KV store
+type kvPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+	Session     string
+}
+
+// list returns entries with keys starting with key.
+// When index is not zero, it is a blocking query waiting for changes after index.
+func (s *Sync) list(ctx context.Context, key string, index uint64) ([]*kvPair, uint64, error) {
+	query := url.Values{"recurse": {""}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", watchWait.String())
+	}
+	pairs := []*kvPair{}
+	newIndex, err := s.do(ctx, "GET", "/v1/kv/"+s.consulKey(key), query, nil, &pairs)
+	if err == errNotFound {
+		return []*kvPair{}, newIndex, nil
+	}
+	return pairs, newIndex, err
+}
+
+// Update sync update sync
+// When jsonString is empty, this method do nothing
+// in the same way as etcd v3 sync which doesn't support directories.
+func (s *Sync) Update(key, jsonString string) error {
+	defer measureTime(time.Now(), "update")
+
+	if jsonString == "" {
+		return nil
+	}
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	if _, err := s.do(ctx, "PUT", "/v1/kv/"+s.consulKey(key), nil, jsonString, nil); err != nil {
+		log.Error(fmt.Sprintf("failed to sync with backend %s", err))
+		updateCounter(1, "update.error")
+		return err
+	}
+	return nil
+}
+
+// Delete sync update sync
+func (s *Sync) Delete(key string, prefix bool) error {
+	defer measureTime(time.Now(), "delete")
+
+	var query url.Values
+	if prefix {
+		query = url.Values{"recurse": {""}}
+	}
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	_, err := s.do(ctx, "DELETE", "/v1/kv/"+s.consulKey(key), query, nil, nil)
+	if err != nil {
+		updateCounter(1, "delete.error")
+	}
+	return err
+}
+
+// txnOperation is a KV operation of a Consul transaction
+type txnOperation struct {
+	KV txnKVOperation
+}
+
+type txnKVOperation struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+}
+
+// MaxBatchSize returns the limit of operations in a Consul transaction
+func (s *Sync) MaxBatchSize() int {
+	return maxTxnOps
+}
+
+// Batch applies operations in a single Consul transaction.
+// As in Update, operations storing an empty value are skipped.
+func (s *Sync) Batch(operations []sync.Operation) error {
+	defer measureTime(time.Now(), "batch")
+
+	txn := make([]txnOperation, 0, len(operations))
+	for _, operation := range operations {
+		switch {
+		case operation.Delete && operation.Prefix:
+			txn = append(txn, txnOperation{KV: txnKVOperation{Verb: "delete-tree", Key: s.consulKey(operation.Key)}})
+		case operation.Delete:
+			txn = append(txn, txnOperation{KV: txnKVOperation{Verb: "delete", Key: s.consulKey(operation.Key)}})
+		case operation.Value != "":
+			txn = append(txn, txnOperation{KV: txnKVOperation{Verb: "set", Key: s.consulKey(operation.Key), Value: []byte(operation.Value)}})
+		}
+	}
+	if len(txn) == 0 {
+		return nil
+	}
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	if _, err := s.do(ctx, "PUT", "/v1/txn", nil, txn, nil); err != nil {
+		log.Error(fmt.Sprintf("failed to sync batch with backend %s", err))
+		updateCounter(1, "batch.error")
+		return err
+	}
+	return nil
+}
+
+// Fetch data from sync
+func (s *Sync) Fetch(key string) (*sync.Node, error) {
+	defer measureTime(time.Now(), "fetch")
+
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	pairs, _, err := s.list(ctx, key, 0)
+	if err != nil {
+		updateCounter(1, "fetch.error")
+		return nil, err
+	}
+	root := s.gohanKey(s.consulKey(key))
+	dir := strings.TrimSuffix(root, "/") + "/"
+	leaves := []*sync.Node{}
+	for _, pair := range pairs {
+		pairKey := s.gohanKey(pair.Key)
+		if pairKey == root || strings.HasPrefix(pairKey, dir) {
+			leaves = append(leaves, &sync.Node{Key: pairKey, Value: string(pair.Value), Revision: int64(pair.ModifyIndex)})
+		}
+	}
+	if len(leaves) == 0 {
+		return nil, fmt.Errorf("Key not found (%s)", key)
+	}
+	return sync.NodeTree(root, leaves), nil
+}
+
+// HasLock checks current process owns lock or not
+func (s *Sync) HasLock(path string) bool {
+	return s.locks.Has(path)
+}
+
+func (s *Sync) createSession(path string) (string, error) {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	var session struct {
+		ID string
+	}
+	_, err := s.do(ctx, "PUT", "/v1/session/create", nil, map[string]interface{}{
+		"Name":      "gohan lock " + path,
+		"TTL":       sessionTTL.String(),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	}, &session)
+	return session.ID, err
+}
+
+func (s *Sync) destroySession(sessionID string) error {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	_, err := s.do(ctx, "PUT", "/v1/session/destroy/"+sessionID, nil, nil, nil)
+	return err
+}
+
+func (s *Sync) renewSession(sessionID string) error {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	_, err := s.do(ctx, "PUT", "/v1/session/renew/"+sessionID, nil, nil, nil)
+	return err
+}
+
+func (s *Sync) acquire(path, sessionID string) (bool, error) {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	var acquired bool
+	_, err := s.do(ctx, "PUT", "/v1/kv/"+s.consulKey(path), url.Values{"acquire": {sessionID}}, s.processID, &acquired)
+	return acquired, err
+}
+
+// waitForRelease blocks until the lock key is modified, the wait times out or the sync is closed
+func (s *Sync) waitForRelease(path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*sessionTTL)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var pairs []*kvPair
+	index, err := s.do(ctx, "GET", "/v1/kv/"+s.consulKey(path), nil, nil, &pairs)
+	if err == nil && len(pairs) > 0 && pairs[0].Session != "" {
+		query := url.Values{"index": {strconv.FormatUint(index, 10)}, "wait": {sessionTTL.String()}}
+		_, err = s.do(ctx, "GET", "/v1/kv/"+s.consulKey(path), query, nil, nil)
+	}
+	if err != nil && err != errNotFound {
+		select {
+		case <-time.After(s.timeout):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Lock locks resources on sync
+// This call blocks until you can get lock when block is true.
+// The returned channel is closed when the lock is released, its session can't be renewed
+// or the lock key is deleted.
+func (s *Sync) Lock(path string, block bool) (chan struct{}, error) {
+	defer measureTime(time.Now(), "lock")
+	updateCounter(1, "lock.waiting")
+	defer updateCounter(-1, "lock.waiting")
+
+	for {
+		select {
+		case <-s.closed:
+			return nil, errClosed
+		default:
+		}
+		sessionID, err := s.createSession(path)
+		acquired := false
+		if err == nil {
+			acquired, err = s.acquire(path, sessionID)
+			if err != nil || !acquired {
+				s.destroySession(sessionID)
+			}
+		}
+		if err != nil || !acquired {
+			msg := fmt.Sprintf("failed to lock path %s", path)
+			if err != nil {
+				updateCounter(1, "lock.error")
+				msg = fmt.Sprintf("failed to lock path %s: %s", path, err)
+			}
+			log.Notice(msg)
+
+			if !block {
+				return nil, errors.New(msg)
+			}
+			s.waitForRelease(path)
+			continue
+		}
+		s.locks.Set(path, sessionID)
+		log.Info("Locked %s", path)
+		updateCounter(1, "lock.granted")
+
+		//Keep the lock until it is released, the session can't be renewed or the lock key disappears
+		ctx, cancel := context.WithCancel(context.Background())
+		go s.keepSession(ctx, cancel, path, sessionID)
+		go s.watchLock(ctx, cancel, path, sessionID)
+		lost := make(chan struct{})
+		go func() {
+			defer s.abortLock(path, sessionID)
+			defer close(lost)
+			defer updateCounter(-1, "lock.granted")
+
+			select {
+			case <-ctx.Done():
+			case <-s.closed:
+				cancel()
+			}
+		}()
+
+		return lost, nil
+	}
+}
+
+// keepSession renews the session until the lock is released or the renewal fails
+func (s *Sync) keepSession(ctx context.Context, cancel context.CancelFunc, path, sessionID string) {
+	defer cancel()
+	for s.hasSession(path, sessionID) {
+		if err := s.renewSession(sessionID); err != nil {
+			updateCounter(1, "lock.keepalive.error")
+			log.Notice("failed to keepalive lock for %s %s", path, err)
+			return
+		}
+		select {
+		case <-time.After(sessionTTL / 2):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchLock waits until the lock key is deleted or held by another session,
+// e.g. when the session is invalidated by Consul
+func (s *Sync) watchLock(ctx context.Context, cancel context.CancelFunc, path, sessionID string) {
+	defer cancel()
+	var index uint64
+	for {
+		query := url.Values{}
+		if index > 0 {
+			query.Set("index", strconv.FormatUint(index, 10))
+			query.Set("wait", sessionTTL.String())
+		}
+		var pairs []*kvPair
+		newIndex, err := s.do(ctx, "GET", "/v1/kv/"+s.consulKey(path), query, nil, &pairs)
+		if ctx.Err() != nil || !s.hasSession(path, sessionID) {
+			return
+		}
+		if err == errNotFound || (err == nil && (len(pairs) == 0 || pairs[0].Session != sessionID)) {
+			updateCounter(1, "lock.lost")
+			log.Notice("lock for %s is lost", path)
+			return
+		}
+		if err != nil {
+			updateCounter(1, "lock.watch.error")
+			log.Notice("failed to watch lock for %s %s", path, err)
+			select {
+			case <-time.After(s.timeout):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+func (s *Sync) hasSession(path, sessionID string) bool {
+	current, ok := s.locks.Get(path)
+	return ok && current.(string) == sessionID
+}
+
+// abortLock forgets the lock on path held by sessionID, or by any session when sessionID is empty
+func (s *Sync) abortLock(path, sessionID string) string {
+	current, ok := s.locks.Get(path)
+	if !ok || (sessionID != "" && current.(string) != sessionID) {
+		return ""
+	}
+	s.locks.Remove(path)
+	log.Info("Unlocked path %s", path)
+	return current.(string)
+}
+
+// Unlock path
+func (s *Sync) Unlock(path string) error {
+	defer measureTime(time.Now(), "unlock")
+
+	if sessionID := s.abortLock(path, ""); sessionID != "" {
+		// the lock key is deleted together with the session
+		return s.destroySession(sessionID)
+	}
+	return nil
+}
+
+func (s *Sync) newEvent(action string, pair *kvPair, revision uint64) *sync.Event {
+	event := &sync.Event{
+		Action:   action,
+		Key:      s.gohanKey(pair.Key),
+		Revision: int64(revision),
+	}
+	if len(pair.Value) > 0 && action != "delete" {
+		err := json.Unmarshal(pair.Value, &event.Data)
+		if err != nil {
+			log.Warning("failed to unmarshal watch response value %s: %s", pair.Value, err)
+		}
+	}
+	return event
+}
+
+func sendEvents(events []*sync.Event, responseChan chan *sync.Event, stopped chan struct{}) bool {
+	for _, event := range events {
+		select {
+		case <-stopped:
+			log.Debug("Events from node interrupted by stop")
+			return false
+		case responseChan <- event:
+		}
+	}
+	return true
+}
+
+// changes returns events for entries modified since the previous state of a watch,
+// known is updated to the current state
+func (s *Sync) changes(known map[string]uint64, pairs []*kvPair, index uint64) []*sync.Event {
+	events := []*sync.Event{}
+	current := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		current[pair.Key] = true
+		if modifyIndex, ok := known[pair.Key]; !ok || modifyIndex != pair.ModifyIndex {
+			known[pair.Key] = pair.ModifyIndex
+			events = append(events, s.newEvent("set", pair, pair.ModifyIndex))
+		}
+	}
+	for key := range known {
+		if !current[key] {
+			delete(known, key)
+			events = append(events, s.newEvent("delete", &kvPair{Key: key}, index))
+		}
+	}
+	sortEvents(events)
+	return events
+}
+
+func sortEvents(events []*sync.Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Revision != events[j].Revision {
+			return events[i].Revision < events[j].Revision
+		}
+		return events[i].Key < events[j].Key
+	})
+}
+
+// Watch keep watch update under the path.
+// Resuming from a revision returns sync.ErrCompacted when keys under the path
+// have been modified since then, as deletes can't be replayed from Consul.
+func (s *Sync) Watch(path string, responseChan chan *sync.Event, stopChan chan bool, revision int64) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-stopChan:
+			close(stopped)
+		case <-s.closed:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	aborted := func(err error) error {
+		select {
+		case <-stopped:
+			return nil
+		case <-s.closed:
+			return fmt.Errorf("Watch aborted by sync close")
+		default:
+			return err
+		}
+	}
+
+	updateCounter(1, "watch.active")
+	defer updateCounter(-1, "watch.active")
+
+	pairs, index, err := s.list(ctx, path, 0)
+	if err != nil {
+		updateCounter(1, "watch.get.error")
+		return aborted(err)
+	}
+	if revision != sync.RevisionCurrent && int64(index) >= revision {
+		// Consul doesn't keep deleted keys, so changes since revision can't be replayed
+		return sync.ErrCompacted
+	}
+	known := map[string]uint64{}
+	events := []*sync.Event{}
+	for _, pair := range pairs {
+		known[pair.Key] = pair.ModifyIndex
+		if revision == sync.RevisionCurrent {
+			events = append(events, s.newEvent("get", pair, pair.ModifyIndex))
+		}
+	}
+	sortEvents(events)
+	if !sendEvents(events, responseChan, stopped) {
+		return nil
+	}
+
+	for {
+		if index == 0 {
+			index = 1
+		}
+		pairs, newIndex, err := s.list(ctx, path, index)
+		if err != nil {
+			updateCounter(1, "watch.client_watch.error")
+			return aborted(err)
+		}
+		if !sendEvents(s.changes(known, pairs, newIndex), responseChan, stopped) {
+			return nil
+		}
+		if newIndex < index {
+			// the index went backwards, e.g. after the cluster was restored from a snapshot
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// WatchContext keep watch update under the path until context is canceled
+func (s *Sync) WatchContext(ctx context.Context, path string, revision int64) <-chan *sync.Event {
+	eventCh := make(chan *sync.Event, 32)
+	stopCh := make(chan bool)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Watch(path, eventCh, stopCh, revision)
+	}()
+	go func() {
+		defer close(eventCh)
+
+		select {
+		case <-ctx.Done():
+			close(stopCh)
+			// don't return without ensuring Watch finished or we risk panic: send on closed channel
+			<-errCh
+		case err := <-errCh:
+			close(stopCh)
+			if err != nil {
+				select {
+				case eventCh <- &sync.Event{Err: err}:
+				default:
+					log.Debug("Unable to send error: '%s' via response chan. Don't linger.", err)
+				}
+			}
+		}
+	}()
+	return eventCh
+}
+
+// Close releases locks held by the sync and stops its watches
+func (s *Sync) Close() {
+	defer measureTime(time.Now(), "close")
+	s.closeOnce.Do(func() {
+		for item := range s.locks.IterBuffered() {
+			s.Unlock(item.Key)
+		}
+		close(s.closed)
+	})
+}
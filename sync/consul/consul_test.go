@@ -0,0 +1,408 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	gohan_sync "github.com/cloudwan/gohan/sync"
+)
+
+// newSync connects to a local agent, e.g. started by "consul agent -dev",
+// or to the one given in CONSUL_HTTP_ADDR
+func newSync(t *testing.T) *Sync {
+	address := os.Getenv("CONSUL_HTTP_ADDR")
+	if address == "" {
+		address = "127.0.0.1:8500"
+	}
+	sync, err := NewSync(address, os.Getenv("CONSUL_HTTP_TOKEN"), "gohan_test", time.Second)
+	if err != nil {
+		t.Skipf("consul agent is not available: %s", err)
+	}
+	if err := sync.Delete("/", true); err != nil {
+		t.Fatalf("failed to clean up: %s", err)
+	}
+	return sync
+}
+
+func TestNewSyncUnavailable(t *testing.T) {
+	_, err := NewSync("127.0.0.1:1", "", "", 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("nil returned for error")
+	}
+}
+
+func TestNonEmptyUpdate(t *testing.T) {
+	sync := newSync(t)
+	defer sync.Close()
+
+	path := "/path/to/somewhere"
+	data := "blabla"
+	err := sync.Update(path, data)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	node, err := sync.Fetch(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if node.Key != path || node.Value != data || len(node.Children) != 0 || node.Revision == 0 {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+
+	err = sync.Delete(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	_, err = sync.Fetch(path)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("Key not found (%s)", path)) {
+		t.Fatalf("unexpected non error")
+	}
+}
+
+func TestRecursiveUpdate(t *testing.T) {
+	syn := newSync(t)
+	defer syn.Close()
+	mustUpdate := func(key, value string) {
+		if err := syn.Update(key, value); err != nil {
+			t.Fatalf("unexpected error %s", err.Error())
+		}
+	}
+
+	mustUpdate("/a/b/c/d/1", "test1")
+	mustUpdate("/a/b/c/d/2", "test2")
+	mustUpdate("/a/b/e/d/1", "test3")
+	mustUpdate("/ab", "not included")
+
+	node, err := syn.Fetch("/a")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	checkNode(node, "/a", "", 1, t)
+	ab := node.Children[0]
+	checkNode(ab, "/a/b", "", 2, t)
+	abcd := ab.Children[0].Children[0]
+	checkNode(abcd, "/a/b/c/d", "", 2, t)
+	checkNode(abcd.Children[0], "/a/b/c/d/1", "test1", 0, t)
+	checkNode(abcd.Children[1], "/a/b/c/d/2", "test2", 0, t)
+	abed := ab.Children[1].Children[0]
+	checkNode(abed, "/a/b/e/d", "", 1, t)
+	checkNode(abed.Children[0], "/a/b/e/d/1", "test3", 0, t)
+
+	if err := syn.Delete("/a/b/c", true); err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if _, err := syn.Fetch("/a/b/c"); err == nil {
+		t.Fatalf("keys not deleted")
+	}
+}
+
+func checkNode(node *gohan_sync.Node, key, value string, children int, t *testing.T) {
+	if node.Key != key {
+		t.Fatalf("expected key %s has %s", key, node.Key)
+	}
+	if node.Value != value {
+		t.Fatalf("expected value %s has %s", value, node.Value)
+	}
+	if len(node.Children) != children {
+		t.Fatalf("expected to has %d children has %d", children, len(node.Children))
+	}
+}
+
+func TestBatch(t *testing.T) {
+	sync := newSync(t)
+	defer sync.Close()
+
+	for _, key := range []string{"/batch/a", "/batch/prefix/a", "/batch/prefix/b"} {
+		if err := sync.Update(key, "old"); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	err := sync.Batch([]gohan_sync.Operation{
+		{Key: "/batch/a", Value: "new"},
+		{Key: "/batch/b", Value: "created"},
+		{Key: "/batch/empty", Value: ""},
+		{Key: "/batch/prefix", Delete: true, Prefix: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	node, err := sync.Fetch("/batch")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(node.Children) != 2 {
+		t.Fatalf("expected 2 children has %d", len(node.Children))
+	}
+	for i, expected := range []string{"new", "created"} {
+		if node.Children[i].Value != expected {
+			t.Fatalf("unexpected node: %+v", node.Children[i])
+		}
+	}
+	sync.Delete("/batch", true)
+}
+
+func TestLockUnblocking(t *testing.T) {
+	sync0 := newSync(t)
+	defer sync0.Close()
+	sync1 := newSync(t)
+	defer sync1.Close()
+
+	path := "/path/lock"
+	_, err := sync0.Lock(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	_, err = sync1.Lock(path, false)
+	if err == nil {
+		t.Fatalf("unexpected non error")
+	}
+
+	if !sync0.HasLock(path) {
+		t.Fatalf("unexpected false")
+	}
+	if sync1.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+	node, err := sync1.Fetch(path)
+	if err != nil || node.Value != sync0.GetProcessID() {
+		t.Fatalf("unexpected lock node %+v: %v", node, err)
+	}
+
+	err = sync0.Unlock(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	_, err = sync1.Lock(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if sync0.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+	if !sync1.HasLock(path) {
+		t.Fatalf("unexpected false")
+	}
+}
+
+func TestLockBlocking(t *testing.T) {
+	sync0 := newSync(t)
+	defer sync0.Close()
+	sync1 := newSync(t)
+	defer sync1.Close()
+
+	path := "/path/lock"
+	_, err := sync0.Lock(path, true)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	locked1 := make(chan error)
+	go func() {
+		_, err := sync1.Lock(path, true)
+		locked1 <- err
+	}()
+
+	select {
+	case <-locked1:
+		t.Fatalf("blocking failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = sync0.Unlock(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	select {
+	case err := <-locked1:
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lock not acquired after unlock")
+	}
+
+	if sync0.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+	if !sync1.HasLock(path) {
+		t.Fatalf("unexpected false")
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	sync := newSync(t)
+	defer sync.Close()
+
+	path := "/path/lock"
+	lost, err := sync.Lock(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	sessionID, _ := sync.locks.Get(path)
+	if err := sync.destroySession(sessionID.(string)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(sessionTTL):
+		t.Fatalf("lock lost not notified")
+	}
+	if sync.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+}
+
+func TestLockLostOnKeyDelete(t *testing.T) {
+	sync := newSync(t)
+	defer sync.Close()
+
+	path := "/path/lock/deleted"
+	lost, err := sync.Lock(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := sync.Delete(path, false); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(sessionTTL / 2):
+		t.Fatalf("lock lost not notified")
+	}
+	if sync.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	sync := newSync(t)
+	defer sync.Close()
+
+	path := "/path/to/watch"
+	responseChan := make(chan *gohan_sync.Event)
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	sync.Update(path+"/existing", `{"existing": true}`)
+
+	go sync.Watch(path, responseChan, stopChan, gohan_sync.RevisionCurrent)
+
+	resp := <-responseChan
+	if resp.Action != "get" || resp.Key != path+"/existing" || resp.Data["existing"].(bool) != true {
+		t.Fatalf("mismatch response: %+v", resp)
+	}
+	existingRevision := resp.Revision
+
+	sync.Update(path+"/new", `{"existing": false}`)
+	resp = <-responseChan
+	if resp.Action != "set" || resp.Key != path+"/new" || resp.Data["existing"].(bool) != false || resp.Revision <= existingRevision {
+		t.Fatalf("mismatch response: %+v", resp)
+	}
+	newRevision := resp.Revision
+
+	sync.Delete(path+"/existing", false)
+	resp = <-responseChan
+	if resp.Action != "delete" || resp.Key != path+"/existing" || len(resp.Data) != 0 || resp.Revision <= newRevision {
+		t.Fatalf("mismatch response: %+v", resp)
+	}
+}
+
+func TestWatchWithRevision(t *testing.T) {
+	sync := newSync(t)
+	defer sync.Close()
+
+	path := "/path/to/watch/with/revision"
+	sync.Update(path+"/existing", `{"existing": true}`)
+	sync.Update(path+"/new", `{"existing": false}`)
+	node, err := sync.Fetch(path + "/new")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	if err := sync.Watch(path, make(chan *gohan_sync.Event), stopChan, node.Revision); err != gohan_sync.ErrCompacted {
+		t.Fatalf("expecting ErrCompacted, got %v", err)
+	}
+
+	_, index, err := sync.list(context.Background(), path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := sync.WatchContext(ctx, path, int64(index)+1)
+	// changes made before the watch starts would be reported as compacted
+	time.Sleep(100 * time.Millisecond)
+
+	sync.Update(path+"/third", `{"existing": false}`)
+	resp := <-events
+	if resp.Action != "set" || resp.Key != path+"/third" {
+		t.Fatalf("mismatch response: %+v, expecting /third", resp)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatalf("unexpected event")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event channel not closed")
+	}
+}
+
+func TestChanges(t *testing.T) {
+	sync := &Sync{prefix: "gohan/"}
+	known := map[string]uint64{"gohan/a": 1, "gohan/b": 2}
+	events := sync.changes(known, []*kvPair{
+		{Key: "gohan/b", Value: []byte(`{"b": 1}`), ModifyIndex: 4},
+		{Key: "gohan/c", Value: []byte(`{"c": 1}`), ModifyIndex: 3},
+	}, 5)
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	expected := []struct {
+		action   string
+		key      string
+		revision int64
+	}{
+		{"set", "/c", 3},
+		{"set", "/b", 4},
+		{"delete", "/a", 5},
+	}
+	for i, e := range expected {
+		if events[i].Action != e.action || events[i].Key != e.key || events[i].Revision != e.revision {
+			t.Fatalf("unexpected event %d: %+v", i, events[i])
+		}
+	}
+	if len(known) != 2 || known["gohan/b"] != 4 || known["gohan/c"] != 3 {
+		t.Fatalf("unexpected known entries %v", known)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/cloudwan/gohan/sync"
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	pb "github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/streamrail/concurrent-map"
 	"github.com/twinj/uuid"
@@ -38,6 +39,8 @@ import (
 const (
 	processPath = "/gohan/cluster/process"
 	masterTTL   = 10
+	// maxTxnOps is the default limit of operations in a transaction of etcd server
+	maxTxnOps = 128
 )
 
 //Sync is struct for etcd based sync
@@ -122,6 +125,49 @@ func (s *Sync) Delete(key string, prefix bool) error {
 	return err
 }
 
+//MaxBatchSize returns the default limit of operations in an etcd transaction
+func (s *Sync) MaxBatchSize() int {
+	return maxTxnOps
+}
+
+//Batch applies operations in a single etcd transaction.
+//As in Update, operations storing an empty value are skipped.
+func (s *Sync) Batch(operations []sync.Operation) error {
+	defer measureTime(time.Now(), "batch")
+
+	ops := make([]etcd.Op, 0, len(operations))
+	for _, operation := range operations {
+		if operation.Delete {
+			opts := []etcd.OpOption{}
+			if operation.Prefix {
+				opts = append(opts, etcd.WithPrefix())
+			}
+			ops = append(ops, etcd.OpDelete(operation.Key, opts...))
+		} else if operation.Value != "" {
+			ops = append(ops, etcd.OpPut(operation.Key, operation.Value))
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	_, err := s.etcdClient.Txn(s.withTimeout()).Then(ops...).Commit()
+	if err != nil {
+		log.Error(fmt.Sprintf("failed to sync batch with backend %s", err))
+		updateCounter(1, "batch.error")
+	}
+	return err
+}
+
+//CurrentRevision returns the revision of the etcd cluster
+func (s *Sync) CurrentRevision() (int64, error) {
+	response, err := s.etcdClient.Get(s.withTimeout(), "/", etcd.WithCountOnly())
+	if err != nil {
+		updateCounter(1, "revision.error")
+		return 0, err
+	}
+	return response.Header.Revision, nil
+}
+
 //Fetch data from sync
 func (s *Sync) Fetch(key string) (*sync.Node, error) {
 	defer measureTime(time.Now(), "fetch")
@@ -286,19 +332,29 @@ func (s *Sync) Unlock(path string) error {
 	return nil
 }
 
+func newEvent(action string, kv *pb.KeyValue) *sync.Event {
+	return &sync.Event{
+		Action:   action,
+		Key:      string(kv.Key),
+		Data:     unmarshalValue(kv),
+		Revision: kv.ModRevision,
+	}
+}
+
+func unmarshalValue(kv *pb.KeyValue) map[string]interface{} {
+	var data map[string]interface{}
+	if kv.Value != nil {
+		err := json.Unmarshal(kv.Value, &data)
+		if err != nil {
+			log.Warning("failed to unmarshal watch response value %s: %s", kv.Value, err)
+		}
+	}
+	return data
+}
+
 func eventsFromNode(action string, kvs []*pb.KeyValue, responseChan chan *sync.Event, stopChan chan bool) {
 	for _, kv := range kvs {
-		event := &sync.Event{
-			Action:   action,
-			Key:      string(kv.Key),
-			Revision: kv.ModRevision,
-		}
-		if kv.Value != nil {
-			err := json.Unmarshal(kv.Value, &event.Data)
-			if err != nil {
-				log.Warning("failed to unmarshal watch response value %s: %s", kv.Value, err)
-			}
-		}
+		event := newEvent(action, kv)
 		select {
 		case <-stopChan:
 			log.Debug("Events from node interrupted by stop")
@@ -310,17 +366,17 @@ func eventsFromNode(action string, kvs []*pb.KeyValue, responseChan chan *sync.E
 
 //Watch keep watch update under the path
 func (s *Sync) Watch(path string, responseChan chan *sync.Event, stopChan chan bool, revision int64) error {
-	options := []etcd.OpOption{etcd.WithPrefix(), etcd.WithSort(etcd.SortByModRevision, etcd.SortAscend)}
-	if revision != sync.RevisionCurrent {
-		options = append(options, etcd.WithMinModRev(revision))
-	}
-	node, err := s.etcdClient.Get(s.withTimeout(), path, options...)
-	if err != nil {
-		updateCounter(1, "watch.get.error")
-		return err
+	// changes since a revision are replayed by the watch, including deletes,
+	// existing keys are sent first when watching from the current revision, which is 0 in etcd
+	if revision == sync.RevisionCurrent || revision == 0 {
+		node, err := s.etcdClient.Get(s.withTimeout(), path, etcd.WithPrefix(), etcd.WithSort(etcd.SortByModRevision, etcd.SortAscend))
+		if err != nil {
+			updateCounter(1, "watch.get.error")
+			return err
+		}
+		eventsFromNode("get", node.Kvs, responseChan, stopChan)
+		revision = node.Header.Revision + 1
 	}
-	eventsFromNode("get", node.Kvs, responseChan, stopChan)
-	revision = node.Header.Revision + 1
 
 	ctx, cancel := context.WithCancel(context.Background())
 	errors := make(chan error, 1)
@@ -332,9 +388,13 @@ func (s *Sync) Watch(path string, responseChan chan *sync.Event, stopChan chan b
 
 		defer wg.Done()
 		err := func() error {
-			rch := s.etcdClient.Watch(ctx, path, etcd.WithPrefix(), etcd.WithRev(revision))
+			rch := s.etcdClient.Watch(ctx, path, etcd.WithPrefix(), etcd.WithRev(revision), etcd.WithPrevKV())
 
 			for wresp := range rch {
+				if wresp.CompactRevision != 0 {
+					updateCounter(1, "watch.compacted")
+					return sync.ErrCompacted
+				}
 				err := wresp.Err()
 				if err != nil {
 					updateCounter(1, "watch.client_watch.error")
@@ -348,10 +408,26 @@ func (s *Sync) Watch(path string, responseChan chan *sync.Event, stopChan chan b
 					case etcd.EventTypeDelete:
 						action = "delete"
 					}
-					eventsFromNode(action, []*pb.KeyValue{ev.Kv}, responseChan, stopChan)
+					event := newEvent(action, ev.Kv)
+					if ev.Type == etcd.EventTypeDelete && ev.PrevKv != nil {
+						event.PrevData = unmarshalValue(ev.PrevKv)
+					}
+					select {
+					case <-stopChan:
+						return nil
+					case responseChan <- event:
+					}
 				}
 			}
 
+			// the watch is closed without a response when the revision has been compacted
+			if ctx.Err() == nil {
+				_, err := s.etcdClient.Get(s.withTimeout(), path, etcd.WithRev(revision), etcd.WithCountOnly())
+				if err == rpctypes.ErrCompacted {
+					updateCounter(1, "watch.compacted")
+					return sync.ErrCompacted
+				}
+			}
 			return nil
 		}()
 		errors <- err
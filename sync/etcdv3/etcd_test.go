@@ -291,6 +291,54 @@ func TestWatchWithRevision(t *testing.T) {
 
 }
 
+func TestWatchWithRevisionReplaysDeletes(t *testing.T) {
+	sync := newSync(t)
+	sync.etcdClient.Delete(context.Background(), "/", etcd.WithPrefix())
+
+	path := "/path/to/watch/deletes"
+	putResponse, err := sync.etcdClient.Put(context.Background(), path+"/existing", `{"existing": true}`)
+	if err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	startRev := putResponse.Header.Revision
+	if _, err := sync.etcdClient.Delete(context.Background(), path+"/existing"); err != nil {
+		t.Fatalf("failed to delete key: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := <-sync.WatchContext(ctx, path, startRev+1)
+	if resp.Err != nil || resp.Action != "delete" || resp.Key != path+"/existing" || resp.PrevData["existing"] != true {
+		t.Fatalf("mismatch response: %+v, expecting delete of /existing with the previous value", resp)
+	}
+}
+
+func TestWatchWithCompactedRevision(t *testing.T) {
+	sync := newSync(t)
+	sync.etcdClient.Delete(context.Background(), "/", etcd.WithPrefix())
+
+	path := "/path/to/watch/compacted"
+	putResponse, err := sync.etcdClient.Put(context.Background(), path+"/first", `{}`)
+	if err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	startRev := putResponse.Header.Revision
+	putResponse, err = sync.etcdClient.Put(context.Background(), path+"/second", `{}`)
+	if err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	if _, err := sync.etcdClient.Compact(context.Background(), putResponse.Header.Revision); err != nil {
+		t.Fatalf("failed to compact: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := <-sync.WatchContext(ctx, path, startRev)
+	if resp.Err != gohan_sync.ErrCompacted {
+		t.Fatalf("expected ErrCompacted, got %+v", resp)
+	}
+}
+
 func TestFetchMultipleNodes(t *testing.T) {
 	sync := newSync(t)
 	sync.etcdClient.Delete(context.Background(), "/", etcd.WithPrefix())
@@ -408,6 +456,39 @@ func TestNotIncludedPaths(t *testing.T) {
 	}
 }
 
+func TestBatch(t *testing.T) {
+	sync := newSync(t)
+	sync.etcdClient.Delete(context.Background(), "/", etcd.WithPrefix())
+
+	for _, key := range []string{"/batch/a", "/batch/prefix/a", "/batch/prefix/b"} {
+		if err := sync.Update(key, "old"); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	err := sync.Batch([]gohan_sync.Operation{
+		{Key: "/batch/a", Value: "new"},
+		{Key: "/batch/b", Value: "created"},
+		{Key: "/batch/empty", Value: ""},
+		{Key: "/batch/prefix", Delete: true, Prefix: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	node, err := sync.Fetch("/batch")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(node.Children) != 2 {
+		t.Fatalf("expected 2 children has %d", len(node.Children))
+	}
+	checkNode(node.Children[0], "/batch/a", "new", 0, t)
+	checkNode(node.Children[1], "/batch/b", "created", 0, t)
+	if node.Children[0].Revision != node.Children[1].Revision {
+		t.Fatalf("batch applied in revisions %d and %d", node.Children[0].Revision, node.Children[1].Revision)
+	}
+}
+
 func TestSubstr(t *testing.T) {
 	expectToEqual := func(a, b string) {
 		if a != b {
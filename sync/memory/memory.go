@@ -0,0 +1,505 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	syn "sync"
+	"time"
+
+	"github.com/cloudwan/gohan/metrics"
+	"github.com/cloudwan/gohan/sync"
+	"github.com/twinj/uuid"
+)
+
+var errClosed = errors.New("sync is closed")
+
+// historySize is the default number of changes kept for watches resuming from a revision
+const historySize = 1000
+
+// Store keeps keys of in-memory syncs.
+// Syncs created on the same store behave like separate processes connected to one etcd cluster.
+type Store struct {
+	mu       syn.Mutex
+	revision int64
+	entries  map[string]*entry
+	locks    map[string]*lock
+	watchers map[*watcher]struct{}
+	// changed is closed and replaced on each change, it wakes up blocked Lock calls
+	changed chan struct{}
+	// history keeps the latest changes, older ones up to revision compacted are dropped
+	history     []change
+	historySize int
+	compacted   int64
+}
+
+type entry struct {
+	value    string
+	revision int64
+}
+
+type lock struct {
+	owner *Sync
+	lost  chan struct{}
+}
+
+// change is a modification of a key passed to watchers
+type change struct {
+	action string
+	key    string
+	value  string
+	// prevValue is the last value of a deleted key
+	prevValue string
+	revision  int64
+}
+
+type watcher struct {
+	prefix  string
+	mu      syn.Mutex
+	pending []change
+	notify  chan struct{}
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{
+		entries:  map[string]*entry{},
+		locks:    map[string]*lock{},
+		watchers: map[*watcher]struct{}{},
+		changed:  make(chan struct{}),
+
+		historySize: historySize,
+	}
+}
+
+// put has to be called with mu held
+func (store *Store) put(key, value string) {
+	store.revision++
+	store.set(key, value)
+}
+
+// set stores value in the current revision, it has to be called with mu held
+func (store *Store) set(key, value string) {
+	store.entries[key] = &entry{value: value, revision: store.revision}
+	store.publish(change{action: "set", key: key, value: value, revision: store.revision})
+}
+
+// remove deletes keys in a single revision, locks on removed keys are lost.
+// It has to be called with mu held
+func (store *Store) remove(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	store.revision++
+	store.drop(keys)
+}
+
+// drop deletes keys in the current revision, it has to be called with mu held
+func (store *Store) drop(keys []string) {
+	for _, key := range keys {
+		prevValue := ""
+		if entry, ok := store.entries[key]; ok {
+			prevValue = entry.value
+		}
+		delete(store.entries, key)
+		if l, ok := store.locks[key]; ok {
+			delete(store.locks, key)
+			close(l.lost)
+			log.Info("Unlocked path %s", key)
+		}
+		store.publish(change{action: "delete", key: key, prevValue: prevValue, revision: store.revision})
+	}
+}
+
+func (store *Store) publish(c change) {
+	store.history = append(store.history, c)
+	if len(store.history) > store.historySize {
+		store.compacted = store.history[0].revision
+		store.history = store.history[1:]
+	}
+	for w := range store.watchers {
+		if strings.HasPrefix(c.key, w.prefix) {
+			w.push(c)
+		}
+	}
+	close(store.changed)
+	store.changed = make(chan struct{})
+}
+
+// keys returns sorted keys matching key, or all keys starting with key when prefix is true
+func (store *Store) keys(key string, prefix bool) []string {
+	keys := []string{}
+	for k := range store.entries {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// since returns changes under path to replay for a watch starting from revision.
+// Current keys are returned for RevisionCurrent, otherwise changes from the history
+// including deletes, it has to be called with mu held
+func (store *Store) since(path string, revision int64) ([]change, error) {
+	changes := []change{}
+	if revision == sync.RevisionCurrent {
+		for _, key := range store.keys(path, true) {
+			entry := store.entries[key]
+			changes = append(changes, change{action: "get", key: key, value: entry.value, revision: entry.revision})
+		}
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changes[i].revision < changes[j].revision
+		})
+		return changes, nil
+	}
+	if revision <= store.compacted {
+		return nil, sync.ErrCompacted
+	}
+	for _, c := range store.history {
+		if c.revision >= revision && strings.HasPrefix(c.key, path) {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+func (w *watcher) push(c change) {
+	w.mu.Lock()
+	w.pending = append(w.pending, c)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) take() []change {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
+
+// Sync is struct for in-memory sync
+type Sync struct {
+	store     *Store
+	processID string
+	closed    chan struct{}
+	closeOnce syn.Once
+}
+
+// NewSync creates in-memory sync instance with its own store
+func NewSync() *Sync {
+	return NewSyncWithStore(NewStore())
+}
+
+// NewSyncWithStore creates in-memory sync instance sharing store with other instances
+func NewSyncWithStore(store *Store) *Sync {
+	hostname, _ := os.Hostname()
+	return &Sync{
+		store:     store,
+		processID: hostname + uuid.NewV4().String(),
+		closed:    make(chan struct{}),
+	}
+}
+
+// GetProcessID returns processID
+func (s *Sync) GetProcessID() string {
+	return s.processID
+}
+
+func measureTime(timeStarted time.Time, action string) {
+	metrics.UpdateTimer(timeStarted, "sync.memory.%s", action)
+}
+
+// Update sync update sync
+// When jsonString is empty, this method do nothing
+// in the same way as etcd v3 sync which doesn't support directories.
+func (s *Sync) Update(key, jsonString string) error {
+	defer measureTime(time.Now(), "update")
+
+	if jsonString == "" {
+		return nil
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.put(key, jsonString)
+	return nil
+}
+
+// Delete sync update sync
+func (s *Sync) Delete(key string, prefix bool) error {
+	defer measureTime(time.Now(), "delete")
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.remove(s.store.keys(key, prefix))
+	return nil
+}
+
+// MaxBatchSize returns the same limit as the default one of etcd transactions
+func (s *Sync) MaxBatchSize() int {
+	return 128
+}
+
+// Batch applies operations in a single revision.
+// As in Update, operations storing an empty value are skipped.
+func (s *Sync) Batch(operations []sync.Operation) error {
+	defer measureTime(time.Now(), "batch")
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	revised := false
+	for _, operation := range operations {
+		var keys []string
+		if operation.Delete {
+			if keys = s.store.keys(operation.Key, operation.Prefix); len(keys) == 0 {
+				continue
+			}
+		} else if operation.Value == "" {
+			continue
+		}
+		if !revised {
+			s.store.revision++
+			revised = true
+		}
+		if operation.Delete {
+			s.store.drop(keys)
+		} else {
+			s.store.set(operation.Key, operation.Value)
+		}
+	}
+	return nil
+}
+
+// Fetch data from sync
+func (s *Sync) Fetch(key string) (*sync.Node, error) {
+	defer measureTime(time.Now(), "fetch")
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	leaves := []*sync.Node{}
+	dir := strings.TrimSuffix(key, "/") + "/"
+	for _, k := range s.store.keys(key, true) {
+		if k == key || strings.HasPrefix(k, dir) {
+			entry := s.store.entries[k]
+			leaves = append(leaves, &sync.Node{Key: k, Value: entry.value, Revision: entry.revision})
+		}
+	}
+	if len(leaves) == 0 {
+		return nil, fmt.Errorf("Key not found (%s)", key)
+	}
+	return sync.NodeTree(key, leaves), nil
+}
+
+// CurrentRevision returns the revision of the last change
+func (s *Sync) CurrentRevision() (int64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.store.revision, nil
+}
+
+// HasLock checks current process owns lock or not
+func (s *Sync) HasLock(path string) bool {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	l, ok := s.store.locks[path]
+	return ok && l.owner == s
+}
+
+// Lock locks resources on sync
+// This call blocks until you can get lock when block is true.
+// The returned channel is closed when the lock is released by Unlock or Close,
+// or lost because its key is deleted.
+func (s *Sync) Lock(path string, block bool) (chan struct{}, error) {
+	defer measureTime(time.Now(), "lock")
+
+	for {
+		s.store.mu.Lock()
+		select {
+		case <-s.closed:
+			s.store.mu.Unlock()
+			return nil, errClosed
+		default:
+		}
+		if _, exists := s.store.entries[path]; !exists {
+			lost := make(chan struct{})
+			s.store.locks[path] = &lock{owner: s, lost: lost}
+			s.store.put(path, s.processID)
+			s.store.mu.Unlock()
+			log.Info("Locked %s", path)
+			return lost, nil
+		}
+		changed := s.store.changed
+		s.store.mu.Unlock()
+
+		msg := fmt.Sprintf("failed to lock path %s", path)
+		log.Notice(msg)
+		if !block {
+			return nil, errors.New(msg)
+		}
+		select {
+		case <-changed:
+		case <-s.closed:
+			return nil, errClosed
+		}
+	}
+}
+
+// Unlock path
+func (s *Sync) Unlock(path string) error {
+	defer measureTime(time.Now(), "unlock")
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if l, ok := s.store.locks[path]; ok && l.owner == s {
+		s.store.remove([]string{path})
+	}
+	return nil
+}
+
+func newEvent(c change) *sync.Event {
+	event := &sync.Event{
+		Action:   c.action,
+		Key:      c.key,
+		Revision: c.revision,
+	}
+	if c.value != "" {
+		err := json.Unmarshal([]byte(c.value), &event.Data)
+		if err != nil {
+			log.Warning("failed to unmarshal watch response value %s: %s", c.value, err)
+		}
+	}
+	if c.prevValue != "" {
+		err := json.Unmarshal([]byte(c.prevValue), &event.PrevData)
+		if err != nil {
+			log.Warning("failed to unmarshal previous value %s: %s", c.prevValue, err)
+		}
+	}
+	return event
+}
+
+func sendEvents(changes []change, responseChan chan *sync.Event, stopChan chan bool) bool {
+	for _, c := range changes {
+		select {
+		case <-stopChan:
+			log.Debug("Events from node interrupted by stop")
+			return false
+		case responseChan <- newEvent(c):
+		}
+	}
+	return true
+}
+
+// Watch keep watch update under the path
+func (s *Sync) Watch(path string, responseChan chan *sync.Event, stopChan chan bool, revision int64) error {
+	s.store.mu.Lock()
+	select {
+	case <-s.closed:
+		s.store.mu.Unlock()
+		return errClosed
+	default:
+	}
+	existing, err := s.store.since(path, revision)
+	if err != nil {
+		s.store.mu.Unlock()
+		return err
+	}
+	w := &watcher{prefix: path, notify: make(chan struct{}, 1)}
+	s.store.watchers[w] = struct{}{}
+	s.store.mu.Unlock()
+
+	defer func() {
+		s.store.mu.Lock()
+		delete(s.store.watchers, w)
+		s.store.mu.Unlock()
+	}()
+
+	if !sendEvents(existing, responseChan, stopChan) {
+		return nil
+	}
+	for {
+		select {
+		case <-stopChan:
+			return nil
+		case <-s.closed:
+			return fmt.Errorf("Watch aborted by sync close")
+		case <-w.notify:
+			if !sendEvents(w.take(), responseChan, stopChan) {
+				return nil
+			}
+		}
+	}
+}
+
+// WatchContext keep watch update under the path until context is canceled
+func (s *Sync) WatchContext(ctx context.Context, path string, revision int64) <-chan *sync.Event {
+	eventCh := make(chan *sync.Event, 32)
+	stopCh := make(chan bool)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Watch(path, eventCh, stopCh, revision)
+	}()
+	go func() {
+		defer close(eventCh)
+
+		select {
+		case <-ctx.Done():
+			close(stopCh)
+			// don't return without ensuring Watch finished or we risk panic: send on closed channel
+			<-errCh
+		case err := <-errCh:
+			close(stopCh)
+			if err != nil {
+				select {
+				case eventCh <- &sync.Event{Err: err}:
+				default:
+					log.Debug("Unable to send error: '%s' via response chan. Don't linger.", err)
+				}
+			}
+		}
+	}()
+	return eventCh
+}
+
+// Close releases locks owned by the sync and stops its watches
+func (s *Sync) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+		owned := []string{}
+		for path, l := range s.store.locks {
+			if l.owner == s {
+				owned = append(owned, path)
+			}
+		}
+		sort.Strings(owned)
+		for _, path := range owned {
+			s.store.remove([]string{path})
+		}
+	})
+}
@@ -0,0 +1,486 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	gohan_sync "github.com/cloudwan/gohan/sync"
+)
+
+func TestNonEmptyUpdate(t *testing.T) {
+	sync := NewSync()
+
+	path := "/path/to/somewhere"
+	data := "blabla"
+	err := sync.Update(path, data)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+
+	node, err := sync.Fetch(path)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	if node.Key != path || node.Value != data || len(node.Children) != 0 || node.Revision != 1 {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+
+	err = sync.Delete(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+
+	node, err = sync.Fetch(path)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("Key not found (%s)", path)) {
+		t.Fatalf("unexpected non error")
+	}
+}
+
+func TestEmptyUpdate(t *testing.T) {
+	sync := NewSync()
+
+	path := "/path/to/somewhere"
+	err := sync.Update(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+
+	// not found because directories are not supported
+	_, err = sync.Fetch(path)
+	if err == nil {
+		t.Fatalf("unexpected non error")
+	}
+}
+
+func TestRecursiveUpdate(t *testing.T) {
+	syn := NewSync()
+	mustUpdate := func(key, value string) {
+		if err := syn.Update(key, value); err != nil {
+			t.Fatalf("unexpected error %s", err.Error())
+		}
+	}
+
+	mustUpdate("/a/b/c/d/1", "test1")
+	mustUpdate("/a/b/c/d/2", "test2")
+	mustUpdate("/a/b/c/d/3", "test3")
+	mustUpdate("/a/b/e/d/1", "test4")
+	mustUpdate("/a/b/e/d/2", "test5")
+	mustUpdate("/a/b/e/d/3", "test6")
+
+	node, err := syn.Fetch("/a")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	checkNode(node, "/a", "", 1, t)
+	ab := node.Children[0]
+	checkNode(ab, "/a/b", "", 2, t)
+	abc := ab.Children[0]
+	checkNode(abc, "/a/b/c", "", 1, t)
+	abcd := abc.Children[0]
+	checkNode(abcd, "/a/b/c/d", "", 3, t)
+	checkNode(abcd.Children[0], "/a/b/c/d/1", "test1", 0, t)
+	checkNode(abcd.Children[1], "/a/b/c/d/2", "test2", 0, t)
+	checkNode(abcd.Children[2], "/a/b/c/d/3", "test3", 0, t)
+
+	abe := ab.Children[1]
+	checkNode(abe, "/a/b/e", "", 1, t)
+	abed := abe.Children[0]
+	checkNode(abed, "/a/b/e/d", "", 3, t)
+	checkNode(abed.Children[0], "/a/b/e/d/1", "test4", 0, t)
+	checkNode(abed.Children[1], "/a/b/e/d/2", "test5", 0, t)
+	checkNode(abed.Children[2], "/a/b/e/d/3", "test6", 0, t)
+
+	node, err = syn.Fetch("/a/b/c")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	checkNode(node, "/a/b/c", "", 1, t)
+}
+
+func TestNotIncludedPaths(t *testing.T) {
+	sync := NewSync()
+
+	err := sync.Update("/path/to/somewhere", "test")
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	err = sync.Update("/pathnottobeincluded", "should not appear")
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+
+	nodes, err := sync.Fetch("/path")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	checkNode(nodes, "/path", "", 1, t)
+	pathTo := nodes.Children[0]
+	checkNode(pathTo, "/path/to", "", 1, t)
+	checkNode(pathTo.Children[0], "/path/to/somewhere", "test", 0, t)
+
+	_, err = sync.Fetch("/path/not")
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("Key not found (%s)", "/path/not")) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestPrefixDelete(t *testing.T) {
+	sync := NewSync()
+
+	for _, key := range []string{"/path/a", "/path/b", "/pathc", "/other"} {
+		if err := sync.Update(key, "test"); err != nil {
+			t.Fatalf("unexpected error")
+		}
+	}
+	if err := sync.Delete("/path/a", false); err != nil {
+		t.Fatalf("unexpected error")
+	}
+	if _, err := sync.Fetch("/path/a"); err == nil {
+		t.Fatalf("key not deleted")
+	}
+	if _, err := sync.Fetch("/path/b"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if err := sync.Delete("/path", true); err != nil {
+		t.Fatalf("unexpected error")
+	}
+	for _, key := range []string{"/path/b", "/pathc"} {
+		if _, err := sync.Fetch(key); err == nil {
+			t.Fatalf("key %s not deleted", key)
+		}
+	}
+	if _, err := sync.Fetch("/other"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	sync := NewSync()
+
+	for _, key := range []string{"/batch/a", "/batch/prefix/a", "/batch/prefix/b"} {
+		if err := sync.Update(key, "old"); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	err := sync.Batch([]gohan_sync.Operation{
+		{Key: "/batch/a", Value: "new"},
+		{Key: "/batch/b", Value: "created"},
+		{Key: "/batch/empty", Value: ""},
+		{Key: "/batch/prefix", Delete: true, Prefix: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	node, err := sync.Fetch("/batch")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(node.Children) != 2 {
+		t.Fatalf("expected 2 children has %d", len(node.Children))
+	}
+	checkNode(node.Children[0], "/batch/a", "new", 0, t)
+	checkNode(node.Children[1], "/batch/b", "created", 0, t)
+	if node.Children[0].Revision != node.Children[1].Revision {
+		t.Fatalf("batch applied in revisions %d and %d", node.Children[0].Revision, node.Children[1].Revision)
+	}
+}
+
+func checkNode(node *gohan_sync.Node, key, value string, children int, t *testing.T) {
+	if node.Key != key {
+		t.Fatalf("expected key %s has %s", key, node.Key)
+	}
+	if node.Value != value {
+		t.Fatalf("expected value %s has %s", value, node.Value)
+	}
+	if len(node.Children) != children {
+		t.Fatalf("expected to has %d children has %d", children, len(node.Children))
+	}
+}
+
+func TestLockUnblocking(t *testing.T) {
+	store := NewStore()
+	sync0 := NewSyncWithStore(store)
+	sync1 := NewSyncWithStore(store)
+
+	path := "/path/lock"
+	_, err := sync0.Lock(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	_, err = sync1.Lock(path, false)
+	if err == nil {
+		t.Fatalf("unexpected non error")
+	}
+
+	if !sync0.HasLock(path) {
+		t.Fatalf("unexpected false")
+	}
+	if sync1.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+	node, err := sync1.Fetch(path)
+	if err != nil || node.Value != sync0.GetProcessID() {
+		t.Fatalf("unexpected lock node %+v: %v", node, err)
+	}
+
+	err = sync0.Unlock(path)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	_, err = sync1.Lock(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+
+	if sync0.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+	if !sync1.HasLock(path) {
+		t.Fatalf("unexpected false")
+	}
+}
+
+func TestLockBlocking(t *testing.T) {
+	store := NewStore()
+	sync0 := NewSyncWithStore(store)
+	sync1 := NewSyncWithStore(store)
+
+	path := "/path/lock"
+	_, err := sync0.Lock(path, true)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	locked1 := make(chan error)
+	go func() {
+		_, err := sync1.Lock(path, true)
+		locked1 <- err
+	}()
+
+	select {
+	case <-locked1:
+		t.Fatalf("blocking failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = sync0.Unlock(path)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	select {
+	case err := <-locked1:
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("lock not acquired after unlock")
+	}
+
+	if sync0.HasLock(path) {
+		t.Fatalf("unexpected true")
+	}
+	if !sync1.HasLock(path) {
+		t.Fatalf("unexpected false")
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	store := NewStore()
+	sync0 := NewSyncWithStore(store)
+	sync1 := NewSyncWithStore(store)
+
+	expectLost := func(lost chan struct{}) {
+		select {
+		case <-lost:
+		case <-time.After(time.Second):
+			t.Fatalf("lock lost not notified")
+		}
+	}
+
+	lost, err := sync0.Lock("/path/lock", false)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	if err := sync1.Delete("/path", true); err != nil {
+		t.Fatalf("unexpected error")
+	}
+	expectLost(lost)
+	if sync0.HasLock("/path/lock") {
+		t.Fatalf("unexpected true")
+	}
+
+	lost, err = sync0.Lock("/path/lock", false)
+	if err != nil {
+		t.Fatalf("unexpected error")
+	}
+	sync0.Close()
+	expectLost(lost)
+	if _, err := sync1.Lock("/path/lock", false); err != nil {
+		t.Fatalf("lock not released on close: %s", err)
+	}
+	if _, err := sync0.Lock("/path/other", false); err == nil {
+		t.Fatalf("unexpected non error on closed sync")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	sync := NewSync()
+
+	path := "/path/to/watch/without/revision"
+	responseChan := make(chan *gohan_sync.Event)
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	sync.Update(path+"/existing", `{"existing": true}`)
+	sync.Update("/path/to/other", `{"existing": true}`)
+
+	go sync.Watch(path, responseChan, stopChan, gohan_sync.RevisionCurrent)
+
+	resp := <-responseChan
+	if resp.Action != "get" || resp.Key != path+"/existing" || resp.Data["existing"].(bool) != true || resp.Revision != 1 {
+		t.Fatalf("mismatch response: %+v", resp)
+	}
+
+	sync.Update("/path/to/other", `{"existing": false}`)
+	sync.Update(path+"/new", `{"existing": false}`)
+	resp = <-responseChan
+	if resp.Action != "set" || resp.Key != path+"/new" || resp.Data["existing"].(bool) != false || resp.Revision != 4 {
+		t.Fatalf("mismatch response: %+v", resp)
+	}
+
+	sync.Delete(path+"/existing", false)
+	resp = <-responseChan
+	if resp.Action != "delete" || resp.Key != path+"/existing" || len(resp.Data) != 0 || resp.Revision != 5 {
+		t.Fatalf("mismatch response: %+v", resp)
+	}
+}
+
+func TestWatchWithRevision(t *testing.T) {
+	sync := NewSync()
+
+	path := "/path/to/watch/with/revision"
+	responseChan := make(chan *gohan_sync.Event)
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	sync.Update(path+"/existing", `{"existing": true}`)
+	sync.Update(path+"/new", `{"existing": false}`)
+
+	go sync.Watch(path, responseChan, stopChan, 2)
+
+	resp := <-responseChan
+	if resp.Key != path+"/new" || resp.Data["existing"].(bool) != false || resp.Revision != 2 {
+		t.Fatalf("mismatch response: %+v, expecting /new, existing==false, revision==2", resp)
+	}
+
+	sync.Update(path+"/third", `{"existing": false}`)
+	resp = <-responseChan
+	if resp.Key != path+"/third" || resp.Data["existing"].(bool) != false || resp.Revision != 3 {
+		t.Fatalf("mismatch response: %+v, expecting /third, existing==false, revision==3", resp)
+	}
+}
+
+func TestWatchContext(t *testing.T) {
+	sync := NewSync()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := sync.WatchContext(ctx, "/path", gohan_sync.RevisionCurrent)
+	sync.Update("/path/key", `{"key": "value"}`)
+
+	select {
+	case event := <-events:
+		if event.Key != "/path/key" || event.Data["key"] != "value" {
+			t.Fatalf("mismatch response: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event not received")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatalf("unexpected event")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event channel not closed")
+	}
+}
+
+func TestWatchAbortedByClose(t *testing.T) {
+	sync := NewSync()
+
+	events := sync.WatchContext(context.Background(), "/path", gohan_sync.RevisionCurrent)
+	time.Sleep(10 * time.Millisecond)
+	sync.Close()
+
+	select {
+	case event := <-events:
+		if event == nil || event.Err == nil {
+			t.Fatalf("expected error event, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watch not aborted")
+	}
+}
+
+func TestWatchWithRevisionReplaysDeletes(t *testing.T) {
+	sync := NewSync()
+
+	path := "/path/to/watch/deletes"
+	responseChan := make(chan *gohan_sync.Event)
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	sync.Update(path+"/first", `{"first": true}`)
+	sync.Update(path+"/second", `{"first": false}`)
+	sync.Delete(path+"/first", false)
+
+	go sync.Watch(path, responseChan, stopChan, 2)
+
+	resp := <-responseChan
+	if resp.Key != path+"/second" || resp.Action != "set" || resp.Revision != 2 {
+		t.Fatalf("mismatch response: %+v, expecting set of /second, revision==2", resp)
+	}
+	resp = <-responseChan
+	if resp.Key != path+"/first" || resp.Action != "delete" || resp.Revision != 3 || resp.PrevData["first"] != true {
+		t.Fatalf("mismatch response: %+v, expecting delete of /first with the previous value, revision==3", resp)
+	}
+}
+
+func TestWatchWithCompactedRevision(t *testing.T) {
+	store := NewStore()
+	store.historySize = 2
+	sync := NewSyncWithStore(store)
+
+	path := "/path/to/watch/compacted"
+	for _, key := range []string{"a", "b", "c"} {
+		sync.Update(path+"/"+key, `{}`)
+	}
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	if err := sync.Watch(path, make(chan *gohan_sync.Event), stopChan, 1); err != gohan_sync.ErrCompacted {
+		t.Fatalf("expecting ErrCompacted, got %v", err)
+	}
+}
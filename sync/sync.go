@@ -17,6 +17,9 @@ package sync
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strings"
 
 	l "github.com/cloudwan/gohan/log"
 )
@@ -26,6 +29,10 @@ const RevisionCurrent = -1
 
 var log = l.NewLogger()
 
+// ErrCompacted is returned by Watch when changes since the requested revision are no longer kept,
+// callers have to fetch the current state and watch again from its revision
+var ErrCompacted = errors.New("requested revision has been compacted")
+
 //Sync is a interface for sync servers
 type Sync interface {
 	HasLock(path string) bool
@@ -38,7 +45,8 @@ type Sync interface {
 	// Close stopChan to cancel.
 	// You can specify the revision to start watching,
 	// give RevisionCurrent when you want to start from the current revision.
-	// Returns an error when gets any error including connection failures.
+	// Returns an error when gets any error including connection failures,
+	// or ErrCompacted when changes since the revision are no longer available.
 	Watch(path string, responseChan chan *Event, stopChan chan bool, revision int64) error
 	//WatchContext keep watch update under the path until context is canceled.
 	WatchContext(ctx context.Context, path string, revision int64) <-chan *Event
@@ -46,11 +54,57 @@ type Sync interface {
 	Close()
 }
 
+//Operation is a single change applied by Batcher
+type Operation struct {
+	Key string
+	// Value is stored at Key, ignored when Delete is set
+	Value  string
+	Delete bool
+	// Prefix deletes all keys starting with Key
+	Prefix bool
+}
+
+//Batcher is implemented by sync backends which can apply multiple changes at once.
+//Either all operations are applied or none of them.
+type Batcher interface {
+	Batch(operations []Operation) error
+	// MaxBatchSize is the maximum number of operations in a batch
+	MaxBatchSize() int
+}
+
+//Revisioner is implemented by sync backends which can report their current revision,
+//watches from the next revision receive all changes made after it
+type Revisioner interface {
+	CurrentRevision() (int64, error)
+}
+
+//ApplyBatch applies operations in a single batch when the sync supports it,
+//otherwise one by one in order
+func ApplyBatch(sync Sync, operations []Operation) error {
+	if batcher, ok := sync.(Batcher); ok {
+		return batcher.Batch(operations)
+	}
+	for _, operation := range operations {
+		var err error
+		if operation.Delete {
+			err = sync.Delete(operation.Key, operation.Prefix)
+		} else {
+			err = sync.Update(operation.Key, operation.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //Event is a struct for Watch response
 type Event struct {
 	Action   string
 	Key      string
 	Data     map[string]interface{}
+	// PrevData is the last value of a deleted key, set on deletes by backends which keep it
+	PrevData map[string]interface{}
 	Revision int64
 	// Err is used only by Sync.WatchContext()
 	Err error
@@ -63,3 +117,40 @@ type Node struct {
 	Revision int64
 	Children []*Node
 }
+
+//NodeTree builds the node of key from leaf nodes stored under it.
+//Leaves have to be keyed by key itself or keys starting with key followed by "/",
+//a node without value is created for each level of keys in between.
+func NodeTree(key string, leaves []*Node) *Node {
+	sorted := make([]*Node, len(leaves))
+	copy(sorted, leaves)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return nodeTree(key, sorted)
+}
+
+func nodeTree(key string, leaves []*Node) *Node {
+	node := &Node{Key: key}
+	dir := strings.TrimSuffix(key, "/") + "/"
+	var childKey string
+	var childLeaves []*Node
+	for _, leaf := range leaves {
+		if leaf.Key == key {
+			node.Value = leaf.Value
+			node.Revision = leaf.Revision
+			continue
+		}
+		next := dir + strings.SplitN(strings.TrimPrefix(leaf.Key, dir), "/", 2)[0]
+		if next != childKey && childLeaves != nil {
+			node.Children = append(node.Children, nodeTree(childKey, childLeaves))
+			childLeaves = nil
+		}
+		childKey = next
+		childLeaves = append(childLeaves, leaf)
+	}
+	if childLeaves != nil {
+		node.Children = append(node.Children, nodeTree(childKey, childLeaves))
+	}
+	return node
+}
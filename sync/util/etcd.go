@@ -6,14 +6,20 @@ import (
 
 	l "github.com/cloudwan/gohan/log"
 	"github.com/cloudwan/gohan/sync"
+	"github.com/cloudwan/gohan/sync/consul"
 	"github.com/cloudwan/gohan/sync/etcd"
 	"github.com/cloudwan/gohan/sync/etcdv3"
+	"github.com/cloudwan/gohan/sync/memory"
 	"github.com/cloudwan/gohan/util"
 )
 
 var log = l.NewLogger()
 
-const etcdTimeoutDefaultValueMS = 1000
+const (
+	etcdTimeoutDefaultValueMS   = 1000
+	consulTimeoutDefaultValueMS = 1000
+	consulAddressDefaultValue   = "http://127.0.0.1:8500"
+)
 
 // CreateFromConfig creates etcd sync from config
 func CreateFromConfig(config *util.Config) (s sync.Sync, err error) {
@@ -35,6 +41,22 @@ func CreateFromConfig(config *util.Config) (s sync.Sync, err error) {
 				return
 			}
 		}
+	case "consul":
+		address := config.GetString("consul/address", consulAddressDefaultValue)
+		log.Info("consul agent: %s", address)
+		s, err = consul.NewSync(
+			address,
+			config.GetString("consul/token", ""),
+			config.GetString("consul/prefix", ""),
+			time.Duration(config.GetInt("consul/timeout_ms", consulTimeoutDefaultValueMS))*time.Millisecond,
+		)
+		if err != nil {
+			err = fmt.Errorf("failed to connect to consul agent: %s", err)
+			return
+		}
+	case "memory":
+		log.Info("using in-memory sync, it can't be shared between processes")
+		s = memory.NewSync()
 	default:
 		err = fmt.Errorf("invalid sync type: %s", syncType)
 		return
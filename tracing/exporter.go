@@ -0,0 +1,256 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter sends ended spans to a tracing backend
+type Exporter interface {
+	Export(spans []*Span) error
+	Close() error
+}
+
+// ExporterFactory creates an exporter from its configuration
+type ExporterFactory func(config map[string]interface{}) (Exporter, error)
+
+var exporterFactories = map[string]ExporterFactory{
+	"file": newFileExporter,
+	"otlp": newOTLPExporter,
+}
+
+// RegisterExporter registers a factory of exporters configured with the given type
+func RegisterExporter(exporterType string, factory ExporterFactory) {
+	exporterFactories[exporterType] = factory
+}
+
+// NewExporter creates an exporter of the type given in its configuration
+func NewExporter(config map[string]interface{}) (Exporter, error) {
+	exporterType, _ := config["type"].(string)
+	factory, ok := exporterFactories[exporterType]
+	if !ok {
+		return nil, fmt.Errorf("unknown exporter type %q", exporterType)
+	}
+	return factory(config)
+}
+
+// Data returns the span as a map
+func (s *Span) Data() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attributes := make(map[string]interface{}, len(s.Attributes))
+	for key, value := range s.Attributes {
+		attributes[key] = value
+	}
+	data := map[string]interface{}{
+		"trace_id":   s.TraceID,
+		"span_id":    s.SpanID,
+		"name":       s.Name,
+		"service":    serviceName,
+		"start":      s.Start.UTC().Format(time.RFC3339Nano),
+		"end":        s.End.UTC().Format(time.RFC3339Nano),
+		"duration":   s.End.Sub(s.Start).Seconds(),
+		"attributes": attributes,
+	}
+	if s.ParentID != "" {
+		data["parent_id"] = s.ParentID
+	}
+	if s.Error != "" {
+		data["error"] = s.Error
+	}
+	return data
+}
+
+// fileExporter appends spans to a file, one JSON object per line
+type fileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileExporter(config map[string]interface{}) (Exporter, error) {
+	path, _ := config["path"].(string)
+	if path == "" {
+		return nil, fmt.Errorf("path is required for file exporter")
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: file}, nil
+}
+
+func (e *fileExporter) Export(spans []*Span) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, span := range spans {
+		if err := encoder.Encode(span.Data()); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.file.Write(buffer.Bytes())
+	return err
+}
+
+func (e *fileExporter) Close() error {
+	return e.file.Close()
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+const defaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+func newOTLPExporter(config map[string]interface{}) (Exporter, error) {
+	endpoint, _ := config["endpoint"].(string)
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+	headers := map[string]string{}
+	if rawHeaders, ok := config["headers"].(map[string]interface{}); ok {
+		for key, value := range rawHeaders {
+			headers[key] = fmt.Sprint(value)
+		}
+	}
+	timeout := 10 * time.Second
+	if rawTimeout, ok := config["timeout"].(string); ok {
+		parsed, err := time.ParseDuration(rawTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %s", rawTimeout, err)
+		}
+		timeout = parsed
+	}
+	return &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (e *otlpExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint %s responded with %s", e.endpoint, response.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() error {
+	return nil
+}
+
+// OTLP span status codes
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func otlpRequest(spans []*Span) map[string]interface{} {
+	otlpSpans := make([]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, otlpSpan(span))
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/cloudwan/gohan/tracing"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpSpan(span *Span) map[string]interface{} {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	status := map[string]interface{}{"code": otlpStatusUnset}
+	if span.Error != "" {
+		status = map[string]interface{}{"code": otlpStatusError, "message": span.Error}
+	}
+	result := map[string]interface{}{
+		"traceId":           span.TraceID,
+		"spanId":            span.SpanID,
+		"name":              span.Name,
+		"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+		"attributes":        otlpAttributes(span.Attributes),
+		"status":            status,
+	}
+	if span.ParentID != "" {
+		result["parentSpanId"] = span.ParentID
+	}
+	return result
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	result := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var otlpValue map[string]interface{}
+		switch v := value.(type) {
+		case bool:
+			otlpValue = map[string]interface{}{"boolValue": v}
+		case int:
+			otlpValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			otlpValue = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			otlpValue = map[string]interface{}{"doubleValue": v}
+		default:
+			otlpValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": otlpValue})
+	}
+	return result
+}
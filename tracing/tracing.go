@@ -0,0 +1,376 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans of requests handled by Gohan in OpenTelemetry style.
+// Trace context is propagated using W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	l "github.com/cloudwan/gohan/log"
+	"github.com/cloudwan/gohan/util"
+)
+
+// TraceparentHeader is the W3C trace context header
+const TraceparentHeader = "traceparent"
+
+// ContextKey is the key of the current span in request contexts
+const ContextKey = "trace_span"
+
+var log = l.NewLogger()
+
+// Span is a timed operation being a part of a trace.
+// All methods of Span are no-ops on nil, which is returned when tracing is disabled.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// StartSpan starts a child span of parent, a new trace is started if parent is nil
+func StartSpan(parent *Span, name string) *Span {
+	if !Enabled() {
+		return nil
+	}
+	span := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newID(16)
+	}
+	return span
+}
+
+// StartSpanFromTraceparent starts a span continuing the trace given in traceparent header,
+// a new trace is started if the header is empty or invalid
+func StartSpanFromTraceparent(traceparent, name string) *Span {
+	span := StartSpan(nil, name)
+	if span == nil {
+		return nil
+	}
+	if traceID, parentID, ok := ParseTraceparent(traceparent); ok {
+		span.TraceID = traceID
+		span.ParentID = parentID
+	}
+	return span
+}
+
+// SetAttribute sets an attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and passes it to exporters, only the first call has an effect
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	export(s)
+}
+
+// Traceparent returns the W3C traceparent header value identifying the span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// ParseTraceparent returns trace and parent span IDs from a W3C traceparent header value
+func ParseTraceparent(traceparent string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, parentID = strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	if !isHexID(traceID, 16) || !isHexID(parentID, 8) {
+		return "", "", false
+	}
+	return traceID, parentID, true
+}
+
+func isHexID(id string, size int) bool {
+	decoded, err := hex.DecodeString(id)
+	if err != nil || len(decoded) != size {
+		return false
+	}
+	for _, b := range decoded {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newID(size int) string {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		log.Warning("Failed to generate trace ID: %s", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartSpanFromContext starts a child span of the span carried by ctx and returns a copy of ctx
+// carrying the new span, no span is started when ctx doesn't carry one
+func StartSpanFromContext(ctx context.Context, name string) (*Span, context.Context) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return nil, ctx
+	}
+	span := StartSpan(parent, name)
+	return span, ContextWithSpan(ctx, span)
+}
+
+// CurrentSpan returns the current span of a request context
+func CurrentSpan(context map[string]interface{}) *Span {
+	span, _ := context[ContextKey].(*Span)
+	return span
+}
+
+// SetCurrentSpan sets the current span of a request context
+// and returns a function restoring the previous one
+func SetCurrentSpan(context map[string]interface{}, span *Span) func() {
+	if span == nil {
+		return func() {}
+	}
+	previous, hadPrevious := context[ContextKey]
+	context[ContextKey] = span
+	return func() {
+		if hadPrevious {
+			context[ContextKey] = previous
+		} else {
+			delete(context, ContextKey)
+		}
+	}
+}
+
+// StartClientSpan starts a child span of the span carried by the context of an outgoing
+// request and sets its traceparent header, nil is returned when there is no parent span
+func StartClientSpan(req *http.Request) *Span {
+	parent := SpanFromContext(req.Context())
+	if parent == nil {
+		return nil
+	}
+	span := StartSpan(parent, "HTTP "+req.Method)
+	if span == nil {
+		return nil
+	}
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+	req.Header.Set(TraceparentHeader, span.Traceparent())
+	return span
+}
+
+// FinishClientSpan records the result of an outgoing request and ends span
+func FinishClientSpan(span *Span, resp *http.Response, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetError(err)
+	} else if resp != nil {
+		span.SetAttribute("http.status_code", resp.StatusCode)
+	}
+	span.Finish()
+}
+
+var (
+	// enabled is 1 when spans are recorded, it's read by request goroutines,
+	// so it's set only after the rest of the configuration
+	enabled     int32
+	serviceName string
+	exporters   []Exporter
+
+	// exportMutex guards the queue of ended spans against closing while spans are added
+	exportMutex sync.RWMutex
+	spans       chan *Span
+	flushed     chan struct{}
+)
+
+const (
+	exportBatchSize = 128
+	exportQueueSize = 4096
+	exportInterval  = time.Second
+)
+
+// Setup configures tracing and exporters of spans from config
+func Setup(config *util.Config) error {
+	Close()
+	serviceName = config.GetString("tracing/service_name", "gohan")
+	if !config.GetBool("tracing/enabled", false) {
+		return nil
+	}
+	newExporters := []Exporter{}
+	for i, rawExporterConfig := range config.GetList("tracing/exporters", nil) {
+		exporterConfig, ok := rawExporterConfig.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("tracing exporter %d has to be an object", i)
+		}
+		exporter, err := NewExporter(exporterConfig)
+		if err != nil {
+			return fmt.Errorf("tracing exporter %d: %s", i, err)
+		}
+		newExporters = append(newExporters, exporter)
+	}
+	exporters = newExporters
+	exportMutex.Lock()
+	spans = make(chan *Span, exportQueueSize)
+	flushed = make(chan struct{})
+	go runExport(spans, flushed, exporters)
+	exportMutex.Unlock()
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+// Enabled checks if spans are recorded
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// ServiceName returns the name of the service reported to exporters
+func ServiceName() string {
+	return serviceName
+}
+
+// Close exports pending spans and closes exporters
+func Close() {
+	atomic.StoreInt32(&enabled, 0)
+	exportMutex.Lock()
+	if spans == nil {
+		exportMutex.Unlock()
+		return
+	}
+	close(spans)
+	<-flushed
+	spans = nil
+	exportMutex.Unlock()
+	for _, exporter := range exporters {
+		if err := exporter.Close(); err != nil {
+			log.Warning("Failed to close tracing exporter: %s", err)
+		}
+	}
+	exporters = nil
+}
+
+func export(span *Span) {
+	exportMutex.RLock()
+	defer exportMutex.RUnlock()
+	if spans == nil {
+		return
+	}
+	select {
+	case spans <- span:
+	default:
+		log.Debug("Tracing queue is full, dropping span %s", span.Name)
+	}
+}
+
+func runExport(queue <-chan *Span, done chan<- struct{}, exporters []Exporter) {
+	defer close(done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, exporter := range exporters {
+			if err := exporter.Export(batch); err != nil {
+				log.Warning("Failed to export spans: %s", err)
+			}
+		}
+		batch = make([]*Span, 0, exportBatchSize)
+	}
+	for {
+		select {
+		case span, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudwan/gohan/tracing"
+	"github.com/cloudwan/gohan/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	var dir string
+
+	setup := func(content string) {
+		configFile := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configFile, []byte(content), 0600)).To(Succeed())
+		config := util.GetConfig()
+		Expect(config.ReadConfig(configFile)).To(Succeed())
+		Expect(tracing.Setup(config)).To(Succeed())
+	}
+
+	readSpans := func(path string) []map[string]interface{} {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		result := []map[string]interface{}{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var span map[string]interface{}
+			Expect(json.Unmarshal(scanner.Bytes(), &span)).To(Succeed())
+			result = append(result, span)
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tracing")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		tracing.Close()
+		os.RemoveAll(dir)
+	})
+
+	Describe("Traceparent", func() {
+		It("should parse a valid header", func() {
+			traceID, parentID, ok := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			Expect(ok).To(BeTrue())
+			Expect(traceID).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(parentID).To(Equal("00f067aa0ba902b7"))
+		})
+
+		It("should reject invalid headers", func() {
+			for _, header := range []string{
+				"",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736",
+				"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+				"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			} {
+				_, _, ok := tracing.ParseTraceparent(header)
+				Expect(ok).To(BeFalse(), header)
+			}
+		})
+	})
+
+	Context("when disabled", func() {
+		BeforeEach(func() {
+			setup("tracing:\n  enabled: false\n")
+		})
+
+		It("should not start spans", func() {
+			span := tracing.StartSpan(nil, "test")
+			Expect(span).To(BeNil())
+			span.SetAttribute("key", "value")
+			span.SetError(errors.New("test"))
+			span.Finish()
+			Expect(span.Traceparent()).To(BeEmpty())
+		})
+	})
+
+	Context("with file exporter", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(dir, "spans.json")
+			setup("tracing:\n  enabled: true\n  service_name: test\n  exporters:\n  - type: file\n    path: " + path + "\n")
+		})
+
+		It("should export finished spans", func() {
+			parent := tracing.StartSpanFromTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "parent")
+			child, ctx := tracing.StartSpanFromContext(tracing.ContextWithSpan(context.Background(), parent), "child")
+			Expect(tracing.SpanFromContext(ctx)).To(Equal(child))
+			child.SetAttribute("key", "value")
+			child.SetError(errors.New("failed"))
+			child.Finish()
+			child.Finish()
+			parent.Finish()
+			tracing.Close()
+
+			spans := readSpans(path)
+			Expect(spans).To(HaveLen(2))
+			Expect(spans[0]).To(HaveKeyWithValue("name", "child"))
+			Expect(spans[0]).To(HaveKeyWithValue("service", "test"))
+			Expect(spans[0]).To(HaveKeyWithValue("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(spans[0]).To(HaveKeyWithValue("parent_id", parent.SpanID))
+			Expect(spans[0]).To(HaveKeyWithValue("error", "failed"))
+			Expect(spans[0]["attributes"]).To(HaveKeyWithValue("key", "value"))
+			Expect(spans[1]).To(HaveKeyWithValue("name", "parent"))
+			Expect(spans[1]).To(HaveKeyWithValue("parent_id", "00f067aa0ba902b7"))
+		})
+
+		It("should propagate traceparent to outgoing requests", func() {
+			var received string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Get(tracing.TraceparentHeader)
+			}))
+			defer server.Close()
+
+			parent := tracing.StartSpan(nil, "parent")
+			request, err := http.NewRequest("GET", server.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+			request = request.WithContext(tracing.ContextWithSpan(context.Background(), parent))
+			span := tracing.StartClientSpan(request)
+			response, err := http.DefaultClient.Do(request)
+			tracing.FinishClientSpan(span, response, err)
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+
+			Expect(received).To(Equal(span.Traceparent()))
+			Expect(span.TraceID).To(Equal(parent.TraceID))
+			Expect(span.Attributes).To(HaveKeyWithValue("http.status_code", http.StatusOK))
+		})
+
+		It("should not start client spans without a parent", func() {
+			request, err := http.NewRequest("GET", "http://localhost", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tracing.StartClientSpan(request)).To(BeNil())
+			Expect(request.Header.Get(tracing.TraceparentHeader)).To(BeEmpty())
+		})
+	})
+
+	Context("with OTLP exporter", func() {
+		var (
+			server   *httptest.Server
+			requests chan map[string]interface{}
+		)
+
+		BeforeEach(func() {
+			requests = make(chan map[string]interface{}, 10)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				Expect(r.Header.Get("X-Token")).To(Equal("secret"))
+				var body map[string]interface{}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				requests <- body
+			}))
+			setup("tracing:\n  enabled: true\n  exporters:\n  - type: otlp\n    endpoint: " + server.URL + "\n    headers:\n      X-Token: secret\n")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should send spans to the collector", func() {
+			span := tracing.StartSpan(nil, "test")
+			span.SetAttribute("http.status_code", 200)
+			span.Finish()
+			tracing.Close()
+
+			var body map[string]interface{}
+			Eventually(requests).Should(Receive(&body))
+			resourceSpans := body["resourceSpans"].([]interface{})
+			Expect(resourceSpans).To(HaveLen(1))
+			scopeSpans := resourceSpans[0].(map[string]interface{})
+			Expect(scopeSpans["resource"]).To(HaveKey("attributes"))
+		})
+	})
+
+	It("should fail on unknown exporter type", func() {
+		configFile := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configFile, []byte("tracing:\n  enabled: true\n  exporters:\n  - type: unknown\n"), 0600)).To(Succeed())
+		config := util.GetConfig()
+		Expect(config.ReadConfig(configFile)).To(Succeed())
+		Expect(tracing.Setup(config)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,133 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package amqputil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Publisher publishes messages to an AMQP topic exchange, declared when connecting.
+// The connection is opened by Connect or by the first message and reopened once
+// when publishing fails.
+type Publisher struct {
+	mu         sync.Mutex
+	connection string
+	exchange   string
+	// confirmTimeout limits the wait for publisher confirms, which are used when it's set
+	confirmTimeout time.Duration
+	conn           *amqp.Connection
+	channel        *amqp.Channel
+	confirms       chan amqp.Confirmation
+}
+
+// NewPublisher creates a publisher to exchange at connection. When confirmTimeout
+// isn't zero, a message is published once the broker acknowledged it.
+func NewPublisher(connection, exchange string, confirmTimeout time.Duration) *Publisher {
+	return &Publisher{connection: connection, exchange: exchange, confirmTimeout: confirmTimeout}
+}
+
+// Connect opens the connection unless it's open
+func (p *Publisher) Connect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.channel != nil {
+		return nil
+	}
+	return p.connect()
+}
+
+func (p *Publisher) connect() error {
+	conn, err := amqp.Dial(p.connection)
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := channel.ExchangeDeclare(p.exchange, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return err
+	}
+	if p.confirmTimeout > 0 {
+		if err := channel.Confirm(false); err != nil {
+			conn.Close()
+			return err
+		}
+		p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+	p.conn = conn
+	p.channel = channel
+	return nil
+}
+
+func (p *Publisher) publish(routingKey string, message amqp.Publishing) error {
+	if err := p.channel.Publish(p.exchange, routingKey, false, false, message); err != nil {
+		return err
+	}
+	if p.confirmTimeout <= 0 {
+		return nil
+	}
+	var confirmation amqp.Confirmation
+	select {
+	case c, ok := <-p.confirms:
+		if !ok {
+			return fmt.Errorf("AMQP channel closed before the message was confirmed")
+		}
+		confirmation = c
+	case <-time.After(p.confirmTimeout):
+		return fmt.Errorf("AMQP broker didn't confirm the message in %s", p.confirmTimeout)
+	}
+	if !confirmation.Ack {
+		return fmt.Errorf("AMQP broker rejected the message")
+	}
+	return nil
+}
+
+// Publish publishes message with routingKey
+func (p *Publisher) Publish(routingKey string, message amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.channel != nil {
+		if err := p.publish(routingKey, message); err == nil {
+			return nil
+		}
+		p.conn.Close()
+		p.channel = nil
+	}
+	// connect on the first message or reconnect once when the connection was lost,
+	// the channel is also replaced after a timeout, so late confirms aren't taken for the next message
+	if err := p.connect(); err != nil {
+		return err
+	}
+	return p.publish(routingKey, message)
+}
+
+// Close closes the connection
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.channel == nil {
+		return nil
+	}
+	p.channel = nil
+	return p.conn.Close()
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retry describes how failed deliveries are retried, waiting longer after each failure
+type Retry struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// RetryFromConfig reads max_attempts, initial_backoff and max_backoff under the given config key
+func RetryFromConfig(config *Config, key string) (Retry, error) {
+	retry := Retry{MaxAttempts: config.GetInt(key+"/max_attempts", 10)}
+	durations := []struct {
+		key          string
+		defaultValue string
+		target       *time.Duration
+	}{
+		{key + "/initial_backoff", "1s", &retry.InitialBackoff},
+		{key + "/max_backoff", "5m", &retry.MaxBackoff},
+	}
+	for _, duration := range durations {
+		value, err := time.ParseDuration(config.GetString(duration.key, duration.defaultValue))
+		if err != nil {
+			return retry, fmt.Errorf("invalid %s: %s", duration.key, err)
+		}
+		*duration.target = value
+	}
+	return retry, nil
+}
+
+// Backoff returns time to wait before the next attempt after the given number of failed ones
+func (retry Retry) Backoff(attempts int) time.Duration {
+	backoff := retry.InitialBackoff
+	for i := 1; i < attempts && backoff < retry.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > retry.MaxBackoff {
+		backoff = retry.MaxBackoff
+	}
+	return backoff
+}
+
+// NextAttempt returns unix time of the next attempt after the given number of failed ones,
+// false when no attempts are left
+func (retry Retry) NextAttempt(attempts int) (int64, bool) {
+	if attempts >= retry.MaxAttempts {
+		return 0, false
+	}
+	return time.Now().Add(retry.Backoff(attempts)).Unix(), true
+}
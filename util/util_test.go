@@ -17,6 +17,7 @@ package util
 
 import (
 	"os"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -34,6 +35,24 @@ var _ = Describe("Util functions", func() {
 		})
 	})
 
+	Describe("Retry", func() {
+		retry := Retry{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}
+
+		It("should double the backoff up to the limit", func() {
+			Expect(retry.Backoff(1)).To(Equal(time.Second))
+			Expect(retry.Backoff(2)).To(Equal(2 * time.Second))
+			Expect(retry.Backoff(3)).To(Equal(3 * time.Second))
+		})
+
+		It("should schedule attempts until they are exhausted", func() {
+			next, ok := retry.NextAttempt(2)
+			Expect(ok).To(BeTrue())
+			Expect(next).To(BeNumerically("~", time.Now().Add(2*time.Second).Unix(), 1))
+			_, ok = retry.NextAttempt(3)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
 	Describe("TempFile", func() {
 		It("should create temporary file properly", func() {
 			file, err := TempFile("./", "util_", "_test")
@@ -0,0 +1,269 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook delivers changes of resources to URLs of subscriptions
+// managed through the subscription resource
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/cloudwan/gohan/util"
+)
+
+const (
+	// SubscriptionSchemaID is ID of the schema of webhook subscriptions
+	SubscriptionSchemaID = "subscription"
+	// DeliverySchemaID is ID of the schema of the delivery history of subscriptions
+	DeliverySchemaID = "subscription_delivery"
+
+	// StatePending is status of deliveries waiting to be sent
+	StatePending = "pending"
+	// StateDelivered is status of deliveries accepted by the receiver
+	StateDelivered = "delivered"
+	// StateFailed is status of deliveries given up after all attempts failed
+	StateFailed = "failed"
+
+	// EventState is type of events of state updates of resources
+	EventState = "state"
+
+	// SignatureHeader holds HMAC-SHA256 of the payload keyed by the subscription secret
+	SignatureHeader = "X-Gohan-Signature"
+)
+
+var (
+	client              = newClient()
+	allowPrivateTargets = false
+	retry               = util.Retry{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Minute}
+	disableAfter        = 20
+	pollingInterval     = 5 * time.Second
+	historyRetention    = 7 * 24 * time.Hour
+
+	// forbiddenNetworks can't be targets of subscriptions unless webhook/allow_private_targets is set
+	forbiddenNetworks = parseNetworks(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8")
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// newClient creates a client connecting only to allowed targets.
+// Addresses are checked when connecting, after host names are resolved, so redirects are checked as well.
+// Proxies aren't used, as they would connect to targets instead.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkTarget(net.ParseIP(host))
+		},
+	}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// checkTarget checks that webhooks can be sent to the address
+func checkTarget(ip net.IP) error {
+	if allowPrivateTargets {
+		return nil
+	}
+	if ip == nil {
+		return fmt.Errorf("invalid target address")
+	}
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("target address %s isn't allowed", ip)
+		}
+	}
+	return nil
+}
+
+// ValidateURL checks that a subscription URL is an http or https URL of an allowed target.
+// Host names which can be resolved are checked here, deliveries check addresses again on each connection.
+func ValidateURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %s", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("URL has to use http or https")
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return fmt.Errorf("URL has to have a host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkTarget(ip)
+	}
+	addresses, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range addresses {
+		if err := checkTarget(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Setup configures delivery of webhooks from config
+func Setup(config *util.Config) error {
+	durations := []struct {
+		key          string
+		defaultValue string
+		target       *time.Duration
+	}{
+		{"webhook/timeout", "10s", &client.Timeout},
+		{"webhook/polling_interval", "5s", &pollingInterval},
+		{"webhook/history_retention", "168h", &historyRetention},
+	}
+	for _, duration := range durations {
+		value, err := time.ParseDuration(config.GetString(duration.key, duration.defaultValue))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", duration.key, err)
+		}
+		*duration.target = value
+	}
+	if pollingInterval <= 0 {
+		return fmt.Errorf("webhook/polling_interval has to be positive")
+	}
+	var err error
+	if retry, err = util.RetryFromConfig(config, "webhook/retry"); err != nil {
+		return err
+	}
+	allowPrivateTargets = config.GetBool("webhook/allow_private_targets", false)
+	disableAfter = config.GetInt("webhook/disable_after", 20)
+	return nil
+}
+
+// MaxAttempts returns the number of attempts to deliver a change before it is marked as failed
+func MaxAttempts() int {
+	return retry.MaxAttempts
+}
+
+// Retry returns how deliveries are retried
+func Retry() util.Retry {
+	return retry
+}
+
+// DisableAfter returns the number of consecutive failures which disable a subscription, 0 never disables it
+func DisableAfter() int {
+	return disableAfter
+}
+
+// PollingInterval returns how often deliveries waiting for retry are checked
+func PollingInterval() time.Duration {
+	return pollingInterval
+}
+
+// HistoryRetention returns how long finished deliveries are kept
+func HistoryRetention() time.Duration {
+	return historyRetention
+}
+
+// Matches checks if a subscription receives the event of a resource.
+// Subscriptions of a tenant receive changes of resources of the tenant only,
+// changes of resources without tenant are received by subscriptions without tenant.
+func Matches(subscription map[string]interface{}, eventType, schemaID, tenantID string) bool {
+	if enabled, ok := subscription["enabled"].(bool); ok && !enabled {
+		return false
+	}
+	if !contains(subscription["schemas"], schemaID) || !contains(subscription["events"], eventType) {
+		return false
+	}
+	subscriptionTenantID, _ := subscription["tenant_id"].(string)
+	return subscriptionTenantID == "" || subscriptionTenantID == tenantID
+}
+
+// contains checks if value is in the list, an empty list contains everything
+func contains(rawList interface{}, value string) bool {
+	list := util.MaybeList(rawList)
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature of a payload sent in SignatureHeader
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver posts a payload to the URL of a subscription. The payload is signed when secret isn't empty.
+// It returns the response status, 0 when no response was received, and an error unless the status is 2xx.
+func Deliver(targetURL, secret, eventType, deliveryID string, payload []byte) (int, error) {
+	request, err := http.NewRequest("POST", targetURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "gohan-webhook")
+	request.Header.Set("X-Gohan-Event", eventType)
+	request.Header.Set("X-Gohan-Delivery", deliveryID)
+	if secret != "" {
+		request.Header.Set(SignatureHeader, Sign(secret, payload))
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		// responses of receivers aren't recorded, as they might reveal internal services
+		return response.StatusCode, fmt.Errorf("responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
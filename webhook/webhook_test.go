@@ -0,0 +1,184 @@
+// Copyright (C) 2018 NTT Innovation Institute, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudwan/gohan/util"
+	"github.com/cloudwan/gohan/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webhook", func() {
+	var dir string
+
+	setup := func(content string) error {
+		configFile := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configFile, []byte(content), 0600)).To(Succeed())
+		config := util.GetConfig()
+		Expect(config.ReadConfig(configFile)).To(Succeed())
+		return webhook.Setup(config)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "webhook")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Setup", func() {
+		It("should read retry configuration", func() {
+			Expect(setup(`
+webhook:
+  disable_after: 3
+  retry:
+    max_attempts: 4
+    initial_backoff: 2s
+    max_backoff: 5s
+`)).To(Succeed())
+			Expect(webhook.MaxAttempts()).To(Equal(4))
+			Expect(webhook.DisableAfter()).To(Equal(3))
+			Expect(webhook.Retry().Backoff(1)).To(Equal(2 * time.Second))
+			Expect(webhook.Retry().Backoff(2)).To(Equal(4 * time.Second))
+			Expect(webhook.Retry().Backoff(3)).To(Equal(5 * time.Second))
+		})
+
+		It("should reject invalid durations", func() {
+			Expect(setup(`
+webhook:
+  timeout: soon
+`)).To(MatchError(ContainSubstring("webhook/timeout")))
+		})
+	})
+
+	Describe("Matches", func() {
+		subscription := func(data map[string]interface{}) map[string]interface{} {
+			result := map[string]interface{}{
+				"tenant_id": "",
+				"schemas":   []interface{}{},
+				"events":    []interface{}{},
+				"enabled":   true,
+			}
+			for key, value := range data {
+				result[key] = value
+			}
+			return result
+		}
+
+		It("should match everything with empty filters", func() {
+			Expect(webhook.Matches(subscription(nil), "create", "network", "red")).To(BeTrue())
+			Expect(webhook.Matches(subscription(nil), webhook.EventState, "subnet", "")).To(BeTrue())
+		})
+
+		It("should filter schemas and events", func() {
+			filtered := subscription(map[string]interface{}{
+				"schemas": []interface{}{"network"},
+				"events":  []interface{}{"delete"},
+			})
+			Expect(webhook.Matches(filtered, "delete", "network", "")).To(BeTrue())
+			Expect(webhook.Matches(filtered, "create", "network", "")).To(BeFalse())
+			Expect(webhook.Matches(filtered, "delete", "subnet", "")).To(BeFalse())
+		})
+
+		It("should match resources of the tenant of the subscription only", func() {
+			red := subscription(map[string]interface{}{"tenant_id": "red"})
+			Expect(webhook.Matches(red, "create", "network", "red")).To(BeTrue())
+			Expect(webhook.Matches(red, "create", "network", "blue")).To(BeFalse())
+			Expect(webhook.Matches(red, "create", "network", "")).To(BeFalse())
+		})
+
+		It("should not match disabled subscriptions", func() {
+			Expect(webhook.Matches(subscription(map[string]interface{}{"enabled": false}), "create", "network", "")).To(BeFalse())
+		})
+	})
+
+	Describe("ValidateURL", func() {
+		It("should reject private targets", func() {
+			Expect(setup("webhook:\n  timeout: 1s\n")).To(Succeed())
+			Expect(webhook.ValidateURL("https://93.184.216.34/hook")).To(Succeed())
+			for _, url := range []string{
+				"http://127.0.0.1/hook",
+				"http://10.1.2.3/hook",
+				"http://169.254.169.254/latest/meta-data",
+				"http://[::1]/hook",
+				"http://[::ffff:192.168.0.1]/hook",
+			} {
+				Expect(webhook.ValidateURL(url)).To(MatchError(ContainSubstring("isn't allowed")), url)
+			}
+			Expect(webhook.ValidateURL("ftp://93.184.216.34/hook")).To(MatchError(ContainSubstring("http or https")))
+
+			Expect(setup("webhook:\n  allow_private_targets: true\n")).To(Succeed())
+			Expect(webhook.ValidateURL("http://127.0.0.1/hook")).To(Succeed())
+		})
+	})
+
+	Describe("Deliver", func() {
+		BeforeEach(func() {
+			Expect(setup("webhook:\n  allow_private_targets: true\n")).To(Succeed())
+		})
+
+		It("should not connect to private targets", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+
+			Expect(setup("webhook:\n  timeout: 1s\n")).To(Succeed())
+			status, err := webhook.Deliver(server.URL, "", "create", "42", []byte(`{}`))
+			Expect(err).To(MatchError(ContainSubstring("isn't allowed")))
+			Expect(status).To(BeZero())
+		})
+
+		It("should post a signed payload", func() {
+			var request *http.Request
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				request = r
+				body, _ = ioutil.ReadAll(r.Body)
+			}))
+			defer server.Close()
+
+			payload := []byte(`{"event":"create"}`)
+			status, err := webhook.Deliver(server.URL, "secret", "create", "42", payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(payload))
+			Expect(request.Header.Get("X-Gohan-Event")).To(Equal("create"))
+			Expect(request.Header.Get("X-Gohan-Delivery")).To(Equal("42"))
+			Expect(request.Header.Get(webhook.SignatureHeader)).To(Equal(webhook.Sign("secret", payload)))
+		})
+
+		It("should fail on error responses", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "gone", http.StatusGone)
+			}))
+			defer server.Close()
+
+			status, err := webhook.Deliver(server.URL, "", "create", "42", []byte(`{}`))
+			Expect(err).To(MatchError("responded with status 410"))
+			Expect(status).To(Equal(http.StatusGone))
+		})
+	})
+})